@@ -0,0 +1,237 @@
+package alerts
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/certs"
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// Default alert settings, used when an alert is created without them
+const (
+	DefaultThreshold     = 5
+	DefaultWindowSeconds = 300
+	MaxWindowSeconds     = 7 * 24 * 60 * 60
+)
+
+// ApplyDefaults fills in missing alert settings with their default values
+func ApplyDefaults(alert *models.Alert) {
+	if alert.Condition == "" {
+		alert.Condition = models.AlertConditionErrorCount
+	}
+	if alert.Severity == "" {
+		alert.Severity = models.AlertSeverityWarning
+	}
+	if alert.WindowSeconds <= 0 {
+		alert.WindowSeconds = DefaultWindowSeconds
+	}
+	if alert.Threshold <= 0 && alert.Condition != models.AlertConditionBackendDown && alert.Condition != models.AlertConditionCircuitOpen {
+		alert.Threshold = DefaultThreshold
+	}
+	if alert.WebhookFormat == "" {
+		alert.WebhookFormat = WebhookFormatGeneric
+	}
+}
+
+// ValidateCondition checks that an alert's condition, threshold, window and severity are usable
+func ValidateCondition(alert models.Alert) error {
+	switch alert.Condition {
+	case models.AlertConditionErrorCount, models.AlertConditionLatencyP95,
+		models.AlertConditionTrafficDrop, models.AlertConditionFilterHits, models.AlertConditionCertExpiry:
+		if alert.Threshold <= 0 {
+			return fmt.Errorf("threshold must be positive")
+		}
+	case models.AlertConditionErrorRate:
+		if alert.Threshold <= 0 || alert.Threshold > 100 {
+			return fmt.Errorf("error rate threshold must be a percentage between 1 and 100")
+		}
+	case models.AlertConditionBackendDown, models.AlertConditionCircuitOpen:
+		// Fires on every health or circuit breaker transition, the threshold is not used
+	default:
+		return fmt.Errorf("invalid alert condition. Must be one of error_count, error_rate, latency_p95, backend_down, circuit_open, traffic_drop, filter_hits or cert_expiry")
+	}
+
+	if alert.WindowSeconds <= 0 || alert.WindowSeconds > MaxWindowSeconds {
+		return fmt.Errorf("window must be between 1 second and 7 days")
+	}
+
+	switch alert.Severity {
+	case models.AlertSeverityInfo, models.AlertSeverityWarning, models.AlertSeverityCritical:
+	default:
+		return fmt.Errorf("invalid alert severity. Must be 'info', 'warning' or 'critical'")
+	}
+
+	return nil
+}
+
+// scopeName describes which hosts an alert watches
+func scopeName(alert models.Alert) string {
+	if alert.DNSRuleID > 0 {
+		return alert.Hostname
+	}
+	return "all hosts"
+}
+
+// scopedQuery restricts a log query to the alert's hostname, if it has one
+func scopedQuery(alert models.Alert, query string, args ...interface{}) (string, []interface{}) {
+	if alert.DNSRuleID > 0 {
+		query += " AND hostname = ?"
+		args = append(args, alert.Hostname)
+	}
+	return query, args
+}
+
+// checkThreshold evaluates a metric based condition and fires the alert when it is met
+func checkThreshold(alert models.Alert, now time.Time) {
+	window := time.Duration(alert.WindowSeconds) * time.Second
+	since := now.Add(-window).Format(timestampFormat)
+	scope := scopeName(alert)
+
+	var subject, message string
+	switch alert.Condition {
+	case models.AlertConditionErrorCount:
+		errors, _, err := countErrors(alert, since)
+		if err != nil {
+			logEvalError(alert, err)
+			return
+		}
+		if errors < alert.Threshold {
+			return
+		}
+		subject = fmt.Sprintf("%d errors on %s", errors, scope)
+		message = fmt.Sprintf("%d requests to %s failed with a server error in the last %v (threshold: %d).",
+			errors, scope, window, alert.Threshold)
+
+	case models.AlertConditionErrorRate:
+		errors, total, err := countErrors(alert, since)
+		if err != nil {
+			logEvalError(alert, err)
+			return
+		}
+		if total == 0 {
+			return
+		}
+		rate := float64(errors) * 100 / float64(total)
+		if rate < float64(alert.Threshold) {
+			return
+		}
+		subject = fmt.Sprintf("%.1f%% error rate on %s", rate, scope)
+		message = fmt.Sprintf("%d of %d requests to %s (%.1f%%) failed with a server error in the last %v (threshold: %d%%).",
+			errors, total, scope, rate, window, alert.Threshold)
+
+	case models.AlertConditionLatencyP95:
+		p95, ok, err := latencyPercentile(alert, since, 0.95)
+		if err != nil {
+			logEvalError(alert, err)
+			return
+		}
+		if !ok || p95 < alert.Threshold {
+			return
+		}
+		subject = fmt.Sprintf("p95 latency %dms on %s", p95, scope)
+		message = fmt.Sprintf("The 95th percentile latency of requests to %s was %dms in the last %v (threshold: %dms).",
+			scope, p95, window, alert.Threshold)
+
+	case models.AlertConditionTrafficDrop:
+		_, total, err := countErrors(alert, since)
+		if err != nil {
+			logEvalError(alert, err)
+			return
+		}
+		if total >= alert.Threshold {
+			return
+		}
+		subject = fmt.Sprintf("Traffic drop on %s", scope)
+		message = fmt.Sprintf("Only %d requests reached %s in the last %v (expected at least %d).",
+			total, scope, window, alert.Threshold)
+
+	case models.AlertConditionFilterHits:
+		// filter_logs timestamps are set by SQLite's CURRENT_TIMESTAMP, which is UTC
+		filterSince := now.UTC().Add(-window).Format(timestampFormat)
+		query, args := scopedQuery(alert, "SELECT COUNT(*) FROM filter_logs WHERE timestamp >= ?", filterSince)
+		var hits int
+		if err := database.DB.QueryRow(query, args...).Scan(&hits); err != nil {
+			logEvalError(alert, err)
+			return
+		}
+		if hits < alert.Threshold {
+			return
+		}
+		subject = fmt.Sprintf("%d filter rule hits on %s", hits, scope)
+		message = fmt.Sprintf("Filter rules matched %d requests to %s in the last %v (threshold: %d).",
+			hits, scope, window, alert.Threshold)
+
+	default:
+		return
+	}
+
+	fire(alert, string(alert.Condition), subject, message, now)
+}
+
+// checkCertExpiry fires the alert for every uploaded certificate in its scope that
+// expires within threshold days
+func checkCertExpiry(alert models.Alert, now time.Time) {
+	expiring, err := certs.Expiring(time.Duration(alert.Threshold) * 24 * time.Hour)
+	if err != nil {
+		logEvalError(alert, err)
+		return
+	}
+
+	for _, cert := range expiring {
+		if alert.DNSRuleID > 0 && !certs.Covers(cert, alert.Hostname) {
+			continue
+		}
+
+		var subject, message string
+		if cert.NotAfter.Before(now) {
+			subject = fmt.Sprintf("Certificate %s has expired", cert.Name)
+			message = fmt.Sprintf("Certificate %s for %s expired on %s.",
+				cert.Name, strings.Join(cert.Hostnames, ", "), cert.NotAfter.Format(time.RFC1123))
+		} else {
+			subject = fmt.Sprintf("Certificate %s expires in %d days", cert.Name, cert.DaysRemaining)
+			message = fmt.Sprintf("Certificate %s for %s expires on %s (threshold: %d days).",
+				cert.Name, strings.Join(cert.Hostnames, ", "), cert.NotAfter.Format(time.RFC1123), alert.Threshold)
+		}
+		fire(alert, fmt.Sprintf("cert_expiry:%d", cert.ID), subject, message, now)
+	}
+}
+
+// countErrors returns the number of server errors and the total number of requests since the given time
+func countErrors(alert models.Alert, since string) (errors, total int, err error) {
+	query, args := scopedQuery(alert,
+		"SELECT COALESCE(SUM(CASE WHEN status_code >= 500 THEN 1 ELSE 0 END), 0), COUNT(*) FROM request_logs WHERE timestamp >= ?",
+		since)
+	err = database.DB.QueryRow(query, args...).Scan(&errors, &total)
+	return errors, total, err
+}
+
+// latencyPercentile returns the given percentile of request latency since the given time.
+// ok is false when there were no requests to measure.
+func latencyPercentile(alert models.Alert, since string, percentile float64) (latency int, ok bool, err error) {
+	countQuery, args := scopedQuery(alert, "SELECT COUNT(*) FROM request_logs WHERE timestamp >= ?", since)
+	var count int
+	if err := database.DB.QueryRow(countQuery, args...).Scan(&count); err != nil {
+		return 0, false, err
+	}
+	if count == 0 {
+		return 0, false, nil
+	}
+
+	// Nearest-rank percentile
+	offset := int(math.Ceil(percentile*float64(count))) - 1
+	if offset < 0 {
+		offset = 0
+	}
+
+	query, args := scopedQuery(alert, "SELECT latency_ms FROM request_logs WHERE timestamp >= ?", since)
+	query += " ORDER BY latency_ms LIMIT 1 OFFSET ?"
+	args = append(args, offset)
+	if err := database.DB.QueryRow(query, args...).Scan(&latency); err != nil {
+		return 0, false, err
+	}
+	return latency, true, nil
+}
@@ -0,0 +1,267 @@
+package alerts
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// SMTP TLS modes
+const (
+	SMTPTLSNone     = "none"     // Plain connection, for local relays and test servers
+	SMTPTLSStartTLS = "starttls" // Upgrade a plain connection with STARTTLS
+	SMTPTLSImplicit = "tls"      // TLS from the first byte, usually port 465
+)
+
+// SMTPConfig holds the settings of the mail server used for email alerts
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	TLSMode  string
+	Timeout  time.Duration
+}
+
+// LoadSMTPConfig reads the mail server settings from the environment
+func LoadSMTPConfig() SMTPConfig {
+	config := SMTPConfig{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     os.Getenv("SMTP_PORT"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+		TLSMode:  strings.ToLower(os.Getenv("SMTP_TLS_MODE")),
+		Timeout:  getEnvDuration("SMTP_TIMEOUT", 10*time.Second),
+	}
+
+	if config.TLSMode == "" {
+		config.TLSMode = SMTPTLSStartTLS
+	}
+	if config.Port == "" {
+		switch config.TLSMode {
+		case SMTPTLSImplicit:
+			config.Port = "465"
+		case SMTPTLSStartTLS:
+			config.Port = "587"
+		default:
+			config.Port = "25"
+		}
+	}
+	if config.From == "" {
+		config.From = "strong-manager@localhost"
+	}
+	return config
+}
+
+// validate checks that the config is complete enough to send mail
+func (c SMTPConfig) validate() error {
+	if c.Host == "" {
+		return fmt.Errorf("SMTP_HOST is not configured")
+	}
+	switch c.TLSMode {
+	case SMTPTLSNone, SMTPTLSStartTLS, SMTPTLSImplicit:
+		return nil
+	default:
+		return fmt.Errorf("invalid SMTP_TLS_MODE %q. Must be 'none', 'starttls' or 'tls'", c.TLSMode)
+	}
+}
+
+// ValidateEmailAddress checks that a destination is a single bare address, so it can be used
+// as the SMTP recipient and in the To header as is
+func ValidateEmailAddress(address string) error {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return err
+	}
+	if parsed.Address != address {
+		return fmt.Errorf("expected a bare address such as ops@example.com")
+	}
+	return nil
+}
+
+// emailNotifier sends notifications through an SMTP server
+type emailNotifier struct {
+	config SMTPConfig
+}
+
+func (e emailNotifier) Send(n Notification) error {
+	if err := e.config.validate(); err != nil {
+		return permanent(err)
+	}
+
+	msg, err := renderEmail(e.config.From, n)
+	if err != nil {
+		return permanent(err)
+	}
+
+	return classifySMTPError(e.send(n.Alert.Destination, msg))
+}
+
+// send delivers a rendered message to a single recipient
+func (e emailNotifier) send(to string, msg []byte) error {
+	addr := net.JoinHostPort(e.config.Host, e.config.Port)
+	tlsConfig := &tls.Config{ServerName: e.config.Host}
+	dialer := &net.Dialer{Timeout: e.config.Timeout}
+
+	var conn net.Conn
+	var err error
+	if e.config.TLSMode == SMTPTLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(e.config.Timeout))
+
+	client, err := smtp.NewClient(conn, e.config.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if e.config.TLSMode == SMTPTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return permanent(fmt.Errorf("SMTP server %s does not support STARTTLS", addr))
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if e.config.Username != "" {
+		auth := smtp.PlainAuth("", e.config.Username, e.config.Password, e.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(e.config.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// classifySMTPError marks SMTP errors that will not go away on retry as permanent.
+// 5xx replies are permanent, 4xx replies and network errors are transient.
+func classifySMTPError(err error) error {
+	if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 {
+		return permanent(err)
+	}
+	return err
+}
+
+var emailHTMLTemplate = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: Arial, sans-serif; color: #1f2937;">
+  <h2 style="margin-bottom: 4px;">{{.Subject}}</h2>
+  <p style="color: #6b7280; margin-top: 0;">Severity: <strong>{{.Severity}}</strong> &middot; {{.Time}}</p>
+  <p>{{.Message}}</p>
+  <table style="border-collapse: collapse; font-size: 13px; color: #4b5563;">
+    <tr><td style="padding-right: 12px;">Alert</td><td>#{{.AlertID}}</td></tr>
+    <tr><td style="padding-right: 12px;">Condition</td><td>{{.Condition}}</td></tr>
+    <tr><td style="padding-right: 12px;">Scope</td><td>{{.Scope}}</td></tr>
+  </table>
+</body>
+</html>
+`))
+
+// renderEmail builds a multipart message with a plain-text and an HTML version of the notification
+func renderEmail(from string, n Notification) ([]byte, error) {
+	data := struct {
+		Subject, Message, Severity, Condition, Scope, Time string
+		AlertID                                            int
+	}{
+		Subject:   n.Subject,
+		Message:   n.Message,
+		Severity:  string(n.Alert.Severity),
+		Condition: string(n.Alert.Condition),
+		Scope:     scopeName(n.Alert),
+		Time:      n.Time.Format(time.RFC1123Z),
+		AlertID:   n.Alert.ID,
+	}
+
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "%s\r\n\r\n", n.Message)
+	fmt.Fprintf(&text, "Severity: %s\r\nCondition: %s\r\nScope: %s\r\nAlert: #%d\r\nTime: %s\r\n",
+		data.Severity, data.Condition, data.Scope, data.AlertID, data.Time)
+
+	var html bytes.Buffer
+	if err := emailHTMLTemplate.Execute(&html, data); err != nil {
+		return nil, err
+	}
+
+	boundary, err := randomBoundary()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	msg.WriteString("From: " + from + "\r\n")
+	msg.WriteString("To: " + n.Alert.Destination + "\r\n")
+	msg.WriteString("Subject: " + strings.NewReplacer("\r", " ", "\n", " ").Replace(n.Subject) + "\r\n")
+	msg.WriteString("Date: " + n.Time.Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: multipart/alternative; boundary=" + boundary + "\r\n\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		body        []byte
+	}{
+		{"text/plain", text.Bytes()},
+		{"text/html", html.Bytes()},
+	} {
+		msg.WriteString("--" + boundary + "\r\n")
+		msg.WriteString("Content-Type: " + part.contentType + "; charset=UTF-8\r\n")
+		msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		qp := quotedprintable.NewWriter(&msg)
+		if _, err := qp.Write(part.body); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+		msg.WriteString("\r\n")
+	}
+	msg.WriteString("--" + boundary + "--\r\n")
+
+	return msg.Bytes(), nil
+}
+
+// randomBoundary returns a MIME boundary that will not appear in the message body
+func randomBoundary() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "strong-manager-" + hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,258 @@
+package alerts
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// fakeSMTPServer is a minimal SMTP server that records the messages it accepts. Each
+// RCPT command is answered with the next reply of rcptReplies, then with 250.
+type fakeSMTPServer struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	rcptReplies []string
+	recipients  []string
+	messages    []string
+}
+
+func newFakeSMTPServer(t *testing.T, rcptReplies ...string) *fakeSMTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &fakeSMTPServer{listener: listener, rcptReplies: rcptReplies}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	t.Setenv("SMTP_HOST", host)
+	t.Setenv("SMTP_PORT", port)
+	t.Setenv("SMTP_TLS_MODE", SMTPTLSNone)
+	t.Setenv("SMTP_FROM", "proxy@example.com")
+	return s
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO", "MAIL", "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			s.mu.Lock()
+			reply := "250 OK"
+			if len(s.rcptReplies) > 0 {
+				reply, s.rcptReplies = s.rcptReplies[0], s.rcptReplies[1:]
+			}
+			if strings.HasPrefix(reply, "250") {
+				s.recipients = append(s.recipients, line)
+			}
+			s.mu.Unlock()
+			tp.PrintfLine("%s", reply)
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, string(data))
+			s.mu.Unlock()
+			tp.PrintfLine("250 Queued")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func (s *fakeSMTPServer) received() (recipients, messages []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.recipients...), append([]string(nil), s.messages...)
+}
+
+// useTestDatabase initializes the database in a temporary directory
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	database.Initialize()
+	t.Cleanup(func() {
+		database.Close()
+		os.Chdir(wd)
+	})
+}
+
+// useFastRetries shortens the delivery retries for the duration of a test
+func useFastRetries(t *testing.T) {
+	attempts, backoff := deliveryAttempts, retryBackoff
+	deliveryAttempts, retryBackoff = 3, time.Millisecond
+	t.Cleanup(func() { deliveryAttempts, retryBackoff = attempts, backoff })
+}
+
+func testEmailAlert() models.Alert {
+	return models.Alert{
+		ID:          1,
+		Type:        models.AlertTypeEmail,
+		Destination: "ops@example.com",
+		Condition:   models.AlertConditionErrorCount,
+		Severity:    models.AlertSeverityCritical,
+	}
+}
+
+func TestEmailSendsMultipartMessage(t *testing.T) {
+	server := newFakeSMTPServer(t)
+
+	n := Notification{
+		Alert:   testEmailAlert(),
+		EventID: 1,
+		Subject: "Errors on <all hosts>",
+		Message: "12 errors in the last 5 minutes",
+		Time:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	if err := (emailNotifier{config: LoadSMTPConfig()}).Send(n); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	recipients, messages := server.received()
+	if len(recipients) != 1 || recipients[0] != "RCPT TO:<ops@example.com>" {
+		t.Fatalf("recipients = %q, want ops@example.com only", recipients)
+	}
+	if len(messages) != 1 {
+		t.Fatalf("received %d messages, want 1", len(messages))
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(messages[0]))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	if got := msg.Header.Get("To"); got != "ops@example.com" {
+		t.Errorf("To = %q, want ops@example.com", got)
+	}
+	if got := msg.Header.Get("Subject"); got != n.Subject {
+		t.Errorf("Subject = %q, want %q", got, n.Subject)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, want multipart/alternative", msg.Header.Get("Content-Type"))
+	}
+
+	parts := make(map[string]string)
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read part: %v", err)
+		}
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("read part body: %v", err)
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[contentType] = string(body)
+	}
+
+	if len(parts) != 2 {
+		t.Fatalf("got parts %v, want text/plain and text/html", parts)
+	}
+	if !strings.Contains(parts["text/plain"], n.Message) {
+		t.Errorf("plain part %q does not contain the message", parts["text/plain"])
+	}
+	if !strings.Contains(parts["text/html"], "<html>") || !strings.Contains(parts["text/html"], n.Message) {
+		t.Errorf("HTML part %q does not contain the message", parts["text/html"])
+	}
+	if !strings.Contains(parts["text/html"], "Errors on &lt;all hosts&gt;") {
+		t.Errorf("HTML part does not escape the subject: %q", parts["text/html"])
+	}
+}
+
+func TestEmailDeliveryRetriesTransientFailures(t *testing.T) {
+	useTestDatabase(t)
+	useFastRetries(t)
+	server := newFakeSMTPServer(t, "451 Try again later")
+
+	event, err := SendTest(testEmailAlert())
+	if err != nil {
+		t.Fatalf("SendTest: %v", err)
+	}
+	if event.DeliveryStatus != models.DeliveryStatusSent || !event.Sent || event.DeliveryAttempts != 2 {
+		t.Errorf("event = %+v, want sent after 2 attempts", event)
+	}
+	if _, messages := server.received(); len(messages) != 1 {
+		t.Errorf("received %d messages, want 1", len(messages))
+	}
+
+	var failed, succeeded int
+	err = database.DB.QueryRow(
+		"SELECT SUM(success = 0), SUM(success = 1) FROM alert_deliveries WHERE event_id = ?", event.ID,
+	).Scan(&failed, &succeeded)
+	if err != nil {
+		t.Fatalf("load delivery log: %v", err)
+	}
+	if failed != 1 || succeeded != 1 {
+		t.Errorf("delivery log has %d failed and %d successful attempts, want 1 and 1", failed, succeeded)
+	}
+}
+
+func TestEmailDeliveryDoesNotRetryPermanentFailures(t *testing.T) {
+	useTestDatabase(t)
+	useFastRetries(t)
+	server := newFakeSMTPServer(t, "550 No such user", "250 OK")
+
+	event, err := SendTest(testEmailAlert())
+	if err == nil {
+		t.Fatal("SendTest succeeded, want the 550 reply")
+	}
+	if event.DeliveryStatus != models.DeliveryStatusFailed || event.Sent || event.DeliveryAttempts != 1 {
+		t.Errorf("event = %+v, want failed after 1 attempt", event)
+	}
+	if !strings.Contains(event.DeliveryError, "550") {
+		t.Errorf("delivery error = %q, want the 550 reply", event.DeliveryError)
+	}
+	if _, messages := server.received(); len(messages) != 0 {
+		t.Errorf("received %d messages, want none", len(messages))
+	}
+}
@@ -0,0 +1,429 @@
+package alerts
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/health"
+	"github.com/arifur/strong-reverse-proxy/models"
+	"github.com/arifur/strong-reverse-proxy/proxy"
+)
+
+const timestampFormat = "2006-01-02 15:04:05"
+
+var (
+	// How often alerts are evaluated
+	evalInterval = time.Minute
+	// Minimum time between two events of the same alert condition
+	cooldown = 15 * time.Minute
+	// Delivery attempts per event, and the wait before the first retry (doubled after each retry)
+	deliveryAttempts = 3
+	retryBackoff     = 2 * time.Second
+
+	// Last time each alert condition fired, keyed by alert ID and condition
+	lastFired     = make(map[string]time.Time)
+	lastFiredLock sync.Mutex
+
+	// Backend health from the previous evaluation, used to detect transitions
+	previousHealth = make(map[string]bool)
+
+	// ID of the last circuit breaker transition seen by the evaluator
+	lastCircuitEvent int64
+)
+
+// Initialize starts the background alert evaluator
+func Initialize() {
+	evalInterval = getEnvDuration("ALERT_EVAL_INTERVAL", evalInterval)
+	cooldown = getEnvDuration("ALERT_COOLDOWN", cooldown)
+	retryBackoff = getEnvDuration("ALERT_RETRY_BACKOFF", retryBackoff)
+	if attempts, err := strconv.Atoi(os.Getenv("ALERT_DELIVERY_ATTEMPTS")); err == nil && attempts > 0 {
+		deliveryAttempts = attempts
+	}
+
+	go func() {
+		ticker := time.NewTicker(evalInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			evaluate()
+		}
+	}()
+
+	log.Printf("Alert evaluator initialized with interval=%v, cooldown=%v", evalInterval, cooldown)
+}
+
+// LoadAlert returns a single alert with its DNS rule hostname
+func LoadAlert(id int) (models.Alert, error) {
+	alerts, err := loadAlerts("a.id = ?", id)
+	if err != nil {
+		return models.Alert{}, err
+	}
+	if len(alerts) == 0 {
+		return models.Alert{}, sql.ErrNoRows
+	}
+	return alerts[0], nil
+}
+
+// loadEnabledAlerts returns all enabled alerts with their DNS rule hostname
+func loadEnabledAlerts() ([]models.Alert, error) {
+	return loadAlerts("a.enabled = 1")
+}
+
+// loadAlerts returns the alerts matching the where clause with their DNS rule hostname
+func loadAlerts(where string, args ...interface{}) ([]models.Alert, error) {
+	rows, err := database.DB.Query(`
+		SELECT
+			a.id,
+			a.dns_rule_id,
+			a.type,
+			a.destination,
+			a.threshold,
+			a.condition_type,
+			a.window_seconds,
+			a.severity,
+			a.webhook_format,
+			a.webhook_secret,
+			a.enabled,
+			d.hostname
+		FROM
+			alerts a
+		LEFT JOIN
+			dns_rules d ON a.dns_rule_id = d.id
+		WHERE
+			`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alerts []models.Alert
+	for rows.Next() {
+		var alert models.Alert
+		var typeStr, conditionStr, severityStr string
+		var hostname sql.NullString
+		if err := rows.Scan(&alert.ID, &alert.DNSRuleID, &typeStr, &alert.Destination, &alert.Threshold,
+			&conditionStr, &alert.WindowSeconds, &severityStr, &alert.WebhookFormat, &alert.WebhookSecret,
+			&alert.Enabled, &hostname); err != nil {
+			log.Printf("Error scanning alert: %v", err)
+			continue
+		}
+		alert.Type = models.AlertType(typeStr)
+		alert.Condition = models.AlertCondition(conditionStr)
+		alert.Severity = models.AlertSeverity(severityStr)
+		alert.HasWebhookSecret = alert.WebhookSecret != ""
+		ApplyDefaults(&alert)
+		if hostname.Valid {
+			alert.Hostname = hostname.String
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, nil
+}
+
+// evaluate checks every enabled alert against recent request logs and backend health
+func evaluate() {
+	alerts, err := loadEnabledAlerts()
+	if err != nil {
+		log.Printf("Error loading alerts: %v", err)
+		return
+	}
+
+	transitions := healthTransitions()
+	circuitEvents := circuitTransitions()
+	now := time.Now()
+
+	for _, alert := range alerts {
+		// A DNS rule alert whose rule no longer exists has nothing to watch
+		if alert.DNSRuleID > 0 && alert.Hostname == "" {
+			continue
+		}
+
+		switch alert.Condition {
+		case models.AlertConditionBackendDown:
+			for _, transition := range transitions {
+				if alert.DNSRuleID == 0 || alert.DNSRuleID == transition.DNSRuleID {
+					fire(alert, "health:"+transition.URL, transition.subject(), transition.message(), now)
+				}
+			}
+		case models.AlertConditionCircuitOpen:
+			for _, event := range circuitEvents {
+				if alert.DNSRuleID == 0 || event.ruleIDs[alert.DNSRuleID] {
+					fire(alert, "circuit:"+event.URL, event.subject(), event.message(), now)
+				}
+			}
+		case models.AlertConditionCertExpiry:
+			checkCertExpiry(alert, now)
+		default:
+			checkThreshold(alert, now)
+		}
+	}
+}
+
+// logEvalError logs a failure to evaluate an alert's condition
+func logEvalError(alert models.Alert, err error) {
+	log.Printf("Error evaluating %s condition of alert %d: %v", alert.Condition, alert.ID, err)
+}
+
+// healthTransition is a backend changing health state between two evaluations
+type healthTransition struct {
+	health.BackendStatus
+}
+
+func (t healthTransition) subject() string {
+	if t.Healthy {
+		return fmt.Sprintf("Backend %s recovered", t.URL)
+	}
+	return fmt.Sprintf("Backend %s is down", t.URL)
+}
+
+func (t healthTransition) message() string {
+	if t.Healthy {
+		return fmt.Sprintf("Backend %s of %s is healthy again.", t.URL, t.Hostname)
+	}
+	return fmt.Sprintf("Backend %s of %s failed its health checks: %s", t.URL, t.Hostname, t.LastError)
+}
+
+// healthTransitions compares the current backend health with the previous evaluation
+func healthTransitions() []healthTransition {
+	var transitions []healthTransition
+	current := make(map[string]bool)
+
+	for _, status := range health.Snapshot() {
+		key := fmt.Sprintf("%d|%s", status.DNSRuleID, status.URL)
+		current[key] = status.Healthy
+
+		// Backends seen for the first time are only reported if they are down
+		wasHealthy, seen := previousHealth[key]
+		if !seen {
+			wasHealthy = true
+		}
+		if wasHealthy != status.Healthy {
+			transitions = append(transitions, healthTransition{status})
+		}
+	}
+
+	previousHealth = current
+	return transitions
+}
+
+// circuitTransition is a backend's circuit breaker opening or closing again
+type circuitTransition struct {
+	proxy.CircuitEvent
+	ruleIDs map[int]bool // DNS rules using the backend
+}
+
+func (t circuitTransition) subject() string {
+	if t.To == proxy.CircuitClosed {
+		return fmt.Sprintf("Circuit of backend %s closed", t.URL)
+	}
+	return fmt.Sprintf("Circuit of backend %s opened", t.URL)
+}
+
+func (t circuitTransition) message() string {
+	if t.To == proxy.CircuitClosed {
+		return fmt.Sprintf("Backend %s receives traffic again: %s.", t.URL, t.Reason)
+	}
+	return fmt.Sprintf("Backend %s stopped receiving traffic: %s.", t.URL, t.Reason)
+}
+
+// circuitTransitions returns the circuit breakers that opened or closed since the previous evaluation
+func circuitTransitions() []circuitTransition {
+	var transitions []circuitTransition
+	for _, event := range proxy.CircuitEventsSince(lastCircuitEvent) {
+		lastCircuitEvent = event.ID
+		// Probing a backend is not worth an alert, only its outcome is
+		if event.To == proxy.CircuitHalfOpen {
+			continue
+		}
+		ruleIDs, err := backendRuleIDs(event.URL)
+		if err != nil {
+			log.Printf("Error loading DNS rules of backend %s: %v", event.URL, err)
+		}
+		transitions = append(transitions, circuitTransition{event, ruleIDs})
+	}
+	return transitions
+}
+
+// backendRuleIDs returns the IDs of the DNS rules that send traffic to a backend,
+// directly or through one of their routes
+func backendRuleIDs(url string) (map[int]bool, error) {
+	rows, err := database.DB.Query(`
+		SELECT m.dns_rule_id FROM dns_backend_map m JOIN backends b ON b.id = m.backend_id WHERE b.url = ?
+		UNION
+		SELECT r.dns_rule_id FROM dns_routes r
+			JOIN dns_route_backend_map rm ON rm.route_id = r.id
+			JOIN backends b ON b.id = rm.backend_id
+		WHERE b.url = ?
+	`, url, url)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ruleIDs := make(map[int]bool)
+	for rows.Next() {
+		var ruleID int
+		if err := rows.Scan(&ruleID); err != nil {
+			return nil, err
+		}
+		ruleIDs[ruleID] = true
+	}
+	return ruleIDs, rows.Err()
+}
+
+// fire records an alert event and delivers it, unless the same condition fired within the cool-down
+func fire(alert models.Alert, condition, subject, message string, now time.Time) {
+	key := fmt.Sprintf("%d|%s", alert.ID, condition)
+
+	lastFiredLock.Lock()
+	if last, ok := lastFired[key]; ok && now.Sub(last) < cooldown {
+		lastFiredLock.Unlock()
+		return
+	}
+	lastFired[key] = now
+	lastFiredLock.Unlock()
+
+	notification, err := recordEvent(alert, subject, message, now)
+	if err != nil {
+		log.Printf("Error recording alert event for alert %d: %v", alert.ID, err)
+		return
+	}
+	deliver(notification)
+}
+
+// SendTest records a test event for the alert and delivers it right away, bypassing
+// its condition and cool-down. It returns the delivery error, if any.
+func SendTest(alert models.Alert) (models.AlertEvent, error) {
+	ApplyDefaults(&alert)
+	now := time.Now()
+	message := fmt.Sprintf("This is a test of alert %d (%s on %s). If you received it, delivery works.",
+		alert.ID, alert.Condition, scopeName(alert))
+
+	notification, err := recordEvent(alert, "Test alert", message, now)
+	if err != nil {
+		return models.AlertEvent{}, err
+	}
+	deliveryErr := deliver(notification)
+
+	event := models.AlertEvent{ID: notification.EventID, AlertID: alert.ID, Message: message, Timestamp: now}
+	var deliveryError sql.NullString
+	err = database.DB.QueryRow(
+		"SELECT sent, delivery_status, delivery_attempts, delivery_error FROM alert_events WHERE id = ?", event.ID,
+	).Scan(&event.Sent, &event.DeliveryStatus, &event.DeliveryAttempts, &deliveryError)
+	if err != nil {
+		log.Printf("Error loading test event %d: %v", event.ID, err)
+	}
+	event.DeliveryError = deliveryError.String
+	return event, deliveryErr
+}
+
+// recordEvent inserts a pending alert event and returns the notification to deliver for it
+func recordEvent(alert models.Alert, subject, message string, now time.Time) (Notification, error) {
+	result, err := database.DB.Exec(
+		"INSERT INTO alert_events (alert_id, message, timestamp, sent, delivery_status) VALUES (?, ?, ?, 0, ?)",
+		alert.ID, message, now.Format(timestampFormat), models.DeliveryStatusPending,
+	)
+	if err != nil {
+		return Notification{}, err
+	}
+	eventID, _ := result.LastInsertId()
+
+	return Notification{
+		Alert:   alert,
+		EventID: int(eventID),
+		Subject: fmt.Sprintf("[Strong Manager][%s] %s", alert.Severity, subject),
+		Message: message,
+		Time:    now,
+	}, nil
+}
+
+// deliver sends a notification, retrying transient failures with exponential backoff,
+// and records the outcome on its event
+func deliver(n Notification) error {
+	notifier, err := notifierFor(n.Alert.Type)
+	if err != nil {
+		log.Printf("Cannot deliver alert %d: %v", n.Alert.ID, err)
+		recordDelivery(n.EventID, models.DeliveryStatusFailed, 0, err)
+		return err
+	}
+
+	backoff := retryBackoff
+	attempt := 1
+	for ; ; attempt++ {
+		started := time.Now()
+		err = notifier.Send(n)
+		recordAttempt(n.EventID, attempt, started, err)
+		if err == nil || isPermanent(err) || attempt >= deliveryAttempts {
+			break
+		}
+		log.Printf("Delivery of alert %d failed (attempt %d/%d), retrying in %v: %v",
+			n.Alert.ID, attempt, deliveryAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	if err != nil {
+		log.Printf("Failed to deliver alert %d to %s after %d attempt(s): %v", n.Alert.ID, n.Alert.Destination, attempt, err)
+		recordDelivery(n.EventID, models.DeliveryStatusFailed, attempt, err)
+		return err
+	}
+
+	recordDelivery(n.EventID, models.DeliveryStatusSent, attempt, nil)
+	return nil
+}
+
+// recordAttempt adds a delivery attempt to the event's delivery log
+func recordAttempt(eventID, attempt int, started time.Time, sendErr error) {
+	errMsg := ""
+	if sendErr != nil {
+		errMsg = sendErr.Error()
+	}
+
+	_, err := database.DB.Exec(`
+		INSERT INTO alert_deliveries (event_id, attempt, timestamp, success, status_code, error, duration_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, eventID, attempt, started.Format(timestampFormat), sendErr == nil, statusCodeOf(sendErr), errMsg,
+		time.Since(started).Milliseconds())
+	if err != nil {
+		log.Printf("Error logging delivery attempt of alert event %d: %v", eventID, err)
+	}
+}
+
+// recordDelivery stores the delivery outcome of an alert event
+func recordDelivery(eventID int, status string, attempts int, deliveryErr error) {
+	errMsg := ""
+	if deliveryErr != nil {
+		errMsg = deliveryErr.Error()
+	}
+	sent := status == models.DeliveryStatusSent
+
+	_, err := database.DB.Exec(`
+		UPDATE alert_events
+		SET sent = ?, delivery_status = ?, delivery_attempts = ?, delivery_error = ?,
+			delivered_at = CASE WHEN ? THEN ? ELSE delivered_at END
+		WHERE id = ?
+	`, sent, status, attempts, errMsg, sent, time.Now().Format(timestampFormat), eventID)
+	if err != nil {
+		log.Printf("Error recording delivery of alert event %d: %v", eventID, err)
+	}
+}
+
+// getEnvDuration gets an environment variable as a duration or returns a default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Warning: Invalid duration for %s: %s, using default %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return duration
+}
@@ -0,0 +1,77 @@
+package alerts
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// Notification is a fired alert event ready to be delivered
+type Notification struct {
+	Alert   models.Alert
+	EventID int
+	Subject string
+	Message string
+	Time    time.Time
+}
+
+// Notifier delivers notifications through a single channel
+type Notifier interface {
+	Send(n Notification) error
+}
+
+// permanentError marks a delivery failure that retrying will not fix
+type permanentError struct {
+	error
+}
+
+// permanent wraps err so that delivery is not retried
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// isPermanent reports whether a delivery error should not be retried
+func isPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// statusError is a delivery failure reported by the receiver with an HTTP status code
+type statusError struct {
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("webhook returned status %d", e.code)
+}
+
+// statusCodeOf returns the HTTP status code carried by a delivery error, or 0
+func statusCodeOf(err error) int {
+	var se statusError
+	if errors.As(err, &se) {
+		return se.code
+	}
+	return 0
+}
+
+// notifierFor returns the notifier matching the alert type
+func notifierFor(alertType models.AlertType) (Notifier, error) {
+	switch alertType {
+	case models.AlertTypeWebhook:
+		return webhookNotifier{client: &http.Client{Timeout: webhookTimeout}}, nil
+	case models.AlertTypeEmail:
+		return emailNotifier{config: LoadSMTPConfig()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported alert type %q", alertType)
+	}
+}
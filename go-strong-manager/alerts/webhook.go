@@ -0,0 +1,173 @@
+package alerts
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// Webhook payload formats
+const (
+	WebhookFormatGeneric = "generic"
+	WebhookFormatSlack   = "slack"
+	WebhookFormatTeams   = "teams"
+	WebhookFormatDiscord = "discord"
+)
+
+// Headers sent with signed webhook requests. The signature is the hex encoded
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the alert's webhook secret.
+const (
+	SignatureHeader          = "X-Strong-Manager-Signature"
+	SignatureTimestampHeader = "X-Strong-Manager-Timestamp"
+)
+
+const webhookTimeout = 10 * time.Second
+
+// IsValidWebhookFormat reports whether the given name is a supported webhook payload format
+func IsValidWebhookFormat(format string) bool {
+	switch format {
+	case WebhookFormatGeneric, WebhookFormatSlack, WebhookFormatTeams, WebhookFormatDiscord:
+		return true
+	default:
+		return false
+	}
+}
+
+// webhookNotifier posts notifications as JSON to the alert's destination URL
+type webhookNotifier struct {
+	client *http.Client
+}
+
+func (w webhookNotifier) Send(n Notification) error {
+	payload, err := json.Marshal(webhookPayload(n))
+	if err != nil {
+		return permanent(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.Alert.Destination, bytes.NewReader(payload))
+	if err != nil {
+		return permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Strong-Manager-Alerts")
+
+	if n.Alert.WebhookSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(SignatureTimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, "sha256="+sign(n.Alert.WebhookSecret, timestamp, payload))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		err := statusError{code: resp.StatusCode}
+		// Client errors other than rate limiting will fail the same way next time
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 signature of a webhook body
+func sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookPayload builds the request body in the alert's webhook format
+func webhookPayload(n Notification) interface{} {
+	scope := scopeName(n.Alert)
+
+	switch n.Alert.WebhookFormat {
+	case WebhookFormatSlack:
+		return map[string]interface{}{
+			"text": n.Subject,
+			"attachments": []map[string]interface{}{{
+				"color": "#" + severityColor(n.Alert.Severity),
+				"title": n.Subject,
+				"text":  n.Message,
+				"fields": []map[string]interface{}{
+					{"title": "Severity", "value": n.Alert.Severity, "short": true},
+					{"title": "Condition", "value": n.Alert.Condition, "short": true},
+					{"title": "Scope", "value": scope, "short": true},
+				},
+				"ts": n.Time.Unix(),
+			}},
+		}
+
+	case WebhookFormatTeams:
+		return map[string]interface{}{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"themeColor": severityColor(n.Alert.Severity),
+			"summary":    n.Subject,
+			"title":      n.Subject,
+			"text":       n.Message,
+			"sections": []map[string]interface{}{{
+				"facts": []map[string]interface{}{
+					{"name": "Severity", "value": n.Alert.Severity},
+					{"name": "Condition", "value": n.Alert.Condition},
+					{"name": "Scope", "value": scope},
+					{"name": "Time", "value": n.Time.Format(time.RFC1123)},
+				},
+			}},
+		}
+
+	case WebhookFormatDiscord:
+		color, _ := strconv.ParseInt(severityColor(n.Alert.Severity), 16, 64)
+		return map[string]interface{}{
+			"embeds": []map[string]interface{}{{
+				"title":       n.Subject,
+				"description": n.Message,
+				"color":       color,
+				"timestamp":   n.Time.Format(time.RFC3339),
+				"fields": []map[string]interface{}{
+					{"name": "Severity", "value": n.Alert.Severity, "inline": true},
+					{"name": "Condition", "value": n.Alert.Condition, "inline": true},
+					{"name": "Scope", "value": scope, "inline": true},
+				},
+			}},
+		}
+
+	default:
+		return map[string]interface{}{
+			"alert_id":    n.Alert.ID,
+			"event_id":    n.EventID,
+			"dns_rule_id": n.Alert.DNSRuleID,
+			"hostname":    n.Alert.Hostname,
+			"condition":   n.Alert.Condition,
+			"severity":    n.Alert.Severity,
+			"subject":     n.Subject,
+			"message":     n.Message,
+			"timestamp":   n.Time.Format(time.RFC3339),
+		}
+	}
+}
+
+// severityColor returns the hex RGB color used to highlight a severity in chat messages
+func severityColor(severity models.AlertSeverity) string {
+	switch severity {
+	case models.AlertSeverityCritical:
+		return "D92D20"
+	case models.AlertSeverityWarning:
+		return "F79009"
+	default:
+		return "2E90FA"
+	}
+}
@@ -0,0 +1,47 @@
+package certs
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newCache returns the storage for ACME account keys and certificates
+func newCache(kind, dir string) (autocert.Cache, error) {
+	switch kind {
+	case "sqlite":
+		return sqliteCache{}, nil
+	case "dir":
+		return autocert.DirCache(dir), nil
+	default:
+		return nil, fmt.Errorf("invalid ACME_CACHE %q. Must be 'sqlite' or 'dir'", kind)
+	}
+}
+
+// sqliteCache stores ACME data in the acme_cache table
+type sqliteCache struct{}
+
+func (sqliteCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := database.DB.QueryRowContext(ctx, "SELECT data FROM acme_cache WHERE key = ?", key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+func (sqliteCache) Put(ctx context.Context, key string, data []byte) error {
+	_, err := database.DB.ExecContext(ctx, `
+		INSERT INTO acme_cache (key, data, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(key) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at
+	`, key, data)
+	return err
+}
+
+func (sqliteCache) Delete(ctx context.Context, key string) error {
+	_, err := database.DB.ExecContext(ctx, "DELETE FROM acme_cache WHERE key = ?", key)
+	return err
+}
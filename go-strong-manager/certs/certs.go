@@ -0,0 +1,235 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	// Whether the proxy serves HTTPS
+	enabled bool
+
+	// ACME certificate manager, nil when TLS or ACME is disabled
+	manager *autocert.Manager
+)
+
+// Initialize sets up uploaded and automatic certificates for DNS rule hostnames when TLS_ENABLED is set
+func Initialize() {
+	if !getEnvBool("TLS_ENABLED", false) {
+		log.Println("TLS disabled, proxy serves plain HTTP only")
+		return
+	}
+	enabled = true
+
+	// Load uploaded certificates, which take precedence over ACME
+	ReloadManual()
+
+	if !getEnvBool("ACME_ENABLED", true) {
+		log.Println("TLS enabled with uploaded certificates only")
+		return
+	}
+
+	cache, err := newCache(getEnv("ACME_CACHE", "sqlite"), getEnv("ACME_CACHE_DIR", "./certs"))
+	if err != nil {
+		log.Printf("Error setting up ACME cache, ACME disabled: %v", err)
+		return
+	}
+
+	client := &acme.Client{DirectoryURL: getEnv("ACME_DIRECTORY_URL", autocert.DefaultACMEDirectory)}
+	if rootsFile := os.Getenv("ACME_CA_ROOTS"); rootsFile != "" {
+		// Trust a private ACME server such as Pebble
+		httpClient, err := clientWithRoots(rootsFile)
+		if err != nil {
+			log.Printf("Error loading ACME CA roots, ACME disabled: %v", err)
+			return
+		}
+		client.HTTPClient = httpClient
+	}
+
+	manager = &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       cache,
+		HostPolicy:  hostPolicy,
+		Email:       os.Getenv("ACME_EMAIL"),
+		RenewBefore: getEnvDuration("ACME_RENEW_BEFORE", 30*24*time.Hour),
+		Client:      client,
+	}
+
+	log.Printf("TLS enabled with ACME directory %s", client.DirectoryURL)
+
+	// Obtain certificates for the configured hostnames ahead of the first request
+	Refresh()
+}
+
+// Enabled reports whether the proxy serves HTTPS
+func Enabled() bool {
+	return enabled
+}
+
+// TLSConfig returns the TLS configuration of the HTTPS proxy listener.
+// Certificates are picked per request via SNI, so uploads take effect without a restart.
+func TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// getCertificate returns the uploaded certificate for the requested hostname,
+// or falls back to an ACME certificate
+func getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := manualCertificate(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	if manager == nil {
+		return nil, fmt.Errorf("no certificate for host %q", hello.ServerName)
+	}
+	return manager.GetCertificate(hello)
+}
+
+// HTTPHandler answers ACME HTTP-01 challenges and passes every other request to fallback
+func HTTPHandler(fallback http.Handler) http.Handler {
+	if manager == nil {
+		return fallback
+	}
+	return manager.HTTPHandler(fallback)
+}
+
+// Refresh obtains or renews certificates for every DNS rule hostname in the background.
+// It should be called after DNS rules are modified.
+func Refresh() {
+	if manager == nil {
+		return
+	}
+
+	hostnames, err := dnsRuleHostnames()
+	if err != nil {
+		log.Printf("Error loading DNS rule hostnames for certificates: %v", err)
+		return
+	}
+
+	for hostname := range hostnames {
+		go func(hostname string) {
+			// Pretend to be a modern client so an ECDSA certificate is issued
+			hello := &tls.ClientHelloInfo{
+				ServerName:       hostname,
+				CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+				SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+				SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			}
+			if _, err := manager.GetCertificate(hello); err != nil {
+				log.Printf("Error obtaining certificate for %s: %v", hostname, err)
+			}
+		}(hostname)
+	}
+}
+
+// hostPolicy only allows certificates for hostnames that have a DNS rule
+func hostPolicy(_ context.Context, host string) error {
+	hostnames, err := dnsRuleHostnames()
+	if err != nil {
+		return err
+	}
+	if !hostnames[strings.ToLower(host)] {
+		return fmt.Errorf("no DNS rule for host %q", host)
+	}
+	return nil
+}
+
+// dnsRuleHostnames returns the set of DNS rule hostnames without ports
+// that are not served with an uploaded certificate
+func dnsRuleHostnames() (map[string]bool, error) {
+	rows, err := database.DB.Query("SELECT hostname FROM dns_rules")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hostnames := make(map[string]bool)
+	for rows.Next() {
+		var hostname string
+		if err := rows.Scan(&hostname); err != nil {
+			return nil, err
+		}
+		hostname = stripPort(strings.ToLower(hostname))
+		// Certificates cannot be issued for IP addresses or wildcards over HTTP-01
+		if hostname == "" || net.ParseIP(hostname) != nil || strings.Contains(hostname, "*") {
+			continue
+		}
+		if manualCertificate(hostname) != nil {
+			continue
+		}
+		hostnames[hostname] = true
+	}
+	return hostnames, rows.Err()
+}
+
+// stripPort removes the port from a host, if any
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// clientWithRoots returns an HTTP client trusting the CA certificates in a PEM file
+func clientWithRoots(path string) (*http.Client, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+// getEnv gets an environment variable or returns a default value
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvBool gets an environment variable as a boolean or returns a default value
+func getEnvBool(key string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// getEnvDuration gets an environment variable as a duration or returns a default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Warning: Invalid duration for %s: %s, using default %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return duration
+}
@@ -0,0 +1,205 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+var (
+	// Uploaded certificates keyed by bound hostname (exact or wildcard)
+	manualCerts     = make(map[string]*tls.Certificate)
+	manualCertsLock sync.RWMutex
+)
+
+// ParseCertificate validates an uploaded certificate and key pair and fills in the
+// details read from the certificate. Bound hostnames default to the certificate's DNS names
+// and must all be covered by it.
+func ParseCertificate(cert *models.Certificate) (*tls.Certificate, error) {
+	pair, err := tls.X509KeyPair([]byte(cert.CertPEM), []byte(cert.KeyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate or key: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %v", err)
+	}
+	pair.Leaf = leaf
+
+	cert.SANs = append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		cert.SANs = append(cert.SANs, ip.String())
+	}
+	cert.Issuer = leaf.Issuer.String()
+	cert.NotBefore = leaf.NotBefore
+	cert.NotAfter = leaf.NotAfter
+	cert.DaysRemaining = int(math.Floor(time.Until(leaf.NotAfter).Hours() / 24))
+
+	if len(cert.Hostnames) == 0 {
+		cert.Hostnames = append([]string{}, leaf.DNSNames...)
+	}
+	if len(cert.Hostnames) == 0 {
+		return nil, fmt.Errorf("certificate has no DNS names, hostnames must be provided")
+	}
+	for i, hostname := range cert.Hostnames {
+		hostname = strings.ToLower(strings.TrimSpace(hostname))
+		if !covers(leaf, hostname) {
+			return nil, fmt.Errorf("certificate is not valid for hostname %q", hostname)
+		}
+		cert.Hostnames[i] = hostname
+	}
+
+	return &pair, nil
+}
+
+// covers reports whether the certificate is valid for a bound hostname. A wildcard
+// binding needs the same wildcard among the certificate's DNS names.
+func covers(leaf *x509.Certificate, hostname string) bool {
+	if strings.HasPrefix(hostname, "*.") {
+		for _, name := range leaf.DNSNames {
+			if strings.EqualFold(name, hostname) {
+				return true
+			}
+		}
+		return false
+	}
+	return leaf.VerifyHostname(hostname) == nil
+}
+
+// LoadCertificates returns all uploaded certificates, ordered by ID. Keys are included,
+// so callers exposing the result must clear KeyPEM.
+func LoadCertificates() ([]models.Certificate, error) {
+	certificates, _, err := loadCertificates()
+	return certificates, err
+}
+
+// loadCertificates returns all valid uploaded certificates together with their parsed key pairs
+func loadCertificates() ([]models.Certificate, []*tls.Certificate, error) {
+	rows, err := database.DB.Query("SELECT id, name, cert_pem, key_pem, hostnames, created_at FROM certificates ORDER BY id")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var certificates []models.Certificate
+	var pairs []*tls.Certificate
+	for rows.Next() {
+		var cert models.Certificate
+		var hostnames, createdAt string
+		if err := rows.Scan(&cert.ID, &cert.Name, &cert.CertPEM, &cert.KeyPEM, &hostnames, &createdAt); err != nil {
+			return nil, nil, err
+		}
+		if err := json.Unmarshal([]byte(hostnames), &cert.Hostnames); err != nil {
+			log.Printf("Invalid hostnames of certificate %d: %v", cert.ID, err)
+		}
+		if t, err := time.Parse("2006-01-02 15:04:05", createdAt); err == nil {
+			cert.CreatedAt = t
+		}
+		pair, err := ParseCertificate(&cert)
+		if err != nil {
+			log.Printf("Skipping invalid certificate %d: %v", cert.ID, err)
+			continue
+		}
+		certificates = append(certificates, cert)
+		pairs = append(pairs, pair)
+	}
+	return certificates, pairs, rows.Err()
+}
+
+// ReloadManual rebuilds the SNI table from the uploaded certificates.
+// It should be called after certificates are modified.
+func ReloadManual() {
+	certificates, pairs, err := loadCertificates()
+	if err != nil {
+		log.Printf("Error loading certificates: %v", err)
+		return
+	}
+
+	// When several certificates are bound to the same hostname, the one expiring last wins
+	order := make([]int, len(certificates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return certificates[order[a]].NotAfter.Before(certificates[order[b]].NotAfter)
+	})
+
+	table := make(map[string]*tls.Certificate)
+	for _, i := range order {
+		for _, hostname := range certificates[i].Hostnames {
+			table[hostname] = pairs[i]
+		}
+	}
+
+	manualCertsLock.Lock()
+	manualCerts = table
+	manualCertsLock.Unlock()
+
+	log.Printf("Loaded %d uploaded certificates for %d hostnames", len(certificates), len(table))
+}
+
+// manualCertificate returns the uploaded certificate for a hostname, trying an exact
+// binding first and then a wildcard binding for its parent domain
+func manualCertificate(serverName string) *tls.Certificate {
+	hostname := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if hostname == "" {
+		return nil
+	}
+
+	manualCertsLock.RLock()
+	defer manualCertsLock.RUnlock()
+
+	if cert, ok := manualCerts[hostname]; ok {
+		return cert
+	}
+	if i := strings.Index(hostname, "."); i > 0 {
+		if cert, ok := manualCerts["*"+hostname[i:]]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// Expiring returns the uploaded certificates that expire within the given duration
+func Expiring(within time.Duration) ([]models.Certificate, error) {
+	certificates, err := LoadCertificates()
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(within)
+	var expiring []models.Certificate
+	for _, cert := range certificates {
+		if cert.NotAfter.Before(deadline) {
+			cert.KeyPEM = ""
+			expiring = append(expiring, cert)
+		}
+	}
+	return expiring, nil
+}
+
+// Covers reports whether a certificate is served for the given hostname
+func Covers(cert models.Certificate, hostname string) bool {
+	hostname = strings.ToLower(stripPort(hostname))
+	for _, bound := range cert.Hostnames {
+		if bound == hostname {
+			return true
+		}
+		if strings.HasPrefix(bound, "*.") {
+			if i := strings.Index(hostname, "."); i > 0 && hostname[i:] == bound[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
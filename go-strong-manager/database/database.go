@@ -83,7 +83,43 @@ func createTables() {
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			email TEXT UNIQUE,
 			password_hash TEXT,
-			role TEXT
+			role TEXT,
+			totp_secret TEXT DEFAULT '',
+			totp_enabled BOOLEAN DEFAULT 0,
+			totp_last_step INTEGER DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_recovery_codes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			code_hash TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			used_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS settings (
+			key TEXT PRIMARY KEY,
+			value TEXT
+		)`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			client_ip TEXT DEFAULT '',
+			user_agent TEXT DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_seen_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL,
+			revoked_at DATETIME,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL DEFAULT '',
+			user_id INTEGER NOT NULL,
+			expires_at DATETIME NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			revoked_at DATETIME,
+			replaced_by TEXT,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 		)`,
 		`CREATE TABLE IF NOT EXISTS dns_rules (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -91,14 +127,46 @@ func createTables() {
 			rate_limit_enabled BOOLEAN DEFAULT 0,
 			rate_limit_quota INTEGER DEFAULT 100,
 			rate_limit_period INTEGER DEFAULT 60,
+			rate_limit_algorithm TEXT DEFAULT 'fixed_window',
+			rate_limit_burst INTEGER DEFAULT 0,
 			log_retention_days INTEGER DEFAULT 30,
-			health_check_enabled BOOLEAN DEFAULT 0
+			health_check_enabled BOOLEAN DEFAULT 0,
+			health_check_path TEXT DEFAULT '/',
+			health_check_method TEXT DEFAULT 'GET',
+			health_check_headers TEXT DEFAULT '{}',
+			health_check_expected_status_min INTEGER DEFAULT 200,
+			health_check_expected_status_max INTEGER DEFAULT 499,
+			health_check_body_match TEXT DEFAULT '',
+			health_check_body_regex BOOLEAN DEFAULT 0,
+			health_check_interval INTEGER DEFAULT 30,
+			health_check_timeout INTEGER DEFAULT 5,
+			health_check_rise INTEGER DEFAULT 2,
+			health_check_fall INTEGER DEFAULT 1,
+			redirect_https BOOLEAN DEFAULT 0,
+			lb_algorithm TEXT DEFAULT 'round_robin',
+			lb_hash_key TEXT DEFAULT 'ip',
+			affinity_mode TEXT DEFAULT 'none',
+			affinity_header TEXT DEFAULT '',
+			affinity_cookie_name TEXT DEFAULT 'sm_affinity',
+			affinity_ttl INTEGER DEFAULT 0,
+			retry_enabled BOOLEAN DEFAULT 0,
+			retry_attempts INTEGER DEFAULT 3,
+			retry_non_idempotent BOOLEAN DEFAULT 0,
+			retry_on_status TEXT DEFAULT '[502,503,504]',
+			retry_per_try_timeout_ms INTEGER DEFAULT 0,
+			retry_budget INTEGER DEFAULT 20
 		)`,
 		`CREATE TABLE IF NOT EXISTS backends (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			url TEXT UNIQUE,
 			weight INTEGER,
-			isActive BOOLEAN
+			isActive BOOLEAN,
+			max_idle_conns_per_host INTEGER,
+			dial_timeout_ms INTEGER,
+			tls_handshake_timeout_ms INTEGER,
+			response_header_timeout_ms INTEGER,
+			idle_conn_timeout_ms INTEGER,
+			http2 TEXT
 		)`,
 		`CREATE TABLE IF NOT EXISTS dns_backend_map (
 			dns_rule_id INTEGER,
@@ -107,6 +175,33 @@ func createTables() {
 			FOREIGN KEY (dns_rule_id) REFERENCES dns_rules(id) ON DELETE CASCADE,
 			FOREIGN KEY (backend_id) REFERENCES backends(id) ON DELETE CASCADE
 		)`,
+		`CREATE TABLE IF NOT EXISTS dns_routes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			dns_rule_id INTEGER NOT NULL,
+			path TEXT NOT NULL,
+			match_type TEXT CHECK(match_type IN ('prefix', 'exact', 'regex')) DEFAULT 'prefix',
+			methods TEXT DEFAULT '[]',
+			priority INTEGER DEFAULT 0,
+			strip_prefix BOOLEAN DEFAULT 0,
+			rewrite_path TEXT DEFAULT '',
+			FOREIGN KEY (dns_rule_id) REFERENCES dns_rules(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS dns_header_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			dns_rule_id INTEGER NOT NULL,
+			direction TEXT CHECK(direction IN ('request', 'response')) NOT NULL,
+			action TEXT CHECK(action IN ('add', 'set', 'remove')) NOT NULL,
+			name TEXT NOT NULL,
+			value TEXT DEFAULT '',
+			FOREIGN KEY (dns_rule_id) REFERENCES dns_rules(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS dns_route_backend_map (
+			route_id INTEGER,
+			backend_id INTEGER,
+			PRIMARY KEY (route_id, backend_id),
+			FOREIGN KEY (route_id) REFERENCES dns_routes(id) ON DELETE CASCADE,
+			FOREIGN KEY (backend_id) REFERENCES backends(id) ON DELETE CASCADE
+		)`,
 		`CREATE TABLE IF NOT EXISTS request_logs (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
@@ -119,6 +214,7 @@ func createTables() {
 			is_success BOOLEAN,
 			user_agent TEXT,
 			filtered_by INTEGER DEFAULT 0,
+			attempt INTEGER DEFAULT 1,
 			FOREIGN KEY (backend_id) REFERENCES backends(id) ON DELETE SET NULL,
 			FOREIGN KEY (filtered_by) REFERENCES filter_rules(id) ON DELETE SET NULL
 		)`,
@@ -128,6 +224,11 @@ func createTables() {
 			type TEXT CHECK(type IN ('email', 'webhook')),
 			destination TEXT NOT NULL,
 			threshold INTEGER DEFAULT 5,
+			condition_type TEXT DEFAULT 'error_count',
+			window_seconds INTEGER DEFAULT 300,
+			severity TEXT DEFAULT 'warning',
+			webhook_format TEXT DEFAULT 'generic',
+			webhook_secret TEXT DEFAULT '',
 			enabled BOOLEAN DEFAULT 1,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY (dns_rule_id) REFERENCES dns_rules(id) ON DELETE SET NULL
@@ -138,8 +239,36 @@ func createTables() {
 			message TEXT,
 			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
 			sent BOOLEAN DEFAULT 0,
+			delivery_status TEXT DEFAULT 'pending',
+			delivery_attempts INTEGER DEFAULT 0,
+			delivery_error TEXT DEFAULT '',
+			delivered_at DATETIME,
 			FOREIGN KEY (alert_id) REFERENCES alerts(id) ON DELETE CASCADE
 		)`,
+		`CREATE TABLE IF NOT EXISTS alert_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			event_id INTEGER,
+			attempt INTEGER,
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP,
+			success BOOLEAN DEFAULT 0,
+			status_code INTEGER DEFAULT 0,
+			error TEXT DEFAULT '',
+			duration_ms INTEGER DEFAULT 0,
+			FOREIGN KEY (event_id) REFERENCES alert_events(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS certificates (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			cert_pem TEXT NOT NULL,
+			key_pem TEXT NOT NULL,
+			hostnames TEXT DEFAULT '[]',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS acme_cache (
+			key TEXT PRIMARY KEY,
+			data BLOB,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
 		`CREATE TABLE IF NOT EXISTS filter_rules (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			name TEXT NOT NULL,
@@ -189,12 +318,58 @@ func addColumnsIfNotExist() {
 		{"dns_rules", "rate_limit_enabled", "BOOLEAN DEFAULT 0"},
 		{"dns_rules", "rate_limit_quota", "INTEGER DEFAULT 100"},
 		{"dns_rules", "rate_limit_period", "INTEGER DEFAULT 60"},
+		{"dns_rules", "rate_limit_algorithm", "TEXT DEFAULT 'fixed_window'"},
+		{"dns_rules", "rate_limit_burst", "INTEGER DEFAULT 0"},
 		{"dns_rules", "log_retention_days", "INTEGER DEFAULT 30"},
 		{"dns_rules", "health_check_enabled", "BOOLEAN DEFAULT 0"},
+		{"dns_rules", "health_check_path", "TEXT DEFAULT '/'"},
+		{"dns_rules", "health_check_method", "TEXT DEFAULT 'GET'"},
+		{"dns_rules", "health_check_headers", "TEXT DEFAULT '{}'"},
+		{"dns_rules", "health_check_expected_status_min", "INTEGER DEFAULT 200"},
+		{"dns_rules", "health_check_expected_status_max", "INTEGER DEFAULT 499"},
+		{"dns_rules", "health_check_body_match", "TEXT DEFAULT ''"},
+		{"dns_rules", "health_check_body_regex", "BOOLEAN DEFAULT 0"},
+		{"dns_rules", "health_check_interval", "INTEGER DEFAULT 30"},
+		{"dns_rules", "health_check_timeout", "INTEGER DEFAULT 5"},
+		{"dns_rules", "health_check_rise", "INTEGER DEFAULT 2"},
+		{"dns_rules", "health_check_fall", "INTEGER DEFAULT 1"},
+		{"dns_rules", "redirect_https", "BOOLEAN DEFAULT 0"},
+		{"dns_rules", "lb_algorithm", "TEXT DEFAULT 'round_robin'"},
+		{"dns_rules", "lb_hash_key", "TEXT DEFAULT 'ip'"},
+		{"dns_rules", "affinity_mode", "TEXT DEFAULT 'none'"},
+		{"dns_rules", "affinity_header", "TEXT DEFAULT ''"},
+		{"dns_rules", "affinity_cookie_name", "TEXT DEFAULT 'sm_affinity'"},
+		{"dns_rules", "affinity_ttl", "INTEGER DEFAULT 0"},
+		{"dns_rules", "retry_enabled", "BOOLEAN DEFAULT 0"},
+		{"dns_rules", "retry_attempts", "INTEGER DEFAULT 3"},
+		{"dns_rules", "retry_non_idempotent", "BOOLEAN DEFAULT 0"},
+		{"dns_rules", "retry_on_status", "TEXT DEFAULT '[502,503,504]'"},
+		{"dns_rules", "retry_per_try_timeout_ms", "INTEGER DEFAULT 0"},
+		{"dns_rules", "retry_budget", "INTEGER DEFAULT 20"},
+		{"backends", "max_idle_conns_per_host", "INTEGER"},
+		{"backends", "dial_timeout_ms", "INTEGER"},
+		{"backends", "tls_handshake_timeout_ms", "INTEGER"},
+		{"backends", "response_header_timeout_ms", "INTEGER"},
+		{"backends", "idle_conn_timeout_ms", "INTEGER"},
+		{"backends", "http2", "TEXT"},
 		{"alerts", "dns_rule_id", "INTEGER DEFAULT 0"},
+		{"alerts", "condition_type", "TEXT DEFAULT 'error_count'"},
+		{"alerts", "window_seconds", "INTEGER DEFAULT 300"},
+		{"alerts", "severity", "TEXT DEFAULT 'warning'"},
+		{"alerts", "webhook_format", "TEXT DEFAULT 'generic'"},
+		{"alerts", "webhook_secret", "TEXT DEFAULT ''"},
+		{"alert_events", "delivery_status", "TEXT DEFAULT 'pending'"},
+		{"alert_events", "delivery_attempts", "INTEGER DEFAULT 0"},
+		{"alert_events", "delivery_error", "TEXT DEFAULT ''"},
+		{"alert_events", "delivered_at", "DATETIME"},
 		{"request_logs", "request_path", "TEXT"},
 		{"request_logs", "user_agent", "TEXT"},
 		{"request_logs", "filtered_by", "INTEGER DEFAULT 0"},
+		{"request_logs", "attempt", "INTEGER DEFAULT 1"},
+		{"users", "totp_secret", "TEXT DEFAULT ''"},
+		{"users", "totp_enabled", "BOOLEAN DEFAULT 0"},
+		{"users", "totp_last_step", "INTEGER DEFAULT 0"},
+		{"refresh_tokens", "session_id", "TEXT NOT NULL DEFAULT ''"},
 	}
 
 	for _, col := range columnsToAdd {
@@ -230,12 +405,20 @@ func createIndexes() {
 		`CREATE INDEX IF NOT EXISTS idx_request_logs_is_success ON request_logs(is_success)`,
 		`CREATE INDEX IF NOT EXISTS idx_request_logs_client_ip ON request_logs(client_ip)`,
 		`CREATE INDEX IF NOT EXISTS idx_request_logs_filtered_by ON request_logs(filtered_by)`,
+		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session_id ON refresh_tokens(session_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_user_recovery_codes_user_id ON user_recovery_codes(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_dns_routes_dns_rule_id ON dns_routes(dns_rule_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_dns_header_rules_dns_rule_id ON dns_header_rules(dns_rule_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_filter_rules_active ON filter_rules(is_active)`,
 		`CREATE INDEX IF NOT EXISTS idx_filter_rules_priority ON filter_rules(priority DESC)`,
 		`CREATE INDEX IF NOT EXISTS idx_filter_rules_match_type ON filter_rules(match_type)`,
 		`CREATE INDEX IF NOT EXISTS idx_filter_logs_timestamp ON filter_logs(timestamp)`,
 		`CREATE INDEX IF NOT EXISTS idx_filter_logs_client_ip ON filter_logs(client_ip)`,
 		`CREATE INDEX IF NOT EXISTS idx_filter_logs_filter_id ON filter_logs(filter_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_filter_logs_hostname ON filter_logs(hostname)`,
+		`CREATE INDEX IF NOT EXISTS idx_alert_deliveries_event_id ON alert_deliveries(event_id)`,
 	}
 
 	for _, indexQuery := range indexes {
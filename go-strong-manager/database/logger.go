@@ -20,6 +20,7 @@ type LogEntry struct {
 	IsSuccess   bool
 	UserAgent   string
 	FilteredBy  int
+	Attempt     int
 	Timestamp   time.Time
 }
 
@@ -55,11 +56,11 @@ func InitBufferedLogger() {
 	})
 }
 
-// LogRequest adds a log entry to the buffer
-func LogRequest(clientIP, hostname, requestPath string, backendID int, latencyMS int, statusCode int, isSuccess bool, userAgent string, filteredBy int) {
-	if logger == nil {
-		InitBufferedLogger()
-	}
+// LogRequest adds a log entry to the buffer. Attempt numbers the tries of a request
+// that was retried on other backends, starting at 1.
+func LogRequest(clientIP, hostname, requestPath string, backendID int, latencyMS int, statusCode int, isSuccess bool, userAgent string, filteredBy int, attempt int) {
+	// Initialize the logger on first use, safely for concurrent callers
+	InitBufferedLogger()
 
 	entry := LogEntry{
 		ClientIP:    clientIP,
@@ -71,6 +72,7 @@ func LogRequest(clientIP, hostname, requestPath string, backendID int, latencyMS
 		IsSuccess:   isSuccess,
 		UserAgent:   userAgent,
 		FilteredBy:  filteredBy,
+		Attempt:     attempt,
 		Timestamp:   time.Now(),
 	}
 
@@ -174,8 +176,9 @@ func (bl *BufferedLogger) batchInsert(entries []LogEntry) error {
 			status_code, 
 			is_success,
 			user_agent,
-			filtered_by
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			filtered_by,
+			attempt
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement: %w", err)
@@ -195,6 +198,7 @@ func (bl *BufferedLogger) batchInsert(entries []LogEntry) error {
 			entry.IsSuccess,
 			entry.UserAgent,
 			entry.FilteredBy,
+			entry.Attempt,
 		)
 		if err != nil {
 			return fmt.Errorf("failed to execute insert: %w", err)
@@ -0,0 +1,129 @@
+package filter
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Networks of the load balancers and proxies in front of the proxy, whose
+// X-Forwarded-For, X-Real-IP and PROXY protocol headers are trusted
+var trustedProxies []*net.IPNet
+
+// configureTrustedProxies loads the trusted proxy networks from TRUSTED_PROXIES, a comma
+// separated list of CIDRs or IP addresses
+func configureTrustedProxies() {
+	trustedProxies = nil
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.Printf("Warning: Invalid trusted proxy address: %s", entry)
+				continue
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Warning: Invalid trusted proxy CIDR: %s", entry)
+			continue
+		}
+		trustedProxies = append(trustedProxies, ipNet)
+	}
+	if len(trustedProxies) > 0 {
+		log.Printf("Trusting forwarded client addresses from %d proxy networks", len(trustedProxies))
+	}
+}
+
+// TrustedProxiesConfigured reports whether any trusted proxy network is configured
+func TrustedProxiesConfigured() bool {
+	return len(trustedProxies) > 0
+}
+
+// IsTrustedProxy reports whether an address belongs to a trusted proxy
+func IsTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedIP parses an address from a forwarding header, which may carry a port
+// or IPv6 brackets
+func parseForwardedIP(value string) net.IP {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if ip := net.ParseIP(value); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(value, "["), "]"))
+}
+
+// RemoteIP returns the address of the peer connected to the proxy, without its port
+func RemoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// IsFromTrustedProxy reports whether the request was received from a trusted proxy
+func IsFromTrustedProxy(r *http.Request) bool {
+	return IsTrustedProxy(net.ParseIP(RemoteIP(r)))
+}
+
+// GetClientIP returns the address of the client that sent the request. Forwarding
+// headers are only honored when the peer is a trusted proxy, and X-Forwarded-For is read
+// from right to left, skipping trusted proxies, so clients cannot spoof their address by
+// sending the header themselves.
+func GetClientIP(r *http.Request) string {
+	peer := RemoteIP(r)
+	if !IsTrustedProxy(net.ParseIP(peer)) {
+		return peer
+	}
+
+	// Every proxy appends the address it received the request from
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseForwardedIP(hops[i])
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !IsTrustedProxy(ip) {
+			return client
+		}
+	}
+	if client != "" {
+		return client
+	}
+
+	// Proxies that do not use X-Forwarded-For
+	if ip := parseForwardedIP(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
@@ -0,0 +1,140 @@
+package filter
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// trustProxies configures the trusted proxy networks for the duration of a test
+func trustProxies(t *testing.T, networks string) {
+	t.Setenv("TRUSTED_PROXIES", networks)
+	configureTrustedProxies()
+	t.Cleanup(func() { trustedProxies = nil })
+}
+
+func TestGetClientIP(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8, 192.0.2.1, 2001:db8:1::/48")
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		realIP       string
+		want         string
+	}{
+		{
+			name:       "direct client",
+			remoteAddr: "203.0.113.7:4000",
+			want:       "203.0.113.7",
+		},
+		{
+			name:         "forged X-Forwarded-For from an untrusted peer",
+			remoteAddr:   "203.0.113.7:4000",
+			forwardedFor: []string{"198.51.100.1"},
+			want:         "203.0.113.7",
+		},
+		{
+			name:       "forged X-Real-IP from an untrusted peer",
+			remoteAddr: "203.0.113.7:4000",
+			realIP:     "198.51.100.1",
+			want:       "203.0.113.7",
+		},
+		{
+			name:         "single trusted proxy",
+			remoteAddr:   "10.0.0.5:4000",
+			forwardedFor: []string{"203.0.113.7"},
+			want:         "203.0.113.7",
+		},
+		{
+			name:         "chain of trusted proxies",
+			remoteAddr:   "10.0.0.5:4000",
+			forwardedFor: []string{"203.0.113.7, 192.0.2.1", "10.1.2.3"},
+			want:         "203.0.113.7",
+		},
+		{
+			name:         "address forged by the client before the trusted proxies",
+			remoteAddr:   "10.0.0.5:4000",
+			forwardedFor: []string{"198.51.100.1, 203.0.113.7, 10.1.2.3"},
+			want:         "203.0.113.7",
+		},
+		{
+			name:         "only trusted proxies in the chain",
+			remoteAddr:   "10.0.0.5:4000",
+			forwardedFor: []string{"10.9.9.9, 10.1.2.3"},
+			want:         "10.9.9.9",
+		},
+		{
+			name:         "malformed hop stops the walk",
+			remoteAddr:   "10.0.0.5:4000",
+			forwardedFor: []string{"203.0.113.7, not-an-ip, 10.1.2.3"},
+			want:         "10.1.2.3",
+		},
+		{
+			name:         "hop with a port",
+			remoteAddr:   "10.0.0.5:4000",
+			forwardedFor: []string{"203.0.113.7:5000"},
+			want:         "203.0.113.7",
+		},
+		{
+			name:         "IPv6 client behind an IPv6 proxy",
+			remoteAddr:   "[2001:db8:1::5]:4000",
+			forwardedFor: []string{"2001:db8:2::7"},
+			want:         "2001:db8:2::7",
+		},
+		{
+			name:         "bracketed IPv6 hop with a port",
+			remoteAddr:   "10.0.0.5:4000",
+			forwardedFor: []string{"[2001:db8:2::7]:5000, 2001:db8:1::9"},
+			want:         "2001:db8:2::7",
+		},
+		{
+			name:         "forged header from an untrusted IPv6 peer",
+			remoteAddr:   "[2001:db8:2::7]:4000",
+			forwardedFor: []string{"198.51.100.1"},
+			want:         "2001:db8:2::7",
+		},
+		{
+			name:       "X-Real-IP from a trusted proxy",
+			remoteAddr: "192.0.2.1:4000",
+			realIP:     "203.0.113.7",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "trusted proxy without forwarding headers",
+			remoteAddr: "10.0.0.5:4000",
+			want:       "10.0.0.5",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := GetClientIP(r); got != tt.want {
+				t.Errorf("GetClientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigureTrustedProxiesSkipsInvalidEntries(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8, not-a-network, 10.0.0.0/99, ::1")
+
+	if len(trustedProxies) != 2 {
+		t.Fatalf("got %d trusted networks, want 2", len(trustedProxies))
+	}
+	for _, ip := range []string{"10.20.30.40", "::1"} {
+		if !IsTrustedProxy(parseForwardedIP(ip)) {
+			t.Errorf("%s is not trusted", ip)
+		}
+	}
+	if IsTrustedProxy(parseForwardedIP("::2")) {
+		t.Error("a single trusted address trusts its neighbours")
+	}
+}
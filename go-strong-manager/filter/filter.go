@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/hostmatch"
 	"github.com/arifur/strong-reverse-proxy/models"
 )
 
@@ -21,6 +22,7 @@ var (
 
 // Initialize sets up the filter system
 func Initialize() {
+	configureTrustedProxies()
 	refreshFilterCache()
 	log.Println("Filter system initialized")
 }
@@ -72,15 +74,16 @@ func refreshFilterCache() {
 	log.Printf("Filter cache refreshed with %d active rules", len(rules))
 }
 
-// FilterRequest checks if a request should be filtered and returns the appropriate response
-func FilterRequest(r *http.Request) (*FilterResult, error) {
+// FilterRequest checks if a request should be filtered and returns the appropriate response.
+// Filtered requests are logged under logHostname, the hostname of the DNS rule serving the request.
+func FilterRequest(r *http.Request, logHostname string) (*FilterResult, error) {
 	filterRuleCacheLock.RLock()
 	rules := make([]models.FilterRule, len(filterRuleCache))
 	copy(rules, filterRuleCache)
 	filterRuleCacheLock.RUnlock()
 
-	clientIP := getClientIP(r)
-	hostname := r.Host
+	clientIP := GetClientIP(r)
+	hostname := hostmatch.Normalize(r.Host)
 	requestPath := r.URL.Path
 	userAgent := r.Header.Get("User-Agent")
 
@@ -88,7 +91,7 @@ func FilterRequest(r *http.Request) (*FilterResult, error) {
 	for _, rule := range rules {
 		if matchesRule(rule, clientIP, hostname, requestPath) {
 			// Log the filtered request
-			go logFilteredRequest(clientIP, hostname, requestPath, userAgent, rule)
+			go logFilteredRequest(clientIP, logHostname, requestPath, userAgent, rule)
 
 			return &FilterResult{
 				Filtered:    true,
@@ -169,6 +172,9 @@ func matchesPath(pattern, requestPath string) bool {
 
 // matchesDNS checks if hostname matches the rule pattern
 func matchesDNS(pattern, hostname string) bool {
+	// Request hostnames are normalized to lowercase
+	pattern = strings.ToLower(pattern)
+
 	// Support wildcard patterns
 	if strings.Contains(pattern, "*") {
 		return matchesWildcard(pattern, hostname)
@@ -259,30 +265,6 @@ func getRedirectURLForAction(rule models.FilterRule) string {
 	return ""
 }
 
-// getClientIP extracts the client IP from the request
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header first
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// Take the first IP in the list
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
-		}
-	}
-
-	// Check X-Real-IP header
-	if xri := r.Header.Get("X-Real-IP"); xri != "" {
-		return xri
-	}
-
-	// Fall back to RemoteAddr
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return ip
-}
-
 // logFilteredRequest logs a filtered request to the database
 func logFilteredRequest(clientIP, hostname, requestPath, userAgent string, rule models.FilterRule) {
 	_, err := database.DB.Exec(`
@@ -0,0 +1,122 @@
+package filter
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// useTestDatabase initializes the database in a temporary directory
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	database.Initialize()
+	t.Cleanup(func() {
+		database.Close()
+		os.Chdir(wd)
+	})
+}
+
+// useFilterRules filters requests with the given rules for the duration of a test
+func useFilterRules(t *testing.T, rules ...models.FilterRule) {
+	filterRuleCacheLock.Lock()
+	previous := filterRuleCache
+	filterRuleCache = rules
+	filterRuleCacheLock.Unlock()
+	t.Cleanup(func() {
+		filterRuleCacheLock.Lock()
+		filterRuleCache = previous
+		filterRuleCacheLock.Unlock()
+	})
+}
+
+// waitForFilterLogs waits until the filter hits logged in the background reach count
+func waitForFilterLogs(t *testing.T, count int) {
+	t.Helper()
+	var logged int
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if err := database.DB.QueryRow("SELECT COUNT(*) FROM filter_logs").Scan(&logged); err != nil {
+			t.Fatalf("count filter logs: %v", err)
+		}
+		if logged >= count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d filter hits logged, want %d", logged, count)
+		}
+	}
+}
+
+func TestDNSFilterRulesMatchNormalizedHostnames(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"blocked.example.com", "blocked.example.com", true},
+		{"blocked.example.com", "Blocked.Example.COM:8080", true},
+		{"blocked.example.com", "blocked.example.com.", true},
+		{"Blocked.example.com", "blocked.example.com", true},
+		{"*.example.com", "API.example.com:443", true},
+		{"xn--bcher-kva.example", "bücher.example", true},
+		{"blocked.example.com", "allowed.example.com", false},
+	}
+	useTestDatabase(t)
+	filtered := 0
+	for _, tt := range tests {
+		useFilterRules(t, models.FilterRule{
+			ID:         1,
+			MatchType:  models.FilterMatchTypeDNS,
+			MatchValue: tt.pattern,
+			ActionType: models.FilterActionBadRequest,
+		})
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = tt.host
+		result, err := FilterRequest(r, "example.com")
+		if err != nil {
+			t.Fatalf("FilterRequest: %v", err)
+		}
+		if result.Filtered != tt.want {
+			t.Errorf("rule %q, host %q: filtered = %v, want %v", tt.pattern, tt.host, result.Filtered, tt.want)
+		}
+		if result.Filtered {
+			filtered++
+		}
+	}
+	waitForFilterLogs(t, filtered)
+}
+
+func TestFilteredRequestsAreLoggedUnderTheGivenHostname(t *testing.T) {
+	useTestDatabase(t)
+	useFilterRules(t, models.FilterRule{
+		ID:         1,
+		MatchType:  models.FilterMatchTypePath,
+		MatchValue: "/admin",
+		ActionType: models.FilterActionBadRequest,
+	})
+
+	r := httptest.NewRequest("GET", "/admin", nil)
+	r.Host = "API.Example.com:8443"
+	if result, err := FilterRequest(r, "*.example.com"); err != nil || !result.Filtered {
+		t.Fatalf("FilterRequest = %+v, %v, want the request filtered", result, err)
+	}
+
+	waitForFilterLogs(t, 1)
+	var hostname string
+	if err := database.DB.QueryRow("SELECT hostname FROM filter_logs").Scan(&hostname); err != nil {
+		t.Fatalf("load filter log: %v", err)
+	}
+	if hostname != "*.example.com" {
+		t.Errorf("logged hostname = %q, want the DNS rule hostname *.example.com", hostname)
+	}
+}
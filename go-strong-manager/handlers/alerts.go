@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/arifur/strong-reverse-proxy/alerts"
 	"github.com/arifur/strong-reverse-proxy/database"
 	"github.com/arifur/strong-reverse-proxy/models"
 	"github.com/gofiber/fiber/v2"
@@ -19,6 +20,11 @@ func GetAlerts(c *fiber.Ctx) error {
 			a.type, 
 			a.destination, 
 			a.threshold, 
+			a.condition_type,
+			a.window_seconds,
+			a.severity,
+			a.webhook_format,
+			a.webhook_secret != '',
 			a.enabled,
 			a.created_at,
 			d.hostname
@@ -40,7 +46,7 @@ func GetAlerts(c *fiber.Ctx) error {
 	alerts := []models.Alert{}
 	for rows.Next() {
 		var alert models.Alert
-		var typeStr string
+		var typeStr, conditionStr, severityStr string
 		var createdAtStr string
 		var hostname sql.NullString
 
@@ -50,6 +56,11 @@ func GetAlerts(c *fiber.Ctx) error {
 			&typeStr,
 			&alert.Destination,
 			&alert.Threshold,
+			&conditionStr,
+			&alert.WindowSeconds,
+			&severityStr,
+			&alert.WebhookFormat,
+			&alert.HasWebhookSecret,
 			&alert.Enabled,
 			&createdAtStr,
 			&hostname,
@@ -59,8 +70,10 @@ func GetAlerts(c *fiber.Ctx) error {
 			})
 		}
 
-		// Parse alert type
+		// Parse alert type and condition
 		alert.Type = models.AlertType(typeStr)
+		alert.Condition = models.AlertCondition(conditionStr)
+		alert.Severity = models.AlertSeverity(severityStr)
 
 		// Get hostname if available
 		if hostname.Valid {
@@ -80,7 +93,11 @@ func GetAlerts(c *fiber.Ctx) error {
 				id, 
 				message, 
 				timestamp, 
-				sent 
+				sent,
+				delivery_status,
+				delivery_attempts,
+				delivery_error,
+				delivered_at
 			FROM 
 				alert_events 
 			WHERE 
@@ -93,8 +110,10 @@ func GetAlerts(c *fiber.Ctx) error {
 			for eventsRows.Next() {
 				var event models.AlertEvent
 				var timestampStr string
+				var deliveryStatus, deliveryError, deliveredAt sql.NullString
 
-				if err := eventsRows.Scan(&event.ID, &event.Message, &timestampStr, &event.Sent); err == nil {
+				if err := eventsRows.Scan(&event.ID, &event.Message, &timestampStr, &event.Sent,
+					&deliveryStatus, &event.DeliveryAttempts, &deliveryError, &deliveredAt); err == nil {
 					event.AlertID = alert.ID
 
 					// Parse timestamp
@@ -103,6 +122,17 @@ func GetAlerts(c *fiber.Ctx) error {
 					} else {
 						event.Timestamp = time.Now() // Fallback
 					}
+
+					// Parse delivery outcome
+					event.DeliveryStatus = deliveryStatus.String
+					event.DeliveryError = deliveryError.String
+					if deliveredAt.Valid {
+						if t, err := time.Parse("2006-01-02 15:04:05", deliveredAt.String); err == nil {
+							event.DeliveredAt = &t
+						}
+					}
+
+					alert.RecentEvents = append(alert.RecentEvents, event)
 				}
 			}
 			eventsRows.Close()
@@ -185,9 +215,25 @@ func CreateAlert(c *fiber.Ctx) error {
 		})
 	}
 
-	// Ensure threshold is positive
-	if alert.Threshold <= 0 {
-		alert.Threshold = 5 // Default
+	if alert.Type == models.AlertTypeEmail {
+		if err := alerts.ValidateEmailAddress(alert.Destination); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid email destination: " + err.Error(),
+			})
+		}
+	}
+
+	// Set default condition settings and validate them
+	alerts.ApplyDefaults(&alert)
+	if err := alerts.ValidateCondition(alert); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if !alerts.IsValidWebhookFormat(alert.WebhookFormat) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid webhook format. Must be 'generic', 'slack', 'teams' or 'discord'",
+		})
 	}
 
 	// If dns_rule_id is provided and not 0, verify it exists
@@ -216,9 +262,16 @@ func CreateAlert(c *fiber.Ctx) error {
 			type, 
 			destination, 
 			threshold, 
+			condition_type,
+			window_seconds,
+			severity,
+			webhook_format,
+			webhook_secret,
 			enabled
-		) VALUES (?, ?, ?, ?, ?)
-	`, alert.DNSRuleID, string(alert.Type), alert.Destination, alert.Threshold, alert.Enabled)
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, alert.DNSRuleID, string(alert.Type), alert.Destination, alert.Threshold,
+		string(alert.Condition), alert.WindowSeconds, string(alert.Severity),
+		alert.WebhookFormat, alert.WebhookSecret, alert.Enabled)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create alert",
@@ -230,6 +283,10 @@ func CreateAlert(c *fiber.Ctx) error {
 	alert.ID = int(id)
 	alert.CreatedAt = time.Now()
 
+	// The webhook secret is write-only
+	alert.HasWebhookSecret = alert.WebhookSecret != ""
+	alert.WebhookSecret = ""
+
 	// Get hostname if associated with a DNS rule
 	if alert.DNSRuleID > 0 {
 		err := database.DB.QueryRow("SELECT hostname FROM dns_rules WHERE id = ?", alert.DNSRuleID).Scan(&alert.Hostname)
@@ -254,17 +311,26 @@ func UpdateAlert(c *fiber.Ctx) error {
 		})
 	}
 
-	// Parse request body
+	// Parse request body, and separately the settings only updated when present
 	var alert models.Alert
+	var present models.AlertUpdate
 	if err := c.BodyParser(&alert); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
+	if err := c.BodyParser(&present); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
 
-	// Check if alert exists
-	var exists bool
-	err = database.DB.QueryRow("SELECT 1 FROM alerts WHERE id = ?", id).Scan(&exists)
+	// Check if alert exists and load its current settings
+	var current models.Alert
+	var currentTypeStr, conditionStr, severityStr string
+	err = database.DB.QueryRow(
+		"SELECT type, destination, threshold, condition_type, window_seconds, severity, webhook_format, webhook_secret FROM alerts WHERE id = ?", id,
+	).Scan(&currentTypeStr, &current.Destination, &current.Threshold, &conditionStr, &current.WindowSeconds, &severityStr, &current.WebhookFormat, &current.WebhookSecret)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
@@ -276,6 +342,58 @@ func UpdateAlert(c *fiber.Ctx) error {
 		})
 	}
 
+	// Keep the current type and destination when they are not part of the update, and
+	// validate the destination against the type the alert ends up with
+	if alert.Type == "" {
+		alert.Type = models.AlertType(currentTypeStr)
+	} else if alert.Type != models.AlertTypeEmail && alert.Type != models.AlertTypeWebhook {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid alert type. Must be 'email' or 'webhook'",
+		})
+	}
+	if alert.Destination == "" {
+		alert.Destination = current.Destination
+	}
+	if alert.Type == models.AlertTypeEmail {
+		if err := alerts.ValidateEmailAddress(alert.Destination); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid email destination: " + err.Error(),
+			})
+		}
+	}
+
+	// Keep current condition settings that are not part of the update, then validate the result
+	if alert.Condition == "" {
+		alert.Condition = models.AlertCondition(conditionStr)
+	}
+	if alert.Severity == "" {
+		alert.Severity = models.AlertSeverity(severityStr)
+	}
+	if alert.WindowSeconds <= 0 {
+		alert.WindowSeconds = current.WindowSeconds
+	}
+	if alert.Threshold <= 0 {
+		alert.Threshold = current.Threshold
+	}
+	if alert.WebhookFormat == "" {
+		alert.WebhookFormat = current.WebhookFormat
+	}
+	// An empty webhook secret clears it, so the current one is only kept when it is not sent
+	if present.WebhookSecret == nil {
+		alert.WebhookSecret = current.WebhookSecret
+	}
+	alerts.ApplyDefaults(&alert)
+	if err := alerts.ValidateCondition(alert); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if !alerts.IsValidWebhookFormat(alert.WebhookFormat) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid webhook format. Must be 'generic', 'slack', 'teams' or 'discord'",
+		})
+	}
+
 	// If dns_rule_id is provided and not 0, verify it exists
 	if alert.DNSRuleID > 0 {
 		var exists bool
@@ -303,10 +421,17 @@ func UpdateAlert(c *fiber.Ctx) error {
 			type = COALESCE(?, type),
 			destination = COALESCE(?, destination),
 			threshold = COALESCE(?, threshold),
+			condition_type = ?,
+			window_seconds = ?,
+			severity = ?,
+			webhook_format = ?,
+			webhook_secret = ?,
 			enabled = COALESCE(?, enabled)
 		WHERE 
 			id = ?
-	`, alert.DNSRuleID, string(alert.Type), alert.Destination, alert.Threshold, alert.Enabled, id)
+	`, alert.DNSRuleID, string(alert.Type), alert.Destination, alert.Threshold,
+		string(alert.Condition), alert.WindowSeconds, string(alert.Severity),
+		alert.WebhookFormat, alert.WebhookSecret, alert.Enabled, id)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to update alert",
@@ -324,6 +449,11 @@ func UpdateAlert(c *fiber.Ctx) error {
 			type, 
 			destination, 
 			threshold, 
+			condition_type,
+			window_seconds,
+			severity,
+			webhook_format,
+			webhook_secret != '',
 			enabled,
 			created_at,
 			(SELECT hostname FROM dns_rules WHERE id = alerts.dns_rule_id)
@@ -336,6 +466,11 @@ func UpdateAlert(c *fiber.Ctx) error {
 		&typeStr,
 		&updatedAlert.Destination,
 		&updatedAlert.Threshold,
+		&conditionStr,
+		&updatedAlert.WindowSeconds,
+		&severityStr,
+		&updatedAlert.WebhookFormat,
+		&updatedAlert.HasWebhookSecret,
 		&updatedAlert.Enabled,
 		&createdAtStr,
 		&hostname,
@@ -347,6 +482,8 @@ func UpdateAlert(c *fiber.Ctx) error {
 	}
 
 	updatedAlert.Type = models.AlertType(typeStr)
+	updatedAlert.Condition = models.AlertCondition(conditionStr)
+	updatedAlert.Severity = models.AlertSeverity(severityStr)
 
 	// Get hostname if available
 	if hostname.Valid {
@@ -399,3 +536,104 @@ func DeleteAlert(c *fiber.Ctx) error {
 
 	return c.Status(fiber.StatusNoContent).Send(nil)
 }
+
+// SendTestAlert delivers a test event through an alert's channel and reports the outcome
+func SendTestAlert(c *fiber.Ctx) error {
+	// Get alert ID from URL
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid alert ID",
+		})
+	}
+
+	alert, err := alerts.LoadAlert(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Alert not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	event, err := alerts.SendTest(alert)
+	if err != nil {
+		if event.ID == 0 {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to record test alert",
+			})
+		}
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Failed to deliver test alert: " + err.Error(),
+			"event": event,
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(event)
+}
+
+// GetAlertEventDeliveries returns the delivery log of an alert event
+func GetAlertEventDeliveries(c *fiber.Ctx) error {
+	// Get event ID from URL
+	eventID, err := c.ParamsInt("eventId")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid alert event ID",
+		})
+	}
+
+	rows, err := database.DB.Query(`
+		SELECT 
+			id, 
+			attempt, 
+			timestamp, 
+			success, 
+			status_code, 
+			error, 
+			duration_ms 
+		FROM 
+			alert_deliveries 
+		WHERE 
+			event_id = ? 
+		ORDER BY 
+			attempt
+	`, eventID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch alert deliveries",
+		})
+	}
+	defer rows.Close()
+
+	deliveries := []models.AlertDelivery{}
+	for rows.Next() {
+		delivery := models.AlertDelivery{EventID: eventID}
+		var timestampStr string
+
+		if err := rows.Scan(
+			&delivery.ID,
+			&delivery.Attempt,
+			&timestampStr,
+			&delivery.Success,
+			&delivery.StatusCode,
+			&delivery.Error,
+			&delivery.DurationMS,
+		); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to scan alert delivery row",
+			})
+		}
+
+		// Parse timestamp
+		if timestamp, err := time.Parse("2006-01-02 15:04:05", timestampStr); err == nil {
+			delivery.Timestamp = timestamp
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(deliveries)
+}
@@ -2,21 +2,15 @@ package handlers
 
 import (
 	"database/sql"
-	"time"
 
 	"github.com/arifur/strong-reverse-proxy/database"
 	"github.com/arifur/strong-reverse-proxy/models"
+	"github.com/arifur/strong-reverse-proxy/tokens"
+	"github.com/arifur/strong-reverse-proxy/twofactor"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
-const (
-	jwtSecret      = "your-secret-key" // In production, use environment variable
-	jwtExpiration  = 24 * time.Hour    // Token expiration time
-	refreshExpTime = 168 * time.Hour   // 7 days
-)
-
 // Signup handles user registration
 func Signup(c *fiber.Ctx) error {
 	// Only allow signup when no users exist
@@ -57,10 +51,10 @@ func Signup(c *fiber.Ctx) error {
 		})
 	}
 
-	// Insert user
+	// Insert user; the first user administers the others
 	result, err := database.DB.Exec(
 		"INSERT INTO users (email, password_hash, role) VALUES (?, ?, ?)",
-		req.Email, string(hashedPassword), "admin",
+		req.Email, string(hashedPassword), models.RoleAdmin,
 	)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -75,7 +69,7 @@ func Signup(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
 		"id":    id,
 		"email": req.Email,
-		"role":  "admin",
+		"role":  models.RoleAdmin,
 	})
 }
 
@@ -99,9 +93,9 @@ func Login(c *fiber.Ctx) error {
 	// Find user
 	var user models.User
 	err := database.DB.QueryRow(
-		"SELECT id, email, password_hash, role FROM users WHERE email = ?",
+		"SELECT id, email, password_hash, role, totp_enabled FROM users WHERE email = ?",
 		req.Email,
-	).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role)
+	).Scan(&user.ID, &user.Email, &user.PasswordHash, &user.Role, &user.TwoFactorEnabled)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
@@ -121,32 +115,62 @@ func Login(c *fiber.Ctx) error {
 		})
 	}
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":    user.ID,
-		"email": user.Email,
-		"role":  user.Role,
-		"exp":   time.Now().Add(jwtExpiration).Unix(),
-	})
+	// Verify the second factor of enrolled users
+	if user.TwoFactorEnabled {
+		if req.Code == "" && req.RecoveryCode == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error":               "Two-factor code required",
+				"two_factor_required": true,
+			})
+		}
+		if err := twofactor.Verify(user.ID, req.Code, req.RecoveryCode); err != nil {
+			return twoFactorError(c, err)
+		}
+	}
 
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+	// Start a session with access and refresh tokens
+	tokenString, refreshTokenString, err := tokens.Issue(user, c.IP(), c.Get(fiber.HeaderUserAgent))
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate token",
 		})
 	}
 
-	// Generate refresh token
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":   user.ID,
-		"exp":  time.Now().Add(refreshExpTime).Unix(),
-		"type": "refresh",
+	// Return tokens, telling users who must enrol in two-factor authentication to do so
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"token":                     tokenString,
+		"refreshToken":              refreshTokenString,
+		"two_factor_setup_required": twofactor.Required() && !user.TwoFactorEnabled,
 	})
+}
+
+// RefreshToken exchanges a refresh token for a new access token and refresh token. The
+// refresh token can only be exchanged once.
+func RefreshToken(c *fiber.Ctx) error {
+	// Parse request body
+	var req models.RefreshRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
 
-	refreshTokenString, err := refreshToken.SignedString([]byte(jwtSecret))
+	if req.RefreshToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Refresh token is required",
+		})
+	}
+
+	// Rotate the refresh token
+	_, tokenString, refreshTokenString, err := tokens.Refresh(req.RefreshToken)
 	if err != nil {
+		if err == tokens.ErrInvalidToken || err == tokens.ErrTokenRevoked {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid or expired refresh token",
+			})
+		}
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to generate refresh token",
+			"error": "Failed to refresh token",
 		})
 	}
 
@@ -156,3 +180,34 @@ func Login(c *fiber.Ctx) error {
 		"refreshToken": refreshTokenString,
 	})
 }
+
+// Logout ends the session of a refresh token, invalidating its access tokens at once
+func Logout(c *fiber.Ctx) error {
+	// Parse request body
+	var req models.RefreshRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.RefreshToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Refresh token is required",
+		})
+	}
+
+	// Revoke the refresh token
+	if err := tokens.Revoke(req.RefreshToken); err != nil {
+		if err == tokens.ErrInvalidToken {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid or expired refresh token",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke token",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -2,17 +2,33 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
 	"strconv"
 
 	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/health"
 	"github.com/arifur/strong-reverse-proxy/models"
+	"github.com/arifur/strong-reverse-proxy/proxy"
 	"github.com/gofiber/fiber/v2"
 )
 
+// backendColumns are the backend columns read by scanBackend
+const backendColumns = `id, url, weight, isActive, max_idle_conns_per_host, dial_timeout_ms,
+	tls_handshake_timeout_ms, response_header_timeout_ms, idle_conn_timeout_ms, http2`
+
+// scanBackend scans a row selected with backendColumns into a backend
+func scanBackend(row rowScanner, backend *models.Backend) error {
+	backend.Transport = &models.BackendTransport{}
+	return row.Scan(&backend.ID, &backend.URL, &backend.Weight, &backend.IsActive,
+		&backend.Transport.MaxIdleConnsPerHost, &backend.Transport.DialTimeoutMS,
+		&backend.Transport.TLSHandshakeTimeoutMS, &backend.Transport.ResponseHeaderTimeoutMS,
+		&backend.Transport.IdleConnTimeoutMS, &backend.Transport.HTTP2)
+}
+
 // GetBackends returns all backends
 func GetBackends(c *fiber.Ctx) error {
 	// Query all backends
-	rows, err := database.DB.Query("SELECT id, url, weight, isActive FROM backends")
+	rows, err := database.DB.Query("SELECT " + backendColumns + " FROM backends")
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Database error",
@@ -24,7 +40,7 @@ func GetBackends(c *fiber.Ctx) error {
 	var backends []models.Backend
 	for rows.Next() {
 		var backend models.Backend
-		if err := rows.Scan(&backend.ID, &backend.URL, &backend.Weight, &backend.IsActive); err != nil {
+		if err := scanBackend(rows, &backend); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "Error scanning backend",
 			})
@@ -51,11 +67,23 @@ func CreateBackend(c *fiber.Ctx) error {
 			"error": "URL is required",
 		})
 	}
+	if backend.Transport == nil {
+		backend.Transport = &models.BackendTransport{}
+	}
+	if err := proxy.ValidateBackendTransport(*backend.Transport); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 
 	// Insert backend
-	result, err := database.DB.Exec(
-		"INSERT INTO backends (url, weight, isActive) VALUES (?, ?, ?)",
-		backend.URL, backend.Weight, backend.IsActive,
+	transport := backend.Transport
+	result, err := database.DB.Exec(`
+		INSERT INTO backends (url, weight, isActive, max_idle_conns_per_host, dial_timeout_ms,
+			tls_handshake_timeout_ms, response_header_timeout_ms, idle_conn_timeout_ms, http2)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, backend.URL, backend.Weight, backend.IsActive, transport.MaxIdleConnsPerHost, transport.DialTimeoutMS,
+		transport.TLSHandshakeTimeoutMS, transport.ResponseHeaderTimeoutMS, transport.IdleConnTimeoutMS, transport.HTTP2,
 	)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -109,13 +137,34 @@ func UpdateBackend(c *fiber.Ctx) error {
 		needsComma = true
 	}
 
-	// IsActive is a boolean, so we need to check if it's explicitly provided
-	if c.Body() != nil && c.Body()[0] != 0 {
+	// IsActive is a boolean, so we need to check if it's explicitly provided. Requests
+	// that only change the connection settings must not deactivate the backend.
+	var fields map[string]json.RawMessage
+	json.Unmarshal(c.Body(), &fields)
+	if _, provided := fields["isActive"]; provided {
 		if needsComma {
 			query += ","
 		}
 		query += " isActive = ?"
 		args = append(args, req.IsActive)
+		needsComma = true
+	}
+
+	// Connection settings are replaced as a whole, settings left out return to the defaults
+	if req.Transport != nil {
+		if err := proxy.ValidateBackendTransport(*req.Transport); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if needsComma {
+			query += ","
+		}
+		query += ` max_idle_conns_per_host = ?, dial_timeout_ms = ?, tls_handshake_timeout_ms = ?,
+			response_header_timeout_ms = ?, idle_conn_timeout_ms = ?, http2 = ?`
+		args = append(args, req.Transport.MaxIdleConnsPerHost, req.Transport.DialTimeoutMS,
+			req.Transport.TLSHandshakeTimeoutMS, req.Transport.ResponseHeaderTimeoutMS,
+			req.Transport.IdleConnTimeoutMS, req.Transport.HTTP2)
 	}
 
 	// If no fields to update
@@ -147,9 +196,7 @@ func UpdateBackend(c *fiber.Ctx) error {
 
 	// Get updated backend
 	var backend models.Backend
-	err = database.DB.QueryRow(
-		"SELECT id, url, weight, isActive FROM backends WHERE id = ?", id,
-	).Scan(&backend.ID, &backend.URL, &backend.Weight, &backend.IsActive)
+	err = scanBackend(database.DB.QueryRow("SELECT "+backendColumns+" FROM backends WHERE id = ?", id), &backend)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
@@ -161,6 +208,10 @@ func UpdateBackend(c *fiber.Ctx) error {
 		})
 	}
 
+	// Stop or resume sending traffic to the backend, with its connection settings, right away
+	proxy.RefreshDNSRulesCache()
+	health.Refresh()
+
 	// Return updated backend
 	return c.JSON(backend)
 }
@@ -191,6 +242,12 @@ func DeleteBackend(c *fiber.Ctx) error {
 			"error": "Failed to delete backend mappings",
 		})
 	}
+	_, err = tx.Exec("DELETE FROM dns_route_backend_map WHERE backend_id = ?", id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete backend mappings",
+		})
+	}
 
 	// Delete backend
 	result, err := tx.Exec("DELETE FROM backends WHERE id = ?", id)
@@ -215,6 +272,10 @@ func DeleteBackend(c *fiber.Ctx) error {
 		})
 	}
 
+	// Stop sending traffic to the backend right away
+	proxy.RefreshDNSRulesCache()
+	health.Refresh()
+
 	// Return success
 	return c.SendStatus(fiber.StatusNoContent)
 }
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/certs"
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetCertificates returns all uploaded certificates with their expiry and SANs
+func GetCertificates(c *fiber.Ctx) error {
+	certificates, err := certs.LoadCertificates()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch certificates",
+		})
+	}
+
+	// Never return private keys
+	result := []models.Certificate{}
+	for _, cert := range certificates {
+		cert.KeyPEM = ""
+		result = append(result, cert)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+// CreateCertificate uploads a PEM certificate and key pair and binds it to hostnames
+func CreateCertificate(c *fiber.Ctx) error {
+	// Parse request body
+	var cert models.Certificate
+	if err := c.BodyParser(&cert); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if cert.CertPEM == "" || cert.KeyPEM == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Certificate and key are required",
+		})
+	}
+
+	// Validate the pair and the hostname bindings
+	if _, err := certs.ParseCertificate(&cert); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if cert.Name == "" {
+		cert.Name = cert.Hostnames[0]
+	}
+
+	hostnames, _ := json.Marshal(cert.Hostnames)
+	result, err := database.DB.Exec(
+		"INSERT INTO certificates (name, cert_pem, key_pem, hostnames) VALUES (?, ?, ?, ?)",
+		cert.Name, cert.CertPEM, cert.KeyPEM, string(hostnames),
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create certificate",
+		})
+	}
+
+	// Get inserted ID
+	id, _ := result.LastInsertId()
+	cert.ID = int(id)
+	cert.CreatedAt = time.Now()
+	cert.KeyPEM = ""
+
+	// Serve the new certificate right away
+	certs.ReloadManual()
+
+	return c.Status(fiber.StatusCreated).JSON(cert)
+}
+
+// UpdateCertificate renames a certificate, changes its hostname bindings or replaces its PEM pair
+func UpdateCertificate(c *fiber.Ctx) error {
+	// Get certificate ID from URL
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid certificate ID",
+		})
+	}
+
+	// Parse request body
+	var req models.Certificate
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Load the current certificate
+	var cert models.Certificate
+	var hostnames string
+	err = database.DB.QueryRow(
+		"SELECT name, cert_pem, key_pem, hostnames FROM certificates WHERE id = ?", id,
+	).Scan(&cert.Name, &cert.CertPEM, &cert.KeyPEM, &hostnames)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Certificate not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	json.Unmarshal([]byte(hostnames), &cert.Hostnames)
+
+	// Apply the provided fields; a new certificate must come with its key
+	if req.Name != "" {
+		cert.Name = req.Name
+	}
+	if req.CertPEM != "" || req.KeyPEM != "" {
+		if req.CertPEM == "" || req.KeyPEM == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Certificate and key must be replaced together",
+			})
+		}
+		cert.CertPEM = req.CertPEM
+		cert.KeyPEM = req.KeyPEM
+	}
+	if req.Hostnames != nil {
+		cert.Hostnames = req.Hostnames
+	}
+
+	// Validate the result
+	if _, err := certs.ParseCertificate(&cert); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	encoded, _ := json.Marshal(cert.Hostnames)
+	_, err = database.DB.Exec(
+		"UPDATE certificates SET name = ?, cert_pem = ?, key_pem = ?, hostnames = ? WHERE id = ?",
+		cert.Name, cert.CertPEM, cert.KeyPEM, string(encoded), id,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update certificate",
+		})
+	}
+
+	cert.ID = id
+	cert.KeyPEM = ""
+
+	// Hot-swap the certificate in the proxy
+	certs.ReloadManual()
+	certs.Refresh()
+
+	return c.Status(fiber.StatusOK).JSON(cert)
+}
+
+// DeleteCertificate deletes an uploaded certificate
+func DeleteCertificate(c *fiber.Ctx) error {
+	// Get certificate ID from URL
+	id, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid certificate ID",
+		})
+	}
+
+	result, err := database.DB.Exec("DELETE FROM certificates WHERE id = ?", id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete certificate",
+		})
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Certificate not found",
+		})
+	}
+
+	// Stop serving the certificate; hostnames left without one fall back to ACME
+	certs.ReloadManual()
+	certs.Refresh()
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -9,7 +9,9 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/arifur/strong-reverse-proxy/certs"
 	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/health"
 	"github.com/arifur/strong-reverse-proxy/middleware"
 	"github.com/arifur/strong-reverse-proxy/proxy"
 	"github.com/gofiber/fiber/v2"
@@ -138,6 +140,8 @@ func RestoreDatabase(c *fiber.Ctx) error {
 	// Refresh caches and configuration
 	proxy.RefreshDNSRulesCache()
 	middleware.RefreshRateLimiterConfigs()
+	health.Refresh()
+	certs.Refresh()
 
 	return c.JSON(fiber.Map{
 		"success": true,
@@ -188,6 +192,8 @@ func ResetDatabase(c *fiber.Ctx) error {
 	// Refresh caches and configuration
 	proxy.RefreshDNSRulesCache()
 	middleware.RefreshRateLimiterConfigs()
+	health.Refresh()
+	certs.Refresh()
 
 	return c.JSON(fiber.Map{
 		"success":     true,
@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+	"github.com/arifur/strong-reverse-proxy/proxy"
+	"github.com/gofiber/fiber/v2"
+)
+
+// loadHeaderRules returns the header rules of a DNS rule, in the order they are applied
+func loadHeaderRules(q queryer, dnsRuleID int) ([]models.HeaderRule, error) {
+	rows, err := q.Query(`
+		SELECT
+			id,
+			direction,
+			action,
+			name,
+			value
+		FROM
+			dns_header_rules
+		WHERE
+			dns_rule_id = ?
+		ORDER BY
+			id
+	`, dnsRuleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	headerRules := []models.HeaderRule{}
+	for rows.Next() {
+		headerRule := models.HeaderRule{DNSRuleID: dnsRuleID}
+		var direction, action string
+		if err := rows.Scan(&headerRule.ID, &direction, &action, &headerRule.Name, &headerRule.Value); err != nil {
+			return nil, err
+		}
+		headerRule.Direction = models.HeaderDirection(direction)
+		headerRule.Action = models.HeaderAction(action)
+		headerRules = append(headerRules, headerRule)
+	}
+	return headerRules, rows.Err()
+}
+
+// loadHeaderRule returns a header rule of a DNS rule
+func loadHeaderRule(dnsRuleID, headerRuleID int) (models.HeaderRule, error) {
+	headerRule := models.HeaderRule{ID: headerRuleID, DNSRuleID: dnsRuleID}
+	var direction, action string
+	err := database.DB.QueryRow(
+		"SELECT direction, action, name, value FROM dns_header_rules WHERE id = ? AND dns_rule_id = ?",
+		headerRuleID, dnsRuleID,
+	).Scan(&direction, &action, &headerRule.Name, &headerRule.Value)
+	headerRule.Direction = models.HeaderDirection(direction)
+	headerRule.Action = models.HeaderAction(action)
+	return headerRule, err
+}
+
+// normalizeHeaderRule canonicalizes a header rule and validates it
+func normalizeHeaderRule(headerRule *models.HeaderRule) error {
+	headerRule.Direction = models.HeaderDirection(strings.ToLower(strings.TrimSpace(string(headerRule.Direction))))
+	headerRule.Action = models.HeaderAction(strings.ToLower(strings.TrimSpace(string(headerRule.Action))))
+	headerRule.Name = http.CanonicalHeaderKey(strings.TrimSpace(headerRule.Name))
+	if headerRule.Action == models.HeaderActionRemove {
+		headerRule.Value = ""
+	}
+	return proxy.ValidateHeaderRule(*headerRule)
+}
+
+// GetDNSHeaderRules returns the header rules of a DNS rule
+func GetDNSHeaderRules(c *fiber.Ctx) error {
+	// Get DNS rule ID from URL
+	dnsRuleID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid DNS rule ID",
+		})
+	}
+
+	headerRules, err := loadHeaderRules(database.DB, dnsRuleID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch header rules",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(headerRules)
+}
+
+// CreateDNSHeaderRule adds a request or response header rule to a DNS rule
+func CreateDNSHeaderRule(c *fiber.Ctx) error {
+	// Get DNS rule ID from URL
+	dnsRuleID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid DNS rule ID",
+		})
+	}
+
+	// Parse request body
+	var headerRule models.HeaderRule
+	if err := c.BodyParser(&headerRule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	headerRule.DNSRuleID = dnsRuleID
+
+	// Validate header rule
+	if err := normalizeHeaderRule(&headerRule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Check if the DNS rule exists
+	var exists bool
+	if err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM dns_rules WHERE id = ?)", dnsRuleID).Scan(&exists); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "DNS rule not found",
+		})
+	}
+
+	// Insert header rule
+	result, err := database.DB.Exec(`
+		INSERT INTO dns_header_rules (
+			dns_rule_id, direction, action, name, value
+		) VALUES (?, ?, ?, ?, ?)`,
+		dnsRuleID, string(headerRule.Direction), string(headerRule.Action), headerRule.Name, headerRule.Value,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create header rule",
+		})
+	}
+	headerRuleID, _ := result.LastInsertId()
+	headerRule.ID = int(headerRuleID)
+
+	proxy.RefreshDNSRulesCache()
+
+	return c.Status(fiber.StatusCreated).JSON(headerRule)
+}
+
+// UpdateDNSHeaderRule updates a header rule of a DNS rule
+func UpdateDNSHeaderRule(c *fiber.Ctx) error {
+	// Get DNS rule and header rule IDs from URL
+	dnsRuleID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid DNS rule ID",
+		})
+	}
+	headerRuleID, err := c.ParamsInt("headerId")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid header rule ID",
+		})
+	}
+
+	// Load the current header rule so fields missing from the body keep their values
+	headerRule, err := loadHeaderRule(dnsRuleID, headerRuleID)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Header rule not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	// Parse request body
+	if err := c.BodyParser(&headerRule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	headerRule.ID = headerRuleID
+	headerRule.DNSRuleID = dnsRuleID
+
+	// Validate header rule
+	if err := normalizeHeaderRule(&headerRule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Update header rule
+	_, err = database.DB.Exec(`
+		UPDATE dns_header_rules
+		SET direction = ?, action = ?, name = ?, value = ?
+		WHERE id = ? AND dns_rule_id = ?`,
+		string(headerRule.Direction), string(headerRule.Action), headerRule.Name, headerRule.Value,
+		headerRuleID, dnsRuleID,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update header rule",
+		})
+	}
+
+	proxy.RefreshDNSRulesCache()
+
+	return c.Status(fiber.StatusOK).JSON(headerRule)
+}
+
+// DeleteDNSHeaderRule deletes a header rule of a DNS rule
+func DeleteDNSHeaderRule(c *fiber.Ctx) error {
+	// Get DNS rule and header rule IDs from URL
+	dnsRuleID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid DNS rule ID",
+		})
+	}
+	headerRuleID, err := c.ParamsInt("headerId")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid header rule ID",
+		})
+	}
+
+	result, err := database.DB.Exec("DELETE FROM dns_header_rules WHERE id = ? AND dns_rule_id = ?", headerRuleID, dnsRuleID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete header rule",
+		})
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Header rule not found",
+		})
+	}
+
+	proxy.RefreshDNSRulesCache()
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,520 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/health"
+	"github.com/arifur/strong-reverse-proxy/models"
+	"github.com/arifur/strong-reverse-proxy/proxy"
+	"github.com/gofiber/fiber/v2"
+)
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// backendUsage returns how many DNS rules and routes use a backend
+func backendUsage(tx *sql.Tx, backendID int) (int, error) {
+	var count int
+	err := tx.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM dns_backend_map WHERE backend_id = ?) +
+			(SELECT COUNT(*) FROM dns_route_backend_map WHERE backend_id = ?)
+	`, backendID, backendID).Scan(&count)
+	return count, err
+}
+
+// upsertBackend returns the ID of the backend with the given URL, creating it if needed
+func upsertBackend(tx *sql.Tx, backend models.Backend) (int64, error) {
+	var backendID int64
+	err := tx.QueryRow("SELECT id FROM backends WHERE url = ?", backend.URL).Scan(&backendID)
+	if err == sql.ErrNoRows {
+		result, err := tx.Exec(
+			"INSERT INTO backends (url, weight, isActive) VALUES (?, ?, ?)",
+			backend.URL, backend.Weight, backend.IsActive,
+		)
+		if err != nil {
+			return 0, err
+		}
+		return result.LastInsertId()
+	}
+	return backendID, err
+}
+
+// loadRoutes returns the routes of a DNS rule with their backends, in matching order
+func loadRoutes(q queryer, dnsRuleID int) ([]models.Route, error) {
+	rows, err := q.Query(`
+		SELECT
+			id,
+			path,
+			match_type,
+			methods,
+			priority,
+			strip_prefix,
+			rewrite_path
+		FROM
+			dns_routes
+		WHERE
+			dns_rule_id = ?
+		ORDER BY
+			priority DESC, id
+	`, dnsRuleID)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []models.Route{}
+	for rows.Next() {
+		route := models.Route{DNSRuleID: dnsRuleID}
+		var matchType, methods string
+		if err := rows.Scan(&route.ID, &route.Path, &matchType, &methods,
+			&route.Priority, &route.StripPrefix, &route.RewritePath); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		route.MatchType = models.RouteMatchType(matchType)
+		route.Methods = []string{}
+		json.Unmarshal([]byte(methods), &route.Methods)
+		routes = append(routes, route)
+	}
+	rows.Close()
+
+	for i := range routes {
+		backendRows, err := q.Query(`
+			SELECT
+				b.id,
+				b.url,
+				b.weight,
+				b.isActive
+			FROM
+				backends b
+			JOIN
+				dns_route_backend_map m ON b.id = m.backend_id
+			WHERE
+				m.route_id = ?
+		`, routes[i].ID)
+		if err != nil {
+			return nil, err
+		}
+
+		routes[i].Backends = []models.Backend{}
+		for backendRows.Next() {
+			var backend models.Backend
+			if err := backendRows.Scan(&backend.ID, &backend.URL, &backend.Weight, &backend.IsActive); err != nil {
+				backendRows.Close()
+				return nil, err
+			}
+			routes[i].Backends = append(routes[i].Backends, backend)
+		}
+		backendRows.Close()
+	}
+
+	return routes, nil
+}
+
+// deleteRoutes deletes the routes matching the where clause with their backend mappings
+// and returns the IDs of the backends they used
+func deleteRoutes(tx *sql.Tx, where string, args ...interface{}) ([]int, error) {
+	rows, err := tx.Query(`
+		SELECT DISTINCT m.backend_id
+		FROM dns_route_backend_map m
+		JOIN dns_routes r ON r.id = m.route_id
+		WHERE r.`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	var backendIDs []int
+	for rows.Next() {
+		var backendID int
+		if err := rows.Scan(&backendID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		backendIDs = append(backendIDs, backendID)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec("DELETE FROM dns_route_backend_map WHERE route_id IN (SELECT id FROM dns_routes WHERE "+where+")", args...); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM dns_routes WHERE "+where, args...); err != nil {
+		return nil, err
+	}
+	return backendIDs, nil
+}
+
+// deleteUnusedBackends deletes the given backends if no DNS rule or route uses them anymore
+func deleteUnusedBackends(tx *sql.Tx, backendIDs []int) error {
+	for _, backendID := range backendIDs {
+		count, err := backendUsage(tx, backendID)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			if _, err := tx.Exec("DELETE FROM backends WHERE id = ?", backendID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// setRouteBackends replaces the backends of a route
+func setRouteBackends(tx *sql.Tx, routeID int, backends []models.Backend) error {
+	if _, err := tx.Exec("DELETE FROM dns_route_backend_map WHERE route_id = ?", routeID); err != nil {
+		return err
+	}
+	for _, backend := range backends {
+		backendID, err := upsertBackend(tx, backend)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(
+			"INSERT OR IGNORE INTO dns_route_backend_map (route_id, backend_id) VALUES (?, ?)",
+			routeID, backendID,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeRoute applies defaults to a route and validates it
+func normalizeRoute(route *models.Route) error {
+	if route.MatchType == "" {
+		route.MatchType = models.RouteMatchPrefix
+	}
+	for i, method := range route.Methods {
+		route.Methods[i] = strings.ToUpper(strings.TrimSpace(method))
+	}
+	if route.Methods == nil {
+		route.Methods = []string{}
+	}
+	for i := range route.Backends {
+		if route.Backends[i].Weight <= 0 {
+			route.Backends[i].Weight = 1
+		}
+	}
+	return proxy.ValidateRoute(*route)
+}
+
+// refreshRoutes reloads the proxy's routes and the health checks of their backends
+func refreshRoutes() {
+	proxy.RefreshDNSRulesCache()
+	health.Refresh()
+}
+
+// GetDNSRoutes returns the routes of a DNS rule
+func GetDNSRoutes(c *fiber.Ctx) error {
+	// Get DNS rule ID from URL
+	dnsRuleID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid DNS rule ID",
+		})
+	}
+
+	routes, err := loadRoutes(database.DB, dnsRuleID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch routes",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(routes)
+}
+
+// CreateDNSRoute adds a path based route to a DNS rule
+func CreateDNSRoute(c *fiber.Ctx) error {
+	// Get DNS rule ID from URL
+	dnsRuleID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid DNS rule ID",
+		})
+	}
+
+	// Parse request body
+	var route models.Route
+	if err := c.BodyParser(&route); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	route.DNSRuleID = dnsRuleID
+
+	// Validate route
+	if err := normalizeRoute(&route); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if len(route.Backends) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one backend URL is required",
+		})
+	}
+
+	// Start a transaction
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	// Check if the DNS rule exists
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM dns_rules WHERE id = ?)", dnsRuleID).Scan(&exists); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "DNS rule not found",
+		})
+	}
+
+	// Insert route
+	methods, _ := json.Marshal(route.Methods)
+	result, err := tx.Exec(`
+		INSERT INTO dns_routes (
+			dns_rule_id, path, match_type, methods, priority, strip_prefix, rewrite_path
+		) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		dnsRuleID, route.Path, string(route.MatchType), string(methods), route.Priority, route.StripPrefix, route.RewritePath,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create route",
+		})
+	}
+	routeID, _ := result.LastInsertId()
+	route.ID = int(routeID)
+
+	if err := setRouteBackends(tx, route.ID, route.Backends); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create route backends",
+		})
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to commit transaction",
+		})
+	}
+
+	refreshRoutes()
+
+	return c.Status(fiber.StatusCreated).JSON(route)
+}
+
+// UpdateDNSRoute updates a route of a DNS rule
+func UpdateDNSRoute(c *fiber.Ctx) error {
+	// Get DNS rule and route IDs from URL
+	dnsRuleID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid DNS rule ID",
+		})
+	}
+	routeID, err := c.ParamsInt("routeId")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid route ID",
+		})
+	}
+
+	// Load the current route so fields missing from the body keep their values
+	routes, err := loadRoutes(database.DB, dnsRuleID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	var route models.Route
+	found := false
+	for _, current := range routes {
+		if current.ID == routeID {
+			route, found = current, true
+			break
+		}
+	}
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Route not found",
+		})
+	}
+
+	// Parse request body; backends are only replaced when provided
+	route.Backends = nil
+	if err := c.BodyParser(&route); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	route.ID = routeID
+	route.DNSRuleID = dnsRuleID
+
+	// Validate route
+	if err := normalizeRoute(&route); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Start a transaction
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	// Update route
+	methods, _ := json.Marshal(route.Methods)
+	result, err := tx.Exec(`
+		UPDATE dns_routes
+		SET path = ?, match_type = ?, methods = ?, priority = ?, strip_prefix = ?, rewrite_path = ?
+		WHERE id = ? AND dns_rule_id = ?`,
+		route.Path, string(route.MatchType), string(methods), route.Priority, route.StripPrefix, route.RewritePath,
+		routeID, dnsRuleID,
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update route",
+		})
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Route not found",
+		})
+	}
+
+	// Replace backends if provided
+	if len(route.Backends) > 0 {
+		oldBackendIDs, err := routeBackendIDs(tx, routeID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to query current route backends",
+			})
+		}
+		if err := setRouteBackends(tx, routeID, route.Backends); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to update route backends",
+			})
+		}
+		if err := deleteUnusedBackends(tx, oldBackendIDs); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to delete unused backends",
+			})
+		}
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to commit transaction",
+		})
+	}
+
+	refreshRoutes()
+
+	// Return the stored route
+	routes, err = loadRoutes(database.DB, dnsRuleID)
+	if err == nil {
+		for _, stored := range routes {
+			if stored.ID == routeID {
+				return c.Status(fiber.StatusOK).JSON(stored)
+			}
+		}
+	}
+	return c.Status(fiber.StatusOK).JSON(route)
+}
+
+// routeBackendIDs returns the IDs of the backends currently used by a route
+func routeBackendIDs(tx *sql.Tx, routeID int) ([]int, error) {
+	rows, err := tx.Query("SELECT backend_id FROM dns_route_backend_map WHERE route_id = ?", routeID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var backendIDs []int
+	for rows.Next() {
+		var backendID int
+		if err := rows.Scan(&backendID); err != nil {
+			return nil, err
+		}
+		backendIDs = append(backendIDs, backendID)
+	}
+	return backendIDs, rows.Err()
+}
+
+// DeleteDNSRoute deletes a route of a DNS rule
+func DeleteDNSRoute(c *fiber.Ctx) error {
+	// Get DNS rule and route IDs from URL
+	dnsRuleID, err := c.ParamsInt("id")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid DNS rule ID",
+		})
+	}
+	routeID, err := c.ParamsInt("routeId")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid route ID",
+		})
+	}
+
+	// Start a transaction
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM dns_routes WHERE id = ? AND dns_rule_id = ?)", routeID, dnsRuleID).Scan(&exists); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Route not found",
+		})
+	}
+
+	backendIDs, err := deleteRoutes(tx, "id = ?", routeID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete route",
+		})
+	}
+	if err := deleteUnusedBackends(tx, backendIDs); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete unused backends",
+		})
+	}
+
+	// Commit transaction
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to commit transaction",
+		})
+	}
+
+	refreshRoutes()
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
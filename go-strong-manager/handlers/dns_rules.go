@@ -2,27 +2,145 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 
+	"github.com/arifur/strong-reverse-proxy/certs"
 	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/health"
+	"github.com/arifur/strong-reverse-proxy/hostmatch"
 	"github.com/arifur/strong-reverse-proxy/middleware"
 	"github.com/arifur/strong-reverse-proxy/models"
 	"github.com/arifur/strong-reverse-proxy/proxy"
 	"github.com/gofiber/fiber/v2"
 )
 
-// GetDNSRules returns all DNS rules
-func GetDNSRules(c *fiber.Ctx) error {
-	// Query all DNS rules
-	rows, err := database.DB.Query(`
-		SELECT 
+// dnsRuleColumns lists the dns_rules columns read by scanDNSRule, in order
+const dnsRuleColumns = `
 			d.id, 
 			d.hostname,
 			d.rate_limit_enabled,
 			d.rate_limit_quota,
 			d.rate_limit_period,
+			d.rate_limit_algorithm,
+			d.rate_limit_burst,
 			d.log_retention_days,
-			d.health_check_enabled
+			d.health_check_enabled,
+			d.health_check_path,
+			d.health_check_method,
+			d.health_check_headers,
+			d.health_check_expected_status_min,
+			d.health_check_expected_status_max,
+			d.health_check_body_match,
+			d.health_check_body_regex,
+			d.health_check_interval,
+			d.health_check_timeout,
+			d.health_check_rise,
+			d.health_check_fall,
+			d.redirect_https,
+			d.lb_algorithm,
+			d.lb_hash_key,
+			d.affinity_mode,
+			d.affinity_header,
+			d.affinity_cookie_name,
+			d.affinity_ttl,
+			d.retry_enabled,
+			d.retry_attempts,
+			d.retry_non_idempotent,
+			d.retry_on_status,
+			d.retry_per_try_timeout_ms,
+			d.retry_budget`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanDNSRule scans a row selected with dnsRuleColumns into a DNS rule
+func scanDNSRule(row rowScanner, rule *models.DNSRule) error {
+	var healthCheckHeaders, retryOnStatus string
+	if err := row.Scan(
+		&rule.ID,
+		&rule.Hostname,
+		&rule.RateLimitEnabled,
+		&rule.RateLimitQuota,
+		&rule.RateLimitPeriod,
+		&rule.RateLimitAlgorithm,
+		&rule.RateLimitBurst,
+		&rule.LogRetentionDays,
+		&rule.HealthCheckEnabled,
+		&rule.HealthCheckPath,
+		&rule.HealthCheckMethod,
+		&healthCheckHeaders,
+		&rule.HealthCheckExpectedStatusMin,
+		&rule.HealthCheckExpectedStatusMax,
+		&rule.HealthCheckBodyMatch,
+		&rule.HealthCheckBodyRegex,
+		&rule.HealthCheckInterval,
+		&rule.HealthCheckTimeout,
+		&rule.HealthCheckRise,
+		&rule.HealthCheckFall,
+		&rule.RedirectHTTPS,
+		&rule.LBAlgorithm,
+		&rule.LBHashKey,
+		&rule.AffinityMode,
+		&rule.AffinityHeader,
+		&rule.AffinityCookieName,
+		&rule.AffinityTTL,
+		&rule.RetryEnabled,
+		&rule.RetryAttempts,
+		&rule.RetryNonIdempotent,
+		&retryOnStatus,
+		&rule.RetryPerTryTimeoutMS,
+		&rule.RetryBudget,
+	); err != nil {
+		return err
+	}
+
+	rule.HealthCheckHeaders = map[string]string{}
+	if healthCheckHeaders != "" {
+		if err := json.Unmarshal([]byte(healthCheckHeaders), &rule.HealthCheckHeaders); err != nil {
+			return fmt.Errorf("invalid health check headers: %w", err)
+		}
+	}
+
+	statuses, err := proxy.ParseRetryOnStatus(retryOnStatus)
+	if err != nil {
+		return err
+	}
+	rule.RetryOnStatus = statuses
+	return nil
+}
+
+// encodeHealthCheckHeaders serializes health check headers for storage
+func encodeHealthCheckHeaders(headers map[string]string) string {
+	if headers == nil {
+		return "{}"
+	}
+	encoded, err := json.Marshal(headers)
+	if err != nil {
+		return "{}"
+	}
+	return string(encoded)
+}
+
+// encodeRetryOnStatus serializes the retried status codes for storage
+func encodeRetryOnStatus(statuses []int) string {
+	if statuses == nil {
+		return "[]"
+	}
+	encoded, err := json.Marshal(statuses)
+	if err != nil {
+		return "[]"
+	}
+	return string(encoded)
+}
+
+// GetDNSRules returns all DNS rules
+func GetDNSRules(c *fiber.Ctx) error {
+	// Query all DNS rules
+	rows, err := database.DB.Query(`
+		SELECT ` + dnsRuleColumns + `
 		FROM 
 			dns_rules d
 	`)
@@ -39,15 +157,7 @@ func GetDNSRules(c *fiber.Ctx) error {
 	// Iterate through DNS rules
 	for rows.Next() {
 		var rule models.DNSRule
-		if err := rows.Scan(
-			&rule.ID,
-			&rule.Hostname,
-			&rule.RateLimitEnabled,
-			&rule.RateLimitQuota,
-			&rule.RateLimitPeriod,
-			&rule.LogRetentionDays,
-			&rule.HealthCheckEnabled,
-		); err != nil {
+		if err := scanDNSRule(rows, &rule); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "Error scanning DNS rule",
 			})
@@ -87,6 +197,25 @@ func GetDNSRules(c *fiber.Ctx) error {
 		}
 
 		rule.TargetBackendURLs = backends
+
+		// Collect path based routes
+		routes, err := loadRoutes(database.DB, rule.ID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Error fetching routes",
+			})
+		}
+		rule.Routes = routes
+
+		// Collect header rules
+		headerRules, err := loadHeaderRules(database.DB, rule.ID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Error fetching header rules",
+			})
+		}
+		rule.HeaderRules = headerRules
+
 		dnsRules = append(dnsRules, rule)
 	}
 
@@ -109,6 +238,13 @@ func CreateDNSRule(c *fiber.Ctx) error {
 			"error": "Hostname is required",
 		})
 	}
+	hostname, err := hostmatch.NormalizePattern(req.Hostname)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid hostname: " + err.Error(),
+		})
+	}
+	req.Hostname = hostname
 
 	// Log the hostname being processed
 	fmt.Printf("Processing DNS rule creation for hostname: %q\n", req.Hostname)
@@ -126,10 +262,76 @@ func CreateDNSRule(c *fiber.Ctx) error {
 	if req.RateLimitPeriod <= 0 {
 		req.RateLimitPeriod = 60 // Default 60 seconds
 	}
+	if req.RateLimitAlgorithm == "" {
+		req.RateLimitAlgorithm = middleware.AlgorithmFixedWindow
+	}
+	if !middleware.IsValidAlgorithm(req.RateLimitAlgorithm) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid rate limit algorithm",
+		})
+	}
+	if req.RateLimitBurst < 0 {
+		req.RateLimitBurst = 0 // Default to the quota
+	}
 	if req.LogRetentionDays <= 0 {
 		req.LogRetentionDays = 30 // Default 30 days
 	}
 
+	// Set default load balancing settings and validate them
+	if req.LBAlgorithm == "" {
+		req.LBAlgorithm = proxy.LBRoundRobin
+	}
+	if !proxy.IsValidLBAlgorithm(req.LBAlgorithm) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid load balancing algorithm",
+		})
+	}
+	if req.LBHashKey == "" {
+		req.LBHashKey = proxy.HashKeyIP
+	}
+	if err := proxy.ValidateHashKey(req.LBHashKey); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Set default session affinity settings and validate them
+	if req.AffinityMode == "" {
+		req.AffinityMode = proxy.AffinityNone
+	}
+	if req.AffinityCookieName == "" {
+		req.AffinityCookieName = proxy.DefaultAffinityCookie
+	}
+	if err := proxy.ValidateAffinity(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Set default retry settings and validate them
+	if req.RetryAttempts <= 0 {
+		req.RetryAttempts = proxy.DefaultRetryAttempts
+	}
+	if req.RetryOnStatus == nil {
+		req.RetryOnStatus = proxy.DefaultRetryOnStatus
+	}
+	if req.RetryBudget <= 0 {
+		req.RetryBudget = proxy.DefaultRetryBudget
+	}
+	if err := proxy.ValidateRetry(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Set default health check settings and validate them
+	health.ApplyDefaults(&req)
+	if err := health.ValidateSettings(req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
 	// Start a transaction
 	tx, err := database.DB.Begin()
 	if err != nil {
@@ -140,9 +342,21 @@ func CreateDNSRule(c *fiber.Ctx) error {
 	defer tx.Rollback()
 
 	// Insert DNS rule
-	result, err := tx.Exec(
-		"INSERT INTO dns_rules (hostname, rate_limit_enabled, rate_limit_quota, rate_limit_period, log_retention_days, health_check_enabled) VALUES (?, ?, ?, ?, ?, ?)",
-		req.Hostname, req.RateLimitEnabled, req.RateLimitQuota, req.RateLimitPeriod, req.LogRetentionDays, req.HealthCheckEnabled,
+	result, err := tx.Exec(`
+		INSERT INTO dns_rules (
+			hostname, rate_limit_enabled, rate_limit_quota, rate_limit_period, rate_limit_algorithm, rate_limit_burst,
+			log_retention_days, health_check_enabled, health_check_path, health_check_method, health_check_headers,
+			health_check_expected_status_min, health_check_expected_status_max, health_check_body_match,
+			health_check_body_regex, health_check_interval, health_check_timeout, health_check_rise, health_check_fall,
+			redirect_https, lb_algorithm, lb_hash_key, affinity_mode, affinity_header, affinity_cookie_name, affinity_ttl,
+			retry_enabled, retry_attempts, retry_non_idempotent, retry_on_status, retry_per_try_timeout_ms, retry_budget
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		req.Hostname, req.RateLimitEnabled, req.RateLimitQuota, req.RateLimitPeriod, req.RateLimitAlgorithm, req.RateLimitBurst,
+		req.LogRetentionDays, req.HealthCheckEnabled, req.HealthCheckPath, req.HealthCheckMethod, encodeHealthCheckHeaders(req.HealthCheckHeaders),
+		req.HealthCheckExpectedStatusMin, req.HealthCheckExpectedStatusMax, req.HealthCheckBodyMatch,
+		req.HealthCheckBodyRegex, req.HealthCheckInterval, req.HealthCheckTimeout, req.HealthCheckRise, req.HealthCheckFall,
+		req.RedirectHTTPS, req.LBAlgorithm, req.LBHashKey, req.AffinityMode, req.AffinityHeader, req.AffinityCookieName, req.AffinityTTL,
+		req.RetryEnabled, req.RetryAttempts, req.RetryNonIdempotent, encodeRetryOnStatus(req.RetryOnStatus), req.RetryPerTryTimeoutMS, req.RetryBudget,
 	)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -203,8 +417,10 @@ func CreateDNSRule(c *fiber.Ctx) error {
 	// After successful creation, immediately refresh the DNS rules cache
 	proxy.RefreshDNSRulesCache()
 
-	// Also refresh rate limiter configurations
+	// Also refresh rate limiter configurations, health checks and certificates
 	middleware.RefreshRateLimiterConfigs()
+	health.Refresh()
+	certs.Refresh()
 
 	return c.Status(fiber.StatusCreated).JSON(req)
 }
@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"strconv"
 
+	"github.com/arifur/strong-reverse-proxy/certs"
 	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/health"
+	"github.com/arifur/strong-reverse-proxy/hostmatch"
 	"github.com/arifur/strong-reverse-proxy/middleware"
 	"github.com/arifur/strong-reverse-proxy/models"
 	"github.com/arifur/strong-reverse-proxy/proxy"
@@ -22,16 +25,29 @@ func UpdateDNSRule(c *fiber.Ctx) error {
 		})
 	}
 
-	// Parse request body
+	// Parse request body, and separately the settings only updated when present
 	var req models.DNSRule
+	var present models.DNSRuleUpdate
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
+	if err := c.BodyParser(&present); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
 
 	// Log hostname if provided
 	if req.Hostname != "" {
+		hostname, err := hostmatch.NormalizePattern(req.Hostname)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid hostname: " + err.Error(),
+			})
+		}
+		req.Hostname = hostname
 		fmt.Printf("Processing DNS rule update with hostname: %q\n", req.Hostname)
 	}
 
@@ -98,6 +114,35 @@ func UpdateDNSRule(c *fiber.Ctx) error {
 		needsComma = true
 	}
 
+	if req.RateLimitAlgorithm != "" {
+		if !middleware.IsValidAlgorithm(req.RateLimitAlgorithm) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid rate limit algorithm",
+			})
+		}
+		if needsComma {
+			query += ", "
+		}
+		query += "rate_limit_algorithm = ?"
+		params = append(params, req.RateLimitAlgorithm)
+		needsComma = true
+	}
+
+	// A burst of 0 means the quota, so it is updated whenever it is present
+	if present.RateLimitBurst != nil {
+		if *present.RateLimitBurst < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Rate limit burst cannot be negative",
+			})
+		}
+		if needsComma {
+			query += ", "
+		}
+		query += "rate_limit_burst = ?"
+		params = append(params, *present.RateLimitBurst)
+		needsComma = true
+	}
+
 	// Log retention field
 	if req.LogRetentionDays > 0 {
 		if needsComma {
@@ -114,7 +159,96 @@ func UpdateDNSRule(c *fiber.Ctx) error {
 	}
 	query += "health_check_enabled = ?"
 	params = append(params, req.HealthCheckEnabled)
-	needsComma = true
+
+	// Optional health check settings - only update the ones provided
+	healthCheckFields := []struct {
+		column string
+		value  interface{}
+		isSet  bool
+	}{
+		{"health_check_path", req.HealthCheckPath, req.HealthCheckPath != ""},
+		{"health_check_method", req.HealthCheckMethod, req.HealthCheckMethod != ""},
+		{"health_check_headers", encodeHealthCheckHeaders(req.HealthCheckHeaders), req.HealthCheckHeaders != nil},
+		{"health_check_expected_status_min", req.HealthCheckExpectedStatusMin, req.HealthCheckExpectedStatusMin > 0},
+		{"health_check_expected_status_max", req.HealthCheckExpectedStatusMax, req.HealthCheckExpectedStatusMax > 0},
+		{"health_check_interval", req.HealthCheckInterval, req.HealthCheckInterval > 0},
+		{"health_check_timeout", req.HealthCheckTimeout, req.HealthCheckTimeout > 0},
+		{"health_check_rise", req.HealthCheckRise, req.HealthCheckRise > 0},
+		{"health_check_fall", req.HealthCheckFall, req.HealthCheckFall > 0},
+		// An empty body match clears it, so it is updated whenever it is present
+		{"health_check_body_match", present.HealthCheckBodyMatch, present.HealthCheckBodyMatch != nil},
+		{"health_check_body_regex", present.HealthCheckBodyRegex, present.HealthCheckBodyRegex != nil},
+	}
+	for _, field := range healthCheckFields {
+		if field.isSet {
+			query += ", " + field.column + " = ?"
+			params = append(params, field.value)
+		}
+	}
+
+	// HTTPS redirect field - only update it if provided
+	if present.RedirectHTTPS != nil {
+		query += ", redirect_https = ?"
+		params = append(params, *present.RedirectHTTPS)
+	}
+
+	// Load balancing fields - only update the ones provided
+	if req.LBAlgorithm != "" {
+		if !proxy.IsValidLBAlgorithm(req.LBAlgorithm) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid load balancing algorithm",
+			})
+		}
+		query += ", lb_algorithm = ?"
+		params = append(params, req.LBAlgorithm)
+	}
+	if req.LBHashKey != "" {
+		if err := proxy.ValidateHashKey(req.LBHashKey); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		query += ", lb_hash_key = ?"
+		params = append(params, req.LBHashKey)
+	}
+
+	// Session affinity fields - only update the ones provided, validated below
+	affinityFields := []struct {
+		column string
+		value  interface{}
+		isSet  bool
+	}{
+		{"affinity_mode", req.AffinityMode, req.AffinityMode != ""},
+		{"affinity_header", req.AffinityHeader, req.AffinityHeader != ""},
+		{"affinity_cookie_name", req.AffinityCookieName, req.AffinityCookieName != ""},
+		{"affinity_ttl", req.AffinityTTL, req.AffinityTTL > 0},
+	}
+	for _, field := range affinityFields {
+		if field.isSet {
+			query += ", " + field.column + " = ?"
+			params = append(params, field.value)
+		}
+	}
+
+	// Retry fields - only update the ones provided, validated below
+	retryFields := []struct {
+		column string
+		value  interface{}
+		isSet  bool
+	}{
+		{"retry_enabled", present.RetryEnabled, present.RetryEnabled != nil},
+		{"retry_non_idempotent", present.RetryNonIdempotent, present.RetryNonIdempotent != nil},
+		{"retry_attempts", req.RetryAttempts, req.RetryAttempts > 0},
+		{"retry_on_status", encodeRetryOnStatus(req.RetryOnStatus), req.RetryOnStatus != nil},
+		{"retry_per_try_timeout_ms", req.RetryPerTryTimeoutMS, req.RetryPerTryTimeoutMS > 0},
+		{"retry_budget", req.RetryBudget, req.RetryBudget > 0},
+	}
+	for _, field := range retryFields {
+		if field.isSet {
+			query += ", " + field.column + " = ?"
+			params = append(params, field.value)
+		}
+	}
 
 	// Add WHERE clause and execute if we have parameters to update
 	if len(params) > 0 {
@@ -129,6 +263,29 @@ func UpdateDNSRule(c *fiber.Ctx) error {
 		}
 	}
 
+	// Validate the resulting health check, session affinity and retry settings before committing
+	var updated models.DNSRule
+	if err := scanDNSRule(tx.QueryRow("SELECT "+dnsRuleColumns+" FROM dns_rules d WHERE d.id = ?", id), &updated); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if err := health.ValidateSettings(updated); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := proxy.ValidateAffinity(updated); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err := proxy.ValidateRetry(updated); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
 	// Update backends if provided
 	if len(req.TargetBackendURLs) > 0 {
 		// Get the list of current backend IDs for this DNS rule
@@ -212,8 +369,7 @@ func UpdateDNSRule(c *fiber.Ctx) error {
 		// For each old backend ID, check if it's still used by any DNS rule
 		// If not, delete it
 		for _, backendID := range oldBackendIDs {
-			var count int
-			err := tx.QueryRow("SELECT COUNT(*) FROM dns_backend_map WHERE backend_id = ?", backendID).Scan(&count)
+			count, err := backendUsage(tx, backendID)
 			if err != nil {
 				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 					"error": "Failed to check backend usage",
@@ -242,27 +398,12 @@ func UpdateDNSRule(c *fiber.Ctx) error {
 
 	// Get updated DNS rule for response
 	var rule models.DNSRule
-	rule.ID = id
-
-	err = database.DB.QueryRow(`
-		SELECT 
-			hostname, 
-			rate_limit_enabled, 
-			rate_limit_quota, 
-			rate_limit_period, 
-			log_retention_days,
-			health_check_enabled
-		FROM dns_rules 
-		WHERE id = ?`,
+	err = scanDNSRule(database.DB.QueryRow(`
+		SELECT `+dnsRuleColumns+`
+		FROM dns_rules d
+		WHERE d.id = ?`,
 		id,
-	).Scan(
-		&rule.Hostname,
-		&rule.RateLimitEnabled,
-		&rule.RateLimitQuota,
-		&rule.RateLimitPeriod,
-		&rule.LogRetentionDays,
-		&rule.HealthCheckEnabled,
-	)
+	), &rule)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Database error",
@@ -306,8 +447,10 @@ func UpdateDNSRule(c *fiber.Ctx) error {
 	// After successful update, immediately refresh the DNS rules cache
 	proxy.RefreshDNSRulesCache()
 
-	// Also refresh rate limiter configurations
+	// Also refresh rate limiter configurations, health checks and certificates
 	middleware.RefreshRateLimiterConfigs()
+	health.Refresh()
+	certs.Refresh()
 
 	return c.JSON(rule)
 }
@@ -361,6 +504,22 @@ func DeleteDNSRule(c *fiber.Ctx) error {
 		})
 	}
 
+	// Delete routes and collect their backends as well
+	routeBackendIDs, err := deleteRoutes(tx, "dns_rule_id = ?", id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete DNS rule routes",
+		})
+	}
+	backendIDs = append(backendIDs, routeBackendIDs...)
+
+	// Delete header rules
+	if _, err := tx.Exec("DELETE FROM dns_header_rules WHERE dns_rule_id = ?", id); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete DNS rule header rules",
+		})
+	}
+
 	// Delete DNS rule
 	result, err := tx.Exec("DELETE FROM dns_rules WHERE id = ?", id)
 	if err != nil {
@@ -372,8 +531,7 @@ func DeleteDNSRule(c *fiber.Ctx) error {
 	// For each backend ID, check if it's still used by other DNS rules
 	// If not, delete it
 	for _, backendID := range backendIDs {
-		var count int
-		err := tx.QueryRow("SELECT COUNT(*) FROM dns_backend_map WHERE backend_id = ?", backendID).Scan(&count)
+		count, err := backendUsage(tx, backendID)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "Failed to check backend usage",
@@ -410,8 +568,10 @@ func DeleteDNSRule(c *fiber.Ctx) error {
 	// After successful deletion, immediately refresh the DNS rules cache
 	proxy.RefreshDNSRulesCache()
 
-	// Also refresh rate limiter configurations
+	// Also refresh rate limiter configurations, health checks and certificates
 	middleware.RefreshRateLimiterConfigs()
+	health.Refresh()
+	certs.Refresh()
 
 	// Return success
 	return c.SendStatus(fiber.StatusNoContent)
@@ -423,12 +583,15 @@ func DeleteDNSRule(c *fiber.Ctx) error {
 func CleanupOrphanedBackends() {
 	fmt.Println("Cleaning up orphaned backends...")
 
-	// Find all backend IDs that aren't in the dns_backend_map table
+	// Find all backend IDs that aren't in the dns_backend_map or dns_route_backend_map tables
 	query := `
 		DELETE FROM backends 
 		WHERE id NOT IN (
 			SELECT DISTINCT backend_id 
 			FROM dns_backend_map
+		) AND id NOT IN (
+			SELECT DISTINCT backend_id 
+			FROM dns_route_backend_map
 		)
 	`
 
@@ -245,7 +245,8 @@ func GetRecentLogs(c *fiber.Ctx) error {
 			r.latency_ms,
 			r.status_code,
 			r.is_success,
-			r.user_agent
+			r.user_agent,
+			COALESCE(r.attempt, 1)
 		FROM 
 			request_logs r
 		LEFT JOIN 
@@ -369,9 +370,10 @@ func GetRecentLogs(c *fiber.Ctx) error {
 			statusCode  int
 			isSuccess   bool
 			userAgent   sql.NullString
+			attempt     int
 		)
 
-		if err := rows.Scan(&id, &timestamp, &clientIP, &hostname, &requestPath, &backendID, &backendURL, &latencyMS, &statusCode, &isSuccess, &userAgent); err != nil {
+		if err := rows.Scan(&id, &timestamp, &clientIP, &hostname, &requestPath, &backendID, &backendURL, &latencyMS, &statusCode, &isSuccess, &userAgent, &attempt); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "Error scanning log",
 			})
@@ -414,6 +416,7 @@ func GetRecentLogs(c *fiber.Ctx) error {
 			"status_code":  statusCode,
 			"is_success":   isSuccess,
 			"user_agent":   userAgentStr,
+			"attempt":      attempt,
 		})
 	}
 
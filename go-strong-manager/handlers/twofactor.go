@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/arifur/strong-reverse-proxy/models"
+	"github.com/arifur/strong-reverse-proxy/tokens"
+	"github.com/arifur/strong-reverse-proxy/twofactor"
+	"github.com/gofiber/fiber/v2"
+)
+
+// currentUserID returns the ID of the authenticated user
+func currentUserID(c *fiber.Ctx) int {
+	id, _ := c.Locals("userID").(float64)
+	return int(id)
+}
+
+// twoFactorError responds to a failed second factor check
+func twoFactorError(c *fiber.Ctx, err error) error {
+	switch err {
+	case twofactor.ErrInvalidCode:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error":               "Invalid two-factor code",
+			"two_factor_required": true,
+		})
+	case twofactor.ErrTooManyAttempts:
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error":               "Too many invalid two-factor codes, try again later",
+			"two_factor_required": true,
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Failed to verify two-factor code",
+	})
+}
+
+// GetTwoFactor returns the two-factor enrolment of the authenticated user
+func GetTwoFactor(c *fiber.Ctx) error {
+	status, err := twofactor.Status(currentUserID(c))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	return c.JSON(status)
+}
+
+// SetupTwoFactor generates a TOTP secret for the authenticated user. It takes effect once
+// confirmed with EnableTwoFactor.
+func SetupTwoFactor(c *fiber.Ctx) error {
+	email, _ := c.Locals("userEmail").(string)
+	setup, err := twofactor.Setup(currentUserID(c), email)
+	if err == twofactor.ErrAlreadyEnabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is already enabled",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to set up two-factor authentication",
+		})
+	}
+	return c.JSON(setup)
+}
+
+// EnableTwoFactor enrolls the authenticated user with a code of their new secret, and
+// returns their recovery codes, which are only shown once
+func EnableTwoFactor(c *fiber.Ctx) error {
+	var req models.TwoFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Code is required",
+		})
+	}
+
+	codes, err := twofactor.Enable(currentUserID(c), req.Code)
+	switch err {
+	case nil:
+		return c.JSON(fiber.Map{"recovery_codes": codes})
+	case twofactor.ErrAlreadyEnabled:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is already enabled",
+		})
+	case twofactor.ErrNotSetUp:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Set up two-factor authentication first",
+		})
+	}
+	return twoFactorError(c, err)
+}
+
+// DisableTwoFactor removes the enrolment of the authenticated user, after checking their
+// second factor
+func DisableTwoFactor(c *fiber.Ctx) error {
+	if twofactor.Required() {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Two-factor authentication is required for all users",
+		})
+	}
+
+	var req models.TwoFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Code or recovery code is required",
+		})
+	}
+
+	userID := currentUserID(c)
+	if err := twofactor.Verify(userID, req.Code, req.RecoveryCode); err != nil {
+		return twoFactorError(c, err)
+	}
+	if err := twofactor.Disable(userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to disable two-factor authentication",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the authenticated user, after
+// checking their second factor
+func RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	var req models.TwoFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Code == "" && req.RecoveryCode == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Code or recovery code is required",
+		})
+	}
+
+	userID := currentUserID(c)
+	if err := twofactor.Verify(userID, req.Code, req.RecoveryCode); err != nil {
+		return twoFactorError(c, err)
+	}
+	codes, err := twofactor.RegenerateRecoveryCodes(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+	return c.JSON(fiber.Map{"recovery_codes": codes})
+}
+
+// ResetUserTwoFactor removes the enrolment of a user who lost their authenticator and
+// recovery codes, and ends their sessions
+func ResetUserTwoFactor(c *fiber.Ctx) error {
+	// Get user ID from URL
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	// Check if user exists
+	exists, err := userExists(id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	if err := twofactor.Disable(id); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to reset two-factor authentication",
+		})
+	}
+	if err := tokens.RevokeUser(id); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// GetSecuritySettings returns the security policies
+func GetSecuritySettings(c *fiber.Ctx) error {
+	return c.JSON(models.SecuritySettings{RequireTwoFactor: twofactor.Required()})
+}
+
+// UpdateSecuritySettings changes the security policies. Requiring two-factor
+// authentication takes effect at once: users who are not enrolled can only enrol.
+func UpdateSecuritySettings(c *fiber.Ctx) error {
+	var req models.SecuritySettings
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Keep the admin requiring two-factor authentication able to use the API
+	if req.RequireTwoFactor {
+		enabled, err := twofactor.Enabled(currentUserID(c))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		if !enabled {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Enable two-factor authentication for your own account first",
+			})
+		}
+	}
+
+	if err := twofactor.SetRequired(req.RequireTwoFactor); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update security settings",
+		})
+	}
+	return c.JSON(models.SecuritySettings{RequireTwoFactor: twofactor.Required()})
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/arifur/strong-reverse-proxy/database"
 	"github.com/arifur/strong-reverse-proxy/models"
+	"github.com/arifur/strong-reverse-proxy/tokens"
 	"github.com/gofiber/fiber/v2"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -13,7 +14,7 @@ import (
 // GetUsers returns all users
 func GetUsers(c *fiber.Ctx) error {
 	// Query all users
-	rows, err := database.DB.Query("SELECT id, email, role FROM users")
+	rows, err := database.DB.Query("SELECT id, email, role, totp_enabled FROM users")
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Database error",
@@ -25,16 +26,17 @@ func GetUsers(c *fiber.Ctx) error {
 	var users []fiber.Map
 	for rows.Next() {
 		var user models.User
-		if err := rows.Scan(&user.ID, &user.Email, &user.Role); err != nil {
+		if err := rows.Scan(&user.ID, &user.Email, &user.Role, &user.TwoFactorEnabled); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "Error scanning user",
 			})
 		}
 
 		users = append(users, fiber.Map{
-			"id":    user.ID,
-			"email": user.Email,
-			"role":  user.Role,
+			"id":                 user.ID,
+			"email":              user.Email,
+			"role":               user.Role,
+			"two_factor_enabled": user.TwoFactorEnabled,
 		})
 	}
 
@@ -64,9 +66,9 @@ func CreateUser(c *fiber.Ctx) error {
 	}
 
 	// Validate role
-	if req.Role != "admin" && req.Role != "operator" {
+	if !models.ValidRole(req.Role) {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Role must be 'admin' or 'operator'",
+			"error": "Role must be 'admin', 'operator' or 'viewer'",
 		})
 	}
 
@@ -124,20 +126,19 @@ func UpdateUser(c *fiber.Ctx) error {
 	}
 
 	// Check if user exists
-	var exists bool
-	err = database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", id).Scan(&exists)
+	var currentRole string
+	err = database.DB.QueryRow("SELECT role FROM users WHERE id = ?", id).Scan(&currentRole)
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Database error",
 		})
 	}
 
-	if !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "User not found",
-		})
-	}
-
 	// Build update query
 	query := "UPDATE users SET"
 	args := []interface{}{}
@@ -167,12 +168,27 @@ func UpdateUser(c *fiber.Ctx) error {
 
 	if req.Role != "" {
 		// Validate role
-		if req.Role != "admin" && req.Role != "operator" {
+		if !models.ValidRole(req.Role) {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Role must be 'admin' or 'operator'",
+				"error": "Role must be 'admin', 'operator' or 'viewer'",
 			})
 		}
 
+		// Keep at least one admin able to manage users
+		if req.Role != models.RoleAdmin {
+			lastAdmin, err := isLastAdmin(id)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Database error",
+				})
+			}
+			if lastAdmin {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Cannot change the role of the last admin",
+				})
+			}
+		}
+
 		if needsComma {
 			query += ","
 		}
@@ -199,6 +215,15 @@ func UpdateUser(c *fiber.Ctx) error {
 		})
 	}
 
+	// A new password or role ends the user's sessions at once
+	if req.Password != "" || (req.Role != "" && req.Role != currentRole) {
+		if err := tokens.RevokeUser(id); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to revoke sessions",
+			})
+		}
+	}
+
 	// Get updated user
 	var user models.User
 	err = database.DB.QueryRow("SELECT id, email, role FROM users WHERE id = ?", id).Scan(
@@ -233,6 +258,19 @@ func DeleteUser(c *fiber.Ctx) error {
 		})
 	}
 
+	// Keep at least one admin able to manage users
+	lastAdmin, err := isLastAdmin(id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if lastAdmin {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Cannot delete the last admin",
+		})
+	}
+
 	// Delete user
 	result, err := database.DB.Exec("DELETE FROM users WHERE id = ?", id)
 	if err != nil {
@@ -249,6 +287,31 @@ func DeleteUser(c *fiber.Ctx) error {
 		})
 	}
 
+	// End the sessions of the deleted user
+	if err := tokens.RevokeUser(id); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	// Delete the recovery codes of the deleted user
+	if _, err := database.DB.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", id); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete recovery codes",
+		})
+	}
+
 	// Return success
 	return c.SendStatus(fiber.StatusNoContent)
 }
+
+// isLastAdmin reports whether the user is the only one with the admin role
+func isLastAdmin(id int) (bool, error) {
+	var lastAdmin bool
+	err := database.DB.QueryRow(`
+		SELECT
+			EXISTS(SELECT 1 FROM users WHERE id = ? AND role = ?) AND
+			(SELECT COUNT(*) FROM users WHERE role = ?) = 1
+	`, id, models.RoleAdmin, models.RoleAdmin).Scan(&lastAdmin)
+	return lastAdmin, err
+}
@@ -0,0 +1,270 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// maxBodyBytes limits how much of a health check response body is inspected
+const maxBodyBytes = 64 * 1024
+
+// target is a backend of a DNS rule that is actively health checked
+type target struct {
+	ruleID    int
+	hostname  string
+	url       string
+	config    *checkConfig
+	nextCheck time.Time
+	running   bool
+}
+
+var (
+	targets     = make(map[statusKey]*target)
+	targetsLock sync.Mutex
+
+	// refreshCh requests an immediate reload of the health check targets
+	refreshCh = make(chan struct{}, 1)
+
+	// Shared client; per-check timeouts are applied through the request context
+	checkClient = &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// Report redirects as-is so they can be matched against the expected status
+			return http.ErrUseLastResponse
+		},
+	}
+)
+
+// Initialize starts the health check system
+func Initialize() {
+	riseThreshold = getEnvInt("HEALTH_CHECK_RISE_THRESHOLD", riseThreshold)
+
+	loadTargets()
+	go run()
+
+	log.Printf("Health checker initialized with default rise_threshold=%d", riseThreshold)
+}
+
+// Refresh reloads the health check settings of all DNS rules.
+// This can be called from other packages after DNS rules are modified.
+func Refresh() {
+	select {
+	case refreshCh <- struct{}{}:
+	default:
+		// A refresh is already pending
+	}
+}
+
+// run schedules checks for every target according to its rule's interval
+func run() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	reloadTicker := time.NewTicker(30 * time.Second) // Pick up changes made directly in the database
+	defer reloadTicker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			runDueChecks()
+		case <-reloadTicker.C:
+			loadTargets()
+		case <-refreshCh:
+			loadTargets()
+		}
+	}
+}
+
+// loadTargets loads all backends of DNS rules with health_check_enabled=true
+func loadTargets() {
+	rows, err := database.DB.Query(`
+		SELECT
+			d.id,
+			d.hostname,
+			d.health_check_path,
+			d.health_check_method,
+			d.health_check_headers,
+			d.health_check_expected_status_min,
+			d.health_check_expected_status_max,
+			d.health_check_body_match,
+			d.health_check_body_regex,
+			d.health_check_interval,
+			d.health_check_timeout,
+			d.health_check_rise,
+			d.health_check_fall,
+			b.url
+		FROM
+			dns_rules d
+		JOIN (
+			SELECT dns_rule_id, backend_id FROM dns_backend_map
+			UNION
+			SELECT r.dns_rule_id, rm.backend_id FROM dns_routes r JOIN dns_route_backend_map rm ON r.id = rm.route_id
+		) m ON d.id = m.dns_rule_id
+		JOIN
+			backends b ON m.backend_id = b.id
+		WHERE
+			d.health_check_enabled = 1 AND b.isActive = 1
+	`)
+	if err != nil {
+		log.Printf("Error querying DNS rules for health check: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	loaded := make(map[statusKey]*target)
+	for rows.Next() {
+		var rule models.DNSRule
+		var headersJSON, backendURL string
+
+		if err := rows.Scan(
+			&rule.ID,
+			&rule.Hostname,
+			&rule.HealthCheckPath,
+			&rule.HealthCheckMethod,
+			&headersJSON,
+			&rule.HealthCheckExpectedStatusMin,
+			&rule.HealthCheckExpectedStatusMax,
+			&rule.HealthCheckBodyMatch,
+			&rule.HealthCheckBodyRegex,
+			&rule.HealthCheckInterval,
+			&rule.HealthCheckTimeout,
+			&rule.HealthCheckRise,
+			&rule.HealthCheckFall,
+			&backendURL,
+		); err != nil {
+			log.Printf("Error scanning DNS rule: %v", err)
+			continue
+		}
+
+		if headersJSON != "" {
+			if err := json.Unmarshal([]byte(headersJSON), &rule.HealthCheckHeaders); err != nil {
+				log.Printf("Invalid health check headers for %s: %v", rule.Hostname, err)
+			}
+		}
+
+		config, err := compileConfig(rule)
+		if err != nil {
+			log.Printf("Skipping health checks for %s: %v", rule.Hostname, err)
+			continue
+		}
+
+		loaded[statusKey{rule.ID, backendURL}] = &target{
+			ruleID:   rule.ID,
+			hostname: rule.Hostname,
+			url:      backendURL,
+			config:   config,
+		}
+	}
+
+	targetsLock.Lock()
+	keep := make(map[statusKey]bool, len(loaded))
+	for key, t := range loaded {
+		// Keep the schedule of targets that were already being checked
+		if existing, ok := targets[key]; ok {
+			existing.hostname = t.hostname
+			existing.config = t.config
+			loaded[key] = existing
+		}
+		keep[key] = true
+	}
+	targets = loaded
+	targetsLock.Unlock()
+
+	// Clear health status entries for backends that don't need health checking anymore
+	// (their DNS rules have health_check_enabled=false or they're no longer active)
+	forget(keep)
+}
+
+// runDueChecks starts a check for every target whose interval has elapsed
+func runDueChecks() {
+	now := time.Now()
+
+	targetsLock.Lock()
+	var due []*target
+	var configs []*checkConfig
+	var hostnames []string
+	for _, t := range targets {
+		if t.running || now.Before(t.nextCheck) {
+			continue
+		}
+		t.running = true
+		t.nextCheck = now.Add(t.config.interval)
+		due = append(due, t)
+		configs = append(configs, t.config)
+		hostnames = append(hostnames, t.hostname)
+	}
+	targetsLock.Unlock()
+
+	for i, t := range due {
+		go func(t *target, config *checkConfig, hostname string) {
+			err := checkBackendHealth(t.url, config)
+			if err != nil {
+				RecordResult(t.ruleID, hostname, t.url, false, err.Error(), config.rise, config.fall)
+			} else {
+				RecordResult(t.ruleID, hostname, t.url, true, "", config.rise, config.fall)
+			}
+
+			targetsLock.Lock()
+			t.running = false
+			targetsLock.Unlock()
+		}(t, configs[i], hostnames[i])
+	}
+}
+
+// checkBackendHealth performs a health check on a backend URL
+func checkBackendHealth(backendURL string, config *checkConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.timeout)
+	defer cancel()
+
+	checkURL := strings.TrimSuffix(backendURL, "/") + config.path
+	req, err := http.NewRequestWithContext(ctx, config.method, checkURL, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range config.headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+
+	resp, err := checkClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < config.statusMin || resp.StatusCode > config.statusMax {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	// Only read the body when it has to match something
+	if config.bodyMatch == "" || config.method == http.MethodHead {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %v", err)
+	}
+
+	if config.bodyRegex != nil {
+		if !config.bodyRegex.Match(body) {
+			return fmt.Errorf("response body does not match %q", config.bodyMatch)
+		}
+	} else if !strings.Contains(string(body), config.bodyMatch) {
+		return fmt.Errorf("response body does not contain %q", config.bodyMatch)
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package health
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BackendStatus holds the health state of a backend within a DNS rule
+type BackendStatus struct {
+	DNSRuleID            int       `json:"dns_rule_id"`
+	Hostname             string    `json:"hostname"`
+	URL                  string    `json:"url"`
+	Healthy              bool      `json:"healthy"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	LastChecked          time.Time `json:"last_checked"`
+	LastError            string    `json:"last_error,omitempty"`
+}
+
+// statusKey identifies a backend within a DNS rule, since each rule has its own check settings
+type statusKey struct {
+	ruleID int
+	url    string
+}
+
+var (
+	// Health status map stores health status for each backend of each DNS rule
+	statuses     = make(map[statusKey]*BackendStatus)
+	statusesLock sync.RWMutex
+
+	// Default number of consecutive successful checks required to re-admit an unhealthy backend
+	riseThreshold = 2
+)
+
+// IsHealthy reports whether the backend should receive traffic for the DNS rule.
+// Backends that have not been checked yet are considered healthy.
+func IsHealthy(ruleID int, url string) bool {
+	statusesLock.RLock()
+	defer statusesLock.RUnlock()
+
+	status, exists := statuses[statusKey{ruleID, url}]
+	if !exists {
+		return true
+	}
+	return status.Healthy
+}
+
+// RecordResult updates the health state of a backend with the result of a check.
+// A backend is marked unhealthy after fall consecutive failures and healthy again
+// after rise consecutive successes.
+func RecordResult(ruleID int, hostname, url string, success bool, checkErr string, rise, fall int) {
+	if rise <= 0 {
+		rise = riseThreshold
+	}
+	if fall <= 0 {
+		fall = 1
+	}
+
+	statusesLock.Lock()
+	defer statusesLock.Unlock()
+
+	key := statusKey{ruleID, url}
+	status, exists := statuses[key]
+	if !exists {
+		// New backends start healthy so they are not penalised before the first failure
+		status = &BackendStatus{DNSRuleID: ruleID, URL: url, Healthy: true}
+		statuses[key] = status
+	}
+	status.Hostname = hostname
+	status.LastChecked = time.Now()
+
+	if success {
+		status.ConsecutiveSuccesses++
+		status.ConsecutiveFailures = 0
+		status.LastError = ""
+
+		// Re-admit an unhealthy backend only after enough consecutive successes
+		if !status.Healthy && status.ConsecutiveSuccesses >= rise {
+			status.Healthy = true
+			log.Printf("Backend %s (%s) is healthy again after %d successful checks", url, hostname, status.ConsecutiveSuccesses)
+		}
+		return
+	}
+
+	status.ConsecutiveFailures++
+	status.ConsecutiveSuccesses = 0
+	status.LastError = checkErr
+	if status.Healthy && status.ConsecutiveFailures >= fall {
+		status.Healthy = false
+		log.Printf("Backend %s (%s) marked unhealthy after %d failed checks: %s", url, hostname, status.ConsecutiveFailures, checkErr)
+	}
+}
+
+// forget removes the health state of backends that are no longer monitored
+func forget(keep map[statusKey]bool) {
+	statusesLock.Lock()
+	defer statusesLock.Unlock()
+
+	for key := range statuses {
+		if !keep[key] {
+			delete(statuses, key)
+		}
+	}
+}
+
+// Snapshot returns a copy of the health state of all monitored backends,
+// ordered by DNS rule and URL
+func Snapshot() []BackendStatus {
+	statusesLock.RLock()
+	result := make([]BackendStatus, 0, len(statuses))
+	for _, status := range statuses {
+		result = append(result, *status)
+	}
+	statusesLock.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].DNSRuleID != result[j].DNSRuleID {
+			return result[i].DNSRuleID < result[j].DNSRuleID
+		}
+		return result[i].URL < result[j].URL
+	})
+	return result
+}
+
+// getEnvInt gets an environment variable as an integer or returns a default value
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil || intValue <= 0 {
+		log.Printf("Warning: Invalid value for %s: %s, using default %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return intValue
+}
@@ -0,0 +1,129 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// Default health check settings, matching the column defaults in dns_rules
+const (
+	DefaultPath      = "/"
+	DefaultMethod    = http.MethodGet
+	DefaultStatusMin = 200
+	DefaultStatusMax = 499
+	DefaultInterval  = 30 // seconds
+	DefaultTimeout   = 5  // seconds
+	DefaultFall      = 1
+)
+
+// allowedMethods are the HTTP methods that may be used for health checks
+var allowedMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodOptions: true,
+}
+
+// checkConfig is the compiled form of a DNS rule's health check settings
+type checkConfig struct {
+	path      string
+	method    string
+	headers   map[string]string
+	statusMin int
+	statusMax int
+	bodyMatch string
+	bodyRegex *regexp.Regexp
+	interval  time.Duration
+	timeout   time.Duration
+	rise      int
+	fall      int
+}
+
+// ApplyDefaults fills in unset health check settings of a DNS rule
+func ApplyDefaults(rule *models.DNSRule) {
+	if rule.HealthCheckPath == "" {
+		rule.HealthCheckPath = DefaultPath
+	}
+	if rule.HealthCheckMethod == "" {
+		rule.HealthCheckMethod = DefaultMethod
+	}
+	if rule.HealthCheckHeaders == nil {
+		rule.HealthCheckHeaders = map[string]string{}
+	}
+	if rule.HealthCheckExpectedStatusMin <= 0 {
+		rule.HealthCheckExpectedStatusMin = DefaultStatusMin
+	}
+	if rule.HealthCheckExpectedStatusMax <= 0 {
+		rule.HealthCheckExpectedStatusMax = DefaultStatusMax
+	}
+	if rule.HealthCheckInterval <= 0 {
+		rule.HealthCheckInterval = DefaultInterval
+	}
+	if rule.HealthCheckTimeout <= 0 {
+		rule.HealthCheckTimeout = DefaultTimeout
+	}
+	if rule.HealthCheckRise <= 0 {
+		rule.HealthCheckRise = riseThreshold
+	}
+	if rule.HealthCheckFall <= 0 {
+		rule.HealthCheckFall = DefaultFall
+	}
+}
+
+// ValidateSettings checks that a DNS rule's health check settings are usable
+func ValidateSettings(rule models.DNSRule) error {
+	_, err := compileConfig(rule)
+	return err
+}
+
+// compileConfig validates a DNS rule's health check settings and converts them
+// into the form used by the checker
+func compileConfig(rule models.DNSRule) (*checkConfig, error) {
+	ApplyDefaults(&rule)
+
+	if !strings.HasPrefix(rule.HealthCheckPath, "/") {
+		return nil, fmt.Errorf("health check path must start with '/'")
+	}
+
+	method := strings.ToUpper(rule.HealthCheckMethod)
+	if !allowedMethods[method] {
+		return nil, fmt.Errorf("health check method must be one of GET, HEAD, POST or OPTIONS")
+	}
+
+	if rule.HealthCheckExpectedStatusMin < 100 || rule.HealthCheckExpectedStatusMax > 599 ||
+		rule.HealthCheckExpectedStatusMin > rule.HealthCheckExpectedStatusMax {
+		return nil, fmt.Errorf("health check expected status range must be within 100-599 with min <= max")
+	}
+
+	if rule.HealthCheckTimeout > rule.HealthCheckInterval {
+		return nil, fmt.Errorf("health check timeout must not exceed the interval")
+	}
+
+	config := &checkConfig{
+		path:      rule.HealthCheckPath,
+		method:    method,
+		headers:   rule.HealthCheckHeaders,
+		statusMin: rule.HealthCheckExpectedStatusMin,
+		statusMax: rule.HealthCheckExpectedStatusMax,
+		bodyMatch: rule.HealthCheckBodyMatch,
+		interval:  time.Duration(rule.HealthCheckInterval) * time.Second,
+		timeout:   time.Duration(rule.HealthCheckTimeout) * time.Second,
+		rise:      rule.HealthCheckRise,
+		fall:      rule.HealthCheckFall,
+	}
+
+	if rule.HealthCheckBodyRegex && rule.HealthCheckBodyMatch != "" {
+		re, err := regexp.Compile(rule.HealthCheckBodyMatch)
+		if err != nil {
+			return nil, fmt.Errorf("invalid health check body regex: %v", err)
+		}
+		config.bodyRegex = re
+	}
+
+	return config, nil
+}
@@ -0,0 +1,94 @@
+package hostmatch
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// CatchAll is the DNS rule hostname that matches requests no other rule matches
+const CatchAll = "*"
+
+// Normalize returns the canonical form of a request host: lowercase, without port
+// or trailing dot, and with internationalized names in their ASCII (punycode) form
+func Normalize(host string) string {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(strings.TrimSuffix(host, "]"), "[")
+	host = strings.TrimSuffix(host, ".")
+
+	if !isASCII(host) {
+		if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+			host = ascii
+		}
+	}
+	return strings.ToLower(host)
+}
+
+// NormalizePattern validates a DNS rule hostname and returns its canonical form.
+// Patterns are an exact hostname, a wildcard such as *.example.com, or the catch-all *.
+func NormalizePattern(pattern string) (string, error) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == CatchAll {
+		return CatchAll, nil
+	}
+
+	wildcard := strings.HasPrefix(pattern, "*.")
+	name := Normalize(strings.TrimPrefix(pattern, "*."))
+	if name == "" {
+		return "", fmt.Errorf("hostname is required")
+	}
+	if strings.Contains(name, "*") {
+		return "", fmt.Errorf("wildcards are only supported as the first label, e.g. *.example.com")
+	}
+	if wildcard {
+		if net.ParseIP(name) != nil {
+			return "", fmt.Errorf("wildcards cannot be used with IP addresses")
+		}
+		return "*." + name, nil
+	}
+	return name, nil
+}
+
+// IsWildcard reports whether a DNS rule hostname matches more than one host
+func IsWildcard(pattern string) bool {
+	return pattern == CatchAll || strings.HasPrefix(pattern, "*.")
+}
+
+// Candidates returns the DNS rule hostnames that match a request host, most specific first:
+// the host itself, wildcards for each of its parent domains, and finally the catch-all.
+// A wildcard matches subdomains at any depth but not the domain itself.
+func Candidates(host string) []string {
+	host = Normalize(host)
+	if host == "" {
+		return []string{CatchAll}
+	}
+
+	candidates := []string{host}
+	if net.ParseIP(host) == nil {
+		for i := strings.Index(host, "."); i >= 0; {
+			candidates = append(candidates, "*"+host[i:])
+			next := strings.Index(host[i+1:], ".")
+			if next < 0 {
+				break
+			}
+			i += next + 1
+		}
+	}
+	return append(candidates, CatchAll)
+}
+
+// isASCII reports whether s contains only ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package hostmatch
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"example.com:8080", "example.com"},
+		{"example.com.", "example.com"},
+		{"Example.com.:443", "example.com"},
+		{" example.com ", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"BÜCHER.example:8443", "xn--bcher-kva.example"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+		{"192.0.2.1:80", "192.0.2.1"},
+		{"[2001:DB8::1]:443", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Normalize(tt.host); got != tt.want {
+			t.Errorf("Normalize(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string // Empty when the pattern is invalid
+	}{
+		{"example.com", "example.com"},
+		{"App.Example.com.", "app.example.com"},
+		{"*.Example.com", "*.example.com"},
+		{"*.bücher.example", "*.xn--bcher-kva.example"},
+		{"*", "*"},
+		{" * ", "*"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"", ""},
+		{"*.", ""},
+		{"app.*.example.com", ""},
+		{"*app.example.com", ""},
+		{"*.*.example.com", ""},
+		{"*.192.0.2.1", ""},
+	}
+	for _, tt := range tests {
+		got, err := NormalizePattern(tt.pattern)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("NormalizePattern(%q) = %q, want an error", tt.pattern, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("NormalizePattern(%q) = %q, %v, want %q", tt.pattern, got, err, tt.want)
+		}
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"api.eu.example.com", "api.eu.example.com *.eu.example.com *.example.com *.com *"},
+		{"API.Example.com.:8443", "api.example.com *.example.com *.com *"},
+		{"bücher.example", "xn--bcher-kva.example *.example *"},
+		{"localhost", "localhost *"},
+		{"192.0.2.1:8080", "192.0.2.1 *"},
+		{"[2001:db8::1]:443", "2001:db8::1 *"},
+		{"", "*"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(Candidates(tt.host), " "); got != tt.want {
+			t.Errorf("Candidates(%q) = %s, want %s", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestMostSpecificPatternWins(t *testing.T) {
+	// Look up hosts the way the proxy does, taking the first candidate that is configured
+	match := func(host string, patterns ...string) string {
+		configured := make(map[string]bool)
+		for _, pattern := range patterns {
+			normalized, err := NormalizePattern(pattern)
+			if err != nil {
+				t.Fatalf("NormalizePattern(%q): %v", pattern, err)
+			}
+			configured[normalized] = true
+		}
+		for _, candidate := range Candidates(host) {
+			if configured[candidate] {
+				return candidate
+			}
+		}
+		return ""
+	}
+
+	tests := []struct {
+		name     string
+		host     string
+		patterns []string
+		want     string
+	}{
+		{"exact over wildcard", "app.example.com", []string{"*", "*.example.com", "app.example.com"}, "app.example.com"},
+		{"wildcard over catch-all", "app.example.com", []string{"*", "*.example.com"}, "*.example.com"},
+		{"deeper wildcard first", "api.eu.example.com", []string{"*.example.com", "*.eu.example.com"}, "*.eu.example.com"},
+		{"wildcard at any depth", "a.b.c.example.com", []string{"*", "*.example.com"}, "*.example.com"},
+		{"wildcard not matching its own domain", "example.com", []string{"*", "*.example.com"}, "*"},
+		{"catch-all for unknown hosts", "other.test", []string{"*", "*.example.com"}, "*"},
+		{"no catch-all", "other.test", []string{"*.example.com"}, ""},
+		{"request host with port and trailing dot", "APP.example.com.:8443", []string{"*", "app.example.com"}, "app.example.com"},
+		{"internationalized host", "shop.bücher.example", []string{"*", "*.Bücher.example"}, "*.xn--bcher-kva.example"},
+		{"IP addresses only match exactly", "192.0.2.1", []string{"*", "192.0.2.1"}, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		if got := match(tt.host, tt.patterns...); got != tt.want {
+			t.Errorf("%s: %s matched %q, want %q", tt.name, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestIsWildcard(t *testing.T) {
+	for pattern, want := range map[string]bool{
+		"*":               true,
+		"*.example.com":   true,
+		"example.com":     false,
+		"app.example.com": false,
+	} {
+		if got := IsWildcard(pattern); got != want {
+			t.Errorf("IsWildcard(%q) = %v, want %v", pattern, got, want)
+		}
+	}
+}
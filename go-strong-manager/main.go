@@ -7,11 +7,16 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/arifur/strong-reverse-proxy/alerts"
+	"github.com/arifur/strong-reverse-proxy/certs"
 	"github.com/arifur/strong-reverse-proxy/database"
 	"github.com/arifur/strong-reverse-proxy/filter"
 	"github.com/arifur/strong-reverse-proxy/handlers"
+	"github.com/arifur/strong-reverse-proxy/health"
 	"github.com/arifur/strong-reverse-proxy/middleware"
 	"github.com/arifur/strong-reverse-proxy/proxy"
+	"github.com/arifur/strong-reverse-proxy/tokens"
+	"github.com/arifur/strong-reverse-proxy/twofactor"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -43,6 +48,10 @@ func main() {
 	database.Initialize()
 	defer database.Close()
 
+	// Load the JWT signing keys and two-factor policy of the admin API
+	tokens.Initialize()
+	twofactor.Initialize()
+
 	// Initialize buffered logger for better performance
 	database.InitBufferedLogger()
 
@@ -52,10 +61,13 @@ func main() {
 	// Initialize periodic backend cleanup
 	initBackendCleanup()
 
-	// Initialize rate limiter - no longer used in the main HTTP server,
-	// but can be used in the admin API if needed
+	// Initialize rate limiter - enforced by the proxy server for DNS rules
+	// with rate limiting enabled
 	middleware.NewRateLimiter(100, time.Minute)
 
+	// Initialize automatic TLS certificates for DNS rule hostnames
+	certs.Initialize()
+
 	// Initialize proxy and DNS cache
 	proxy.Initialize()
 
@@ -66,7 +78,10 @@ func main() {
 	initLogRetention()
 
 	// Initialize health checker for DNS rules with health_check_enabled
-	handlers.InitHealthChecker()
+	health.Initialize()
+
+	// Initialize alert evaluator for enabled alerts
+	alerts.Initialize()
 
 	// Admin API routes
 	setupAdminRoutes(app)
@@ -74,6 +89,7 @@ func main() {
 	// Get ports from environment variables
 	adminPort := getEnv("ADMIN_PORT", "8089")
 	proxyPort := getEnv("PROXY_PORT", "89")
+	httpsPort := getEnv("HTTPS_PORT", "443")
 
 	// Set up graceful shutdown
 	c := make(chan os.Signal, 1)
@@ -95,6 +111,13 @@ func main() {
 		}
 	}()
 
+	// Start the HTTPS proxy server when TLS is enabled
+	go func() {
+		if err := proxy.StartTLSProxyServer(":" + httpsPort); err != nil {
+			log.Printf("TLS proxy server error: %v", err)
+		}
+	}()
+
 	// Wait for interrupt signal
 	<-c
 	log.Println("Shutting down gracefully...")
@@ -124,26 +147,47 @@ func setupAdminRoutes(app *fiber.App) {
 	// Admin API prefix
 	adminAPI := app.Group("/admin")
 
-	// Health check
+	// Liveness probe, the only public endpoint besides authentication
 	adminAPI.Get("/health", handlers.HealthCheck)
 
 	// Authentication routes
 	auth := adminAPI.Group("/api")
 	auth.Post("/signup", handlers.Signup)
 	auth.Post("/login", handlers.Login)
+	auth.Post("/refresh", handlers.RefreshToken)
+	auth.Post("/logout", handlers.Logout)
 
-	// Protected routes
-	api := adminAPI.Group("/api", middleware.JWTMiddleware)
+	// Protected routes, each group limited to the roles allowed to use it
+	api := adminAPI.Group("/api", middleware.JWTMiddleware, middleware.RequireTwoFactor)
+	configAccess := middleware.Authorize(middleware.ResourceConfig)
+	metricsAccess := middleware.Authorize(middleware.ResourceMetrics)
 
 	// User management
-	users := api.Group("/users")
+	users := api.Group("/users", middleware.Authorize(middleware.ResourceUsers))
 	users.Get("/", handlers.GetUsers)
 	users.Post("/", handlers.CreateUser)
 	users.Patch("/:id", handlers.UpdateUser)
 	users.Delete("/:id", handlers.DeleteUser)
+	users.Get("/:id/sessions", handlers.GetUserSessions)
+	users.Delete("/:id/sessions", handlers.DeleteUserSessions)
+	users.Delete("/:id/sessions/:sessionId", handlers.DeleteUserSession)
+	users.Delete("/:id/two-factor", handlers.ResetUserTwoFactor)
+
+	// Security policies
+	security := api.Group("/security", middleware.Authorize(middleware.ResourceUsers))
+	security.Get("/", handlers.GetSecuritySettings)
+	security.Patch("/", handlers.UpdateSecuritySettings)
+
+	// Two-factor enrolment of the authenticated user, open to every role
+	account := api.Group("/account")
+	account.Get("/two-factor", handlers.GetTwoFactor)
+	account.Post("/two-factor/setup", handlers.SetupTwoFactor)
+	account.Post("/two-factor/enable", handlers.EnableTwoFactor)
+	account.Post("/two-factor/disable", handlers.DisableTwoFactor)
+	account.Post("/two-factor/recovery-codes", handlers.RegenerateRecoveryCodes)
 
 	// Configuration
-	config := api.Group("/config")
+	config := api.Group("/config", configAccess)
 
 	// DNS Rules
 	dnsRules := config.Group("/dns_rules")
@@ -151,6 +195,14 @@ func setupAdminRoutes(app *fiber.App) {
 	dnsRules.Post("/", handlers.CreateDNSRule)
 	dnsRules.Patch("/:id", handlers.UpdateDNSRule)
 	dnsRules.Delete("/:id", handlers.DeleteDNSRule)
+	dnsRules.Get("/:id/routes", handlers.GetDNSRoutes)
+	dnsRules.Post("/:id/routes", handlers.CreateDNSRoute)
+	dnsRules.Patch("/:id/routes/:routeId", handlers.UpdateDNSRoute)
+	dnsRules.Delete("/:id/routes/:routeId", handlers.DeleteDNSRoute)
+	dnsRules.Get("/:id/headers", handlers.GetDNSHeaderRules)
+	dnsRules.Post("/:id/headers", handlers.CreateDNSHeaderRule)
+	dnsRules.Patch("/:id/headers/:headerId", handlers.UpdateDNSHeaderRule)
+	dnsRules.Delete("/:id/headers/:headerId", handlers.DeleteDNSHeaderRule)
 
 	// Backends
 	backends := config.Group("/backends")
@@ -159,14 +211,26 @@ func setupAdminRoutes(app *fiber.App) {
 	backends.Patch("/:id", handlers.UpdateBackend)
 	backends.Delete("/:id", handlers.DeleteBackend)
 
+	// Certificates
+	certificates := config.Group("/certificates")
+	certificates.Get("/", handlers.GetCertificates)
+	certificates.Post("/", handlers.CreateCertificate)
+	certificates.Patch("/:id", handlers.UpdateCertificate)
+	certificates.Delete("/:id", handlers.DeleteCertificate)
+
+	// Backend health and circuit breakers
+	api.Get("/health", metricsAccess, handlers.GetHealthDetails)
+	api.Get("/circuits", metricsAccess, handlers.GetCircuitBreakers)
+
 	// Metrics
-	adminAPI.Get("/metrics", handlers.GetMetrics)
-	adminAPI.Get("/metrics/logs", handlers.GetRecentLogs)
-	adminAPI.Get("/metrics/system", handlers.GetSystemResources)
-	adminAPI.Delete("/metrics/logs/delete-all", handlers.DeleteAllLogs)
+	metrics := adminAPI.Group("/metrics", middleware.JWTMiddleware, middleware.RequireTwoFactor, metricsAccess)
+	metrics.Get("/", handlers.GetMetrics)
+	metrics.Get("/logs", handlers.GetRecentLogs)
+	metrics.Get("/system", handlers.GetSystemResources)
+	metrics.Delete("/logs/delete-all", handlers.DeleteAllLogs)
 
 	// Database operations
-	dbOps := adminAPI.Group("/database")
+	dbOps := adminAPI.Group("/database", middleware.JWTMiddleware, middleware.RequireTwoFactor, middleware.Authorize(middleware.ResourceDatabase))
 	dbOps.Get("/backups", handlers.GetBackups)
 	dbOps.Post("/backup", handlers.BackupDatabase)
 	dbOps.Post("/restore", handlers.RestoreDatabase)
@@ -176,22 +240,24 @@ func setupAdminRoutes(app *fiber.App) {
 	dbOps.Post("/upload", handlers.UploadBackup)
 
 	// Alerts
-	alerts := api.Group("/alerts")
+	alerts := api.Group("/alerts", configAccess)
 	alerts.Get("/", handlers.GetAlerts)
 	alerts.Get("/dns-rules", handlers.GetDNSRulesForAlerts)
 	alerts.Post("/", handlers.CreateAlert)
 	alerts.Patch("/:id", handlers.UpdateAlert)
 	alerts.Delete("/:id", handlers.DeleteAlert)
+	alerts.Post("/:id/test", handlers.SendTestAlert)
+	alerts.Get("/events/:eventId/deliveries", handlers.GetAlertEventDeliveries)
 
-	// Filter Rules
+	// Filter Rules, whose logs are part of the metrics
 	filterRules := api.Group("/filter-rules")
-	filterRules.Get("/", handlers.GetFilterRules)
-	filterRules.Post("/", handlers.CreateFilterRule)
-	filterRules.Patch("/:id", handlers.UpdateFilterRule)
-	filterRules.Delete("/:id", handlers.DeleteFilterRule)
-	filterRules.Patch("/:id/toggle", handlers.ToggleFilterRule)
-	filterRules.Get("/logs", handlers.GetFilterLogs)
-	filterRules.Delete("/logs/delete-all", handlers.DeleteAllFilterLogs)
+	filterRules.Get("/", configAccess, handlers.GetFilterRules)
+	filterRules.Post("/", configAccess, handlers.CreateFilterRule)
+	filterRules.Patch("/:id", configAccess, handlers.UpdateFilterRule)
+	filterRules.Delete("/:id", configAccess, handlers.DeleteFilterRule)
+	filterRules.Patch("/:id/toggle", configAccess, handlers.ToggleFilterRule)
+	filterRules.Get("/logs", metricsAccess, handlers.GetFilterLogs)
+	filterRules.Delete("/logs/delete-all", metricsAccess, handlers.DeleteAllFilterLogs)
 }
 
 // initLogRetention initializes the log retention mechanism
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/middleware"
+	"github.com/arifur/strong-reverse-proxy/models"
+	"github.com/arifur/strong-reverse-proxy/tokens"
+	"github.com/arifur/strong-reverse-proxy/twofactor"
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// publicRoutes are the admin routes reachable without a token
+var publicRoutes = map[string]bool{
+	"GET /admin/health":       true,
+	"POST /admin/api/signup":  true,
+	"POST /admin/api/login":   true,
+	"POST /admin/api/refresh": true,
+	"POST /admin/api/logout":  true,
+}
+
+// testPassword is the password of the users created by createTestUser
+const testPassword = "secret123"
+
+// newTestAdminApp builds the admin API on a database in a temporary directory
+func newTestAdminApp(t *testing.T) *fiber.App {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	database.Initialize()
+	t.Cleanup(func() {
+		database.Close()
+		os.Chdir(wd)
+	})
+	t.Setenv("JWT_SECRET", "test-secret")
+	tokens.Initialize()
+
+	app := fiber.New()
+	setupAdminRoutes(app)
+	return app
+}
+
+// createTestUser adds a user with the given role and returns their ID
+func createTestUser(t *testing.T, email, role string) int {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := database.DB.Exec("INSERT INTO users (email, password_hash, role) VALUES (?, ?, ?)", email, string(hash), role)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	return int(id)
+}
+
+// sendRequest calls the admin API with an access token and a JSON body, when not empty,
+// and returns the response with its decoded body
+func sendRequest(t *testing.T, app *fiber.App, method, path, accessToken string, body interface{}) (*http.Response, map[string]interface{}) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", fiber.MIMEApplicationJSON)
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	// Bodies that are not JSON objects, such as lists, are not decoded
+	var decoded map[string]interface{}
+	data, _ := io.ReadAll(resp.Body)
+	json.Unmarshal(data, &decoded)
+	return resp, decoded
+}
+
+// login logs a user created by createTestUser in and returns their tokens
+func login(t *testing.T, app *fiber.App, email string) (accessToken, refreshToken string) {
+	t.Helper()
+	resp, body := sendRequest(t, app, fiber.MethodPost, "/admin/api/login", "", fiber.Map{"email": email, "password": testPassword})
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("login as %s returned %d: %v", email, resp.StatusCode, body)
+	}
+	accessToken, _ = body["token"].(string)
+	refreshToken, _ = body["refreshToken"].(string)
+	return accessToken, refreshToken
+}
+
+// requestPath fills the parameters of a route path with sample values
+func requestPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = "1"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func TestAdminRoutesRequireAuthentication(t *testing.T) {
+	app := newTestAdminApp(t)
+
+	checked := 0
+	for _, route := range app.GetRoutes(true) {
+		if !strings.HasPrefix(route.Path, "/admin") || route.Method == fiber.MethodHead || publicRoutes[route.Method+" "+route.Path] {
+			continue
+		}
+
+		resp, err := app.Test(httptest.NewRequest(route.Method, requestPath(route.Path), nil))
+		if err != nil {
+			t.Fatalf("%s %s: %v", route.Method, route.Path, err)
+		}
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("%s %s without a token returned %d, want 401", route.Method, route.Path, resp.StatusCode)
+		}
+		checked++
+	}
+
+	// Make sure the routes were found, including the mutating and operational ones
+	if checked < 50 {
+		t.Fatalf("checked %d routes, want every protected admin route", checked)
+	}
+}
+
+func TestAdminRoutesWithInvalidToken(t *testing.T) {
+	app := newTestAdminApp(t)
+
+	for _, route := range []struct{ method, path string }{
+		{fiber.MethodDelete, "/admin/api/users/1"},
+		{fiber.MethodDelete, "/admin/metrics/logs/delete-all"},
+		{fiber.MethodPost, "/admin/database/reset"},
+	} {
+		req := httptest.NewRequest(route.method, route.path, nil)
+		req.Header.Set("Authorization", "Bearer not-a-token")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", route.method, route.path, err)
+		}
+		if resp.StatusCode != fiber.StatusUnauthorized {
+			t.Errorf("%s %s with an invalid token returned %d, want 401", route.method, route.path, resp.StatusCode)
+		}
+	}
+}
+
+func TestAdminLivenessProbeIsPublic(t *testing.T) {
+	app := newTestAdminApp(t)
+
+	resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/admin/health", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("GET /admin/health returned %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestRequiredTwoFactorOnlyAllowsEnrolment(t *testing.T) {
+	app := newTestAdminApp(t)
+	userID := createTestUser(t, "admin@example.com", models.RoleAdmin)
+	accessToken, _ := login(t, app, "admin@example.com")
+	if err := twofactor.SetRequired(true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { twofactor.SetRequired(false) })
+
+	checked := 0
+	for _, route := range app.GetRoutes(true) {
+		if !strings.HasPrefix(route.Path, "/admin") || route.Method == fiber.MethodHead || publicRoutes[route.Method+" "+route.Path] {
+			continue
+		}
+
+		resp, body := sendRequest(t, app, route.Method, requestPath(route.Path), accessToken, nil)
+		blocked := resp.StatusCode == fiber.StatusForbidden && body["two_factor_setup_required"] == true
+		enrolment := strings.HasPrefix(route.Path, "/admin/api/account/two-factor")
+		if enrolment && blocked {
+			t.Errorf("%s %s blocked a user who has to enrol", route.Method, route.Path)
+		}
+		if !enrolment && !blocked {
+			t.Errorf("%s %s returned %d to a user who is not enrolled, want 403", route.Method, route.Path, resp.StatusCode)
+		}
+		checked++
+	}
+	if checked < 50 {
+		t.Fatalf("checked %d routes, want every protected admin route", checked)
+	}
+
+	// Once enrolled the user gets through
+	if _, err := database.DB.Exec("UPDATE users SET totp_enabled = 1 WHERE id = ?", userID); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := sendRequest(t, app, fiber.MethodGet, "/admin/api/users/", accessToken, nil); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("GET /admin/api/users/ returned %d to an enrolled user, want 200", resp.StatusCode)
+	}
+}
+
+func TestAccessTokensAreRevokedWithTheirSession(t *testing.T) {
+	tests := []struct {
+		name   string
+		revoke func(t *testing.T, app *fiber.App, adminToken string, userID int, refreshToken string) *http.Response
+	}{
+		{
+			name: "password change",
+			revoke: func(t *testing.T, app *fiber.App, adminToken string, userID int, _ string) *http.Response {
+				resp, _ := sendRequest(t, app, fiber.MethodPatch, fmt.Sprintf("/admin/api/users/%d", userID), adminToken, fiber.Map{"password": "changed123"})
+				return resp
+			},
+		},
+		{
+			name: "role change",
+			revoke: func(t *testing.T, app *fiber.App, adminToken string, userID int, _ string) *http.Response {
+				resp, _ := sendRequest(t, app, fiber.MethodPatch, fmt.Sprintf("/admin/api/users/%d", userID), adminToken, fiber.Map{"role": models.RoleOperator})
+				return resp
+			},
+		},
+		{
+			name: "user deletion",
+			revoke: func(t *testing.T, app *fiber.App, adminToken string, userID int, _ string) *http.Response {
+				resp, _ := sendRequest(t, app, fiber.MethodDelete, fmt.Sprintf("/admin/api/users/%d", userID), adminToken, nil)
+				return resp
+			},
+		},
+		{
+			name: "logout",
+			revoke: func(t *testing.T, app *fiber.App, _ string, _ int, refreshToken string) *http.Response {
+				resp, _ := sendRequest(t, app, fiber.MethodPost, "/admin/api/logout", "", fiber.Map{"refreshToken": refreshToken})
+				return resp
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestAdminApp(t)
+			createTestUser(t, "admin@example.com", models.RoleAdmin)
+			userID := createTestUser(t, "viewer@example.com", models.RoleViewer)
+			adminToken, _ := login(t, app, "admin@example.com")
+			accessToken, refreshToken := login(t, app, "viewer@example.com")
+
+			if resp, _ := sendRequest(t, app, fiber.MethodGet, "/admin/api/account/two-factor", accessToken, nil); resp.StatusCode != fiber.StatusOK {
+				t.Fatalf("access token rejected before the %s: %d", tt.name, resp.StatusCode)
+			}
+
+			if resp := tt.revoke(t, app, adminToken, userID, refreshToken); resp.StatusCode >= 300 {
+				t.Fatalf("%s returned %d", tt.name, resp.StatusCode)
+			}
+
+			if resp, _ := sendRequest(t, app, fiber.MethodGet, "/admin/api/account/two-factor", accessToken, nil); resp.StatusCode != fiber.StatusUnauthorized {
+				t.Errorf("access token after the %s returned %d, want 401", tt.name, resp.StatusCode)
+			}
+			if resp, _ := sendRequest(t, app, fiber.MethodPost, "/admin/api/refresh", "", fiber.Map{"refreshToken": refreshToken}); resp.StatusCode != fiber.StatusUnauthorized {
+				t.Errorf("refresh token after the %s returned %d, want 401", tt.name, resp.StatusCode)
+			}
+
+			// The sessions of other users are not affected
+			if resp, _ := sendRequest(t, app, fiber.MethodGet, "/admin/api/account/two-factor", adminToken, nil); resp.StatusCode != fiber.StatusOK {
+				t.Errorf("access token of another user returned %d after the %s, want 200", resp.StatusCode, tt.name)
+			}
+		})
+	}
+}
+
+func TestDeleteUserSessionOnlyRevokesThatSession(t *testing.T) {
+	app := newTestAdminApp(t)
+	createTestUser(t, "admin@example.com", models.RoleAdmin)
+	userID := createTestUser(t, "viewer@example.com", models.RoleViewer)
+	adminToken, _ := login(t, app, "admin@example.com")
+	laptopToken, _ := login(t, app, "viewer@example.com")
+	phoneToken, _ := login(t, app, "viewer@example.com")
+
+	claims, err := tokens.ParseAccessToken(laptopToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptopSession := claims["sid"].(string)
+
+	sessionsPath := fmt.Sprintf("/admin/api/users/%d/sessions", userID)
+	if sessions, err := tokens.Sessions(userID); err != nil || len(sessions) != 2 {
+		t.Fatalf("sessions = %v, %v, want 2", sessions, err)
+	}
+	if resp, _ := sendRequest(t, app, fiber.MethodDelete, sessionsPath+"/"+laptopSession, adminToken, nil); resp.StatusCode != fiber.StatusNoContent {
+		t.Fatalf("DELETE session returned %d, want 204", resp.StatusCode)
+	}
+
+	if resp, _ := sendRequest(t, app, fiber.MethodGet, "/admin/api/account/two-factor", laptopToken, nil); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("access token of the revoked session returned %d, want 401", resp.StatusCode)
+	}
+	if resp, _ := sendRequest(t, app, fiber.MethodGet, "/admin/api/account/two-factor", phoneToken, nil); resp.StatusCode != fiber.StatusOK {
+		t.Errorf("access token of the other session returned %d, want 200", resp.StatusCode)
+	}
+	if sessions, err := tokens.Sessions(userID); err != nil || len(sessions) != 1 || sessions[0].ID == laptopSession {
+		t.Errorf("sessions = %v, %v, want only the other session", sessions, err)
+	}
+
+	// Revoking it again, or a session of another user, finds nothing
+	if resp, _ := sendRequest(t, app, fiber.MethodDelete, sessionsPath+"/"+laptopSession, adminToken, nil); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("DELETE of a revoked session returned %d, want 404", resp.StatusCode)
+	}
+	adminClaims, _ := tokens.ParseAccessToken(adminToken)
+	if resp, _ := sendRequest(t, app, fiber.MethodDelete, sessionsPath+"/"+adminClaims["sid"].(string), adminToken, nil); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("DELETE of another user's session returned %d, want 404", resp.StatusCode)
+	}
+}
+
+// routeResource returns the resource whose permissions protect an admin route, and false
+// for the routes open to every role
+func routeResource(path string) (middleware.Resource, bool) {
+	switch {
+	case strings.HasPrefix(path, "/admin/api/account/"):
+		return "", false
+	case strings.HasPrefix(path, "/admin/api/users"), strings.HasPrefix(path, "/admin/api/security"):
+		return middleware.ResourceUsers, true
+	case strings.HasPrefix(path, "/admin/database"):
+		return middleware.ResourceDatabase, true
+	case strings.HasPrefix(path, "/admin/metrics"), strings.HasPrefix(path, "/admin/api/filter-rules/logs"),
+		path == "/admin/api/health", path == "/admin/api/circuits":
+		return middleware.ResourceMetrics, true
+	}
+	return middleware.ResourceConfig, true
+}
+
+func TestAdminRoutesFollowRolePermissions(t *testing.T) {
+	app := newTestAdminApp(t)
+
+	for _, role := range []string{models.RoleAdmin, models.RoleOperator, models.RoleViewer} {
+		createTestUser(t, role+"@example.com", role)
+		accessToken, _ := login(t, app, role+"@example.com")
+
+		for _, route := range app.GetRoutes(true) {
+			if !strings.HasPrefix(route.Path, "/admin") || route.Method == fiber.MethodHead || publicRoutes[route.Method+" "+route.Path] {
+				continue
+			}
+			resource, restricted := routeResource(route.Path)
+			access := middleware.AccessWrite
+			if route.Method == fiber.MethodGet {
+				access = middleware.AccessRead
+			}
+			allowed := !restricted || middleware.Allowed(role, resource, access)
+
+			// Only reads are made when allowed, as changes such as a database reset would
+			// affect the other requests
+			if allowed && route.Method != fiber.MethodGet {
+				continue
+			}
+
+			resp, body := sendRequest(t, app, route.Method, requestPath(route.Path), accessToken, nil)
+			denied := resp.StatusCode == fiber.StatusForbidden && body["error"] == "Your role does not allow this action"
+			if allowed && denied {
+				t.Errorf("%s %s denied to %s", route.Method, route.Path, role)
+			}
+			if !allowed && !denied {
+				t.Errorf("%s %s returned %d to %s, want 403", route.Method, route.Path, resp.StatusCode, role)
+			}
+		}
+	}
+}
+
+func TestRolePermissionsOfRepresentativeRoutes(t *testing.T) {
+	app := newTestAdminApp(t)
+	accessTokens := make(map[string]string)
+	for _, role := range []string{models.RoleOperator, models.RoleViewer} {
+		createTestUser(t, role+"@example.com", role)
+		accessTokens[role], _ = login(t, app, role+"@example.com")
+	}
+
+	tests := []struct {
+		role, method, path string
+		want               int
+	}{
+		{models.RoleViewer, fiber.MethodGet, "/admin/api/config/dns_rules/", fiber.StatusOK},
+		{models.RoleViewer, fiber.MethodGet, "/admin/api/config/backends/", fiber.StatusOK},
+		{models.RoleViewer, fiber.MethodGet, "/admin/api/alerts/", fiber.StatusOK},
+		{models.RoleViewer, fiber.MethodGet, "/admin/api/filter-rules/", fiber.StatusOK},
+		{models.RoleViewer, fiber.MethodGet, "/admin/metrics/logs", fiber.StatusOK},
+		{models.RoleViewer, fiber.MethodPatch, "/admin/api/config/dns_rules/1", fiber.StatusForbidden},
+		{models.RoleViewer, fiber.MethodDelete, "/admin/api/config/backends/1", fiber.StatusForbidden},
+		{models.RoleViewer, fiber.MethodPatch, "/admin/api/filter-rules/1/toggle", fiber.StatusForbidden},
+		{models.RoleViewer, fiber.MethodDelete, "/admin/metrics/logs/delete-all", fiber.StatusForbidden},
+		{models.RoleViewer, fiber.MethodGet, "/admin/api/users/", fiber.StatusForbidden},
+
+		{models.RoleOperator, fiber.MethodGet, "/admin/api/config/dns_rules/", fiber.StatusOK},
+		{models.RoleOperator, fiber.MethodDelete, "/admin/api/config/dns_rules/999", fiber.StatusNotFound},
+		{models.RoleOperator, fiber.MethodGet, "/admin/api/users/", fiber.StatusForbidden},
+		{models.RoleOperator, fiber.MethodPost, "/admin/api/users/", fiber.StatusForbidden},
+		{models.RoleOperator, fiber.MethodGet, "/admin/api/security/", fiber.StatusForbidden},
+		{models.RoleOperator, fiber.MethodPatch, "/admin/api/security/", fiber.StatusForbidden},
+		{models.RoleOperator, fiber.MethodGet, "/admin/database/backups", fiber.StatusForbidden},
+		{models.RoleOperator, fiber.MethodPost, "/admin/database/reset", fiber.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if resp, _ := sendRequest(t, app, tt.method, tt.path, accessTokens[tt.role], nil); resp.StatusCode != tt.want {
+			t.Errorf("%s %s as %s returned %d, want %d", tt.method, tt.path, tt.role, resp.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestUpdateAlertValidatesTheEffectiveType(t *testing.T) {
+	app := newTestAdminApp(t)
+	createTestUser(t, "admin@example.com", models.RoleAdmin)
+	accessToken, _ := login(t, app, "admin@example.com")
+
+	createAlert := func(alertType models.AlertType, destination string) string {
+		t.Helper()
+		resp, body := sendRequest(t, app, fiber.MethodPost, "/admin/api/alerts/", accessToken, fiber.Map{"type": alertType, "destination": destination})
+		if resp.StatusCode != fiber.StatusCreated {
+			t.Fatalf("create %s alert returned %d: %v", alertType, resp.StatusCode, body)
+		}
+		return fmt.Sprintf("/admin/api/alerts/%v", body["id"])
+	}
+	webhookAlert := createAlert(models.AlertTypeWebhook, "https://hooks.example.com/alerts")
+	emailAlert := createAlert(models.AlertTypeEmail, "ops@example.com")
+
+	tests := []struct {
+		name   string
+		path   string
+		update fiber.Map
+		want   int
+	}{
+		{"webhook turned into email alert keeping its URL", webhookAlert, fiber.Map{"type": models.AlertTypeEmail}, fiber.StatusBadRequest},
+		{"invalid destination of an email alert", emailAlert, fiber.Map{"destination": "not-an-address"}, fiber.StatusBadRequest},
+		{"unknown type", emailAlert, fiber.Map{"type": "sms"}, fiber.StatusBadRequest},
+		{"threshold of an email alert", emailAlert, fiber.Map{"threshold": 5}, fiber.StatusOK},
+		{"webhook turned into email alert with an address", webhookAlert, fiber.Map{"type": models.AlertTypeEmail, "destination": "oncall@example.com"}, fiber.StatusOK},
+	}
+	for _, tt := range tests {
+		if resp, body := sendRequest(t, app, fiber.MethodPatch, tt.path, accessToken, tt.update); resp.StatusCode != tt.want {
+			t.Errorf("%s: returned %d, want %d: %v", tt.name, resp.StatusCode, tt.want, body)
+		}
+	}
+
+	// Updates without a type or destination keep the current ones
+	var alertType string
+	if err := database.DB.QueryRow("SELECT type FROM alerts WHERE destination = 'ops@example.com'").Scan(&alertType); err != nil {
+		t.Fatalf("load email alert: %v", err)
+	}
+	if alertType != string(models.AlertTypeEmail) {
+		t.Errorf("type of the email alert = %q after updating its threshold", alertType)
+	}
+}
+
+func TestUpdateAlertKeepsOrClearsTheWebhookSecret(t *testing.T) {
+	app := newTestAdminApp(t)
+	createTestUser(t, "admin@example.com", models.RoleAdmin)
+	accessToken, _ := login(t, app, "admin@example.com")
+
+	resp, body := sendRequest(t, app, fiber.MethodPost, "/admin/api/alerts/", accessToken, fiber.Map{
+		"type": models.AlertTypeWebhook, "destination": "https://hooks.example.com/alerts", "webhook_secret": "signing-key",
+	})
+	if resp.StatusCode != fiber.StatusCreated || body["has_webhook_secret"] != true {
+		t.Fatalf("create alert returned %d: %v", resp.StatusCode, body)
+	}
+	path := fmt.Sprintf("/admin/api/alerts/%v", body["id"])
+
+	tests := []struct {
+		name   string
+		update fiber.Map
+		want   bool
+	}{
+		{"update without the secret", fiber.Map{"threshold": 5}, true},
+		{"null secret", fiber.Map{"webhook_secret": nil}, true},
+		{"empty secret", fiber.Map{"webhook_secret": ""}, false},
+		{"new secret", fiber.Map{"webhook_secret": "rotated-key"}, true},
+	}
+	for _, tt := range tests {
+		resp, body := sendRequest(t, app, fiber.MethodPatch, path, accessToken, tt.update)
+		if resp.StatusCode != fiber.StatusOK {
+			t.Fatalf("%s: returned %d: %v", tt.name, resp.StatusCode, body)
+		}
+		if body["has_webhook_secret"] != tt.want {
+			t.Errorf("%s: has_webhook_secret = %v, want %v", tt.name, body["has_webhook_secret"], tt.want)
+		}
+	}
+}
+
+func TestUpdateDNSRuleRateLimitBurst(t *testing.T) {
+	app := newTestAdminApp(t)
+	createTestUser(t, "admin@example.com", models.RoleAdmin)
+	accessToken, _ := login(t, app, "admin@example.com")
+
+	result, err := database.DB.Exec("INSERT INTO dns_rules (hostname, rate_limit_burst) VALUES ('app.example.com', 20)")
+	if err != nil {
+		t.Fatalf("create DNS rule: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	path := fmt.Sprintf("/admin/api/config/dns_rules/%d", id)
+
+	tests := []struct {
+		name   string
+		update fiber.Map
+		status int
+		want   int
+	}{
+		{"update without the burst", fiber.Map{"rate_limit_quota": 50}, fiber.StatusOK, 20},
+		{"negative burst", fiber.Map{"rate_limit_burst": -1}, fiber.StatusBadRequest, 20},
+		{"burst of the quota", fiber.Map{"rate_limit_burst": 0}, fiber.StatusOK, 0},
+		{"larger burst", fiber.Map{"rate_limit_burst": 80}, fiber.StatusOK, 80},
+	}
+	for _, tt := range tests {
+		if resp, body := sendRequest(t, app, fiber.MethodPatch, path, accessToken, tt.update); resp.StatusCode != tt.status {
+			t.Fatalf("%s: returned %d, want %d: %v", tt.name, resp.StatusCode, tt.status, body)
+		}
+		var burst int
+		if err := database.DB.QueryRow("SELECT rate_limit_burst FROM dns_rules WHERE id = ?", id).Scan(&burst); err != nil {
+			t.Fatalf("load DNS rule: %v", err)
+		}
+		if burst != tt.want {
+			t.Errorf("%s: rate_limit_burst = %d, want %d", tt.name, burst, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/filter"
+	"github.com/arifur/strong-reverse-proxy/hostmatch"
+)
+
+// CheckHTTP enforces the hostname's rate limit for a net/http request.
+// It sets the X-RateLimit-* headers and, when the quota is exhausted, writes a
+// 429 response, logs the throttled request and returns false.
+func (rl *RateLimiter) CheckHTTP(w http.ResponseWriter, r *http.Request) bool {
+	clientIP := filter.GetClientIP(r)
+	result := rl.Allow(clientIP, r.Host)
+
+	// Nothing to report if rate limiting is disabled for this hostname
+	if !result.Limited {
+		return true
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(result.Reset.Unix(), 10))
+
+	if result.Allowed {
+		return true
+	}
+
+	// Round up so clients never retry before the window has passed
+	retryAfter := int(math.Ceil(result.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, "Rate limit exceeded for this hostname. Please try again later.", http.StatusTooManyRequests)
+
+	// Log the throttled request under the DNS rule's hostname, like proxied requests
+	hostname := result.Hostname
+	if hostname == "" {
+		hostname = hostmatch.Normalize(r.Host)
+	}
+	go database.LogRequest(clientIP, hostname, r.URL.Path, 0, 0, http.StatusTooManyRequests, false, r.Header.Get("User-Agent"), 0, 1)
+
+	return false
+}
+
+// HTTPMiddleware wraps a net/http handler with per-hostname rate limiting
+func (rl *RateLimiter) HTTPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rl.CheckHTTP(w, r) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CheckHTTPRateLimit enforces rate limits using the global rate limiter.
+// Requests are always allowed if the rate limiter has not been initialized.
+func CheckHTTPRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if globalRateLimiter == nil {
+		return true
+	}
+	return globalRateLimiter.CheckHTTP(w, r)
+}
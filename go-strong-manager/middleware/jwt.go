@@ -3,12 +3,10 @@ package middleware
 import (
 	"strings"
 
+	"github.com/arifur/strong-reverse-proxy/tokens"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
 )
 
-const jwtSecret = "your-secret-key" // Should match the auth.go secret
-
 // JWTMiddleware authenticates requests using JWT tokens
 func JWTMiddleware(c *fiber.Ctx) error {
 	// Get authorization header
@@ -27,34 +25,21 @@ func JWTMiddleware(c *fiber.Ctx) error {
 		})
 	}
 
-	// Parse and validate token
-	tokenString := parts[1]
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Validate signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
-		}
-		return []byte(jwtSecret), nil
-	})
-
+	// Parse and validate token against the configured keys and its session
+	claims, err := tokens.ParseAccessToken(parts[1])
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid or expired token",
-		})
-	}
-
-	// Check if token is valid
-	if !token.Valid {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid token",
-		})
-	}
-
-	// Extract claims
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid token claims",
+		switch err {
+		case tokens.ErrInvalidToken:
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid or expired token",
+			})
+		case tokens.ErrTokenRevoked:
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Session has been revoked",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
 		})
 	}
 
@@ -62,6 +47,7 @@ func JWTMiddleware(c *fiber.Ctx) error {
 	c.Locals("userID", claims["id"])
 	c.Locals("userEmail", claims["email"])
 	c.Locals("userRole", claims["role"])
+	c.Locals("sessionID", claims["sid"])
 
 	return c.Next()
 }
@@ -0,0 +1,337 @@
+package middleware
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Rate limiting algorithms selectable per DNS rule
+const (
+	AlgorithmFixedWindow   = "fixed_window"
+	AlgorithmSlidingLog    = "sliding_log"
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmTokenBucket   = "token_bucket"
+)
+
+// IsValidAlgorithm reports whether the given name is a supported rate limit algorithm
+func IsValidAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case AlgorithmFixedWindow, AlgorithmSlidingLog, AlgorithmSlidingWindow, AlgorithmTokenBucket:
+		return true
+	default:
+		return false
+	}
+}
+
+// Limiter tracks request quotas for a set of keys (usually client IPs)
+type Limiter interface {
+	// Allow records a request for the key at the given time and reports whether it is within quota
+	Allow(key string, now time.Time) RateLimitResult
+	// Cleanup drops state for keys that have not been seen recently
+	Cleanup(now time.Time)
+}
+
+// NewLimiter creates a limiter for the given algorithm.
+// Unknown algorithms fall back to a fixed window.
+func NewLimiter(algorithm string, limit int, interval time.Duration, burst int) Limiter {
+	switch algorithm {
+	case AlgorithmSlidingLog:
+		return newSlidingLogLimiter(limit, interval)
+	case AlgorithmSlidingWindow:
+		return newSlidingWindowLimiter(limit, interval)
+	case AlgorithmTokenBucket:
+		return newTokenBucketLimiter(limit, interval, burst)
+	default:
+		return newFixedWindowLimiter(limit, interval)
+	}
+}
+
+// fixedWindowLimiter counts requests in windows that start with the first request
+type fixedWindowLimiter struct {
+	limit    int
+	interval time.Duration
+	windows  map[string]*fixedWindow
+	mu       sync.Mutex
+}
+
+type fixedWindow struct {
+	start time.Time
+	count int
+}
+
+func newFixedWindowLimiter(limit int, interval time.Duration) *fixedWindowLimiter {
+	return &fixedWindowLimiter{
+		limit:    limit,
+		interval: interval,
+		windows:  make(map[string]*fixedWindow),
+	}
+}
+
+func (l *fixedWindowLimiter) Allow(key string, now time.Time) RateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Start a new window if none exists or the current one has expired
+	window, exists := l.windows[key]
+	if !exists || now.Sub(window.start) >= l.interval {
+		window = &fixedWindow{start: now}
+		l.windows[key] = window
+	}
+
+	reset := window.start.Add(l.interval)
+	result := RateLimitResult{Limited: true, Limit: l.limit, Reset: reset}
+
+	if window.count >= l.limit {
+		result.RetryAfter = reset.Sub(now)
+		return result
+	}
+
+	window.count++
+	result.Allowed = true
+	result.Remaining = l.limit - window.count
+	return result
+}
+
+func (l *fixedWindowLimiter) Cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, window := range l.windows {
+		if now.Sub(window.start) >= l.interval {
+			delete(l.windows, key)
+		}
+	}
+}
+
+// slidingLogLimiter keeps the timestamp of every accepted request within the interval
+type slidingLogLimiter struct {
+	limit    int
+	interval time.Duration
+	logs     map[string][]time.Time
+	mu       sync.Mutex
+}
+
+func newSlidingLogLimiter(limit int, interval time.Duration) *slidingLogLimiter {
+	return &slidingLogLimiter{
+		limit:    limit,
+		interval: interval,
+		logs:     make(map[string][]time.Time),
+	}
+}
+
+// prune drops timestamps that have fallen out of the interval
+func (l *slidingLogLimiter) prune(key string, now time.Time) []time.Time {
+	entries := l.logs[key]
+	cutoff := now.Add(-l.interval)
+	i := 0
+	for i < len(entries) && !entries[i].After(cutoff) {
+		i++
+	}
+	entries = entries[i:]
+	l.logs[key] = entries
+	return entries
+}
+
+func (l *slidingLogLimiter) Allow(key string, now time.Time) RateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := l.prune(key, now)
+	result := RateLimitResult{Limited: true, Limit: l.limit, Reset: now.Add(l.interval)}
+
+	if len(entries) >= l.limit {
+		// The oldest entry has to expire before another request is allowed
+		result.Reset = entries[0].Add(l.interval)
+		result.RetryAfter = result.Reset.Sub(now)
+		return result
+	}
+
+	entries = append(entries, now)
+	l.logs[key] = entries
+	result.Allowed = true
+	result.Remaining = l.limit - len(entries)
+	result.Reset = entries[0].Add(l.interval)
+	return result
+}
+
+func (l *slidingLogLimiter) Cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key := range l.logs {
+		if len(l.prune(key, now)) == 0 {
+			delete(l.logs, key)
+		}
+	}
+}
+
+// slidingWindowLimiter approximates a sliding window by weighting the previous
+// fixed window's count by how much of it still overlaps the sliding window
+type slidingWindowLimiter struct {
+	limit    int
+	interval time.Duration
+	counters map[string]*slidingCounter
+	mu       sync.Mutex
+}
+
+type slidingCounter struct {
+	windowStart time.Time
+	current     int
+	previous    int
+}
+
+func newSlidingWindowLimiter(limit int, interval time.Duration) *slidingWindowLimiter {
+	return &slidingWindowLimiter{
+		limit:    limit,
+		interval: interval,
+		counters: make(map[string]*slidingCounter),
+	}
+}
+
+// advance moves the counter's windows forward so that now falls in the current window
+func (l *slidingWindowLimiter) advance(counter *slidingCounter, now time.Time) {
+	windowStart := now.Truncate(l.interval)
+	switch {
+	case windowStart.Equal(counter.windowStart):
+		return
+	case windowStart.Sub(counter.windowStart) == l.interval:
+		counter.previous = counter.current
+	default:
+		counter.previous = 0
+	}
+	counter.current = 0
+	counter.windowStart = windowStart
+}
+
+func (l *slidingWindowLimiter) Allow(key string, now time.Time) RateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	counter, exists := l.counters[key]
+	if !exists {
+		counter = &slidingCounter{windowStart: now.Truncate(l.interval)}
+		l.counters[key] = counter
+	}
+	l.advance(counter, now)
+
+	// Weight the previous window by the fraction still inside the sliding window
+	elapsed := now.Sub(counter.windowStart)
+	weight := 1 - float64(elapsed)/float64(l.interval)
+	estimated := float64(counter.previous)*weight + float64(counter.current)
+
+	reset := counter.windowStart.Add(l.interval)
+	result := RateLimitResult{Limited: true, Limit: l.limit, Reset: reset}
+
+	if estimated+1 > float64(l.limit) {
+		result.RetryAfter = l.retryAfter(counter, elapsed)
+		return result
+	}
+
+	counter.current++
+	result.Allowed = true
+	result.Remaining = int(math.Max(0, math.Floor(float64(l.limit)-estimated-1)))
+	return result
+}
+
+// retryAfter estimates how long until the weighted count drops enough to admit a request
+func (l *slidingWindowLimiter) retryAfter(counter *slidingCounter, elapsed time.Duration) time.Duration {
+	remaining := l.interval - elapsed
+	if counter.previous == 0 || counter.current+1 > l.limit {
+		return remaining
+	}
+
+	// Solve previous*(1 - t/interval) + current + 1 <= limit for t
+	needed := 1 - float64(l.limit-counter.current-1)/float64(counter.previous)
+	wait := time.Duration(needed*float64(l.interval)) - elapsed
+	if wait < 0 || wait > remaining {
+		return remaining
+	}
+	return wait
+}
+
+func (l *slidingWindowLimiter) Cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, counter := range l.counters {
+		if now.Sub(counter.windowStart) >= 2*l.interval {
+			delete(l.counters, key)
+		}
+	}
+}
+
+// tokenBucketLimiter refills tokens at limit/interval and allows bursts up to the bucket size
+type tokenBucketLimiter struct {
+	rate     float64 // Tokens per second
+	capacity float64
+	interval time.Duration
+	buckets  map[string]*tokenBucket
+	mu       sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newTokenBucketLimiter(limit int, interval time.Duration, burst int) *tokenBucketLimiter {
+	// Default the bucket size to the quota so a full interval's worth can be spent at once
+	if burst <= 0 {
+		burst = limit
+	}
+	return &tokenBucketLimiter{
+		rate:     float64(limit) / interval.Seconds(),
+		capacity: float64(burst),
+		interval: interval,
+		buckets:  make(map[string]*tokenBucket),
+	}
+}
+
+func (l *tokenBucketLimiter) Allow(key string, now time.Time) RateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: l.capacity, lastRefill: now}
+		l.buckets[key] = bucket
+	}
+
+	// Refill tokens for the time elapsed since the last request
+	if elapsed := now.Sub(bucket.lastRefill).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(l.capacity, bucket.tokens+elapsed*l.rate)
+		bucket.lastRefill = now
+	}
+
+	result := RateLimitResult{Limited: true, Limit: int(l.capacity)}
+
+	if bucket.tokens < 1 {
+		result.RetryAfter = l.timeUntil(1 - bucket.tokens)
+		result.Reset = now.Add(result.RetryAfter)
+		return result
+	}
+
+	bucket.tokens--
+	result.Allowed = true
+	result.Remaining = int(bucket.tokens)
+	result.Reset = now.Add(l.timeUntil(l.capacity - bucket.tokens))
+	return result
+}
+
+// timeUntil returns how long it takes to refill the given number of tokens
+func (l *tokenBucketLimiter) timeUntil(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+func (l *tokenBucketLimiter) Cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A bucket idle long enough to be full again is equivalent to a new one
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.lastRefill) >= l.timeUntil(l.capacity) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+// base is aligned to the minute, so sliding windows start on it
+var base = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// at returns the time the given offset after base
+func at(offset time.Duration) time.Time {
+	return base.Add(offset)
+}
+
+// expectAllowed checks that a request is admitted with the given number of requests left
+func expectAllowed(t *testing.T, l Limiter, now time.Time, remaining int) RateLimitResult {
+	t.Helper()
+	result := l.Allow("client", now)
+	if !result.Allowed || !result.Limited {
+		t.Fatalf("request at %v: got %+v, want allowed", now.Sub(base), result)
+	}
+	if result.Remaining != remaining {
+		t.Fatalf("request at %v: remaining = %d, want %d", now.Sub(base), result.Remaining, remaining)
+	}
+	return result
+}
+
+// expectDenied checks that a request is throttled and told to retry after the given time
+func expectDenied(t *testing.T, l Limiter, now time.Time, retryAfter time.Duration) RateLimitResult {
+	t.Helper()
+	result := l.Allow("client", now)
+	if result.Allowed || !result.Limited {
+		t.Fatalf("request at %v: got %+v, want denied", now.Sub(base), result)
+	}
+	if result.Remaining != 0 {
+		t.Fatalf("request at %v: remaining = %d, want 0", now.Sub(base), result.Remaining)
+	}
+	if result.RetryAfter != retryAfter {
+		t.Fatalf("request at %v: retry after = %v, want %v", now.Sub(base), result.RetryAfter, retryAfter)
+	}
+	return result
+}
+
+func TestFixedWindowResetsAtWindowBoundary(t *testing.T) {
+	l := NewLimiter(AlgorithmFixedWindow, 3, time.Minute, 0)
+
+	expectAllowed(t, l, at(10*time.Second), 2)
+	expectAllowed(t, l, at(20*time.Second), 1)
+	result := expectAllowed(t, l, at(30*time.Second), 0)
+	if want := at(70 * time.Second); !result.Reset.Equal(want) {
+		t.Fatalf("reset = %v, want one interval after the first request", result.Reset.Sub(base))
+	}
+
+	expectDenied(t, l, at(40*time.Second), 30*time.Second)
+	expectDenied(t, l, at(70*time.Second-time.Millisecond), time.Millisecond)
+
+	// The window started with the first request, so the quota is back one interval later
+	expectAllowed(t, l, at(70*time.Second), 2)
+
+	// Other keys have their own window
+	if result := l.Allow("other", at(70*time.Second)); !result.Allowed || result.Remaining != 2 {
+		t.Fatalf("other key: got %+v, want its own quota", result)
+	}
+}
+
+func TestSlidingLogExpiresEntriesAfterInterval(t *testing.T) {
+	l := NewLimiter(AlgorithmSlidingLog, 3, time.Minute, 0)
+
+	expectAllowed(t, l, at(0), 2)
+	expectAllowed(t, l, at(10*time.Second), 1)
+	expectAllowed(t, l, at(20*time.Second), 0)
+
+	// The oldest entry expires one interval after it was logged
+	result := expectDenied(t, l, at(30*time.Second), 30*time.Second)
+	if want := at(time.Minute); !result.Reset.Equal(want) {
+		t.Fatalf("reset = %v, want when the oldest entry expires", result.Reset.Sub(base))
+	}
+
+	// Only one entry expired, so only one request is admitted
+	expectAllowed(t, l, at(time.Minute), 0)
+	expectDenied(t, l, at(61*time.Second), 9*time.Second)
+
+	// Denied requests are not logged: after the next two entries expire, two are admitted
+	expectAllowed(t, l, at(80*time.Second), 1)
+	expectAllowed(t, l, at(80*time.Second), 0)
+	expectDenied(t, l, at(80*time.Second), 40*time.Second)
+}
+
+func TestSlidingWindowWeightsPreviousWindow(t *testing.T) {
+	l := NewLimiter(AlgorithmSlidingWindow, 8, time.Minute, 0)
+
+	// Spend the whole quota at the end of the first window
+	for i := 7; i >= 0; i-- {
+		expectAllowed(t, l, at(50*time.Second), i)
+	}
+	result := expectDenied(t, l, at(59*time.Second), time.Second)
+	if want := at(time.Minute); !result.Reset.Equal(want) {
+		t.Fatalf("reset = %v, want the end of the window", result.Reset.Sub(base))
+	}
+
+	// A new window does not grant a fresh quota: the previous one still counts fully, and
+	// weighs 8*(1 - t/60s) until a request fits, after 7.5s
+	expectDenied(t, l, at(time.Minute), 7500*time.Millisecond)
+
+	// After 15s the previous window weighs 6, leaving room for 2 requests
+	expectAllowed(t, l, at(75*time.Second), 1)
+	expectAllowed(t, l, at(75*time.Second), 0)
+	expectDenied(t, l, at(75*time.Second), 7500*time.Millisecond)
+
+	// Halfway through it weighs 4, with 2 requests in the current window
+	expectAllowed(t, l, at(90*time.Second), 1)
+
+	// A window without requests resets the previous count
+	expectAllowed(t, l, at(3*time.Minute), 7)
+}
+
+func TestSlidingWindowAllowsFullQuotaWithoutPreviousWindow(t *testing.T) {
+	l := NewLimiter(AlgorithmSlidingWindow, 3, time.Minute, 0)
+
+	expectAllowed(t, l, at(30*time.Second), 2)
+	expectAllowed(t, l, at(30*time.Second), 1)
+	expectAllowed(t, l, at(30*time.Second), 0)
+
+	// Without a previous window, the request has to wait for the next window
+	expectDenied(t, l, at(30*time.Second), 30*time.Second)
+}
+
+func TestTokenBucketRefillAndBurst(t *testing.T) {
+	// 10 requests per 10s refill one token per second, into a bucket of 5
+	l := NewLimiter(AlgorithmTokenBucket, 10, 10*time.Second, 5)
+
+	// A full bucket admits a burst of its size at once
+	for i := 4; i >= 0; i-- {
+		result := expectAllowed(t, l, at(0), i)
+		if result.Limit != 5 {
+			t.Fatalf("limit = %d, want the bucket size", result.Limit)
+		}
+	}
+	result := expectDenied(t, l, at(0), time.Second)
+	if want := at(time.Second); !result.Reset.Equal(want) {
+		t.Fatalf("reset = %v, want when the next token is available", result.Reset.Sub(base))
+	}
+
+	// 2.5s refill 2.5 tokens
+	expectAllowed(t, l, at(2500*time.Millisecond), 1)
+	result = expectAllowed(t, l, at(2500*time.Millisecond), 0)
+	if want := at(7 * time.Second); !result.Reset.Equal(want) {
+		t.Fatalf("reset = %v, want when the bucket is full again", result.Reset.Sub(base))
+	}
+	expectDenied(t, l, at(2500*time.Millisecond), 500*time.Millisecond)
+
+	// An idle bucket refills only up to its size
+	for i := 4; i >= 0; i-- {
+		expectAllowed(t, l, at(time.Hour), i)
+	}
+	expectDenied(t, l, at(time.Hour), time.Second)
+}
+
+func TestTokenBucketDefaultsBurstToLimit(t *testing.T) {
+	l := NewLimiter(AlgorithmTokenBucket, 10, time.Minute, 0)
+
+	for i := 9; i >= 0; i-- {
+		expectAllowed(t, l, at(0), i)
+	}
+	expectDenied(t, l, at(0), 6*time.Second)
+}
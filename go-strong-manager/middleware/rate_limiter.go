@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/hostmatch"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -18,43 +19,53 @@ type DNSRateLimitConfig struct {
 	Enabled     bool
 	Quota       int
 	PeriodSecs  int
+	Algorithm   string
+	Burst       int
 	LastUpdated time.Time
 }
 
+// sameLimits reports whether two configurations produce an identical limiter
+func (c *DNSRateLimitConfig) sameLimits(other *DNSRateLimitConfig) bool {
+	return c.Quota == other.Quota &&
+		c.PeriodSecs == other.PeriodSecs &&
+		c.Algorithm == other.Algorithm &&
+		c.Burst == other.Burst
+}
+
 // RateLimiter defines the configuration for the rate limiter middleware
 type RateLimiter struct {
-	// Maps IP addresses to their request counts
-	ipMap     map[string]*IPLimit
-	ipMapLock sync.RWMutex
-
-	// Maps hostnames to their rate limit configuration
-	dnsConfigMap     map[string]*DNSRateLimitConfig
+	// Maps normalized DNS rule hostnames to their rate limit configuration
+	dnsConfigMap map[string]*DNSRateLimitConfig
+	// Maps normalized DNS rule hostnames to the limiter tracking their per-IP quotas
+	limiters         map[string]Limiter
 	dnsConfigMapLock sync.RWMutex
 
+	// Limiter used for hostnames without a DNS rule, keyed by IP and hostname
+	defaultLimiter Limiter
+
 	// Default values
 	defaultMaxRequests int
 	defaultInterval    time.Duration
 }
 
-// IPLimit represents the limit for a specific IP
-type IPLimit struct {
-	count      int                   // Current request count
-	lastSeen   time.Time             // Last request time
-	hostCounts map[string]*HostCount // Per-hostname counts
-}
-
-// HostCount tracks requests for a specific host
-type HostCount struct {
-	count    int
-	lastSeen time.Time
+// RateLimitResult describes the outcome of a rate limit check
+type RateLimitResult struct {
+	Allowed    bool          // Whether the request may proceed
+	Limited    bool          // Whether a rate limit applies to this hostname at all
+	Hostname   string        // Hostname of the DNS rule whose limit applies, if any
+	Limit      int           // Maximum requests per interval
+	Remaining  int           // Requests left in the current interval
+	Reset      time.Time     // When the quota is fully available again
+	RetryAfter time.Duration // How long the client should wait when throttled
 }
 
 // NewRateLimiter creates a new rate limiter middleware
 func NewRateLimiter(defaultMaxRequests int, defaultInterval time.Duration) *RateLimiter {
 	// Create new rate limiter instance
 	rl := &RateLimiter{
-		ipMap:              make(map[string]*IPLimit),
 		dnsConfigMap:       make(map[string]*DNSRateLimitConfig),
+		limiters:           make(map[string]Limiter),
+		defaultLimiter:     NewLimiter(AlgorithmFixedWindow, defaultMaxRequests, defaultInterval, 0),
 		defaultMaxRequests: defaultMaxRequests,
 		defaultInterval:    defaultInterval,
 	}
@@ -87,12 +98,14 @@ func (rl *RateLimiter) refreshDNSConfigs() {
 // loadDNSConfigs loads DNS rate limit configurations from the database
 func (rl *RateLimiter) loadDNSConfigs() {
 	rows, err := database.DB.Query(`
-		SELECT 
-			hostname, 
-			rate_limit_enabled, 
-			rate_limit_quota, 
-			rate_limit_period 
-		FROM 
+		SELECT
+			hostname,
+			rate_limit_enabled,
+			rate_limit_quota,
+			rate_limit_period,
+			rate_limit_algorithm,
+			rate_limit_burst
+		FROM
 			dns_rules
 	`)
 	if err != nil {
@@ -105,7 +118,7 @@ func (rl *RateLimiter) loadDNSConfigs() {
 
 	for rows.Next() {
 		var config DNSRateLimitConfig
-		if err := rows.Scan(&config.Hostname, &config.Enabled, &config.Quota, &config.PeriodSecs); err != nil {
+		if err := rows.Scan(&config.Hostname, &config.Enabled, &config.Quota, &config.PeriodSecs, &config.Algorithm, &config.Burst); err != nil {
 			log.Printf("Error scanning DNS rate limit config: %v", err)
 			continue
 		}
@@ -117,14 +130,41 @@ func (rl *RateLimiter) loadDNSConfigs() {
 		if config.PeriodSecs <= 0 {
 			config.PeriodSecs = int(rl.defaultInterval.Seconds())
 		}
+		if !IsValidAlgorithm(config.Algorithm) {
+			config.Algorithm = AlgorithmFixedWindow
+		}
+
+		// Key by the normalized hostname so requests match the same rule as in the proxy
+		pattern, err := hostmatch.NormalizePattern(config.Hostname)
+		if err != nil {
+			log.Printf("Skipping rate limit config for %s: %v", config.Hostname, err)
+			continue
+		}
+		if _, exists := newConfigs[pattern]; exists {
+			continue
+		}
 
 		config.LastUpdated = time.Now()
-		newConfigs[config.Hostname] = &config
+		newConfigs[pattern] = &config
 	}
 
-	// Update the DNS config map
+	// Update the DNS config map, keeping limiter state for unchanged configurations
 	rl.dnsConfigMapLock.Lock()
+	newLimiters := make(map[string]Limiter)
+	for hostname, config := range newConfigs {
+		if !config.Enabled {
+			continue
+		}
+		if old, exists := rl.dnsConfigMap[hostname]; exists && old.Enabled && old.sameLimits(config) {
+			if limiter, ok := rl.limiters[hostname]; ok {
+				newLimiters[hostname] = limiter
+				continue
+			}
+		}
+		newLimiters[hostname] = NewLimiter(config.Algorithm, config.Quota, time.Duration(config.PeriodSecs)*time.Second, config.Burst)
+	}
 	rl.dnsConfigMap = newConfigs
+	rl.limiters = newLimiters
 	rl.dnsConfigMapLock.Unlock()
 
 	log.Printf("Loaded %d DNS rate limit configurations", len(newConfigs))
@@ -148,99 +188,55 @@ func RefreshRateLimiterConfigs() {
 	}
 }
 
-// RateLimiterMiddleware limits the number of requests from an IP address based on DNS rules
-func (rl *RateLimiter) RateLimiterMiddleware() fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		// Skip rate limiting for admin API routes
-		if c.Path() != "/" && len(c.Path()) >= 6 && c.Path()[:6] == "/admin" {
-			return c.Next()
-		}
-
-		// Get client IP
-		ip := c.IP()
-
-		// Get the requested hostname
-		hostname := c.Hostname()
-
-		// Check if there is a DNS-specific rate limit configuration
-		rl.dnsConfigMapLock.RLock()
-		config, exists := rl.dnsConfigMap[hostname]
-		rl.dnsConfigMapLock.RUnlock()
-
-		// Use default values if no specific config exists or rate limiting is disabled
-		maxRequests := rl.defaultMaxRequests
-		interval := rl.defaultInterval
-
-		// If a config exists and rate limiting is enabled, use its values
-		if exists && config.Enabled {
-			maxRequests = config.Quota
-			interval = time.Duration(config.PeriodSecs) * time.Second
-		} else if exists && !config.Enabled {
-			// If there's a config but rate limiting is disabled, skip limiting
-			return c.Next()
+// Allow records a request from the given IP for the given hostname and reports
+// whether it is within the quota of the DNS rule matching the hostname
+func (rl *RateLimiter) Allow(ip, hostname string) RateLimitResult {
+	// Check if there is a DNS-specific rate limit configuration, most specific rule first
+	var config *DNSRateLimitConfig
+	var limiter Limiter
+	exists := false
+	rl.dnsConfigMapLock.RLock()
+	for _, pattern := range hostmatch.Candidates(hostname) {
+		if config, exists = rl.dnsConfigMap[pattern]; exists {
+			limiter = rl.limiters[pattern]
+			break
 		}
+	}
+	rl.dnsConfigMapLock.RUnlock()
 
-		// Check if IP is rate limited
-		rl.ipMapLock.Lock()
-		limit, exists := rl.ipMap[ip]
-
-		// If IP not in map, create new limit
-		now := time.Now()
-		if !exists {
-			limit = &IPLimit{
-				count:      1,
-				lastSeen:   now,
-				hostCounts: make(map[string]*HostCount),
-			}
-
-			// Initialize host count
-			limit.hostCounts[hostname] = &HostCount{
-				count:    1,
-				lastSeen: now,
-			}
-
-			rl.ipMap[ip] = limit
-			rl.ipMapLock.Unlock()
-			return c.Next()
-		}
+	// If there's a config but rate limiting is disabled, skip limiting
+	if exists && !config.Enabled {
+		return RateLimitResult{Allowed: true}
+	}
 
-		// Update the global count for this IP
-		limit.count++
-		limit.lastSeen = now
+	// Use default values if no specific config exists
+	if !exists || limiter == nil {
+		return rl.defaultLimiter.Allow(ip+"|"+hostmatch.Normalize(hostname), time.Now())
+	}
 
-		// Check or create host-specific count
-		hostCount, hostExists := limit.hostCounts[hostname]
-		if !hostExists {
-			hostCount = &HostCount{
-				count:    1,
-				lastSeen: now,
-			}
-			limit.hostCounts[hostname] = hostCount
-			rl.ipMapLock.Unlock()
-			return c.Next()
-		}
+	result := limiter.Allow(ip, time.Now())
+	result.Hostname = config.Hostname
+	return result
+}
 
-		// Check if we should reset the counter (new interval)
-		if now.Sub(hostCount.lastSeen) > interval {
-			hostCount.count = 1
-			hostCount.lastSeen = now
-			rl.ipMapLock.Unlock()
+// RateLimiterMiddleware limits the number of requests from an IP address based on DNS rules
+func (rl *RateLimiter) RateLimiterMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		// Skip rate limiting for admin API routes
+		if c.Path() != "/" && len(c.Path()) >= 6 && c.Path()[:6] == "/admin" {
 			return c.Next()
 		}
 
-		// Increment host-specific counter and check if limit exceeded
-		hostCount.count++
-		hostCount.lastSeen = now
+		// Check the client IP against the requested hostname's quota
+		result := rl.Allow(c.IP(), c.Hostname())
 
 		// If limit exceeded, return error
-		if hostCount.count > maxRequests {
-			rl.ipMapLock.Unlock()
+		if !result.Allowed {
 			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
 				"error": "Rate limit exceeded for this hostname. Please try again later.",
 			})
 		}
 
-		rl.ipMapLock.Unlock()
 		return c.Next()
 	}
 }
@@ -251,34 +247,19 @@ func (rl *RateLimiter) cleanup() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		rl.ipMapLock.Lock()
 		now := time.Now()
 
-		// Remove IPs that haven't been seen in a while
-		for ip, limit := range rl.ipMap {
-			if now.Sub(limit.lastSeen) > 3*rl.defaultInterval {
-				delete(rl.ipMap, ip)
-				continue
-			}
-
-			// Also clean up per-host counters
-			for hostname, hostCount := range limit.hostCounts {
-				// Get the interval for this hostname
-				interval := rl.defaultInterval
-
-				rl.dnsConfigMapLock.RLock()
-				if config, exists := rl.dnsConfigMap[hostname]; exists && config.Enabled {
-					interval = time.Duration(config.PeriodSecs) * time.Second
-				}
-				rl.dnsConfigMapLock.RUnlock()
-
-				// Remove host counts that haven't been seen in a while
-				if now.Sub(hostCount.lastSeen) > 3*interval {
-					delete(limit.hostCounts, hostname)
-				}
-			}
+		rl.dnsConfigMapLock.RLock()
+		limiters := make([]Limiter, 0, len(rl.limiters)+1)
+		for _, limiter := range rl.limiters {
+			limiters = append(limiters, limiter)
 		}
+		rl.dnsConfigMapLock.RUnlock()
+		limiters = append(limiters, rl.defaultLimiter)
 
-		rl.ipMapLock.Unlock()
+		// Each limiter removes IPs that haven't been seen in a while
+		for _, limiter := range limiters {
+			limiter.Cleanup(now)
+		}
 	}
 }
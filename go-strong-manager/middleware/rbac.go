@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"github.com/arifur/strong-reverse-proxy/models"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Resource is a group of admin API endpoints sharing the same permissions
+type Resource string
+
+const (
+	ResourceConfig   Resource = "config"   // DNS rules, backends, certificates, filter rules and alerts
+	ResourceMetrics  Resource = "metrics"  // Traffic metrics, request and filter logs, circuit breakers
+	ResourceUsers    Resource = "users"    // Admin API users
+	ResourceDatabase Resource = "database" // Backups, restores and resets
+)
+
+// Access is the level of access a role has to a resource
+type Access int
+
+const (
+	AccessNone  Access = iota
+	AccessRead         // GET and HEAD requests
+	AccessWrite        // Every request, including changes
+)
+
+// rolePermissions is the permission matrix of the admin API. Roles missing from the
+// matrix, and resources missing from a role, have no access.
+var rolePermissions = map[string]map[Resource]Access{
+	models.RoleAdmin: {
+		ResourceConfig:   AccessWrite,
+		ResourceMetrics:  AccessWrite,
+		ResourceUsers:    AccessWrite,
+		ResourceDatabase: AccessWrite,
+	},
+	models.RoleOperator: {
+		ResourceConfig:  AccessWrite,
+		ResourceMetrics: AccessWrite,
+	},
+	models.RoleViewer: {
+		ResourceConfig:  AccessRead,
+		ResourceMetrics: AccessRead,
+	},
+}
+
+// Allowed reports whether a role has at least the given access to a resource
+func Allowed(role string, resource Resource, access Access) bool {
+	return rolePermissions[role][resource] >= access
+}
+
+// Authorize returns a middleware that only lets users whose role may access the resource
+// through. Reading requires read access and any other method write access. It must run
+// after JWTMiddleware, which stores the role of the user.
+func Authorize(resource Resource) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		role, _ := c.Locals("userRole").(string)
+
+		access := AccessWrite
+		if c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead {
+			access = AccessRead
+		}
+
+		if !Allowed(role, resource, access) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Your role does not allow this action",
+			})
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		role     string
+		resource Resource
+		read     bool
+		write    bool
+	}{
+		{models.RoleAdmin, ResourceConfig, true, true},
+		{models.RoleAdmin, ResourceMetrics, true, true},
+		{models.RoleAdmin, ResourceUsers, true, true},
+		{models.RoleAdmin, ResourceDatabase, true, true},
+
+		{models.RoleOperator, ResourceConfig, true, true},
+		{models.RoleOperator, ResourceMetrics, true, true},
+		{models.RoleOperator, ResourceUsers, false, false},
+		{models.RoleOperator, ResourceDatabase, false, false},
+
+		{models.RoleViewer, ResourceConfig, true, false},
+		{models.RoleViewer, ResourceMetrics, true, false},
+		{models.RoleViewer, ResourceUsers, false, false},
+		{models.RoleViewer, ResourceDatabase, false, false},
+
+		// Unknown roles and resources have no access
+		{"", ResourceConfig, false, false},
+		{"superuser", ResourceMetrics, false, false},
+		{models.RoleAdmin, Resource("backups"), false, false},
+	}
+
+	for _, tt := range tests {
+		if got := Allowed(tt.role, tt.resource, AccessNone); !got {
+			t.Errorf("Allowed(%q, %s, none) = false, want true", tt.role, tt.resource)
+		}
+		if got := Allowed(tt.role, tt.resource, AccessRead); got != tt.read {
+			t.Errorf("Allowed(%q, %s, read) = %v, want %v", tt.role, tt.resource, got, tt.read)
+		}
+		if got := Allowed(tt.role, tt.resource, AccessWrite); got != tt.write {
+			t.Errorf("Allowed(%q, %s, write) = %v, want %v", tt.role, tt.resource, got, tt.write)
+		}
+	}
+}
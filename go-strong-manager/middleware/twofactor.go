@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/arifur/strong-reverse-proxy/twofactor"
+	"github.com/gofiber/fiber/v2"
+)
+
+// twoFactorSetupPath holds the endpoints where users enrol in two-factor authentication,
+// the only ones open to users who must enrol first
+const twoFactorSetupPath = "/admin/api/account/two-factor"
+
+// RequireTwoFactor blocks users who are not enrolled in two-factor authentication while
+// it is required for all users, except from enrolling. It must run after JWTMiddleware,
+// which stores the ID of the user.
+func RequireTwoFactor(c *fiber.Ctx) error {
+	if !twofactor.Required() || strings.HasPrefix(c.Path(), twoFactorSetupPath) {
+		return c.Next()
+	}
+
+	userID, _ := c.Locals("userID").(float64)
+	enabled, err := twofactor.Enabled(int(userID))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if !enabled {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error":                     "Two-factor authentication must be set up first",
+			"two_factor_setup_required": true,
+		})
+	}
+	return c.Next()
+}
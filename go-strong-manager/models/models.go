@@ -8,12 +8,29 @@ type User struct {
 	Email        string `json:"email"`
 	PasswordHash string `json:"-"`
 	Role         string `json:"role"`
+	// Whether the user logs in with a TOTP code besides their password
+	TwoFactorEnabled bool `json:"two_factor_enabled"`
+}
+
+// User roles, from most to least privileged
+const (
+	RoleAdmin    = "admin"    // Full access, including users and the database
+	RoleOperator = "operator" // Manages proxy configuration and logs
+	RoleViewer   = "viewer"   // Read-only access to configuration, metrics and logs
+)
+
+// ValidRole reports whether a role is one of the defined roles
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleOperator || role == RoleViewer
 }
 
 // LoginRequest represents the login request payload
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Second factor of users enrolled in two-factor authentication
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
 }
 
 // LoginResponse represents the login response payload
@@ -22,13 +39,66 @@ type LoginResponse struct {
 	RefreshToken string `json:"refreshToken"`
 }
 
+// TwoFactorStatus represents the two-factor enrolment of a user
+type TwoFactorStatus struct {
+	Enabled                bool `json:"enabled"`
+	Required               bool `json:"required"` // Whether every user must enrol
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// TwoFactorSetup represents a pending TOTP secret, to be added to an authenticator app
+type TwoFactorSetup struct {
+	Secret     string `json:"secret"`      // Base32 secret, for manual entry
+	OtpauthURI string `json:"otpauth_uri"` // otpauth:// URI, usually shown as a QR code
+}
+
+// TwoFactorRequest represents a second factor: a TOTP code or a recovery code
+type TwoFactorRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// SecuritySettings represents the security policies of the admin API
+type SecuritySettings struct {
+	RequireTwoFactor bool `json:"require_two_factor"` // Every user must enrol in two-factor authentication
+}
+
+// RefreshRequest represents the refresh and logout request payload
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// Session represents a login of a user, kept alive by refreshing its tokens
+type Session struct {
+	ID         string    `json:"id"`
+	UserID     int       `json:"user_id"`
+	ClientIP   string    `json:"client_ip"`  // Address the user logged in from
+	UserAgent  string    `json:"user_agent"` // Browser or client the user logged in with
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"` // Last request or refresh, updated at most once a minute
+	ExpiresAt  time.Time `json:"expires_at"`   // When the session ends unless it is refreshed
+	Current    bool      `json:"current"`      // Whether the session made the request listing it
+}
+
 // Backend represents a backend server
 type Backend struct {
-	ID       int     `json:"id"`
-	URL      string  `json:"url"`
-	Weight   int     `json:"weight"`
-	IsActive bool    `json:"isActive"`
-	Ratio    float64 `json:"-"` // For weighted distribution calculation
+	ID       int    `json:"id"`
+	URL      string `json:"url"`
+	Weight   int    `json:"weight"`
+	IsActive bool   `json:"isActive"`
+	// Connection settings of the backend, only loaded by the backend endpoints
+	Transport *BackendTransport `json:"transport,omitempty"`
+}
+
+// BackendTransport holds the connection settings of a backend. Unset (null) settings use
+// the PROXY_* environment defaults.
+type BackendTransport struct {
+	MaxIdleConnsPerHost     *int    `json:"max_idle_conns_per_host"`    // Idle connections kept to the backend
+	DialTimeoutMS           *int    `json:"dial_timeout_ms"`            // Time to establish a connection
+	TLSHandshakeTimeoutMS   *int    `json:"tls_handshake_timeout_ms"`   // Time for the TLS handshake
+	ResponseHeaderTimeoutMS *int    `json:"response_header_timeout_ms"` // Time to wait for response headers, 0 = no limit
+	IdleConnTimeoutMS       *int    `json:"idle_conn_timeout_ms"`       // Time an idle connection is kept open
+	HTTP2                   *string `json:"http2"`                      // auto, off or h2c
 }
 
 // DNSRule represents a DNS rule for proxy routing
@@ -40,10 +110,106 @@ type DNSRule struct {
 	RateLimitEnabled bool `json:"rate_limit_enabled"`
 	RateLimitQuota   int  `json:"rate_limit_quota"`  // Requests per interval
 	RateLimitPeriod  int  `json:"rate_limit_period"` // Period in seconds
+	// Algorithm used to enforce the quota: fixed_window, sliding_log, sliding_window or token_bucket
+	RateLimitAlgorithm string `json:"rate_limit_algorithm"`
+	RateLimitBurst     int    `json:"rate_limit_burst"` // Token bucket size, 0 = same as quota
 	// Log retention settings
 	LogRetentionDays int `json:"log_retention_days"` // Number of days to keep logs, 0 = use default
 	// Health check settings
-	HealthCheckEnabled bool `json:"health_check_enabled"` // Whether to enable health checks
+	HealthCheckEnabled           bool              `json:"health_check_enabled"`             // Whether to enable health checks
+	HealthCheckPath              string            `json:"health_check_path"`                // Path requested on each backend, e.g. /healthz
+	HealthCheckMethod            string            `json:"health_check_method"`              // HTTP method used for the check
+	HealthCheckHeaders           map[string]string `json:"health_check_headers"`             // Extra request headers sent with the check
+	HealthCheckExpectedStatusMin int               `json:"health_check_expected_status_min"` // Lowest status code considered healthy
+	HealthCheckExpectedStatusMax int               `json:"health_check_expected_status_max"` // Highest status code considered healthy
+	HealthCheckBodyMatch         string            `json:"health_check_body_match"`          // Substring (or regex) the response body must contain, empty = any
+	HealthCheckBodyRegex         bool              `json:"health_check_body_regex"`          // Treat HealthCheckBodyMatch as a regular expression
+	HealthCheckInterval          int               `json:"health_check_interval"`            // Seconds between checks
+	HealthCheckTimeout           int               `json:"health_check_timeout"`             // Seconds before a check times out
+	HealthCheckRise              int               `json:"health_check_rise"`                // Consecutive successes to mark a backend healthy
+	HealthCheckFall              int               `json:"health_check_fall"`                // Consecutive failures to mark a backend unhealthy
+	// TLS settings
+	RedirectHTTPS bool `json:"redirect_https"` // Redirect plain HTTP requests to HTTPS when TLS is enabled
+	// Load balancing settings
+	LBAlgorithm string `json:"lb_algorithm"` // round_robin, least_connections, least_latency, random_two_choices or consistent_hash
+	LBHashKey   string `json:"lb_hash_key"`  // Consistent hash key: ip, header:<name> or cookie:<name>
+	// Session affinity settings
+	AffinityMode       string `json:"affinity_mode"`        // none, cookie, ip or header
+	AffinityHeader     string `json:"affinity_header"`      // Header hashed for header affinity
+	AffinityCookieName string `json:"affinity_cookie_name"` // Name of the signed cookie for cookie affinity
+	AffinityTTL        int    `json:"affinity_ttl"`         // Affinity cookie lifetime in seconds, 0 = browser session
+	// Retry settings
+	RetryEnabled         bool  `json:"retry_enabled"`            // Retry failed attempts on another backend
+	RetryAttempts        int   `json:"retry_attempts"`           // Attempts per request, including the first
+	RetryNonIdempotent   bool  `json:"retry_non_idempotent"`     // Also retry methods such as POST and PATCH
+	RetryOnStatus        []int `json:"retry_on_status"`          // Backend status codes that are retried
+	RetryPerTryTimeoutMS int   `json:"retry_per_try_timeout_ms"` // Milliseconds to wait for response headers per attempt, 0 = no limit
+	RetryBudget          int   `json:"retry_budget"`             // Share of requests, in percent, that may be retried
+	// Path based routes, matched in order before falling back to TargetBackendURLs
+	Routes []Route `json:"routes,omitempty"`
+	// Request and response header changes, applied in order
+	HeaderRules []HeaderRule `json:"header_rules,omitempty"`
+}
+
+// DNSRuleUpdate holds the DNS rule settings whose zero value is a valid setting, so an
+// update only changes them when they are present in the request body
+type DNSRuleUpdate struct {
+	RetryEnabled       *bool `json:"retry_enabled"`
+	RetryNonIdempotent *bool `json:"retry_non_idempotent"`
+	RedirectHTTPS      *bool `json:"redirect_https"`
+	RateLimitBurst     *int  `json:"rate_limit_burst"` // 0 resets the bucket size to the quota
+
+	HealthCheckBodyMatch *string `json:"health_check_body_match"`
+	HealthCheckBodyRegex *bool   `json:"health_check_body_regex"`
+}
+
+// RouteMatchType represents how a route's path is compared with the request path
+type RouteMatchType string
+
+const (
+	RouteMatchPrefix RouteMatchType = "prefix"
+	RouteMatchExact  RouteMatchType = "exact"
+	RouteMatchRegex  RouteMatchType = "regex"
+)
+
+// Route sends the requests of a DNS rule that match a path to its own backend pool
+type Route struct {
+	ID          int            `json:"id"`
+	DNSRuleID   int            `json:"dns_rule_id"`
+	Path        string         `json:"path"`         // Path prefix, exact path or regular expression
+	MatchType   RouteMatchType `json:"match_type"`   // prefix, exact or regex
+	Methods     []string       `json:"methods"`      // Allowed HTTP methods, empty = any
+	Priority    int            `json:"priority"`     // Higher priority routes are matched first
+	StripPrefix bool           `json:"strip_prefix"` // Remove the matched prefix before proxying
+	RewritePath string         `json:"rewrite_path"` // Replacement path; for regex routes it may reference groups like $1
+	Backends    []Backend      `json:"backends"`
+}
+
+// HeaderDirection represents whether a header rule changes requests or responses
+type HeaderDirection string
+
+const (
+	HeaderDirectionRequest  HeaderDirection = "request"  // Headers sent to the backend
+	HeaderDirectionResponse HeaderDirection = "response" // Headers returned to the client
+)
+
+// HeaderAction represents how a header rule changes a header
+type HeaderAction string
+
+const (
+	HeaderActionAdd    HeaderAction = "add"    // Add a value, keeping existing ones
+	HeaderActionSet    HeaderAction = "set"    // Replace all values
+	HeaderActionRemove HeaderAction = "remove" // Delete the header
+)
+
+// HeaderRule changes a header of the requests a DNS rule forwards, or of the responses it returns
+type HeaderRule struct {
+	ID        int             `json:"id"`
+	DNSRuleID int             `json:"dns_rule_id"`
+	Direction HeaderDirection `json:"direction"` // request or response
+	Action    HeaderAction    `json:"action"`    // add, set or remove
+	Name      string          `json:"name"`
+	Value     string          `json:"value"` // May contain placeholders such as {client_ip} and {request_id}
 }
 
 // RequestLog represents a log entry for a proxied request
@@ -59,6 +225,7 @@ type RequestLog struct {
 	IsSuccess   bool      `json:"is_success"`
 	UserAgent   string    `json:"user_agent"`
 	FilteredBy  int       `json:"filtered_by,omitempty"` // ID of filter rule that matched, 0 if not filtered
+	Attempt     int       `json:"attempt"`               // Try of the request this entry records, starting at 1
 }
 
 // HealthResponse represents the health check response
@@ -76,17 +243,56 @@ const (
 	AlertTypeWebhook AlertType = "webhook"
 )
 
+// AlertCondition represents what an alert measures
+type AlertCondition string
+
+const (
+	AlertConditionErrorCount  AlertCondition = "error_count"  // Server errors in the window >= threshold
+	AlertConditionErrorRate   AlertCondition = "error_rate"   // Percentage of server errors in the window >= threshold
+	AlertConditionLatencyP95  AlertCondition = "latency_p95"  // 95th percentile latency in ms >= threshold
+	AlertConditionBackendDown AlertCondition = "backend_down" // A backend failed its health checks
+	AlertConditionTrafficDrop AlertCondition = "traffic_drop" // Requests in the window < threshold
+	AlertConditionFilterHits  AlertCondition = "filter_hits"  // Filter rule matches in the window >= threshold
+	AlertConditionCertExpiry  AlertCondition = "cert_expiry"  // An uploaded certificate expires within threshold days
+	AlertConditionCircuitOpen AlertCondition = "circuit_open" // A backend's circuit breaker opened
+)
+
+// AlertSeverity represents how urgent an alert is
+type AlertSeverity string
+
+const (
+	AlertSeverityInfo     AlertSeverity = "info"
+	AlertSeverityWarning  AlertSeverity = "warning"
+	AlertSeverityCritical AlertSeverity = "critical"
+)
+
 // Alert represents an alert configuration
 type Alert struct {
 	ID          int       `json:"id"`
 	DNSRuleID   int       `json:"dns_rule_id"` // ID of DNS rule this alert is associated with (0 = global)
 	Type        AlertType `json:"type"`
 	Destination string    `json:"destination"` // Email address or webhook URL
-	Threshold   int       `json:"threshold"`   // Threshold to trigger alert (e.g., error count)
+	Threshold   int       `json:"threshold"`   // Threshold to trigger alert, measured in the unit of the condition
 	Enabled     bool      `json:"enabled"`
 	CreatedAt   time.Time `json:"created_at"`
+	// Evaluation settings
+	Condition     AlertCondition `json:"condition"`      // What the threshold is compared against
+	WindowSeconds int            `json:"window_seconds"` // How far back request and filter logs are inspected
+	Severity      AlertSeverity  `json:"severity"`
+	// Webhook settings
+	WebhookFormat    string `json:"webhook_format"`           // generic, slack, teams or discord
+	WebhookSecret    string `json:"webhook_secret,omitempty"` // HMAC-SHA256 signing key, never returned by the API
+	HasWebhookSecret bool   `json:"has_webhook_secret"`       // Whether requests are signed
 	// DNS rule info for UI (only populated when needed)
 	Hostname string `json:"hostname,omitempty"`
+	// Most recent events of this alert (only populated when listing alerts)
+	RecentEvents []AlertEvent `json:"recent_events,omitempty"`
+}
+
+// AlertUpdate holds the alert settings whose zero value is a valid setting, so an
+// update only changes them when they are present in the request body
+type AlertUpdate struct {
+	WebhookSecret *string `json:"webhook_secret"` // An empty secret stops signing requests
 }
 
 // AlertEvent represents an alert event
@@ -96,6 +302,45 @@ type AlertEvent struct {
 	Message   string    `json:"message"`
 	Timestamp time.Time `json:"timestamp"`
 	Sent      bool      `json:"sent"`
+	// Delivery outcome
+	DeliveryStatus   string     `json:"delivery_status"`          // pending, sent or failed
+	DeliveryAttempts int        `json:"delivery_attempts"`        // Number of delivery attempts made
+	DeliveryError    string     `json:"delivery_error,omitempty"` // Last delivery error, empty on success
+	DeliveredAt      *time.Time `json:"delivered_at,omitempty"`   // When the event was delivered
+}
+
+// AlertDelivery represents a single delivery attempt of an alert event
+type AlertDelivery struct {
+	ID         int       `json:"id"`
+	EventID    int       `json:"event_id"`
+	Attempt    int       `json:"attempt"`
+	Timestamp  time.Time `json:"timestamp"`
+	Success    bool      `json:"success"`
+	StatusCode int       `json:"status_code,omitempty"` // HTTP status returned by a webhook receiver
+	Error      string    `json:"error,omitempty"`
+	DurationMS int       `json:"duration_ms"`
+}
+
+// Alert event delivery statuses
+const (
+	DeliveryStatusPending = "pending"
+	DeliveryStatusSent    = "sent"
+	DeliveryStatusFailed  = "failed"
+)
+
+// Certificate represents an uploaded TLS certificate bound to DNS rule hostnames
+type Certificate struct {
+	ID            int       `json:"id"`
+	Name          string    `json:"name"`
+	CertPEM       string    `json:"cert_pem,omitempty"` // Certificate chain in PEM format, leaf first
+	KeyPEM        string    `json:"key_pem,omitempty"`  // Private key in PEM format, never returned by the API
+	Hostnames     []string  `json:"hostnames"`          // Hostnames served with this certificate, may include wildcards
+	SANs          []string  `json:"sans"`               // DNS names and IP addresses the certificate is valid for
+	Issuer        string    `json:"issuer"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	DaysRemaining int       `json:"days_remaining"`
+	CreatedAt     time.Time `json:"created_at"`
 }
 
 // FilterMatchType represents the type of filter match
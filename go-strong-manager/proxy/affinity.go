@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// Session affinity modes
+const (
+	AffinityNone   = "none"   // Every request is balanced independently
+	AffinityCookie = "cookie" // A signed cookie pins the client to the backend that served it first
+	AffinityIP     = "ip"     // Clients are hashed to a backend by IP
+	AffinityHeader = "header" // Clients are hashed to a backend by the value of a header
+)
+
+// DefaultAffinityCookie is the name of the affinity cookie when a DNS rule does not set one
+const DefaultAffinityCookie = "sm_affinity"
+
+// Key used to sign affinity cookies
+var affinitySecret []byte
+
+// configureAffinity loads the affinity cookie signing key from the environment.
+// Without AFFINITY_SECRET a random key is used, so clients are pinned again after a restart.
+func configureAffinity() {
+	if secret := os.Getenv("AFFINITY_SECRET"); secret != "" {
+		affinitySecret = []byte(secret)
+		return
+	}
+
+	affinitySecret = make([]byte, 32)
+	if _, err := rand.Read(affinitySecret); err != nil {
+		panic(fmt.Sprintf("failed to generate affinity secret: %v", err))
+	}
+	fmt.Println("Warning: AFFINITY_SECRET not set, affinity cookies will not survive a restart")
+}
+
+// IsValidAffinityMode reports whether the session affinity mode is supported
+func IsValidAffinityMode(mode string) bool {
+	switch mode {
+	case AffinityNone, AffinityCookie, AffinityIP, AffinityHeader:
+		return true
+	}
+	return false
+}
+
+// ValidateAffinity checks the session affinity settings of a DNS rule
+func ValidateAffinity(rule models.DNSRule) error {
+	if !IsValidAffinityMode(rule.AffinityMode) {
+		return fmt.Errorf("affinity mode must be 'none', 'cookie', 'ip' or 'header'")
+	}
+	if rule.AffinityMode == AffinityHeader && rule.AffinityHeader == "" {
+		return fmt.Errorf("affinity header is required for header affinity")
+	}
+	if rule.AffinityMode == AffinityCookie && !isValidCookieName(rule.AffinityCookieName) {
+		return fmt.Errorf("invalid affinity cookie name %q", rule.AffinityCookieName)
+	}
+	if rule.AffinityTTL < 0 {
+		return fmt.Errorf("affinity TTL must not be negative")
+	}
+	return nil
+}
+
+// isValidCookieName reports whether a cookie name only contains token characters
+func isValidCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("()<>@,;:\\\"/[]?={}", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleBalancer creates the balancer of a DNS rule's backend pool. IP and header affinity
+// hash clients onto the pool, so a client only moves when its backend becomes unavailable.
+func ruleBalancer(rule *models.DNSRule) Balancer {
+	switch rule.AffinityMode {
+	case AffinityIP:
+		return &consistentHashBalancer{hashKey: HashKeyIP}
+	case AffinityHeader:
+		return &consistentHashBalancer{hashKey: HashKeyHeaderPrefix + rule.AffinityHeader}
+	default:
+		return newBalancer(rule.LBAlgorithm, rule.LBHashKey)
+	}
+}
+
+// selectSticky picks the backend for a request with cookie affinity. The backend named
+// by a valid affinity cookie is used while it is available and not skipped; otherwise
+// the balancer picks one and the cookie is (re)issued. The pool names the backend pool,
+// so routes with their own backends get their own cookie.
+func selectSticky(w http.ResponseWriter, r *http.Request, rule *models.DNSRule, pool string, backends []models.Backend, skip map[int]bool, balancer Balancer) *models.Backend {
+	cookieName := rule.AffinityCookieName
+	if cookieName == "" {
+		cookieName = DefaultAffinityCookie
+	}
+	if pool != "" {
+		cookieName += "_" + pool
+	}
+
+	if cookie, err := r.Cookie(cookieName); err == nil {
+		if backendID, ok := verifyAffinity(cookieName, cookie.Value); ok {
+			for i := range backends {
+				if backends[i].ID == backendID && !skip[backendID] {
+					return &backends[i]
+				}
+			}
+		}
+	}
+
+	// No valid cookie, or its backend is inactive or unhealthy: pin the client to a new one
+	backend := balancer.Select(backends, skip, r)
+	cookie := &http.Cookie{
+		Name:     cookieName,
+		Value:    signAffinity(cookieName, backend.ID),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if rule.AffinityTTL > 0 {
+		cookie.MaxAge = rule.AffinityTTL
+	}
+	http.SetCookie(w, cookie)
+	return backend
+}
+
+// signAffinity returns the cookie value naming a backend: its ID and a signature
+// binding the ID to the cookie name
+func signAffinity(cookieName string, backendID int) string {
+	id := strconv.Itoa(backendID)
+	return id + "." + affinitySignature(cookieName, id)
+}
+
+// verifyAffinity returns the backend ID of a correctly signed cookie value
+func verifyAffinity(cookieName, value string) (int, bool) {
+	id, signature, found := strings.Cut(value, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(affinitySignature(cookieName, id))) {
+		return 0, false
+	}
+	backendID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, false
+	}
+	return backendID, true
+}
+
+// affinitySignature signs a backend ID for a cookie name
+func affinitySignature(cookieName, id string) string {
+	mac := hmac.New(sha256.New, affinitySecret)
+	mac.Write([]byte(cookieName + "|" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
@@ -0,0 +1,399 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/filter"
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// Load balancing algorithms
+const (
+	LBRoundRobin       = "round_robin"        // Smooth weighted round-robin
+	LBLeastConnections = "least_connections"  // Fewest in-flight requests relative to weight
+	LBLeastLatency     = "least_latency"      // Lowest latency EWMA, scaled by in-flight requests and weight
+	LBRandomTwoChoices = "random_two_choices" // Two weighted random picks, the less loaded one wins
+	LBConsistentHash   = "consistent_hash"    // Hash ring on the client IP, a header or a cookie
+)
+
+// Consistent hash key sources
+const (
+	HashKeyIP           = "ip"
+	HashKeyHeaderPrefix = "header:"
+	HashKeyCookiePrefix = "cookie:"
+)
+
+const (
+	// Weight of a new latency sample in the EWMA
+	latencyEWMAAlpha = 0.3
+	// Points on the hash ring per unit of backend weight
+	hashRingReplicas = 100
+)
+
+// Balancer picks the backend that serves a request
+type Balancer interface {
+	// Select returns one of the given backends whose ID is not in skip, such as the
+	// backends a retried request already tried. At least one backend must be left. The
+	// backends are the whole pool, so state kept per backend survives the skipped ones.
+	Select(backends []models.Backend, skip map[int]bool, r *http.Request) *models.Backend
+}
+
+// IsValidLBAlgorithm reports whether the load balancing algorithm is supported
+func IsValidLBAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case LBRoundRobin, LBLeastConnections, LBLeastLatency, LBRandomTwoChoices, LBConsistentHash:
+		return true
+	}
+	return false
+}
+
+// ValidateHashKey checks a consistent hash key: ip, header:<name> or cookie:<name>
+func ValidateHashKey(key string) error {
+	switch {
+	case key == "" || key == HashKeyIP:
+		return nil
+	case strings.HasPrefix(key, HashKeyHeaderPrefix) && len(key) > len(HashKeyHeaderPrefix):
+		return nil
+	case strings.HasPrefix(key, HashKeyCookiePrefix) && len(key) > len(HashKeyCookiePrefix):
+		return nil
+	}
+	return fmt.Errorf("hash key must be 'ip', 'header:<name>' or 'cookie:<name>'")
+}
+
+// newBalancer creates the balancer for a backend pool. Unknown algorithms fall back to round-robin.
+func newBalancer(algorithm, hashKey string) Balancer {
+	switch algorithm {
+	case LBLeastConnections:
+		return leastConnectionsBalancer{}
+	case LBLeastLatency:
+		return leastLatencyBalancer{}
+	case LBRandomTwoChoices:
+		return randomTwoChoicesBalancer{}
+	case LBConsistentHash:
+		return &consistentHashBalancer{hashKey: hashKey}
+	default:
+		return &roundRobinBalancer{current: make(map[string]int)}
+	}
+}
+
+// weightOf returns the weight of a backend, treating unset weights as 1
+func weightOf(backend models.Backend) int {
+	if backend.Weight <= 0 {
+		return 1
+	}
+	return backend.Weight
+}
+
+// roundRobinBalancer implements smooth weighted round-robin: every pick adds each
+// backend's weight to its current value, and the highest one wins and is reduced by
+// the total weight. Backends receive traffic in proportion to their weight, evenly spread.
+// Skipped backends sit the pick out, keeping their current value.
+type roundRobinBalancer struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+func (b *roundRobinBalancer) Select(backends []models.Backend, skip map[int]bool, _ *http.Request) *models.Backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := 0
+	best := -1
+	for i := range backends {
+		if skip[backends[i].ID] {
+			continue
+		}
+		weight := weightOf(backends[i])
+		total += weight
+		b.current[backends[i].URL] += weight
+		if best < 0 || b.current[backends[i].URL] > b.current[backends[best].URL] {
+			best = i
+		}
+	}
+	b.current[backends[best].URL] -= total
+
+	// Forget backends that left the pool so the state stays bounded
+	if len(b.current) > len(backends) {
+		inPool := make(map[string]bool, len(backends))
+		for _, backend := range backends {
+			inPool[backend.URL] = true
+		}
+		for url := range b.current {
+			if !inPool[url] {
+				delete(b.current, url)
+			}
+		}
+	}
+
+	return &backends[best]
+}
+
+// leastConnectionsBalancer picks the backend with the fewest in-flight requests per unit of weight
+type leastConnectionsBalancer struct{}
+
+func (leastConnectionsBalancer) Select(backends []models.Backend, skip map[int]bool, _ *http.Request) *models.Backend {
+	return pickLowest(backends, skip, func(backend models.Backend) float64 {
+		return float64(loads.get(backend.URL).active.Load()) / float64(weightOf(backend))
+	})
+}
+
+// leastLatencyBalancer picks the backend with the lowest latency EWMA, multiplied by its
+// in-flight requests plus one so a fast backend is not flooded. Backends without samples
+// score zero and are tried first.
+type leastLatencyBalancer struct{}
+
+func (leastLatencyBalancer) Select(backends []models.Backend, skip map[int]bool, _ *http.Request) *models.Backend {
+	return pickLowest(backends, skip, func(backend models.Backend) float64 {
+		load := loads.get(backend.URL)
+		return load.latency() * float64(load.active.Load()+1) / float64(weightOf(backend))
+	})
+}
+
+// pickLowest returns the backend with the lowest score that is not skipped, choosing
+// among ties in proportion to their weight
+func pickLowest(backends []models.Backend, skip map[int]bool, score func(models.Backend) float64) *models.Backend {
+	best := -1
+	var bestScore float64
+	tiedWeight := 0
+	for i := range backends {
+		if skip[backends[i].ID] {
+			continue
+		}
+		s := score(backends[i])
+		switch {
+		case best < 0 || s < bestScore:
+			best, bestScore, tiedWeight = i, s, weightOf(backends[i])
+		case s == bestScore:
+			// Weighted reservoir sampling over the tied backends
+			tiedWeight += weightOf(backends[i])
+			if rand.IntN(tiedWeight) < weightOf(backends[i]) {
+				best = i
+			}
+		}
+	}
+	return &backends[best]
+}
+
+// randomTwoChoicesBalancer picks two distinct backends at random, in proportion to their
+// weight, and sends the request to the one with fewer in-flight requests per unit of weight
+type randomTwoChoicesBalancer struct{}
+
+func (randomTwoChoicesBalancer) Select(backends []models.Backend, skip map[int]bool, _ *http.Request) *models.Backend {
+	first := weightedRandom(backends, skip, -1)
+	second := weightedRandom(backends, skip, first)
+	if second < 0 {
+		return &backends[first]
+	}
+
+	firstLoad := float64(loads.get(backends[first].URL).active.Load()) / float64(weightOf(backends[first]))
+	secondLoad := float64(loads.get(backends[second].URL).active.Load()) / float64(weightOf(backends[second]))
+	if secondLoad < firstLoad {
+		return &backends[second]
+	}
+	return &backends[first]
+}
+
+// weightedRandom returns the index of a backend picked in proportion to its weight,
+// never returning the excluded index or a skipped backend. It returns -1 when none is left.
+func weightedRandom(backends []models.Backend, skip map[int]bool, exclude int) int {
+	total := 0
+	for i, backend := range backends {
+		if i != exclude && !skip[backend.ID] {
+			total += weightOf(backend)
+		}
+	}
+	if total == 0 {
+		return -1
+	}
+
+	n := rand.IntN(total)
+	last := -1
+	for i, backend := range backends {
+		if i == exclude || skip[backend.ID] {
+			continue
+		}
+		last = i
+		n -= weightOf(backend)
+		if n < 0 {
+			return i
+		}
+	}
+	return last
+}
+
+// consistentHashBalancer maps requests to backends on a hash ring, so the same client
+// keeps reaching the same backend and only the clients of a removed backend move
+type consistentHashBalancer struct {
+	hashKey string
+
+	mu        sync.Mutex
+	ring      []ringPoint
+	signature string // Backends and weights the ring was built for
+}
+
+// ringPoint is a position on the hash ring owned by a backend
+type ringPoint struct {
+	hash    uint64
+	backend string
+}
+
+func (b *consistentHashBalancer) Select(backends []models.Backend, skip map[int]bool, r *http.Request) *models.Backend {
+	if len(backends) == 1 {
+		return &backends[0]
+	}
+
+	// Skipped backends keep their points: the request walks on to the next allowed one,
+	// so the ring is not rebuilt and the keys of other backends do not move
+	allowed := make(map[string]*models.Backend, len(backends))
+	for i := range backends {
+		if !skip[backends[i].ID] {
+			allowed[backends[i].URL] = &backends[i]
+		}
+	}
+
+	ring := b.ringFor(backends)
+	hash := hashString(b.requestKey(r))
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	for n := 0; n < len(ring); n++ {
+		if backend, ok := allowed[ring[(start+n)%len(ring)].backend]; ok {
+			return backend
+		}
+	}
+	return &backends[0]
+}
+
+// ringFor returns the hash ring of the backends, rebuilding it when the pool changed,
+// e.g. because a backend failed its health checks
+func (b *consistentHashBalancer) ringFor(backends []models.Backend) []ringPoint {
+	var signature strings.Builder
+	for _, backend := range backends {
+		signature.WriteString(backend.URL)
+		signature.WriteByte('=')
+		signature.WriteString(strconv.Itoa(weightOf(backend)))
+		signature.WriteByte(' ')
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.signature == signature.String() {
+		return b.ring
+	}
+
+	ring := make([]ringPoint, 0, len(backends)*hashRingReplicas)
+	for _, backend := range backends {
+		for i := 0; i < weightOf(backend)*hashRingReplicas; i++ {
+			ring = append(ring, ringPoint{hash: hashString(backend.URL + "#" + strconv.Itoa(i)), backend: backend.URL})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	b.ring = ring
+	b.signature = signature.String()
+	return ring
+}
+
+// requestKey returns the value hashed for a request, falling back to the client IP
+// when the configured header or cookie is missing
+func (b *consistentHashBalancer) requestKey(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(b.hashKey, HashKeyHeaderPrefix):
+		if value := r.Header.Get(strings.TrimPrefix(b.hashKey, HashKeyHeaderPrefix)); value != "" {
+			return value
+		}
+	case strings.HasPrefix(b.hashKey, HashKeyCookiePrefix):
+		if cookie, err := r.Cookie(strings.TrimPrefix(b.hashKey, HashKeyCookiePrefix)); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	return filter.GetClientIP(r)
+}
+
+// hashString hashes a string with FNV-1a followed by a 64-bit finalizer, which spreads
+// similar inputs such as "url#1" and "url#2" evenly over the ring
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// backendLoad tracks the live load of a backend across all DNS rules using it
+type backendLoad struct {
+	active atomic.Int64 // In-flight requests
+
+	mu         sync.Mutex
+	ewma       float64 // Latency EWMA in milliseconds
+	hasSamples bool
+}
+
+// latency returns the latency EWMA in milliseconds, 0 before the first sample
+func (l *backendLoad) latency() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ewma
+}
+
+// observe adds a latency sample to the EWMA
+func (l *backendLoad) observe(latency time.Duration) {
+	ms := float64(latency) / float64(time.Millisecond)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.hasSamples {
+		l.ewma = ms
+		l.hasSamples = true
+		return
+	}
+	l.ewma = latencyEWMAAlpha*ms + (1-latencyEWMAAlpha)*l.ewma
+}
+
+// backendLoads holds the load of every backend, keyed by URL
+type backendLoads struct {
+	mu    sync.RWMutex
+	loads map[string]*backendLoad
+}
+
+var loads = &backendLoads{loads: make(map[string]*backendLoad)}
+
+// get returns the load of a backend, creating it if needed
+func (l *backendLoads) get(url string) *backendLoad {
+	l.mu.RLock()
+	load, exists := l.loads[url]
+	l.mu.RUnlock()
+	if exists {
+		return load
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if load, exists = l.loads[url]; !exists {
+		load = &backendLoad{}
+		l.loads[url] = load
+	}
+	return load
+}
+
+// retain drops the load of backends that are no longer used
+func (l *backendLoads) retain(backendURLs map[string]bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for url, load := range l.loads {
+		if !backendURLs[url] && load.active.Load() == 0 {
+			delete(l.loads, url)
+		}
+	}
+}
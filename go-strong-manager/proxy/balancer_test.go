@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// testBackends returns backends with the given weights, named a, b, c...
+func testBackends(weights ...int) []models.Backend {
+	backends := make([]models.Backend, len(weights))
+	for i, weight := range weights {
+		backends[i] = models.Backend{ID: i + 1, URL: fmt.Sprintf("http://%c.test", 'a'+i), Weight: weight, IsActive: true}
+	}
+	return backends
+}
+
+// resetLoads forgets the load of the test backends once the test is done
+func resetLoads(t *testing.T, backends []models.Backend) {
+	t.Cleanup(func() {
+		for _, backend := range backends {
+			load := loads.get(backend.URL)
+			load.active.Store(0)
+		}
+		loads.retain(nil)
+	})
+}
+
+// selectionShares picks n backends and returns the share of picks each URL received
+func selectionShares(b Balancer, backends []models.Backend, n int) map[string]float64 {
+	counts := make(map[string]int)
+	r := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < n; i++ {
+		counts[b.Select(backends, nil, r).URL]++
+	}
+	shares := make(map[string]float64, len(counts))
+	for url, count := range counts {
+		shares[url] = float64(count) / float64(n)
+	}
+	return shares
+}
+
+func TestRoundRobinFollowsWeightsOverEachCycle(t *testing.T) {
+	backends := testBackends(5, 1, 1)
+	b := newBalancer(LBRoundRobin, "")
+	r := httptest.NewRequest("GET", "/", nil)
+
+	// Smooth weighted round-robin interleaves the heavy backend with the others
+	want := []string{"a", "a", "b", "a", "c", "a", "a"}
+	for cycle := 0; cycle < 3; cycle++ {
+		counts := make(map[string]int)
+		for i, name := range want {
+			got := b.Select(backends, nil, r).URL
+			if got != "http://"+name+".test" {
+				t.Fatalf("cycle %d pick %d = %s, want %s", cycle, i, got, name)
+			}
+			counts[got]++
+		}
+		for _, backend := range backends {
+			if counts[backend.URL] != backend.Weight {
+				t.Fatalf("cycle %d: %s picked %d times, want its weight %d", cycle, backend.URL, counts[backend.URL], backend.Weight)
+			}
+		}
+	}
+}
+
+func TestRoundRobinTreatsUnsetWeightAsOne(t *testing.T) {
+	backends := testBackends(0, 2)
+	b := newBalancer(LBRoundRobin, "")
+
+	shares := selectionShares(b, backends, 300)
+	if shares["http://a.test"] != 1.0/3 || shares["http://b.test"] != 2.0/3 {
+		t.Fatalf("shares = %v, want 1/3 and 2/3", shares)
+	}
+}
+
+func TestRoundRobinKeepsStateOfSkippedBackends(t *testing.T) {
+	backends := testBackends(5, 1, 1)
+	b := newBalancer(LBRoundRobin, "").(*roundRobinBalancer)
+	r := httptest.NewRequest("GET", "/", nil)
+
+	counts := make(map[string]int)
+	for i := 0; i < 700; i++ {
+		counts[b.Select(backends, nil, r).URL]++
+
+		// Retries skip the backend they tried, without resetting its state
+		if i%10 == 0 {
+			if got := b.Select(backends, map[int]bool{1: true}, r).URL; got == "http://a.test" {
+				t.Fatalf("retry picked the skipped backend")
+			}
+			if len(b.current) != len(backends) {
+				t.Fatalf("state of %d backends kept, want the whole pool", len(b.current))
+			}
+		}
+	}
+
+	for _, backend := range backends {
+		if want := 100 * backend.Weight; counts[backend.URL] < want-10 || counts[backend.URL] > want+10 {
+			t.Errorf("%s picked %d times, want about %d", backend.URL, counts[backend.URL], want)
+		}
+	}
+}
+
+func TestBalancersNeverPickSkippedBackends(t *testing.T) {
+	backends := testBackends(1, 5, 1)
+	resetLoads(t, backends)
+	loads.get("http://b.test").observe(time.Millisecond)
+	loads.get("http://c.test").observe(time.Second)
+	skip := map[int]bool{2: true}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	for _, algorithm := range []string{LBRoundRobin, LBLeastConnections, LBLeastLatency, LBRandomTwoChoices, LBConsistentHash} {
+		b := newBalancer(algorithm, "")
+		for i := 0; i < 100; i++ {
+			r.RemoteAddr = fmt.Sprintf("203.0.113.%d:4000", i)
+			if got := b.Select(backends, skip, r).URL; got == "http://b.test" {
+				t.Fatalf("%s picked the skipped backend", algorithm)
+			}
+		}
+		if got := b.Select(backends, map[int]bool{1: true, 2: true}, r).URL; got != "http://c.test" {
+			t.Fatalf("%s picked %s, want the only backend left", algorithm, got)
+		}
+	}
+}
+
+func TestRandomTwoChoicesFollowsWeights(t *testing.T) {
+	backends := testBackends(3, 1)
+	resetLoads(t, backends)
+	b := newBalancer(LBRandomTwoChoices, "")
+
+	// With equal load the first, weighted, pick wins
+	shares := selectionShares(b, backends, 20000)
+	for url, want := range map[string]float64{"http://a.test": 0.75, "http://b.test": 0.25} {
+		if math.Abs(shares[url]-want) > 0.02 {
+			t.Errorf("%s share = %.3f, want about %.2f", url, shares[url], want)
+		}
+	}
+}
+
+func TestRandomTwoChoicesAvoidsLoadedBackend(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	resetLoads(t, backends)
+	loads.get("http://a.test").active.Store(10)
+	b := newBalancer(LBRandomTwoChoices, "")
+
+	// The two picks are distinct, so the loaded backend always loses
+	shares := selectionShares(b, backends, 3000)
+	if shares["http://a.test"] != 0 {
+		t.Errorf("loaded backend share = %.3f, want 0", shares["http://a.test"])
+	}
+	for _, url := range []string{"http://b.test", "http://c.test"} {
+		if math.Abs(shares[url]-0.5) > 0.05 {
+			t.Errorf("%s share = %.3f, want about 0.5", url, shares[url])
+		}
+	}
+}
+
+func TestConsistentHashIsStableAndMovesFewKeys(t *testing.T) {
+	backends := testBackends(1, 1, 1, 1, 1)
+	b := newBalancer(LBConsistentHash, "header:X-User")
+
+	const keys = 10000
+	r := httptest.NewRequest("GET", "/", nil)
+	assign := func(pool []models.Backend) map[string]string {
+		assigned := make(map[string]string, keys)
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("user-%d", i)
+			r.Header.Set("X-User", key)
+			assigned[key] = b.Select(pool, nil, r).URL
+		}
+		return assigned
+	}
+
+	before := assign(backends)
+	if again := assign(backends); fmt.Sprint(again) != fmt.Sprint(before) {
+		t.Fatal("the same keys were mapped to different backends")
+	}
+
+	counts := make(map[string]int)
+	for _, url := range before {
+		counts[url]++
+	}
+	for _, backend := range backends {
+		if share := float64(counts[backend.URL]) / keys; share < 0.1 || share > 0.3 {
+			t.Errorf("%s owns %.3f of the keys, want about 0.2", backend.URL, share)
+		}
+	}
+
+	// Removing a backend only moves its own keys
+	removed := backends[2].URL
+	after := assign(append(append([]models.Backend(nil), backends[:2]...), backends[3:]...))
+	moved := 0
+	for key, url := range before {
+		if after[key] == url {
+			continue
+		}
+		if url != removed {
+			t.Fatalf("key %s moved from %s to %s, but only keys of %s should move", key, url, after[key], removed)
+		}
+		moved++
+	}
+	if share := float64(moved) / keys; share < 0.1 || share > 0.3 {
+		t.Errorf("%.3f of the keys moved, want about 1/5", share)
+	}
+}
+
+func TestConsistentHashWalksPastSkippedBackends(t *testing.T) {
+	backends := testBackends(1, 1, 1, 1, 1)
+	b := newBalancer(LBConsistentHash, "header:X-User").(*consistentHashBalancer)
+	removed := newBalancer(LBConsistentHash, "header:X-User")
+	without := append(append([]models.Backend(nil), backends[:2]...), backends[3:]...)
+	r := httptest.NewRequest("GET", "/", nil)
+
+	b.Select(backends, nil, r)
+	ring := b.signature
+	for i := 0; i < 1000; i++ {
+		r.Header.Set("X-User", fmt.Sprintf("user-%d", i))
+		owner := b.Select(backends, nil, r).URL
+
+		// Skipping a backend moves its keys where removing it would, and no other key
+		got := b.Select(backends, map[int]bool{3: true}, r).URL
+		if want := removed.Select(without, nil, r).URL; owner == "http://c.test" && got != want {
+			t.Fatalf("key of the skipped backend went to %s, want %s", got, want)
+		}
+		if owner != "http://c.test" && got != owner {
+			t.Fatalf("key of %s moved to %s when another backend was skipped", owner, got)
+		}
+	}
+	if b.signature != ring {
+		t.Fatal("the ring was rebuilt for a skipped backend")
+	}
+}
+
+func TestConsistentHashFallsBackToClientIP(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	b := newBalancer(LBConsistentHash, "cookie:session")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.7:4000"
+	first := b.Select(backends, nil, r).URL
+	for i := 0; i < 10; i++ {
+		r.RemoteAddr = fmt.Sprintf("203.0.113.7:%d", 5000+i)
+		if got := b.Select(backends, nil, r).URL; got != first {
+			t.Fatalf("client moved from %s to %s when only its port changed", first, got)
+		}
+	}
+}
+
+func TestLeastConnectionsPicksLeastLoadedBackend(t *testing.T) {
+	backends := testBackends(1, 1)
+	resetLoads(t, backends)
+	b := newBalancer(LBLeastConnections, "")
+	r := httptest.NewRequest("GET", "/", nil)
+
+	loads.get("http://a.test").active.Store(3)
+	loads.get("http://b.test").active.Store(1)
+	if got := b.Select(backends, nil, r).URL; got != "http://b.test" {
+		t.Fatalf("picked %s, want the backend with fewer requests", got)
+	}
+
+	// In-flight requests are relative to the weight
+	backends[0].Weight = 4
+	if got := b.Select(backends, nil, r).URL; got != "http://a.test" {
+		t.Fatalf("picked %s, want the backend with fewer requests per unit of weight", got)
+	}
+}
+
+func TestLeastLatencyPicksFasterBackend(t *testing.T) {
+	backends := testBackends(1, 1)
+	resetLoads(t, backends)
+	b := newBalancer(LBLeastLatency, "")
+	r := httptest.NewRequest("GET", "/", nil)
+
+	// A backend without samples is tried first
+	loads.get("http://a.test").observe(100 * time.Millisecond)
+	if got := b.Select(backends, nil, r).URL; got != "http://b.test" {
+		t.Fatalf("picked %s, want the backend without latency samples", got)
+	}
+
+	loads.get("http://b.test").observe(20 * time.Millisecond)
+	if got := b.Select(backends, nil, r).URL; got != "http://b.test" {
+		t.Fatalf("picked %s, want the faster backend", got)
+	}
+
+	// The faster backend is not flooded: its latency is scaled by its in-flight requests
+	loads.get("http://b.test").active.Store(9)
+	if got := b.Select(backends, nil, r).URL; got != "http://a.test" {
+		t.Fatalf("picked %s, want the slower but idle backend", got)
+	}
+}
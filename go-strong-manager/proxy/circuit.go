@@ -0,0 +1,343 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	CircuitClosed   = "closed"    // Traffic flows normally
+	CircuitOpen     = "open"      // The backend receives no traffic
+	CircuitHalfOpen = "half_open" // A limited number of probe requests test the backend
+)
+
+// Buckets of the rolling window used to compute the error rate
+const circuitBuckets = 10
+
+// CircuitStatus is the circuit breaker state of a backend
+type CircuitStatus struct {
+	URL                 string    `json:"url"`
+	State               string    `json:"state"`
+	Requests            int       `json:"requests"` // Requests in the rolling window
+	Failures            int       `json:"failures"` // Failed requests in the rolling window
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	OpenedAt            time.Time `json:"opened_at,omitempty"`
+	OpenUntil           time.Time `json:"open_until,omitempty"`
+	LastFailure         string    `json:"last_failure,omitempty"`
+}
+
+// CircuitEvent records a state transition of a backend's circuit breaker
+type CircuitEvent struct {
+	ID        int64     `json:"id"`
+	URL       string    `json:"url"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Reason    string    `json:"reason,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// circuitResult is the outcome of a request as seen by the circuit breaker
+type circuitResult int
+
+const (
+	circuitIgnored circuitResult = iota // The request was abandoned by the client
+	circuitSuccess
+	circuitFailure
+)
+
+// circuitBucket counts requests in one slice of the rolling window
+type circuitBucket struct {
+	epoch    int64 // Index of the time slice the counts belong to
+	requests int
+	failures int
+}
+
+// circuitBreaker is the state of one backend
+type circuitBreaker struct {
+	status  CircuitStatus
+	buckets [circuitBuckets]circuitBucket
+
+	probes         int // Probe requests in flight while half-open
+	probeSuccesses int // Successful probes since the breaker became half-open
+}
+
+// circuitBreakers stops traffic to backends whose requests keep failing. A breaker
+// opens on a run of consecutive failures or a high error rate over a rolling window,
+// stays open for a while, then lets a few probe requests through and closes once
+// they all succeed.
+type circuitBreakers struct {
+	breakers map[string]*circuitBreaker
+	history  []CircuitEvent
+	nextID   int64
+	mu       sync.Mutex
+
+	window              time.Duration // Rolling window the error rate is computed over
+	minRequests         int           // Requests in the window before the error rate is considered
+	errorRate           int           // Percentage of failed requests that opens the breaker
+	consecutiveFailures int           // Failures in a row that open the breaker
+	openTime            time.Duration // Time the breaker stays open before probing
+	halfOpenRequests    int           // Successful probes needed to close, and probes allowed at once
+	historySize         int
+	now                 func() time.Time
+}
+
+var circuits = newCircuitBreakers()
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{
+		breakers:            make(map[string]*circuitBreaker),
+		window:              10 * time.Second,
+		minRequests:         20,
+		errorRate:           50,
+		consecutiveFailures: 5,
+		openTime:            30 * time.Second,
+		halfOpenRequests:    3,
+		historySize:         100,
+		now:                 time.Now,
+	}
+}
+
+// configureCircuitBreakers loads circuit breaker settings from the environment
+func configureCircuitBreakers() {
+	circuits.mu.Lock()
+	defer circuits.mu.Unlock()
+
+	circuits.window = getEnvDuration("CIRCUIT_WINDOW", circuits.window)
+	circuits.minRequests = getEnvInt("CIRCUIT_MIN_REQUESTS", circuits.minRequests)
+	circuits.errorRate = getEnvInt("CIRCUIT_ERROR_RATE", circuits.errorRate)
+	circuits.consecutiveFailures = getEnvInt("CIRCUIT_CONSECUTIVE_FAILURES", circuits.consecutiveFailures)
+	circuits.openTime = getEnvDuration("CIRCUIT_OPEN_TIME", circuits.openTime)
+	circuits.halfOpenRequests = getEnvInt("CIRCUIT_HALF_OPEN_REQUESTS", circuits.halfOpenRequests)
+}
+
+// breaker returns the state of a backend, creating it if needed. Caller must hold mu.
+func (c *circuitBreakers) breaker(url string) *circuitBreaker {
+	b, exists := c.breakers[url]
+	if !exists {
+		b = &circuitBreaker{status: CircuitStatus{URL: url, State: CircuitClosed}}
+		c.breakers[url] = b
+	}
+	return b
+}
+
+// epoch returns the index of the window slice a time falls into. Caller must hold mu.
+func (c *circuitBreakers) epoch(now time.Time) int64 {
+	slice := int64(c.window / circuitBuckets)
+	if slice <= 0 {
+		slice = 1
+	}
+	return now.UnixNano() / slice
+}
+
+// bucket returns the window bucket for the current time slice, clearing stale counts. Caller must hold mu.
+func (c *circuitBreakers) bucket(b *circuitBreaker, now time.Time) *circuitBucket {
+	epoch := c.epoch(now)
+	bucket := &b.buckets[epoch%circuitBuckets]
+	if bucket.epoch != epoch {
+		*bucket = circuitBucket{epoch: epoch}
+	}
+	return bucket
+}
+
+// windowCounts sums the requests and failures of the rolling window. Caller must hold mu.
+func (c *circuitBreakers) windowCounts(b *circuitBreaker, now time.Time) (requests, failures int) {
+	epoch := c.epoch(now)
+	for _, bucket := range b.buckets {
+		if epoch-bucket.epoch < circuitBuckets {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+// transition moves a breaker to a new state and records the event. Caller must hold mu.
+func (c *circuitBreakers) transition(b *circuitBreaker, to, reason string, now time.Time) {
+	from := b.status.State
+	b.status.State = to
+	b.probes = 0
+	b.probeSuccesses = 0
+
+	switch to {
+	case CircuitOpen:
+		b.status.OpenedAt = now
+		b.status.OpenUntil = now.Add(c.openTime)
+	case CircuitClosed:
+		b.status.ConsecutiveFailures = 0
+		b.status.OpenedAt = time.Time{}
+		b.status.OpenUntil = time.Time{}
+		b.buckets = [circuitBuckets]circuitBucket{}
+	}
+
+	c.nextID++
+	c.history = append(c.history, CircuitEvent{ID: c.nextID, URL: b.status.URL, From: from, To: to, Reason: reason, Timestamp: now})
+	if len(c.history) > c.historySize {
+		c.history = c.history[len(c.history)-c.historySize:]
+	}
+	if reason != "" {
+		fmt.Printf("Circuit breaker of backend %s: %s -> %s (%s)\n", b.status.URL, from, to, reason)
+	} else {
+		fmt.Printf("Circuit breaker of backend %s: %s -> %s\n", b.status.URL, from, to)
+	}
+}
+
+// halfOpenExpired starts probing an open breaker once its open time is over. Caller must hold mu.
+func (c *circuitBreakers) halfOpenExpired(b *circuitBreaker, now time.Time) {
+	if b.status.State == CircuitOpen && !now.Before(b.status.OpenUntil) {
+		c.transition(b, CircuitHalfOpen, "", now)
+	}
+}
+
+// Allows reports whether a backend may be selected: its breaker is closed, or it is
+// half-open with a probe slot free
+func (c *circuitBreakers) Allows(url string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, exists := c.breakers[url]
+	if !exists {
+		return true
+	}
+	c.halfOpenExpired(b, c.now())
+	switch b.status.State {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return b.probes < c.halfOpenRequests-b.probeSuccesses
+	}
+	return true
+}
+
+// Acquire admits a request to a backend, taking a probe slot when the breaker is
+// half-open. It reports whether the request may be sent and whether it is a probe.
+func (c *circuitBreakers) Acquire(url string) (allowed, probe bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, exists := c.breakers[url]
+	if !exists {
+		return true, false
+	}
+	c.halfOpenExpired(b, c.now())
+	switch b.status.State {
+	case CircuitOpen:
+		return false, false
+	case CircuitHalfOpen:
+		if b.probes >= c.halfOpenRequests-b.probeSuccesses {
+			return false, false
+		}
+		b.probes++
+		return true, true
+	}
+	return true, false
+}
+
+// Release records the outcome of a request admitted by Acquire
+func (c *circuitBreakers) Release(url string, probe bool, result circuitResult, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	b := c.breaker(url)
+
+	if probe {
+		if b.status.State != CircuitHalfOpen {
+			return
+		}
+		if b.probes > 0 {
+			b.probes--
+		}
+		switch result {
+		case circuitFailure:
+			b.status.LastFailure = reason
+			c.transition(b, CircuitOpen, "probe failed: "+reason, now)
+		case circuitSuccess:
+			b.probeSuccesses++
+			if b.probeSuccesses >= c.halfOpenRequests {
+				c.transition(b, CircuitClosed, fmt.Sprintf("%d probes succeeded", b.probeSuccesses), now)
+			}
+		}
+		return
+	}
+
+	// Requests sent before the breaker opened do not change its state
+	if b.status.State != CircuitClosed || result == circuitIgnored {
+		return
+	}
+
+	bucket := c.bucket(b, now)
+	bucket.requests++
+	if result == circuitSuccess {
+		b.status.ConsecutiveFailures = 0
+		return
+	}
+	bucket.failures++
+	b.status.ConsecutiveFailures++
+	b.status.LastFailure = reason
+
+	if b.status.ConsecutiveFailures >= c.consecutiveFailures {
+		c.transition(b, CircuitOpen, fmt.Sprintf("%d consecutive failures, last: %s", b.status.ConsecutiveFailures, reason), now)
+		return
+	}
+	requests, failures := c.windowCounts(b, now)
+	if requests >= c.minRequests && failures*100 >= c.errorRate*requests {
+		c.transition(b, CircuitOpen, fmt.Sprintf("%d of %d requests failed in %v, last: %s", failures, requests, c.window, reason), now)
+	}
+}
+
+// retain drops the breakers of backends that are no longer used
+func (c *circuitBreakers) retain(backendURLs map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for url, b := range c.breakers {
+		if !backendURLs[url] && b.probes == 0 {
+			delete(c.breakers, url)
+		}
+	}
+}
+
+// Snapshot returns a copy of all breaker states and the transition history, newest event first
+func (c *circuitBreakers) Snapshot() ([]CircuitStatus, []CircuitEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	statuses := make([]CircuitStatus, 0, len(c.breakers))
+	for _, b := range c.breakers {
+		c.halfOpenExpired(b, now)
+		status := b.status
+		status.Requests, status.Failures = c.windowCounts(b, now)
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].URL < statuses[j].URL })
+
+	history := make([]CircuitEvent, len(c.history))
+	for i, event := range c.history {
+		history[len(c.history)-1-i] = event
+	}
+	return statuses, history
+}
+
+// GetCircuitStatus returns the circuit breaker state of all backends that have
+// received traffic, along with the transition history
+func GetCircuitStatus() ([]CircuitStatus, []CircuitEvent) {
+	return circuits.Snapshot()
+}
+
+// CircuitEventsSince returns the circuit breaker transitions with an ID above the
+// given one, oldest first, so callers can follow new transitions
+func CircuitEventsSince(id int64) []CircuitEvent {
+	circuits.mu.Lock()
+	defer circuits.mu.Unlock()
+
+	var events []CircuitEvent
+	for _, event := range circuits.history {
+		if event.ID > id {
+			events = append(events, event)
+		}
+	}
+	return events
+}
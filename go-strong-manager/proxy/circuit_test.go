@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+// testClock is a synthetic clock that only moves when told to
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newTestCircuits returns circuit breakers running on a synthetic clock, which only open
+// on the error rate unless a test lowers consecutiveFailures
+func newTestCircuits() (*circuitBreakers, *testClock) {
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := newCircuitBreakers()
+	c.now = clock.Now
+	c.window = 10 * time.Second
+	c.minRequests = 10
+	c.errorRate = 50
+	c.consecutiveFailures = 1000
+	c.openTime = 30 * time.Second
+	c.halfOpenRequests = 2
+	return c, clock
+}
+
+// useOpenCircuit opens the circuit breaker of a backend for the duration of a test
+func useOpenCircuit(t *testing.T, url string) {
+	circuits.mu.Lock()
+	circuits.transition(circuits.breaker(url), CircuitOpen, "test", circuits.now())
+	circuits.mu.Unlock()
+	t.Cleanup(func() { circuits.retain(nil) })
+}
+
+// send records requests to a backend, failing the ones for which fail returns true
+func send(c *circuitBreakers, url string, count int, fail func(i int) bool) {
+	for i := 0; i < count; i++ {
+		allowed, probe := c.Acquire(url)
+		if !allowed {
+			continue
+		}
+		result := circuitSuccess
+		if fail(i) {
+			result = circuitFailure
+		}
+		c.Release(url, probe, result, "status 502")
+	}
+}
+
+// state returns the state of a backend's breaker, as shown by the admin API
+func state(c *circuitBreakers, url string) string {
+	statuses, _ := c.Snapshot()
+	for _, status := range statuses {
+		if status.URL == url {
+			return status.State
+		}
+	}
+	return CircuitClosed
+}
+
+func always(int) bool { return true }
+func never(int) bool  { return false }
+
+func TestCircuitOpensOnErrorRate(t *testing.T) {
+	const url = "http://a.test"
+
+	t.Run("not before the minimum number of requests", func(t *testing.T) {
+		c, _ := newTestCircuits()
+		send(c, url, 9, always)
+		if got := state(c, url); got != CircuitClosed {
+			t.Fatalf("state after 9 failures = %s, want closed below 10 requests", got)
+		}
+		send(c, url, 1, always)
+		if got := state(c, url); got != CircuitOpen {
+			t.Fatalf("state after 10 failures = %s, want open", got)
+		}
+	})
+
+	t.Run("at the error rate", func(t *testing.T) {
+		c, _ := newTestCircuits()
+		send(c, url, 9, func(i int) bool { return i < 4 })
+		send(c, url, 1, always)
+		if got := state(c, url); got != CircuitOpen {
+			t.Fatalf("state at 5 failures of 10 requests = %s, want open", got)
+		}
+	})
+
+	t.Run("below the error rate", func(t *testing.T) {
+		c, _ := newTestCircuits()
+		send(c, url, 6, never)
+		send(c, url, 5, always)
+		if got := state(c, url); got != CircuitClosed {
+			t.Fatalf("state at 5 failures of 11 requests = %s, want closed", got)
+		}
+	})
+
+	t.Run("only over the rolling window", func(t *testing.T) {
+		c, clock := newTestCircuits()
+		send(c, url, 8, always)
+		send(c, url, 1, never)
+
+		// The failures slide out of the window one bucket at a time
+		clock.Advance(10 * time.Second)
+		send(c, url, 1, always)
+		if got := state(c, url); got != CircuitClosed {
+			t.Fatalf("state with the failures out of the window = %s, want closed", got)
+		}
+		statuses, _ := c.Snapshot()
+		if statuses[0].Requests != 1 || statuses[0].Failures != 1 {
+			t.Fatalf("window counts = %d requests, %d failures, want 1 and 1", statuses[0].Requests, statuses[0].Failures)
+		}
+
+		// Requests spread over the window all count
+		for i := 0; i < 9; i++ {
+			clock.Advance(time.Second)
+			send(c, url, 1, func(int) bool { return i%2 == 0 })
+		}
+		if got := state(c, url); got != CircuitOpen {
+			t.Fatalf("state at 6 failures of 10 requests over 9s = %s, want open", got)
+		}
+	})
+
+	t.Run("requests abandoned by the client do not count", func(t *testing.T) {
+		c, _ := newTestCircuits()
+		for i := 0; i < 20; i++ {
+			c.Release(url, false, circuitIgnored, "")
+		}
+		send(c, url, 9, always)
+		if got := state(c, url); got != CircuitClosed {
+			t.Fatalf("state = %s, want closed with only 9 counted requests", got)
+		}
+	})
+}
+
+func TestCircuitOpensOnConsecutiveFailures(t *testing.T) {
+	const url = "http://a.test"
+	c, _ := newTestCircuits()
+	c.consecutiveFailures = 3
+
+	// A success resets the run, even when the error rate is high
+	send(c, url, 2, always)
+	send(c, url, 1, never)
+	send(c, url, 2, always)
+	if got := state(c, url); got != CircuitClosed {
+		t.Fatalf("state = %s, want closed without 3 failures in a row", got)
+	}
+	send(c, url, 1, always)
+	if got := state(c, url); got != CircuitOpen {
+		t.Fatalf("state = %s, want open after 3 failures in a row", got)
+	}
+}
+
+func TestCircuitHalfOpenProbes(t *testing.T) {
+	const url = "http://a.test"
+	c, clock := newTestCircuits()
+	send(c, url, 10, always)
+
+	// Open: nothing goes through until the open time is over
+	clock.Advance(30*time.Second - time.Nanosecond)
+	if allowed, _ := c.Acquire(url); allowed || c.Allows(url) {
+		t.Fatal("open circuit let a request through")
+	}
+	clock.Advance(time.Nanosecond)
+
+	// Half-open: only halfOpenRequests probes at once
+	if !c.Allows(url) {
+		t.Fatal("half-open circuit has no probe slot")
+	}
+	first, firstProbe := c.Acquire(url)
+	second, secondProbe := c.Acquire(url)
+	if !first || !firstProbe || !second || !secondProbe {
+		t.Fatal("half-open circuit did not admit 2 probes")
+	}
+	if allowed, _ := c.Acquire(url); allowed || c.Allows(url) {
+		t.Fatal("half-open circuit admitted a third probe")
+	}
+
+	// Requests sent before the circuit opened do not change its state
+	c.Release(url, false, circuitSuccess, "")
+	if got := state(c, url); got != CircuitHalfOpen {
+		t.Fatalf("state after a late request = %s, want half_open", got)
+	}
+
+	// A successful probe does not free its slot, it counts towards closing
+	c.Release(url, true, circuitSuccess, "")
+	if allowed, _ := c.Acquire(url); allowed {
+		t.Fatal("probe slot of a successful probe was reused")
+	}
+	c.Release(url, true, circuitSuccess, "")
+	if got := state(c, url); got != CircuitClosed {
+		t.Fatalf("state after 2 successful probes = %s, want closed", got)
+	}
+	if allowed, probe := c.Acquire(url); !allowed || probe {
+		t.Fatalf("closed circuit: allowed %v, probe %v, want a normal request", allowed, probe)
+	}
+
+	// The failures that opened the circuit are forgotten once it closes
+	send(c, url, 9, always)
+	if got := state(c, url); got != CircuitClosed {
+		t.Fatalf("state after reclosing and 9 failures = %s, want closed", got)
+	}
+}
+
+func TestCircuitFailedProbeReopens(t *testing.T) {
+	const url = "http://a.test"
+	c, clock := newTestCircuits()
+	send(c, url, 10, always)
+	clock.Advance(30 * time.Second)
+
+	c.Acquire(url)
+	c.Acquire(url)
+	c.Release(url, true, circuitFailure, "status 503")
+	if got := state(c, url); got != CircuitOpen {
+		t.Fatalf("state after a failed probe = %s, want open", got)
+	}
+
+	// The other probe finishing does not change the reopened circuit
+	c.Release(url, true, circuitSuccess, "")
+	statuses, history := c.Snapshot()
+	if statuses[0].State != CircuitOpen || !statuses[0].OpenUntil.Equal(clock.Now().Add(30*time.Second)) {
+		t.Fatalf("status = %+v, want open for another 30s", statuses[0])
+	}
+	if len(history) != 3 || history[0].From != CircuitHalfOpen || history[0].To != CircuitOpen {
+		t.Fatalf("history = %+v, want closed -> open -> half_open -> open", history)
+	}
+
+	// The probes of the next half-open period start over
+	clock.Advance(30 * time.Second)
+	if allowed, probe := c.Acquire(url); !allowed || !probe {
+		t.Fatal("reopened circuit did not probe again after its open time")
+	}
+}
+
+func TestCanRetryOnSkipsOpenCircuits(t *testing.T) {
+	backends := testBackends(1, 1, 1)
+	tried := map[int]bool{backends[0].ID: true}
+	if !canRetryOn(backends, tried) {
+		t.Fatal("no retry with 2 untried backends")
+	}
+
+	useOpenCircuit(t, backends[1].URL)
+	if !canRetryOn(backends, tried) {
+		t.Fatal("no retry with an untried backend whose circuit is closed")
+	}
+	useOpenCircuit(t, backends[2].URL)
+	if canRetryOn(backends, tried) {
+		t.Fatal("retry allowed while every untried backend has an open circuit")
+	}
+}
@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/filter"
+	"github.com/arifur/strong-reverse-proxy/models"
+	"golang.org/x/net/http/httpguts"
+)
+
+var (
+	// Compiled header rules of each DNS rule, keyed by DNS rule ID
+	headerCache     = make(map[int]*headerRules)
+	headerCacheLock = sync.RWMutex{}
+)
+
+// Placeholders that header rule values can contain
+var headerPlaceholders = map[string]bool{
+	"client_ip":  true, // Client IP, resolved through trusted proxies
+	"request_id": true, // X-Request-ID of the request, or a generated ID
+	"host":       true, // Host requested by the client
+	"rule":       true, // Hostname of the matched DNS rule, e.g. *.example.com
+	"method":     true,
+	"path":       true, // Request path before route rewrites
+	"scheme":     true, // http or https
+	"backend":    true, // URL of the backend serving the request
+}
+
+// Headers managed by the HTTP connection itself, which header rules cannot change
+var protectedHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// headerRules holds the compiled header rules of a DNS rule, in order
+type headerRules struct {
+	request       []compiledHeaderRule
+	response      []compiledHeaderRule
+	usesRequestID bool
+}
+
+// compiledHeaderRule is a header rule with its value split into literals and placeholders
+type compiledHeaderRule struct {
+	action models.HeaderAction
+	name   string
+	parts  []templatePart
+}
+
+// templatePart is a literal piece of a header value, or a placeholder when name is set
+type templatePart struct {
+	literal string
+	name    string
+}
+
+// ValidateHeaderRule checks that a header rule can be applied
+func ValidateHeaderRule(rule models.HeaderRule) error {
+	_, err := compileHeaderRule(rule)
+	return err
+}
+
+// compileHeaderRule validates a header rule and parses its value
+func compileHeaderRule(rule models.HeaderRule) (compiledHeaderRule, error) {
+	compiled := compiledHeaderRule{action: rule.Action, name: http.CanonicalHeaderKey(rule.Name)}
+
+	if rule.Direction != models.HeaderDirectionRequest && rule.Direction != models.HeaderDirectionResponse {
+		return compiled, fmt.Errorf("header direction must be 'request' or 'response'")
+	}
+	if rule.Action != models.HeaderActionAdd && rule.Action != models.HeaderActionSet && rule.Action != models.HeaderActionRemove {
+		return compiled, fmt.Errorf("header action must be 'add', 'set' or 'remove'")
+	}
+	if !httpguts.ValidHeaderFieldName(rule.Name) {
+		return compiled, fmt.Errorf("invalid header name %q", rule.Name)
+	}
+	if protectedHeaders[compiled.name] {
+		return compiled, fmt.Errorf("header %s cannot be changed", compiled.name)
+	}
+	if compiled.name == "Host" && (rule.Direction != models.HeaderDirectionRequest || rule.Action != models.HeaderActionSet) {
+		return compiled, fmt.Errorf("the Host header can only be set on requests")
+	}
+
+	if rule.Action == models.HeaderActionRemove {
+		return compiled, nil
+	}
+	if rule.Value == "" {
+		return compiled, fmt.Errorf("header value is required for '%s'", rule.Action)
+	}
+	if !httpguts.ValidHeaderFieldValue(rule.Value) {
+		return compiled, fmt.Errorf("invalid header value for %s", compiled.name)
+	}
+	compiled.parts = parseTemplate(rule.Value)
+	return compiled, nil
+}
+
+// parseTemplate splits a header value into literals and {placeholders}. Braces that do
+// not enclose a known placeholder are kept as they are.
+func parseTemplate(value string) []templatePart {
+	var parts []templatePart
+	var literal strings.Builder
+	for {
+		start := strings.IndexByte(value, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			break
+		}
+		name := value[start+1 : start+end]
+		if !headerPlaceholders[name] {
+			literal.WriteString(value[:start+1])
+			value = value[start+1:]
+			continue
+		}
+		literal.WriteString(value[:start])
+		if literal.Len() > 0 {
+			parts = append(parts, templatePart{literal: literal.String()})
+			literal.Reset()
+		}
+		parts = append(parts, templatePart{name: name})
+		value = value[start+end+1:]
+	}
+	literal.WriteString(value)
+	if literal.Len() > 0 {
+		parts = append(parts, templatePart{literal: literal.String()})
+	}
+	return parts
+}
+
+// expand returns the header value for a request
+func (h compiledHeaderRule) expand(req *http.Request, pr *proxyRequest) string {
+	if len(h.parts) == 1 && h.parts[0].name == "" {
+		return h.parts[0].literal
+	}
+
+	var value strings.Builder
+	for _, part := range h.parts {
+		switch part.name {
+		case "":
+			value.WriteString(part.literal)
+		case "client_ip":
+			value.WriteString(pr.clientIP)
+		case "request_id":
+			value.WriteString(pr.requestID)
+		case "host":
+			value.WriteString(pr.requestHost)
+		case "rule":
+			value.WriteString(pr.hostname)
+		case "method":
+			value.WriteString(req.Method)
+		case "path":
+			value.WriteString(pr.requestPath)
+		case "scheme":
+			if req.TLS != nil {
+				value.WriteString("https")
+			} else {
+				value.WriteString("http")
+			}
+		case "backend":
+			value.WriteString(pr.backend.URL)
+		}
+	}
+	return value.String()
+}
+
+// apply changes the headers according to the rule
+func (h compiledHeaderRule) apply(header http.Header, req *http.Request, pr *proxyRequest) {
+	switch h.action {
+	case models.HeaderActionAdd:
+		header.Add(h.name, h.expand(req, pr))
+	case models.HeaderActionSet:
+		header.Set(h.name, h.expand(req, pr))
+	case models.HeaderActionRemove:
+		header.Del(h.name)
+	}
+}
+
+// Headers describing the client connection, only kept when sent by a trusted proxy
+var forwardingHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"}
+
+// setForwardedHeaders tells the backend who the client is and how it connected, in
+// X-Forwarded-Proto, X-Forwarded-Host, X-Real-IP and the RFC 7239 Forwarded header.
+// Headers from trusted proxies are extended, while the ones sent by anyone else are
+// replaced so backends cannot be fooled by forged values. The reverse proxy itself
+// appends the peer address to X-Forwarded-For.
+func setForwardedHeaders(req *http.Request, pr *proxyRequest) {
+	peer := filter.RemoteIP(req)
+	if !filter.IsTrustedProxy(net.ParseIP(peer)) {
+		for _, name := range forwardingHeaders {
+			req.Header.Del(name)
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", pr.requestHost)
+	}
+	req.Header.Set("X-Real-Ip", pr.clientIP)
+
+	// IPv6 addresses are bracketed, and values that are not tokens quoted
+	node := peer
+	if ip := net.ParseIP(peer); ip != nil && ip.To4() == nil {
+		node = "[" + peer + "]"
+	}
+	element := "for=" + forwardedValue(node) + ";host=" + forwardedValue(pr.requestHost) + ";proto=" + proto
+	if prior := req.Header.Values("Forwarded"); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+}
+
+// forwardedValue returns a Forwarded header parameter value, quoted unless it is a token
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+// applyRequestHeaders changes the headers of a request about to be sent to a backend
+func applyRequestHeaders(req *http.Request, pr *proxyRequest) {
+	if pr.headers == nil {
+		return
+	}
+	for _, h := range pr.headers.request {
+		switch {
+		case h.name == "Host":
+			req.Host = h.expand(req, pr)
+		case h.name == "X-Forwarded-For" && h.action == models.HeaderActionRemove:
+			// A nil value stops the reverse proxy from adding the header back
+			req.Header[h.name] = nil
+		default:
+			h.apply(req.Header, req, pr)
+		}
+	}
+}
+
+// applyResponseHeaders changes the headers of a backend response before it is returned
+func applyResponseHeaders(resp *http.Response, pr *proxyRequest) {
+	if pr.headers == nil {
+		return
+	}
+	for _, h := range pr.headers.response {
+		h.apply(resp.Header, resp.Request, pr)
+	}
+}
+
+// headerRulesFor returns the compiled header rules of a DNS rule, or nil if it has none
+func headerRulesFor(ruleID int) *headerRules {
+	headerCacheLock.RLock()
+	defer headerCacheLock.RUnlock()
+	return headerCache[ruleID]
+}
+
+// requestID returns the X-Request-ID of a request, generating one when it has none
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		return id
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// loadHeaderRules returns the compiled header rules of all DNS rules, in creation order
+func loadHeaderRules() map[int]*headerRules {
+	rows, err := database.DB.Query(`
+		SELECT
+			id,
+			dns_rule_id,
+			direction,
+			action,
+			name,
+			value
+		FROM
+			dns_header_rules
+		ORDER BY
+			id
+	`)
+	if err != nil {
+		fmt.Printf("Error loading header rules: %v\n", err)
+		return nil
+	}
+	defer rows.Close()
+
+	result := make(map[int]*headerRules)
+	for rows.Next() {
+		var rule models.HeaderRule
+		var direction, action string
+		if err := rows.Scan(&rule.ID, &rule.DNSRuleID, &direction, &action, &rule.Name, &rule.Value); err != nil {
+			fmt.Printf("Error scanning header rule: %v\n", err)
+			continue
+		}
+		rule.Direction = models.HeaderDirection(direction)
+		rule.Action = models.HeaderAction(action)
+
+		compiled, err := compileHeaderRule(rule)
+		if err != nil {
+			fmt.Printf("Skipping header rule %d: %v\n", rule.ID, err)
+			continue
+		}
+
+		rules, exists := result[rule.DNSRuleID]
+		if !exists {
+			rules = &headerRules{}
+			result[rule.DNSRuleID] = rules
+		}
+		if rule.Direction == models.HeaderDirectionRequest {
+			rules.request = append(rules.request, compiled)
+		} else {
+			rules.response = append(rules.response, compiled)
+		}
+		for _, part := range compiled.parts {
+			if part.name == "request_id" {
+				rules.usesRequestID = true
+			}
+		}
+	}
+	return result
+}
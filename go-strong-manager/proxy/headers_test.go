@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+func TestSetForwardedHeadersReplacesForgedHeaders(t *testing.T) {
+	// Without trusted proxies every peer is untrusted
+	req := httptest.NewRequest("GET", "http://app.test/", nil)
+	req.RemoteAddr = "203.0.113.7:4000"
+	req.Header.Set("Forwarded", "for=198.51.100.1")
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Forwarded-Host", "admin.internal")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Real-IP", "198.51.100.1")
+
+	setForwardedHeaders(req, &proxyRequest{clientIP: "203.0.113.7", requestHost: "app.test"})
+
+	want := map[string]string{
+		"Forwarded":         "for=203.0.113.7;host=app.test;proto=http",
+		"X-Forwarded-Host":  "app.test",
+		"X-Forwarded-Proto": "http",
+		"X-Real-Ip":         "203.0.113.7",
+	}
+	for name, value := range want {
+		if got := req.Header.Values(name); len(got) != 1 || got[0] != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	// The reverse proxy appends the peer to an empty X-Forwarded-For
+	if got := req.Header.Values("X-Forwarded-For"); len(got) != 0 {
+		t.Errorf("X-Forwarded-For = %q, want the forged value removed", got)
+	}
+}
+
+func TestSetForwardedHeadersBracketsIPv6Peers(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://app.test/", nil)
+	req.RemoteAddr = "[2001:db8::7]:4000"
+
+	setForwardedHeaders(req, &proxyRequest{clientIP: "2001:db8::7", requestHost: "app.test:8080"})
+
+	if got, want := req.Header.Get("Forwarded"), `for="[2001:db8::7]";host="app.test:8080";proto=http`; got != want {
+		t.Errorf("Forwarded = %s, want %s", got, want)
+	}
+}
+
+func TestCompileHeaderRule(t *testing.T) {
+	rule := func(direction models.HeaderDirection, action models.HeaderAction, name, value string) models.HeaderRule {
+		return models.HeaderRule{Direction: direction, Action: action, Name: name, Value: value}
+	}
+	request, response := models.HeaderDirectionRequest, models.HeaderDirectionResponse
+	add, set, remove := models.HeaderActionAdd, models.HeaderActionSet, models.HeaderActionRemove
+
+	tests := []struct {
+		name  string
+		rule  models.HeaderRule
+		valid bool
+	}{
+		{"add to requests", rule(request, add, "X-Client", "{client_ip}"), true},
+		{"set on responses", rule(response, set, "Strict-Transport-Security", "max-age=63072000"), true},
+		{"remove without a value", rule(response, remove, "Server", ""), true},
+		{"lowercase name", rule(request, set, "x-tenant", "acme"), true},
+		{"Host set on requests", rule(request, set, "host", "internal.example.com"), true},
+		{"unknown direction", rule("both", set, "X-Tenant", "acme"), false},
+		{"unknown action", rule(request, "append", "X-Tenant", "acme"), false},
+		{"invalid name", rule(request, set, "X Tenant", "acme"), false},
+		{"empty name", rule(request, set, "", "acme"), false},
+		{"missing value", rule(request, add, "X-Tenant", ""), false},
+		{"value with a line break", rule(response, set, "X-Tenant", "acme\r\nSet-Cookie: a=b"), false},
+		{"Host added to requests", rule(request, add, "Host", "internal.example.com"), false},
+		{"Host removed from requests", rule(request, remove, "Host", ""), false},
+		{"Host set on responses", rule(response, set, "Host", "internal.example.com"), false},
+	}
+	for _, tt := range tests {
+		if err := ValidateHeaderRule(tt.rule); (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+
+	// Headers managed by the connection cannot be changed in any way
+	for _, name := range []string{"Connection", "content-length", "Keep-Alive", "Proxy-Connection", "TE", "Trailer", "Transfer-Encoding", "Upgrade"} {
+		for _, r := range []models.HeaderRule{rule(request, set, name, "close"), rule(response, add, name, "close"), rule(response, remove, name, "")} {
+			if err := ValidateHeaderRule(r); err == nil {
+				t.Errorf("%s %s of the %s header was accepted", r.Direction, r.Action, name)
+			}
+		}
+	}
+}
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct {
+		value string
+		parts []templatePart
+	}{
+		{"static", []templatePart{{literal: "static"}}},
+		{"{client_ip}", []templatePart{{name: "client_ip"}}},
+		{"for={client_ip};by={rule}", []templatePart{{literal: "for="}, {name: "client_ip"}, {literal: ";by="}, {name: "rule"}}},
+		{"{method}{path}", []templatePart{{name: "method"}, {name: "path"}}},
+		// Unknown placeholders and unbalanced braces are kept literally
+		{"{unknown}", []templatePart{{literal: "{unknown}"}}},
+		{"{unknown}-{host}", []templatePart{{literal: "{unknown}-"}, {name: "host"}}},
+		{"{{host}}", []templatePart{{literal: "{"}, {name: "host"}, {literal: "}"}}},
+		{"{host", []templatePart{{literal: "{host"}}},
+		{"host}", []templatePart{{literal: "host}"}}},
+		{"{}", []templatePart{{literal: "{}"}}},
+		{"{ host }", []templatePart{{literal: "{ host }"}}},
+	}
+	for _, tt := range tests {
+		got := parseTemplate(tt.value)
+		if len(got) != len(tt.parts) {
+			t.Errorf("parseTemplate(%q) = %+v, want %+v", tt.value, got, tt.parts)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.parts[i] {
+				t.Errorf("parseTemplate(%q) = %+v, want %+v", tt.value, got, tt.parts)
+				break
+			}
+		}
+	}
+}
+
+func TestHeaderRuleExpandsPlaceholders(t *testing.T) {
+	pr := &proxyRequest{
+		clientIP:    "203.0.113.7",
+		requestID:   "abc123",
+		requestHost: "app.example.com:8443",
+		hostname:    "*.example.com",
+		requestPath: "/api/users",
+		backend:     models.Backend{URL: "http://10.0.0.1:8080"},
+	}
+	req := httptest.NewRequest("POST", "https://app.example.com:8443/users", nil)
+	req.TLS = &tls.ConnectionState{}
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"{client_ip}", "203.0.113.7"},
+		{"id={request_id}", "id=abc123"},
+		{"{scheme}://{host}{path}", "https://app.example.com:8443/api/users"},
+		{"{method} via {rule} to {backend}", "POST via *.example.com to http://10.0.0.1:8080"},
+		{"{unknown} {client_ip}", "{unknown} 203.0.113.7"},
+	}
+	for _, tt := range tests {
+		compiled, err := compileHeaderRule(models.HeaderRule{
+			Direction: models.HeaderDirectionRequest,
+			Action:    models.HeaderActionSet,
+			Name:      "X-Test",
+			Value:     tt.value,
+		})
+		if err != nil {
+			t.Fatalf("compileHeaderRule(%q): %v", tt.value, err)
+		}
+		if got := compiled.expand(req, pr); got != tt.want {
+			t.Errorf("expand(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestApplyRequestHeaders(t *testing.T) {
+	compile := func(action models.HeaderAction, name, value string) compiledHeaderRule {
+		t.Helper()
+		compiled, err := compileHeaderRule(models.HeaderRule{Direction: models.HeaderDirectionRequest, Action: action, Name: name, Value: value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return compiled
+	}
+	pr := &proxyRequest{clientIP: "203.0.113.7", requestHost: "app.example.com", headers: &headerRules{request: []compiledHeaderRule{
+		compile(models.HeaderActionSet, "Host", "internal.{host}"),
+		compile(models.HeaderActionAdd, "X-Tenant", "beta"),
+		compile(models.HeaderActionSet, "X-Client", "{client_ip}"),
+		compile(models.HeaderActionRemove, "Cookie", ""),
+		compile(models.HeaderActionRemove, "X-Forwarded-For", ""),
+	}}}
+
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("X-Client", "forged")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	applyRequestHeaders(req, pr)
+
+	if req.Host != "internal.app.example.com" {
+		t.Errorf("Host = %q, want internal.app.example.com", req.Host)
+	}
+	if got := req.Header.Values("X-Tenant"); len(got) != 2 || got[0] != "acme" || got[1] != "beta" {
+		t.Errorf("X-Tenant = %q, want the added value after the existing one", got)
+	}
+	if got := req.Header.Values("X-Client"); len(got) != 1 || got[0] != "203.0.113.7" {
+		t.Errorf("X-Client = %q, want it replaced", got)
+	}
+	if _, ok := req.Header["Cookie"]; ok {
+		t.Error("Cookie was not removed")
+	}
+	// A nil value keeps the reverse proxy from adding X-Forwarded-For back
+	if values, ok := req.Header["X-Forwarded-For"]; !ok || values != nil {
+		t.Errorf("X-Forwarded-For = %q, present %v, want a nil value", values, ok)
+	}
+}
@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OutlierStatus is the passive health state of a backend, derived from live traffic
+type OutlierStatus struct {
+	URL                 string    `json:"url"`
+	Ejected             bool      `json:"ejected"`
+	EjectedUntil        time.Time `json:"ejected_until,omitempty"`
+	EjectionCount       int       `json:"ejection_count"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastFailure         string    `json:"last_failure,omitempty"`
+	LastFailureAt       time.Time `json:"last_failure_at,omitempty"`
+}
+
+// OutlierEvent records a backend being ejected or returned to rotation
+type OutlierEvent struct {
+	URL       string    `json:"url"`
+	Event     string    `json:"event"` // "ejected" or "restored"
+	Reason    string    `json:"reason,omitempty"`
+	Duration  string    `json:"duration,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// outlierDetector ejects backends that keep failing on live requests
+type outlierDetector struct {
+	statuses map[string]*OutlierStatus
+	history  []OutlierEvent
+	mu       sync.Mutex
+
+	consecutiveFailures int           // Failures in a row that trigger an ejection
+	baseEjection        time.Duration // Ejection time for the first ejection, doubled for each repeat
+	maxEjection         time.Duration // Upper bound for the ejection time
+	historySize         int
+	now                 func() time.Time
+}
+
+var outliers = newOutlierDetector(5, 30*time.Second, 10*time.Minute)
+
+func newOutlierDetector(consecutiveFailures int, baseEjection, maxEjection time.Duration) *outlierDetector {
+	return &outlierDetector{
+		statuses:            make(map[string]*OutlierStatus),
+		consecutiveFailures: consecutiveFailures,
+		baseEjection:        baseEjection,
+		maxEjection:         maxEjection,
+		historySize:         100,
+		now:                 time.Now,
+	}
+}
+
+// configureOutlierDetection loads outlier detection settings from the environment
+func configureOutlierDetection() {
+	outliers.mu.Lock()
+	defer outliers.mu.Unlock()
+
+	outliers.consecutiveFailures = getEnvInt("OUTLIER_CONSECUTIVE_FAILURES", outliers.consecutiveFailures)
+	outliers.baseEjection = getEnvDuration("OUTLIER_BASE_EJECTION_TIME", outliers.baseEjection)
+	outliers.maxEjection = getEnvDuration("OUTLIER_MAX_EJECTION_TIME", outliers.maxEjection)
+}
+
+// status returns the state of a backend, creating it if needed. Caller must hold mu.
+func (d *outlierDetector) status(url string) *OutlierStatus {
+	status, exists := d.statuses[url]
+	if !exists {
+		status = &OutlierStatus{URL: url}
+		d.statuses[url] = status
+	}
+	return status
+}
+
+// record appends an event to the history, dropping the oldest ones. Caller must hold mu.
+func (d *outlierDetector) record(event OutlierEvent) {
+	d.history = append(d.history, event)
+	if len(d.history) > d.historySize {
+		d.history = d.history[len(d.history)-d.historySize:]
+	}
+}
+
+// restoreExpired returns a backend to rotation once its ejection has expired. Caller must hold mu.
+func (d *outlierDetector) restoreExpired(status *OutlierStatus, now time.Time) {
+	if status.Ejected && !now.Before(status.EjectedUntil) {
+		status.Ejected = false
+		status.ConsecutiveFailures = 0
+		d.record(OutlierEvent{URL: status.URL, Event: "restored", Timestamp: now})
+	}
+}
+
+// IsEjected reports whether the backend is currently ejected from rotation
+func (d *outlierDetector) IsEjected(url string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status, exists := d.statuses[url]
+	if !exists {
+		return false
+	}
+	d.restoreExpired(status, d.now())
+	return status.Ejected
+}
+
+// RecordSuccess resets the failure streak of a backend
+func (d *outlierDetector) RecordSuccess(url string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if status, exists := d.statuses[url]; exists {
+		status.ConsecutiveFailures = 0
+	}
+}
+
+// RecordFailure counts a failed request and ejects the backend once the streak is long enough
+func (d *outlierDetector) RecordFailure(url, reason string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	status := d.status(url)
+	d.restoreExpired(status, now)
+
+	status.ConsecutiveFailures++
+	status.LastFailure = reason
+	status.LastFailureAt = now
+
+	if status.Ejected || status.ConsecutiveFailures < d.consecutiveFailures {
+		return
+	}
+
+	// Forget earlier ejections if the backend has been stable for a while
+	if status.EjectionCount > 0 && now.Sub(status.EjectedUntil) > d.maxEjection {
+		status.EjectionCount = 0
+	}
+
+	// Double the ejection time for each repeated ejection, up to the maximum
+	duration := d.baseEjection
+	for i := 0; i < status.EjectionCount && duration < d.maxEjection; i++ {
+		duration *= 2
+	}
+	if duration > d.maxEjection {
+		duration = d.maxEjection
+	}
+
+	status.Ejected = true
+	status.EjectedUntil = now.Add(duration)
+	status.EjectionCount++
+	d.record(OutlierEvent{
+		URL:       url,
+		Event:     "ejected",
+		Reason:    fmt.Sprintf("%d consecutive failures, last: %s", status.ConsecutiveFailures, reason),
+		Duration:  duration.String(),
+		Timestamp: now,
+	})
+	fmt.Printf("Backend %s ejected for %v after %d consecutive failures\n", url, duration, status.ConsecutiveFailures)
+}
+
+// retain drops the state of backends that are no longer used
+func (d *outlierDetector) retain(backendURLs map[string]bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for url := range d.statuses {
+		if !backendURLs[url] {
+			delete(d.statuses, url)
+		}
+	}
+}
+
+// Snapshot returns a copy of all backend states and the ejection history, newest event first
+func (d *outlierDetector) Snapshot() ([]OutlierStatus, []OutlierEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	statuses := make([]OutlierStatus, 0, len(d.statuses))
+	for _, status := range d.statuses {
+		d.restoreExpired(status, now)
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].URL < statuses[j].URL })
+
+	history := make([]OutlierEvent, len(d.history))
+	for i, event := range d.history {
+		history[len(d.history)-1-i] = event
+	}
+	return statuses, history
+}
+
+// GetOutlierStatus returns the passive health state of all backends that have
+// seen failures, along with the ejection history
+func GetOutlierStatus() ([]OutlierStatus, []OutlierEvent) {
+	return outliers.Snapshot()
+}
+
+// getEnvInt gets an environment variable as an integer or returns a default value
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil || intValue <= 0 {
+		fmt.Printf("Warning: Invalid value for %s: %s, using default %d\n", key, value, defaultValue)
+		return defaultValue
+	}
+	return intValue
+}
+
+// getEnvDuration gets an environment variable as a duration or returns a default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		fmt.Printf("Warning: Invalid duration for %s: %s, using default %v\n", key, value, defaultValue)
+		return defaultValue
+	}
+	return duration
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestOutliers returns an outlier detector running on a synthetic clock, which ejects
+// after 3 failures for 30s, doubled for each repeat up to 3m
+func newTestOutliers() (*outlierDetector, *testClock) {
+	clock := &testClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	d := newOutlierDetector(3, 30*time.Second, 3*time.Minute)
+	d.now = clock.Now
+	return d, clock
+}
+
+// fail records failed requests to a backend
+func fail(d *outlierDetector, url string, count int) {
+	for i := 0; i < count; i++ {
+		d.RecordFailure(url, "status 502")
+	}
+}
+
+// ejectedUntil returns when the ejection of a backend ends, or the zero time when it is not ejected
+func ejectedUntil(d *outlierDetector, url string) time.Time {
+	statuses, _ := d.Snapshot()
+	for _, status := range statuses {
+		if status.URL == url && status.Ejected {
+			return status.EjectedUntil
+		}
+	}
+	return time.Time{}
+}
+
+func TestOutlierEjectionAfterConsecutiveFailures(t *testing.T) {
+	const url = "http://a.test"
+	d, _ := newTestOutliers()
+
+	// A success resets the streak
+	fail(d, url, 2)
+	d.RecordSuccess(url)
+	fail(d, url, 2)
+	if d.IsEjected(url) {
+		t.Fatal("ejected without 3 failures in a row")
+	}
+	fail(d, url, 1)
+	if !d.IsEjected(url) {
+		t.Fatal("not ejected after 3 failures in a row")
+	}
+
+	// Failures while ejected do not extend the ejection
+	until := ejectedUntil(d, url)
+	fail(d, url, 5)
+	if got := ejectedUntil(d, url); !got.Equal(until) {
+		t.Fatalf("ejection extended to %v by failures while ejected, want %v", got, until)
+	}
+}
+
+func TestOutlierEjectionDoublesUpToTheMax(t *testing.T) {
+	const url = "http://a.test"
+	d, clock := newTestOutliers()
+
+	for i, want := range []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		fail(d, url, 3)
+		until := ejectedUntil(d, url)
+		if got := until.Sub(clock.Now()); got != want {
+			t.Fatalf("ejection %d lasts %v, want %v", i+1, got, want)
+		}
+
+		// Ejected until the time is over, then back in rotation with a fresh streak
+		clock.Advance(want - time.Nanosecond)
+		if !d.IsEjected(url) {
+			t.Fatalf("ejection %d ended early", i+1)
+		}
+		clock.Advance(time.Nanosecond)
+		if d.IsEjected(url) {
+			t.Fatalf("ejection %d did not end after %v", i+1, want)
+		}
+		fail(d, url, 2)
+		if d.IsEjected(url) {
+			t.Fatalf("ejected again after 2 failures following ejection %d", i+1)
+		}
+		d.RecordSuccess(url)
+	}
+
+	_, history := d.Snapshot()
+	if len(history) != 10 || history[0].Event != "restored" || history[1].Event != "ejected" || history[1].Duration != "3m0s" {
+		t.Fatalf("history = %+v, want 5 ejections each followed by a restore", history)
+	}
+}
+
+func TestOutlierEjectionsAreForgottenWhenStable(t *testing.T) {
+	const url = "http://a.test"
+	d, clock := newTestOutliers()
+
+	fail(d, url, 3)
+	clock.Advance(30 * time.Second)
+	fail(d, url, 3)
+	if got := ejectedUntil(d, url).Sub(clock.Now()); got != time.Minute {
+		t.Fatalf("second ejection lasts %v, want 1m", got)
+	}
+
+	// Stable for longer than the maximum ejection time after the last ejection ended
+	clock.Advance(time.Minute + 3*time.Minute + time.Second)
+	fail(d, url, 3)
+	if got := ejectedUntil(d, url).Sub(clock.Now()); got != 30*time.Second {
+		t.Fatalf("ejection after a stable period lasts %v, want the base 30s", got)
+	}
+}
+
+func TestOutlierRetainDropsRemovedBackends(t *testing.T) {
+	d, _ := newTestOutliers()
+	fail(d, "http://a.test", 3)
+	fail(d, "http://b.test", 1)
+	fail(d, "http://c.test", 3)
+
+	d.retain(map[string]bool{"http://a.test": true, "http://b.test": true})
+	statuses, history := d.Snapshot()
+	if len(statuses) != 2 || statuses[0].URL != "http://a.test" || statuses[1].URL != "http://b.test" {
+		t.Fatalf("statuses = %+v, want a.test and b.test only", statuses)
+	}
+	if !statuses[0].Ejected || statuses[1].ConsecutiveFailures != 1 {
+		t.Fatalf("statuses = %+v, want the state of kept backends unchanged", statuses)
+	}
+	// The history still records what happened to removed backends
+	if len(history) != 2 {
+		t.Fatalf("history = %+v, want both ejections", history)
+	}
+
+	// A backend added back starts from a clean state
+	d.retain(map[string]bool{"http://a.test": true, "http://b.test": true, "http://c.test": true})
+	if d.IsEjected("http://c.test") {
+		t.Fatal("backend added back is still ejected")
+	}
+
+	d.retain(nil)
+	if statuses, _ := d.Snapshot(); len(statuses) != 0 {
+		t.Fatalf("statuses = %+v, want none", statuses)
+	}
+}
@@ -1,33 +1,67 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/arifur/strong-reverse-proxy/certs"
 	"github.com/arifur/strong-reverse-proxy/database"
 	"github.com/arifur/strong-reverse-proxy/filter"
+	"github.com/arifur/strong-reverse-proxy/health"
+	"github.com/arifur/strong-reverse-proxy/hostmatch"
+	"github.com/arifur/strong-reverse-proxy/middleware"
 	"github.com/arifur/strong-reverse-proxy/models"
 )
 
 var (
-	// Cache for DNS rules
-	dnsRuleCache     = make(map[string][]models.Backend)
+	// Cache for DNS rules, keyed by normalized hostname pattern, with their active backends
+	dnsRuleCache     = make(map[string]*models.DNSRule)
 	dnsRuleCacheLock = sync.RWMutex{}
 
-	// HTTP server instance
-	httpServer *http.Server
+	// HTTP and HTTPS server instances
+	httpServer  *http.Server
+	httpsServer *http.Server
 
-	// Track selected counts for each backend
-	backendCountMap     = make(map[string]int) // map[backendID]selectedCount
-	backendCountMapLock = sync.Mutex{}
+	// Balancers of the DNS rules' backend pools, keyed by DNS rule ID
+	balancerCache     = make(map[int]Balancer)
+	balancerCacheLock = sync.RWMutex{}
+
+	// Port of the HTTPS listener, used to build redirect URLs
+	httpsPort = "443"
 )
 
 // Initialize sets up the proxy functionality
 func Initialize() {
+	// Load passive health check and circuit breaker settings
+	configureOutlierDetection()
+	configureCircuitBreakers()
+
+	// Load connection settings for backend transports
+	configureTransport()
+
+	// Load the affinity cookie signing key
+	configureAffinity()
+
+	// Load retry settings
+	configureRetries()
+
+	// Load PROXY protocol settings of the listeners
+	configureProxyProtocol()
+
+	// Port of the HTTPS listener, used to build redirect URLs
+	if port := os.Getenv("HTTPS_PORT"); port != "" {
+		httpsPort = port
+	}
+
 	// Load DNS rules into cache initially
 	refreshCache()
 
@@ -49,7 +83,21 @@ func refreshCache() {
 	rows, err := database.DB.Query(`
 		SELECT 
 			d.id, 
-			d.hostname
+			d.hostname,
+			d.health_check_enabled,
+			d.redirect_https,
+			d.lb_algorithm,
+			d.lb_hash_key,
+			d.affinity_mode,
+			d.affinity_header,
+			d.affinity_cookie_name,
+			d.affinity_ttl,
+			d.retry_enabled,
+			d.retry_attempts,
+			d.retry_non_idempotent,
+			d.retry_on_status,
+			d.retry_per_try_timeout_ms,
+			d.retry_budget
 		FROM 
 			dns_rules d
 	`)
@@ -60,15 +108,21 @@ func refreshCache() {
 	defer rows.Close()
 
 	// Temporary cache to avoid locking the main cache during the entire operation
-	tempCache := make(map[string][]models.Backend)
+	tempCache := make(map[string]*models.DNSRule)
 
 	// Iterate through DNS rules
 	for rows.Next() {
 		var rule models.DNSRule
-		if err := rows.Scan(&rule.ID, &rule.Hostname); err != nil {
+		var retryOnStatus string
+		if err := rows.Scan(&rule.ID, &rule.Hostname, &rule.HealthCheckEnabled, &rule.RedirectHTTPS, &rule.LBAlgorithm, &rule.LBHashKey,
+			&rule.AffinityMode, &rule.AffinityHeader, &rule.AffinityCookieName, &rule.AffinityTTL,
+			&rule.RetryEnabled, &rule.RetryAttempts, &rule.RetryNonIdempotent, &retryOnStatus, &rule.RetryPerTryTimeoutMS, &rule.RetryBudget); err != nil {
 			fmt.Printf("Error scanning DNS rule: %v\n", err)
 			continue
 		}
+		if rule.RetryOnStatus, err = ParseRetryOnStatus(retryOnStatus); err != nil {
+			fmt.Printf("DNS rule %s: %v\n", rule.Hostname, err)
+		}
 
 		// Get backends for this DNS rule
 		backendRows, err := database.DB.Query(`
@@ -103,24 +157,99 @@ func refreshCache() {
 		}
 		backendRows.Close()
 
-		// Add to temporary cache
-		if len(backends) > 0 {
-			// Store by original hostname (could include port)
-			tempCache[rule.Hostname] = backends
+		// Add to temporary cache, keyed without port and case so lookups can match any form of the host
+		pattern, err := hostmatch.NormalizePattern(rule.Hostname)
+		if err != nil {
+			fmt.Printf("Skipping DNS rule %s: %v\n", rule.Hostname, err)
+			continue
+		}
+		if existing, ok := tempCache[pattern]; ok {
+			fmt.Printf("Skipping DNS rule %s: hostname already served by %s\n", rule.Hostname, existing.Hostname)
+			continue
+		}
+		rule.TargetBackendURLs = backends
+		tempCache[pattern] = &rule
+
+		// Also log the hostnames being cached
+		fmt.Printf("DNS rule cached: %s with %d backends\n", rule.Hostname, len(backends))
+	}
+
+	// Create a balancer for each DNS rule, and for each of its routes with the same settings
+	balancers := make(map[int]Balancer, len(tempCache))
+	rulesByID := make(map[int]*models.DNSRule, len(tempCache))
+	for _, rule := range tempCache {
+		balancers[rule.ID] = ruleBalancer(rule)
+		rulesByID[rule.ID] = rule
+	}
+
+	// Load path based routes of the DNS rules
+	routes := loadRoutes()
+	for ruleID, ruleRoutes := range routes {
+		for _, route := range ruleRoutes {
+			if rule, exists := rulesByID[ruleID]; exists {
+				route.balancer = ruleBalancer(rule)
+			}
+		}
+	}
+
+	// Load request and response header rules of the DNS rules
+	headers := loadHeaderRules()
 
-			// Also log the hostnames being cached
-			fmt.Printf("DNS rule cached: %s with %d backends\n", rule.Hostname, len(backends))
+	// Build reverse proxies for every backend in use with its connection settings, keeping
+	// the ones that already exist with the same settings
+	backendURLs := make(map[string]bool)
+	for _, rule := range tempCache {
+		for _, backend := range rule.TargetBackendURLs {
+			backendURLs[backend.URL] = true
 		}
 	}
+	for _, ruleRoutes := range routes {
+		for _, route := range ruleRoutes {
+			for _, backend := range route.Backends {
+				backendURLs[backend.URL] = true
+			}
+		}
+	}
+	rebuildBackendProxies(backendURLs, loadBackendTransports())
+	loads.retain(backendURLs)
+	circuits.retain(backendURLs)
+	outliers.retain(backendURLs)
+	retainRetryBudgets(rulesByID)
 
 	// Update the main cache with a lock
 	dnsRuleCacheLock.Lock()
 	dnsRuleCache = tempCache
 	dnsRuleCacheLock.Unlock()
 
+	routeCacheLock.Lock()
+	routeCache = routes
+	routeCacheLock.Unlock()
+
+	headerCacheLock.Lock()
+	headerCache = headers
+	headerCacheLock.Unlock()
+
+	balancerCacheLock.Lock()
+	balancerCache = balancers
+	balancerCacheLock.Unlock()
+
 	fmt.Printf("DNS cache refreshed with %d entries\n", len(tempCache))
 }
 
+// lookupRule returns the most specific DNS rule for a request host: an exact match,
+// then the closest wildcard, then the catch-all rule. It returns nil if none matches.
+func lookupRule(host string) *models.DNSRule {
+	dnsRuleCacheLock.RLock()
+	defer dnsRuleCacheLock.RUnlock()
+
+	for _, pattern := range hostmatch.Candidates(host) {
+		if rule, ok := dnsRuleCache[pattern]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
 // RefreshDNSRulesCache immediately refreshes the DNS rules cache
 // This can be called from other packages after DNS rules are modified
 func RefreshDNSRulesCache() {
@@ -128,56 +257,43 @@ func RefreshDNSRulesCache() {
 	refreshCache()
 }
 
-// selects a backend using weighted round-robin algorithm
-// weight will give the percentage of requests to send to the backend based on the other backends weight.
-// after weight adjustment, then follow round robin algorithm to select the backend.
-func selectBackend(backends []models.Backend) *models.Backend {
-	if len(backends) == 1 {
-		// If there's only one backend, increment its count and return it
-		backendCountMapLock.Lock()
-		backendCountMap[backends[0].URL]++
-		backendCountMapLock.Unlock()
-		return &backends[0]
-	}
-
-	// find minimum weight backend
-	minWeight := backends[0].Weight
-	for _, backend := range backends {
-		if backend.Weight < minWeight {
-			minWeight = backend.Weight
+// availableBackends returns the backends of a DNS rule that may receive traffic.
+// When health checks are enabled, unhealthy backends are skipped, and backends
+// ejected for failing live requests are skipped as well. If that would leave no
+// backend at all, the previous candidates are used as a last resort. Backends with
+// an open circuit breaker are always skipped, so the result may be empty.
+func availableBackends(rule *models.DNSRule) []models.Backend {
+	candidates := rule.TargetBackendURLs
+
+	if rule.HealthCheckEnabled {
+		healthy := make([]models.Backend, 0, len(candidates))
+		for _, backend := range candidates {
+			if health.IsHealthy(rule.ID, backend.URL) {
+				healthy = append(healthy, backend)
+			}
+		}
+		if len(healthy) > 0 {
+			candidates = healthy
 		}
 	}
 
-	backendCountMapLock.Lock()
-	defer backendCountMapLock.Unlock()
-
-	var selectedBackend *models.Backend
-	var maxPriorityValue float64 = 0
-
-	// update ratio for each backend based on min weight
-	for i := range backends {
-		// Use the pointer to the backend in the slice
-		backend := &backends[i]
-
-		// Calculate ratio
-		backend.Ratio = float64(backend.Weight) / float64(minWeight)
-
-		// Get current selected count from the map
-		selectedCount := backendCountMap[backend.URL]
-
-		// Calculate priority
-		priority := backend.Ratio - float64(selectedCount)
-
-		if selectedBackend == nil || priority > maxPriorityValue {
-			maxPriorityValue = priority
-			selectedBackend = backend
+	active := make([]models.Backend, 0, len(candidates))
+	for _, backend := range candidates {
+		if !outliers.IsEjected(backend.URL) {
+			active = append(active, backend)
 		}
 	}
+	if len(active) == 0 {
+		active = candidates
+	}
 
-	// Increment the selected backend's count
-	backendCountMap[selectedBackend.URL]++
-
-	return selectedBackend
+	allowed := make([]models.Backend, 0, len(active))
+	for _, backend := range active {
+		if circuits.Allows(backend.URL) {
+			allowed = append(allowed, backend)
+		}
+	}
+	return allowed
 }
 
 type DebugTransport struct{}
@@ -193,8 +309,22 @@ func (DebugTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 
 // proxyHandler is the main HTTP handler for proxying requests
 func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	// Send plain HTTP requests to HTTPS for DNS rules that require it
+	if r.TLS == nil && redirectToHTTPS(w, r) {
+		return
+	}
+
+	// Look up the DNS rule for this hostname. Filtered requests are logged under its
+	// hostname too, so that alerts scoped to the DNS rule count them.
+	hostname := r.Host
+	rule := lookupRule(hostname)
+	logHostname := hostmatch.Normalize(hostname)
+	if rule != nil {
+		logHostname = rule.Hostname
+	}
+
 	// Check if request should be filtered first
-	filterResult, err := filter.FilterRequest(r)
+	filterResult, err := filter.FilterRequest(r, logHostname)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
@@ -215,89 +345,263 @@ func proxyHandler(w http.ResponseWriter, r *http.Request) {
 
 		// Log the filtered request in request_logs table as well
 		userAgent := r.Header.Get("User-Agent")
-		clientIP := r.RemoteAddr
-		go logRequest(clientIP, r.Host, r.URL.Path, 0, 0, filterResult.StatusCode, false, userAgent, filterResult.Rule.ID)
+		go logRequest(filter.GetClientIP(r), logHostname, r.URL.Path, 0, 0, filterResult.StatusCode, false, userAgent, filterResult.Rule.ID, 1)
 		return
 	}
 
-	// Extract hostname from request
-	hostname := r.Host
-	// Look up backends for this hostname
-	dnsRuleCacheLock.RLock()
-	backends, exists := dnsRuleCache[hostname]
-	dnsRuleCacheLock.RUnlock()
-
-	if !exists || len(backends) == 0 {
-		http.Error(w, "No backends found for this hostname "+hostname, http.StatusGone)
+	// Enforce the per-hostname rate limit for this client
+	if !middleware.CheckHTTPRateLimit(w, r) {
 		return
 	}
 
-	// Select a backend using weighted round-robin
-	backend := selectBackend(backends)
+	// Extract the real client address from request
+	clientIP := filter.GetClientIP(r)
+	if rule == nil {
+		http.Error(w, "No DNS rule found for this hostname "+hostmatch.Normalize(hostname), http.StatusNotFound)
+		return
+	}
 
-	// Start measuring request time
-	startTime := time.Now()
+	balancerCacheLock.RLock()
+	balancer := balancerCache[rule.ID]
+	balancerCacheLock.RUnlock()
+
+	// Requests matching a path based route go to the route's own backend pool
+	requestPath := r.URL.Path
+	pool := ""
+	if route := matchRoute(rule.ID, r); route != nil {
+		routed := *rule
+		routed.TargetBackendURLs = route.Backends
+		rule = &routed
+		balancer = route.balancer
+		pool = "r" + strconv.Itoa(route.ID)
+
+		r.URL.Path = route.rewrite(requestPath)
+		r.URL.RawPath = ""
+	}
+	if len(rule.TargetBackendURLs) == 0 {
+		http.Error(w, "No active backends for this hostname "+hostmatch.Normalize(hostname), http.StatusServiceUnavailable)
+		go logRequest(clientIP, rule.Hostname, requestPath, 0, 0, http.StatusServiceUnavailable, false, r.Header.Get("User-Agent"), 0, 1)
+		return
+	}
 
-	// Parse the backend URL
-	targetURL, err := url.Parse(backend.URL)
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	// Skip backends that failed their health checks, and fail fast when every circuit breaker is open
+	backends := availableBackends(rule)
+	if len(backends) == 0 {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		go logRequest(clientIP, rule.Hostname, requestPath, 0, 0, http.StatusServiceUnavailable, false, r.Header.Get("User-Agent"), 0, 1)
 		return
 	}
+	if balancer == nil {
+		balancer = ruleBalancer(rule)
+	}
+
+	// Retries are only possible when the request body can be replayed
+	maxAttempts := retryAttempts(rule, r)
+	var body []byte
+	if maxAttempts > 1 {
+		var replayable bool
+		if body, replayable = bufferBody(r); !replayable {
+			maxAttempts = 1
+		}
+	}
+	var budget *retryBudget
+	if rule.RetryEnabled {
+		budget = budgetFor(rule.ID)
+		budget.deposit(rule.RetryBudget)
+	}
+
+	// Header rules are applied by the shared proxy's director and response handler
+	headers := headerRulesFor(rule.ID)
+	reqID := ""
+	if headers != nil && headers.usesRequestID {
+		reqID = requestID(r)
+	}
 
 	//r.Host = targetURL.Host
 	r.Header.Set("host", hostname)
-	// Create reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(targetURL)
 
-	// Called on every response from the backend
-	proxy.ModifyResponse = func(resp *http.Response) error {
+	tried := make(map[int]bool)
+	var failed *proxyRequest
+	for attempt := 1; ; attempt++ {
+		// Select a backend the request has not tried yet
+		backend, probe := selectBackend(w, r, rule, pool, backends, tried, balancer)
+		if backend == nil {
+			// A failure left to a retry is answered as it would have been without retries
+			// when the untried backends stopped accepting requests in the meantime
+			status := http.StatusServiceUnavailable
+			if failed != nil {
+				budget.refund()
+				status = failed.status
+			}
+			http.Error(w, http.StatusText(status), status)
+			go logRequest(clientIP, rule.Hostname, requestPath, 0, 0, status, false, r.Header.Get("User-Agent"), 0, attempt)
+			return
+		}
 
-		// Calculate latency
-		latencyMS := time.Since(startTime).Milliseconds()
-		userAgent := r.Header.Get("User-Agent")
-		go logRequest(r.RemoteAddr, hostname, r.URL.Path, backend.ID, int(latencyMS), resp.StatusCode, true, userAgent, 0)
+		// Get the reverse proxy of the backend
+		bp, err := getBackendProxy(backend.URL)
+		if err != nil {
+			circuits.Release(backend.URL, probe, circuitIgnored, "")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
 
-		return nil
-	}
+		// A failed attempt may be retried while attempts, budget and untried backends whose
+		// circuit breaker lets requests through remain
+		retryable := attempt < maxAttempts && canRetryOn(backends, tried) && budget.withdraw()
+
+		// Pass the request details to the shared proxy's response and error handlers
+		pr := &proxyRequest{
+			clientIP:    clientIP,
+			hostname:    rule.Hostname,
+			requestPath: requestPath,
+			userAgent:   r.Header.Get("User-Agent"),
+			backend:     *backend,
+			startTime:   time.Now(),
+			attempt:     attempt,
+			rule:        rule,
+			retryable:   retryable,
+			backends:    backends,
+			tried:       tried,
+			probe:       probe,
+
+			headers:     headers,
+			requestHost: hostname,
+			requestID:   reqID,
+		}
+		ctx, cancel := context.WithCancelCause(context.WithValue(r.Context(), proxyRequestKey{}, pr))
+		if rule.RetryEnabled && rule.RetryPerTryTimeoutMS > 0 {
+			pr.timer = time.AfterFunc(time.Duration(rule.RetryPerTryTimeoutMS)*time.Millisecond, func() {
+				cancel(errPerTryTimeout)
+			})
+		}
+		outreq := r.WithContext(ctx)
+		if body != nil {
+			outreq.Body = io.NopCloser(bytes.NewReader(body))
+		}
 
-	// Optional: catch errors in contacting backend
-	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
-		rw.WriteHeader(http.StatusBadGateway)
-		rw.Write([]byte("Bad Gateway"))
+		// Serve the attempt, counting it as in flight for the load aware balancers,
+		// and report its outcome to the circuit breaker
+		func() {
+			load := loads.get(backend.URL)
+			load.active.Add(1)
+			defer load.active.Add(-1)
+			defer func() { circuits.Release(backend.URL, pr.probe, pr.result, pr.failureReason) }()
+			defer cancel(nil)
+			bp.proxy.ServeHTTP(w, outreq)
+		}()
+		if pr.timer != nil {
+			pr.timer.Stop()
+		}
 
-		// Calculate latency
-		latencyMS := time.Since(startTime).Milliseconds()
-		userAgent := req.Header.Get("User-Agent")
-		go logRequest(req.RemoteAddr, hostname, req.URL.Path, backend.ID, int(latencyMS), http.StatusBadGateway, false, userAgent, 0)
+		if pr.failure == nil {
+			if retryable {
+				budget.refund()
+			}
+			return
+		}
+		failed = pr
 	}
+}
 
-	// Serve the request
-	proxy.ServeHTTP(w, r)
+// selectBackend picks the backend of an attempt among the ones not tried yet, using the
+// DNS rule's session affinity and load balancing algorithm. Backends whose half-open
+// circuit breaker has no probe slot left are skipped. It returns nil when no backend is
+// left, and whether the request is a circuit breaker probe.
+func selectBackend(w http.ResponseWriter, r *http.Request, rule *models.DNSRule, pool string, backends []models.Backend, tried map[int]bool, balancer Balancer) (*models.Backend, bool) {
+	for len(untriedBackends(backends, tried)) > 0 {
+		// The balancer gets the whole pool, so its state is not reset by the tried backends
+		var backend *models.Backend
+		if rule.AffinityMode == AffinityCookie {
+			// Only the cookie of the backend that answers is sent to the client
+			w.Header().Del("Set-Cookie")
+			backend = selectSticky(w, r, rule, pool, backends, tried, balancer)
+		} else {
+			backend = balancer.Select(backends, tried, r)
+		}
+		tried[backend.ID] = true
 
+		if allowed, probe := circuits.Acquire(backend.URL); allowed {
+			return backend, probe
+		}
+	}
+	return nil, false
 }
 
-// logRequest logs the request to the database using buffered logging
-func logRequest(clientIP, hostname, requestPath string, backendID int, latencyMS int, statusCode int, isSuccess bool, userAgent string, filteredBy int) {
+func logRequest(clientIP, hostname, requestPath string, backendID int, latencyMS int, statusCode int, isSuccess bool, userAgent string, filteredBy int, attempt int) {
 	// Use buffered logger to reduce database contention
-	database.LogRequest(clientIP, hostname, requestPath, backendID, latencyMS, statusCode, isSuccess, userAgent, filteredBy)
+	database.LogRequest(clientIP, hostname, requestPath, backendID, latencyMS, statusCode, isSuccess, userAgent, filteredBy, attempt)
+}
+
+// redirectToHTTPS redirects the request to HTTPS if TLS is enabled and its DNS rule asks for it.
+// It reports whether a redirect was sent.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) bool {
+	if !certs.Enabled() {
+		return false
+	}
+
+	rule := lookupRule(r.Host)
+	if rule == nil || !rule.RedirectHTTPS {
+		return false
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if httpsPort != "443" {
+		host = net.JoinHostPort(host, httpsPort)
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	return true
 }
 
 // StartProxyServer starts the HTTP server for the proxy
 func StartProxyServer(address string) error {
-	// Create a new server
+	// Create a new server, answering ACME challenges before proxying
 	httpServer = &http.Server{
 		Addr:    address,
-		Handler: http.HandlerFunc(proxyHandler),
+		Handler: certs.HTTPHandler(http.HandlerFunc(proxyHandler)),
+	}
+
+	listener, err := listen(address)
+	if err != nil {
+		return err
 	}
 
 	// Start the server
 	fmt.Printf("Starting proxy server on %s\n", address)
-	return httpServer.ListenAndServe()
+	return httpServer.Serve(listener)
+}
+
+// StartTLSProxyServer starts the HTTPS server for the proxy, serving certificates for
+// DNS rule hostnames. It does nothing when TLS is disabled.
+func StartTLSProxyServer(address string) error {
+	if !certs.Enabled() {
+		return nil
+	}
+
+	httpsServer = &http.Server{
+		Addr:      address,
+		Handler:   http.HandlerFunc(proxyHandler),
+		TLSConfig: certs.TLSConfig(),
+	}
+
+	listener, err := listen(address)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Starting TLS proxy server on %s\n", address)
+	return httpsServer.ServeTLS(listener, "", "")
 }
 
-// StopProxyServer stops the HTTP server
+// StopProxyServer stops the HTTP and HTTPS servers
 func StopProxyServer() error {
+	if httpsServer != nil {
+		httpsServer.Close()
+	}
 	if httpServer != nil {
 		return httpServer.Close()
 	}
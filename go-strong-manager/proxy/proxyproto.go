@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/filter"
+)
+
+// Signature that starts a PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// Longest PROXY protocol v1 header, including the trailing CRLF
+	proxyProtocolV1MaxLength = 107
+	// Length of the fixed part of a PROXY protocol v2 header
+	proxyProtocolV2HeaderLength = 16
+)
+
+var (
+	// Whether the listeners expect a PROXY protocol header from the load balancer
+	proxyProtocolEnabled = false
+	// Time allowed for a connection to send its PROXY protocol header
+	proxyProtocolTimeout = 5 * time.Second
+
+	errProxyProtocolHeader = errors.New("invalid PROXY protocol header")
+)
+
+// configureProxyProtocol loads PROXY protocol settings from the environment
+func configureProxyProtocol() {
+	if value := os.Getenv("PROXY_PROTOCOL"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			fmt.Printf("Warning: Invalid value for PROXY_PROTOCOL: %s, using default %v\n", value, proxyProtocolEnabled)
+		} else {
+			proxyProtocolEnabled = enabled
+		}
+	}
+	proxyProtocolTimeout = getEnvDuration("PROXY_PROTOCOL_TIMEOUT", proxyProtocolTimeout)
+}
+
+// listen opens a TCP listener, reading PROXY protocol headers when enabled
+func listen(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil || !proxyProtocolEnabled {
+		return listener, err
+	}
+	return &proxyProtocolListener{Listener: listener}, nil
+}
+
+// proxyProtocolListener accepts connections that start with a PROXY protocol v1 or v2
+// header carrying the client address, as sent by load balancers such as HAProxy or AWS
+// NLB. The header is required from trusted proxies, or from every peer when no trusted
+// proxy is configured; connections from other peers are served without it.
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the load balancer may tell us who the client is
+	if filter.TrustedProxiesConfigured() {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); !ok || !filter.IsTrustedProxy(addr.IP) {
+			return conn, nil
+		}
+	}
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header on first use, so a slow peer does
+// not block the accept loop
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	err        error
+}
+
+// readHeader parses the PROXY protocol header once
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		c.remoteAddr, c.localAddr, c.err = readProxyProtocolHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			fmt.Printf("Rejecting connection from %s: %v\n", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the header, or the peer address for
+// connections the load balancer opened itself, such as health checks
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyProtocolHeader reads a v1 or v2 header and returns the addresses it carries.
+// Both are nil when the header does not describe a proxied TCP connection.
+func readProxyProtocolHeader(r *bufio.Reader) (remote, local net.Addr, err error) {
+	start, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errProxyProtocolHeader, err)
+	}
+	if start[0] == proxyProtocolV2Signature[0] {
+		return readProxyProtocolV2(r)
+	}
+	return readProxyProtocolV1(r)
+}
+
+// readProxyProtocolV1 parses a header such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, nil, fmt.Errorf("%w: v1 header too long", errProxyProtocolHeader)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", errProxyProtocolHeader, err)
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, errProxyProtocolHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("%w: malformed v1 header", errProxyProtocolHeader)
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, nil, fmt.Errorf("%w: malformed v1 addresses", errProxyProtocolHeader)
+	}
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
+
+// readProxyProtocolV2 parses the binary header, ignoring its TLVs
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, proxyProtocolV2HeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errProxyProtocolHeader, err)
+	}
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) || header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("%w: bad v2 signature", errProxyProtocolHeader)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errProxyProtocolHeader, err)
+	}
+
+	switch command := header[12] & 0x0f; command {
+	case 0x0: // LOCAL: the load balancer's own connection
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown v2 command %d", errProxyProtocolHeader, command)
+	}
+
+	// Only TCP over IPv4 and IPv6 carry addresses we use
+	switch header[13] {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, nil, fmt.Errorf("%w: short v2 IPv4 addresses", errProxyProtocolHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))},
+			&net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}, nil
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, nil, fmt.Errorf("%w: short v2 IPv6 addresses", errProxyProtocolHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))},
+			&net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}, nil
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyProtocolV2 builds a v2 header with the given command, address family and payload
+func proxyProtocolV2(command, family byte, payload []byte) []byte {
+	header := append([]byte(nil), proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+// v2Addresses builds the address payload of a v2 header followed by extra bytes, such as TLVs
+func v2Addresses(src, dst string, srcPort, dstPort uint16, extra ...byte) []byte {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if srcIP.To4() != nil {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	}
+	payload := append(append([]byte(nil), srcIP...), dstIP...)
+	payload = binary.BigEndian.AppendUint16(payload, srcPort)
+	payload = binary.BigEndian.AppendUint16(payload, dstPort)
+	return append(payload, extra...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  []byte
+		remote  string // Empty when the header carries no addresses
+		local   string
+		invalid bool
+	}{
+		{
+			name:   "v1 TCP4",
+			header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+			remote: "192.0.2.1:56324",
+			local:  "198.51.100.1:443",
+		},
+		{
+			name:   "v1 TCP6",
+			header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			remote: "[2001:db8::1]:56324",
+			local:  "[2001:db8::2]:443",
+		},
+		{
+			name:   "v1 UNKNOWN",
+			header: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name:    "v1 without the PROXY keyword",
+			header:  []byte("GET / HTTP/1.1\r\n"),
+			invalid: true,
+		},
+		{
+			name:    "v1 with missing fields",
+			header:  []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"),
+			invalid: true,
+		},
+		{
+			name:    "v1 with an unknown protocol",
+			header:  []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+			invalid: true,
+		},
+		{
+			name:    "v1 with a bad address",
+			header:  []byte("PROXY TCP4 192.0.2.999 198.51.100.1 56324 443\r\n"),
+			invalid: true,
+		},
+		{
+			name:    "v1 with a port out of range",
+			header:  []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"),
+			invalid: true,
+		},
+		{
+			name:    "v1 without CRLF",
+			header:  []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"),
+			invalid: true,
+		},
+		{
+			name:    "v1 longer than allowed",
+			header:  []byte("PROXY TCP6 " + strings.Repeat("f", 120) + "\r\n"),
+			invalid: true,
+		},
+		{
+			name:   "v2 PROXY TCP over IPv4",
+			header: proxyProtocolV2(0x1, 0x11, v2Addresses("192.0.2.1", "198.51.100.1", 56324, 443)),
+			remote: "192.0.2.1:56324",
+			local:  "198.51.100.1:443",
+		},
+		{
+			name:   "v2 PROXY TCP over IPv6 with TLVs",
+			header: proxyProtocolV2(0x1, 0x21, v2Addresses("2001:db8::1", "2001:db8::2", 56324, 443, 0x04, 0x00, 0x01, 0xff)),
+			remote: "[2001:db8::1]:56324",
+			local:  "[2001:db8::2]:443",
+		},
+		{
+			name:   "v2 LOCAL",
+			header: proxyProtocolV2(0x0, 0x11, v2Addresses("192.0.2.1", "198.51.100.1", 56324, 443)),
+		},
+		{
+			name:   "v2 LOCAL without addresses",
+			header: proxyProtocolV2(0x0, 0x00, nil),
+		},
+		{
+			name:   "v2 PROXY with the UNSPEC family",
+			header: proxyProtocolV2(0x1, 0x00, nil),
+		},
+		{
+			name:   "v2 PROXY over UDP",
+			header: proxyProtocolV2(0x1, 0x12, v2Addresses("192.0.2.1", "198.51.100.1", 56324, 443)),
+		},
+		{
+			name:    "v2 with an unknown command",
+			header:  proxyProtocolV2(0x2, 0x11, v2Addresses("192.0.2.1", "198.51.100.1", 56324, 443)),
+			invalid: true,
+		},
+		{
+			name:    "v2 with a wrong version",
+			header:  append(append([]byte(nil), proxyProtocolV2Signature...), 0x11, 0x11, 0, 0),
+			invalid: true,
+		},
+		{
+			name:    "v2 with a bad signature",
+			header:  append([]byte("\r\n\r\n\x00\r\nQUIT!"), 0x21, 0x11, 0, 0),
+			invalid: true,
+		},
+		{
+			name:    "v2 truncated in the fixed header",
+			header:  proxyProtocolV2(0x1, 0x11, nil)[:10],
+			invalid: true,
+		},
+		{
+			name:    "v2 truncated in the payload",
+			header:  proxyProtocolV2(0x1, 0x11, v2Addresses("192.0.2.1", "198.51.100.1", 56324, 443))[:20],
+			invalid: true,
+		},
+		{
+			name:    "v2 IPv4 payload too short for the addresses",
+			header:  proxyProtocolV2(0x1, 0x11, v2Addresses("192.0.2.1", "198.51.100.1", 56324, 443)[:8]),
+			invalid: true,
+		},
+		{
+			name:    "v2 IPv6 payload too short for the addresses",
+			header:  proxyProtocolV2(0x1, 0x21, v2Addresses("192.0.2.1", "198.51.100.1", 56324, 443)),
+			invalid: true,
+		},
+		{
+			name:    "empty connection",
+			header:  nil,
+			invalid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The request that follows the header must be left unread
+			const request = "GET / HTTP/1.1\r\n\r\n"
+			r := bufio.NewReader(bytes.NewReader(append(append([]byte(nil), tt.header...), request...)))
+			if tt.invalid {
+				r = bufio.NewReader(bytes.NewReader(tt.header))
+			}
+
+			remote, local, err := readProxyProtocolHeader(r)
+			if tt.invalid {
+				if !errors.Is(err, errProxyProtocolHeader) {
+					t.Fatalf("err = %v, want errProxyProtocolHeader", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.remote == "" {
+				if remote != nil || local != nil {
+					t.Fatalf("addresses = %v, %v, want none", remote, local)
+				}
+			} else if remote == nil || local == nil || remote.String() != tt.remote || local.String() != tt.local {
+				t.Fatalf("addresses = %v, %v, want %s, %s", remote, local, tt.remote, tt.local)
+			}
+
+			if rest, _ := io.ReadAll(r); string(rest) != request {
+				t.Fatalf("data after the header = %q, want %q", rest, request)
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+const (
+	// DefaultRetryAttempts is the number of attempts, including the first, when a DNS rule does not set one
+	DefaultRetryAttempts = 3
+	// DefaultRetryBudget is the share of requests, in percent, that may be retried
+	DefaultRetryBudget = 20
+
+	// Upper bound for the number of attempts of a request
+	maxRetryAttempts = 10
+	// Retries a DNS rule may make before its budget has to be earned by new requests
+	retryBudgetBurst = 10
+)
+
+// DefaultRetryOnStatus lists the backend status codes retried when a DNS rule does not set any
+var DefaultRetryOnStatus = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+var (
+	// Largest request body buffered so it can be replayed to another backend
+	retryMaxBodyBytes = 64 * 1024
+
+	// Retry budgets keyed by DNS rule ID, kept across cache refreshes
+	retryBudgets     = make(map[int]*retryBudget)
+	retryBudgetsLock = sync.Mutex{}
+
+	// errPerTryTimeout is the cancellation cause of an attempt that timed out
+	errPerTryTimeout = errors.New("per-try timeout exceeded")
+	// errRetryableStatus is returned by modifyResponse to discard a response that will be retried
+	errRetryableStatus = errors.New("retryable status")
+)
+
+// configureRetries loads retry settings from the environment
+func configureRetries() {
+	retryMaxBodyBytes = getEnvInt("RETRY_MAX_BODY_BYTES", retryMaxBodyBytes)
+}
+
+// ValidateRetry checks the retry settings of a DNS rule
+func ValidateRetry(rule models.DNSRule) error {
+	if rule.RetryAttempts < 1 || rule.RetryAttempts > maxRetryAttempts {
+		return fmt.Errorf("retry attempts must be between 1 and %d", maxRetryAttempts)
+	}
+	for _, status := range rule.RetryOnStatus {
+		if status < 400 || status > 599 {
+			return fmt.Errorf("retry status codes must be between 400 and 599, got %d", status)
+		}
+	}
+	if rule.RetryPerTryTimeoutMS < 0 {
+		return fmt.Errorf("retry per-try timeout must not be negative")
+	}
+	if rule.RetryBudget < 1 || rule.RetryBudget > 100 {
+		return fmt.Errorf("retry budget must be between 1 and 100 percent")
+	}
+	return nil
+}
+
+// ParseRetryOnStatus decodes the stored list of retried status codes
+func ParseRetryOnStatus(encoded string) ([]int, error) {
+	statuses := []int{}
+	if encoded == "" {
+		return statuses, nil
+	}
+	if err := json.Unmarshal([]byte(encoded), &statuses); err != nil {
+		return nil, fmt.Errorf("invalid retry status codes: %w", err)
+	}
+	return statuses, nil
+}
+
+// isIdempotent reports whether a request with the method can safely be sent twice
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryAttempts returns how many attempts a request may make under its DNS rule
+func retryAttempts(rule *models.DNSRule, r *http.Request) int {
+	if !rule.RetryEnabled || rule.RetryAttempts <= 1 {
+		return 1
+	}
+	if !rule.RetryNonIdempotent && !isIdempotent(r.Method) {
+		return 1
+	}
+	return rule.RetryAttempts
+}
+
+// bufferBody reads a small request body into memory so it can be sent again. It reports
+// false when the body is too large, in which case the request must not be retried and its
+// body is left intact for the first attempt.
+func bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+	if r.ContentLength > int64(retryMaxBodyBytes) {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(retryMaxBodyBytes)+1))
+	if err != nil || len(body) > retryMaxBodyBytes {
+		// Put back what was read in front of the rest of the body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false
+	}
+	r.Body.Close()
+	return body, true
+}
+
+// isRetryableError reports whether a failed attempt may be retried on another backend:
+// the backend could not be dialed, timed out, or answered with a retried status code.
+// Requests abandoned by the client are never retried.
+func isRetryableError(req *http.Request, err error) bool {
+	if errors.Is(err, errRetryableStatus) {
+		return true
+	}
+	if errors.Is(context.Cause(req.Context()), errPerTryTimeout) {
+		return true
+	}
+	if req.Context().Err() != nil {
+		return false
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retriesOnStatus reports whether the DNS rule retries responses with the status code
+func retriesOnStatus(rule *models.DNSRule, status int) bool {
+	for _, s := range rule.RetryOnStatus {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// untriedBackends returns the backends not attempted yet for a request
+func untriedBackends(backends []models.Backend, tried map[int]bool) []models.Backend {
+	untried := make([]models.Backend, 0, len(backends))
+	for _, backend := range backends {
+		if !tried[backend.ID] {
+			untried = append(untried, backend)
+		}
+	}
+	return untried
+}
+
+// canRetryOn reports whether a backend not attempted yet can take a retry, that is
+// whether its circuit breaker lets a request through
+func canRetryOn(backends []models.Backend, tried map[int]bool) bool {
+	for _, backend := range backends {
+		if !tried[backend.ID] && circuits.Allows(backend.URL) {
+			return true
+		}
+	}
+	return false
+}
+
+// canRetry reports whether a failure of the attempt can be left to a retry: retries were
+// allowed when it started, and a backend not tried yet still accepts requests
+func (pr *proxyRequest) canRetry() bool {
+	return pr.retryable && canRetryOn(pr.backends, pr.tried)
+}
+
+// retryBudget limits retries to a share of the requests of a DNS rule, so retries cannot
+// multiply the load on backends that are already failing. Every request earns a fraction
+// of a retry, and every retry spends a whole one.
+type retryBudget struct {
+	mu     sync.Mutex
+	tokens float64
+}
+
+// deposit credits the budget for a new request
+func (b *retryBudget) deposit(percent int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += float64(percent) / 100
+	if b.tokens > retryBudgetBurst {
+		b.tokens = retryBudgetBurst
+	}
+}
+
+// withdraw reserves a retry, reporting false when the budget is exhausted
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refund returns a reserved retry that was not needed
+func (b *retryBudget) refund() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens++
+}
+
+// budgetFor returns the retry budget of a DNS rule, creating a full one if needed
+func budgetFor(ruleID int) *retryBudget {
+	retryBudgetsLock.Lock()
+	defer retryBudgetsLock.Unlock()
+	budget, exists := retryBudgets[ruleID]
+	if !exists {
+		budget = &retryBudget{tokens: retryBudgetBurst}
+		retryBudgets[ruleID] = budget
+	}
+	return budget
+}
+
+// retainRetryBudgets drops the retry budgets of DNS rules that no longer exist
+func retainRetryBudgets(rulesByID map[int]*models.DNSRule) {
+	retryBudgetsLock.Lock()
+	defer retryBudgetsLock.Unlock()
+	for ruleID := range retryBudgets {
+		if _, exists := rulesByID[ruleID]; !exists {
+			delete(retryBudgets, ruleID)
+		}
+	}
+}
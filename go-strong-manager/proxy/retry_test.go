@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// useRetryMaxBodyBytes limits buffered request bodies for the duration of a test
+func useRetryMaxBodyBytes(t *testing.T, limit int) {
+	previous := retryMaxBodyBytes
+	retryMaxBodyBytes = limit
+	t.Cleanup(func() { retryMaxBodyBytes = previous })
+}
+
+// closeRecorder records whether a body was closed
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestBufferBody(t *testing.T) {
+	useRetryMaxBodyBytes(t, 10)
+
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64 // -1 for a body of unknown length
+		replayable    bool
+	}{
+		{"empty", "", 0, true},
+		{"small", "hello", 5, true},
+		{"exactly the limit", "0123456789", 10, true},
+		{"small of unknown length", "hello", -1, true},
+		{"announced larger than the limit", "0123456789a", 11, false},
+		{"larger than the limit of unknown length", "0123456789abcdef", -1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/", nil)
+			source := &closeRecorder{Reader: strings.NewReader(tt.body)}
+			r.Body, r.ContentLength = source, tt.contentLength
+
+			body, replayable := bufferBody(r)
+			if replayable != tt.replayable {
+				t.Fatalf("replayable = %v, want %v", replayable, tt.replayable)
+			}
+
+			if replayable {
+				if string(body) != tt.body {
+					t.Errorf("buffered %q, want %q", body, tt.body)
+				}
+				if !source.closed {
+					t.Error("buffered body was not closed")
+				}
+				return
+			}
+
+			// The first attempt still gets the whole body
+			if body != nil {
+				t.Errorf("buffered %q of a body too large to replay", body)
+			}
+			rest, _ := io.ReadAll(r.Body)
+			if string(rest) != tt.body {
+				t.Errorf("body left for the first attempt = %q, want %q", rest, tt.body)
+			}
+			r.Body.Close()
+			if !source.closed {
+				t.Error("closing the restored body does not close the original")
+			}
+		})
+	}
+
+	// Requests without a body can always be replayed
+	if body, replayable := bufferBody(httptest.NewRequest("GET", "/", nil)); body != nil || !replayable {
+		t.Errorf("request without body: got %q, %v, want nothing to buffer", body, replayable)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	perTryTimeout, cancelPerTry := context.WithCancelCause(context.Background())
+	cancelPerTry(errPerTryTimeout)
+	clientGone, cancelClient := context.WithCancel(context.Background())
+	cancelClient()
+
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	readErr := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}
+	timeoutErr := &net.DNSError{Err: "i/o timeout", IsTimeout: true}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"retried status", context.Background(), fmt.Errorf("modify response: %w", errRetryableStatus), true},
+		{"dial failure", context.Background(), dialErr, true},
+		{"network timeout", context.Background(), timeoutErr, true},
+		{"per-try timeout", perTryTimeout, context.Canceled, true},
+		{"connection reset after the request was sent", context.Background(), readErr, false},
+		{"unexpected end of the response", context.Background(), io.ErrUnexpectedEOF, false},
+		{"client went away", clientGone, context.Canceled, false},
+		{"client went away while dialing", clientGone, dialErr, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil).WithContext(tt.ctx)
+		if got := isRetryableError(req, tt.err); got != tt.want {
+			t.Errorf("%s: isRetryableError = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	b := &retryBudget{}
+
+	// Nothing to spend before requests earned it
+	if b.withdraw() {
+		t.Fatal("withdrew from an empty budget")
+	}
+
+	// With a 20% budget every fifth request earns a retry
+	for i := 0; i < 4; i++ {
+		b.deposit(20)
+	}
+	if b.withdraw() {
+		t.Fatal("withdrew after 4 requests at 20%")
+	}
+	b.deposit(20)
+	if !b.withdraw() {
+		t.Fatal("could not withdraw after 5 requests at 20%")
+	}
+	if b.withdraw() {
+		t.Fatal("withdrew the same retry twice")
+	}
+
+	// A retry that was not needed is given back
+	b.deposit(100)
+	if !b.withdraw() {
+		t.Fatal("could not withdraw after a request at 100%")
+	}
+	b.refund()
+	if !b.withdraw() {
+		t.Fatal("could not withdraw a refunded retry")
+	}
+
+	// Idle time does not save up more than a burst
+	for i := 0; i < 100; i++ {
+		b.deposit(100)
+	}
+	for i := 0; i < retryBudgetBurst; i++ {
+		if !b.withdraw() {
+			t.Fatalf("could only withdraw %d retries, want the burst of %d", i, retryBudgetBurst)
+		}
+	}
+	if b.withdraw() {
+		t.Fatal("withdrew more than the burst")
+	}
+}
+
+func TestBudgetForStartsFull(t *testing.T) {
+	t.Cleanup(func() { retainRetryBudgets(nil) })
+
+	b := budgetFor(1)
+	if budgetFor(1) != b {
+		t.Fatal("a DNS rule got a second budget")
+	}
+	for i := 0; i < retryBudgetBurst; i++ {
+		if !b.withdraw() {
+			t.Fatalf("new budget only allowed %d retries, want %d", i, retryBudgetBurst)
+		}
+	}
+
+	retainRetryBudgets(map[int]*models.DNSRule{2: {ID: 2}})
+	if budgetFor(1) == b {
+		t.Fatal("budget of a removed DNS rule was kept")
+	}
+}
+
+func TestHandleProxyErrorStatus(t *testing.T) {
+	t.Cleanup(func() { outliers.retain(nil) })
+
+	backends := testBackends(1, 1, 1)
+	tests := []struct {
+		name       string
+		perTry     bool
+		retryable  bool
+		openOthers bool // Open the circuits of the backends not tried yet
+		written    bool // Whether the failure is answered, or left to a retry
+		status     int  // Status written, or kept for when the retry finds no backend
+	}{
+		{"connection failure", false, false, false, true, http.StatusBadGateway},
+		{"connection failure left to a retry", false, true, false, false, http.StatusBadGateway},
+		{"per-try timeout of the last attempt", true, false, false, true, http.StatusGatewayTimeout},
+		{"per-try timeout left to a retry", true, true, false, false, http.StatusGatewayTimeout},
+		{"per-try timeout when the other circuits opened", true, true, true, true, http.StatusGatewayTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.openOthers {
+				useOpenCircuit(t, backends[1].URL)
+				useOpenCircuit(t, backends[2].URL)
+			}
+			pr := &proxyRequest{
+				backend:   backends[0],
+				retryable: tt.retryable,
+				backends:  backends,
+				tried:     map[int]bool{backends[0].ID: true},
+			}
+			ctx, cancel := context.WithCancelCause(context.WithValue(context.Background(), proxyRequestKey{}, pr))
+			err := error(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+			if tt.perTry {
+				cancel(errPerTryTimeout)
+				err = context.Canceled
+			}
+			defer cancel(nil)
+
+			w := httptest.NewRecorder()
+			handleProxyError(w, httptest.NewRequest("GET", "/", nil).WithContext(ctx), err)
+
+			if !tt.written {
+				if w.Body.Len() > 0 || pr.failure == nil {
+					t.Fatalf("wrote %d %q, want the failure left to a retry", w.Code, w.Body)
+				}
+				if pr.status != tt.status {
+					t.Fatalf("status kept for the failure = %d, want %d", pr.status, tt.status)
+				}
+				return
+			}
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if pr.result != circuitFailure {
+				t.Error("failure not reported to the circuit breaker")
+			}
+		})
+	}
+}
+
+func TestRetriedStatusIsKeptWhenNoBackendIsLeft(t *testing.T) {
+	t.Cleanup(func() { outliers.retain(nil) })
+	backends := testBackends(1, 1)
+	resetLoads(t, backends)
+	rule := &models.DNSRule{RetryEnabled: true, RetryOnStatus: []int{http.StatusServiceUnavailable}}
+
+	modify := func() (*proxyRequest, error) {
+		pr := &proxyRequest{
+			backend:   backends[0],
+			rule:      rule,
+			retryable: true,
+			backends:  backends,
+			tried:     map[int]bool{backends[0].ID: true},
+			startTime: time.Now(),
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), proxyRequestKey{}, pr))
+		return pr, modifyResponse(&http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}, Request: req})
+	}
+
+	pr, err := modify()
+	if !errors.Is(err, errRetryableStatus) || pr.status != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v, status = %d, want the 503 discarded for a retry", err, pr.status)
+	}
+
+	// Once the other backend stops accepting requests the response is returned as is
+	useOpenCircuit(t, backends[1].URL)
+	if _, err := modify(); err != nil {
+		t.Fatalf("err = %v, want the 503 returned to the client", err)
+	}
+}
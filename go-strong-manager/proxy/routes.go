@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+var (
+	// Compiled routes of each DNS rule, keyed by DNS rule ID, in matching order
+	routeCache     = make(map[int][]*compiledRoute)
+	routeCacheLock = sync.RWMutex{}
+)
+
+// compiledRoute is a route ready to be matched against requests
+type compiledRoute struct {
+	models.Route
+	regex    *regexp.Regexp
+	methods  map[string]bool
+	balancer Balancer
+}
+
+// ValidateRoute checks that a route's match settings are usable
+func ValidateRoute(route models.Route) error {
+	_, err := compileRoute(route)
+	return err
+}
+
+// compileRoute validates a route and prepares it for matching
+func compileRoute(route models.Route) (*compiledRoute, error) {
+	compiled := &compiledRoute{Route: route}
+
+	switch route.MatchType {
+	case models.RouteMatchPrefix, models.RouteMatchExact:
+		if !strings.HasPrefix(route.Path, "/") {
+			return nil, fmt.Errorf("route path must start with '/'")
+		}
+	case models.RouteMatchRegex:
+		re, err := regexp.Compile(route.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route regex: %v", err)
+		}
+		compiled.regex = re
+	default:
+		return nil, fmt.Errorf("route match type must be 'prefix', 'exact' or 'regex'")
+	}
+
+	if route.StripPrefix && route.MatchType != models.RouteMatchPrefix {
+		return nil, fmt.Errorf("strip_prefix is only supported for prefix routes")
+	}
+	if route.RewritePath != "" && route.MatchType != models.RouteMatchRegex && !strings.HasPrefix(route.RewritePath, "/") {
+		return nil, fmt.Errorf("route rewrite path must start with '/'")
+	}
+
+	if len(route.Methods) > 0 {
+		compiled.methods = make(map[string]bool, len(route.Methods))
+		for _, method := range route.Methods {
+			compiled.methods[strings.ToUpper(method)] = true
+		}
+	}
+
+	return compiled, nil
+}
+
+// matches reports whether the request is handled by the route
+func (r *compiledRoute) matches(req *http.Request) bool {
+	if r.methods != nil && !r.methods[req.Method] {
+		return false
+	}
+
+	path := req.URL.Path
+	switch r.MatchType {
+	case models.RouteMatchExact:
+		return path == r.Path
+	case models.RouteMatchRegex:
+		return r.regex.MatchString(path)
+	default:
+		// Prefixes match whole path segments, so /v1 does not match /v10
+		prefix := strings.TrimSuffix(r.Path, "/")
+		return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+	}
+}
+
+// rewrite returns the path sent to the backend for a matched request path
+func (r *compiledRoute) rewrite(path string) string {
+	switch r.MatchType {
+	case models.RouteMatchExact:
+		if r.RewritePath != "" {
+			return r.RewritePath
+		}
+	case models.RouteMatchRegex:
+		if r.RewritePath != "" {
+			return r.regex.ReplaceAllString(path, r.RewritePath)
+		}
+	default:
+		if r.RewritePath == "" && !r.StripPrefix {
+			return path
+		}
+		rest := strings.TrimPrefix(path, strings.TrimSuffix(r.Path, "/"))
+		rewritten := strings.TrimSuffix(r.RewritePath, "/") + "/" + strings.TrimPrefix(rest, "/")
+		// Keep the request path as is when nothing follows the prefix, e.g. /api -> /
+		if rest == "" && r.RewritePath != "" {
+			rewritten = r.RewritePath
+		}
+		return rewritten
+	}
+	return path
+}
+
+// matchRoute returns the first route of the DNS rule that handles the request, or nil
+func matchRoute(ruleID int, req *http.Request) *compiledRoute {
+	routeCacheLock.RLock()
+	routes := routeCache[ruleID]
+	routeCacheLock.RUnlock()
+
+	for _, route := range routes {
+		if route.matches(req) {
+			return route
+		}
+	}
+	return nil
+}
+
+// loadRoutes returns the compiled routes of all DNS rules that have active backends,
+// ordered by priority (highest first) and then by creation
+func loadRoutes() map[int][]*compiledRoute {
+	rows, err := database.DB.Query(`
+		SELECT
+			id,
+			dns_rule_id,
+			path,
+			match_type,
+			methods,
+			priority,
+			strip_prefix,
+			rewrite_path
+		FROM
+			dns_routes
+		ORDER BY
+			priority DESC, id
+	`)
+	if err != nil {
+		fmt.Printf("Error loading routes: %v\n", err)
+		return nil
+	}
+
+	var routes []models.Route
+	for rows.Next() {
+		var route models.Route
+		var matchType, methods string
+		if err := rows.Scan(&route.ID, &route.DNSRuleID, &route.Path, &matchType, &methods,
+			&route.Priority, &route.StripPrefix, &route.RewritePath); err != nil {
+			fmt.Printf("Error scanning route: %v\n", err)
+			continue
+		}
+		route.MatchType = models.RouteMatchType(matchType)
+		json.Unmarshal([]byte(methods), &route.Methods)
+		routes = append(routes, route)
+	}
+	rows.Close()
+
+	result := make(map[int][]*compiledRoute)
+	for _, route := range routes {
+		backendRows, err := database.DB.Query(`
+			SELECT
+				b.id,
+				b.url,
+				b.weight,
+				b.isActive
+			FROM
+				backends b
+			JOIN
+				dns_route_backend_map m ON b.id = m.backend_id
+			WHERE
+				m.route_id = ? AND b.isActive = 1
+		`, route.ID)
+		if err != nil {
+			fmt.Printf("Error getting route backends: %v\n", err)
+			continue
+		}
+		for backendRows.Next() {
+			var backend models.Backend
+			if err := backendRows.Scan(&backend.ID, &backend.URL, &backend.Weight, &backend.IsActive); err != nil {
+				fmt.Printf("Error scanning backend: %v\n", err)
+				continue
+			}
+			route.Backends = append(route.Backends, backend)
+		}
+		backendRows.Close()
+
+		// Routes without backends would only produce errors, let the DNS rule's pool handle them
+		if len(route.Backends) == 0 {
+			continue
+		}
+
+		compiled, err := compileRoute(route)
+		if err != nil {
+			fmt.Printf("Skipping route %d: %v\n", route.ID, err)
+			continue
+		}
+		result[route.DNSRuleID] = append(result[route.DNSRuleID], compiled)
+	}
+
+	return result
+}
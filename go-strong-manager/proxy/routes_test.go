@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// useTestDatabase initializes the database in a temporary directory
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	database.Initialize()
+	t.Cleanup(func() {
+		database.Close()
+		os.Chdir(wd)
+	})
+}
+
+// mustCompileRoute compiles a route that is expected to be valid
+func mustCompileRoute(t *testing.T, route models.Route) *compiledRoute {
+	t.Helper()
+	compiled, err := compileRoute(route)
+	if err != nil {
+		t.Fatalf("compileRoute(%+v): %v", route, err)
+	}
+	return compiled
+}
+
+func TestCompileRoute(t *testing.T) {
+	tests := []struct {
+		name  string
+		route models.Route
+		valid bool
+	}{
+		{"prefix", models.Route{Path: "/api", MatchType: models.RouteMatchPrefix}, true},
+		{"exact", models.Route{Path: "/health", MatchType: models.RouteMatchExact}, true},
+		{"regex", models.Route{Path: `^/users/(\d+)$`, MatchType: models.RouteMatchRegex}, true},
+		{"regex without a leading slash", models.Route{Path: `\.php$`, MatchType: models.RouteMatchRegex}, true},
+		{"prefix stripped", models.Route{Path: "/api", MatchType: models.RouteMatchPrefix, StripPrefix: true}, true},
+		{"regex rewritten with groups", models.Route{Path: `^/u/(\d+)$`, MatchType: models.RouteMatchRegex, RewritePath: "users/$1"}, true},
+		{"prefix without a leading slash", models.Route{Path: "api", MatchType: models.RouteMatchPrefix}, false},
+		{"exact without a leading slash", models.Route{Path: "health", MatchType: models.RouteMatchExact}, false},
+		{"invalid regex", models.Route{Path: "/users/(", MatchType: models.RouteMatchRegex}, false},
+		{"unknown match type", models.Route{Path: "/api", MatchType: "glob"}, false},
+		{"exact route stripped", models.Route{Path: "/api", MatchType: models.RouteMatchExact, StripPrefix: true}, false},
+		{"regex route stripped", models.Route{Path: "^/api", MatchType: models.RouteMatchRegex, StripPrefix: true}, false},
+		{"prefix rewritten without a leading slash", models.Route{Path: "/api", MatchType: models.RouteMatchPrefix, RewritePath: "v2"}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateRoute(tt.route); (err == nil) != tt.valid {
+			t.Errorf("%s: err = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestRouteMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		route  models.Route
+		method string
+		path   string
+		want   bool
+	}{
+		{"prefix itself", models.Route{Path: "/v1", MatchType: models.RouteMatchPrefix}, "GET", "/v1", true},
+		{"prefix with a sub path", models.Route{Path: "/v1", MatchType: models.RouteMatchPrefix}, "GET", "/v1/users", true},
+		{"prefix with a trailing slash", models.Route{Path: "/v1/", MatchType: models.RouteMatchPrefix}, "GET", "/v1", true},
+		{"prefix is not a segment of the path", models.Route{Path: "/v1", MatchType: models.RouteMatchPrefix}, "GET", "/v10", false},
+		{"prefix is not a segment with a trailing slash", models.Route{Path: "/v1/", MatchType: models.RouteMatchPrefix}, "GET", "/v10/users", false},
+		{"prefix elsewhere in the path", models.Route{Path: "/v1", MatchType: models.RouteMatchPrefix}, "GET", "/api/v1", false},
+		{"root prefix", models.Route{Path: "/", MatchType: models.RouteMatchPrefix}, "GET", "/anything", true},
+		{"exact", models.Route{Path: "/health", MatchType: models.RouteMatchExact}, "GET", "/health", true},
+		{"exact with a sub path", models.Route{Path: "/health", MatchType: models.RouteMatchExact}, "GET", "/health/live", false},
+		{"exact with a trailing slash", models.Route{Path: "/health", MatchType: models.RouteMatchExact}, "GET", "/health/", false},
+		{"regex", models.Route{Path: `^/users/\d+$`, MatchType: models.RouteMatchRegex}, "GET", "/users/42", true},
+		{"regex not matching", models.Route{Path: `^/users/\d+$`, MatchType: models.RouteMatchRegex}, "GET", "/users/me", false},
+		{"unanchored regex", models.Route{Path: `\.php$`, MatchType: models.RouteMatchRegex}, "GET", "/admin/index.php", true},
+		{"allowed method", models.Route{Path: "/api", MatchType: models.RouteMatchPrefix, Methods: []string{"get", "POST"}}, "GET", "/api", true},
+		{"other method", models.Route{Path: "/api", MatchType: models.RouteMatchPrefix, Methods: []string{"GET"}}, "DELETE", "/api", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://app.test"+tt.path, nil)
+		if got := mustCompileRoute(t, tt.route).matches(req); got != tt.want {
+			t.Errorf("%s: %s %s matched = %v, want %v", tt.name, tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRouteRewrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		route models.Route
+		path  string
+		want  string
+	}{
+		{"prefix kept", models.Route{Path: "/api", MatchType: models.RouteMatchPrefix}, "/api/users", "/api/users"},
+		{"prefix stripped", models.Route{Path: "/api", MatchType: models.RouteMatchPrefix, StripPrefix: true}, "/api/users", "/users"},
+		{"prefix with a trailing slash stripped", models.Route{Path: "/api/", MatchType: models.RouteMatchPrefix, StripPrefix: true}, "/api/users", "/users"},
+		{"prefix itself stripped", models.Route{Path: "/api", MatchType: models.RouteMatchPrefix, StripPrefix: true}, "/api", "/"},
+		{"prefix rewritten", models.Route{Path: "/api", MatchType: models.RouteMatchPrefix, RewritePath: "/v2"}, "/api/users", "/v2/users"},
+		{"prefix rewritten with a trailing slash", models.Route{Path: "/api", MatchType: models.RouteMatchPrefix, RewritePath: "/v2/"}, "/api/users", "/v2/users"},
+		{"prefix itself rewritten", models.Route{Path: "/api", MatchType: models.RouteMatchPrefix, RewritePath: "/v2"}, "/api", "/v2"},
+		{"prefix rewritten to the root", models.Route{Path: "/api", MatchType: models.RouteMatchPrefix, RewritePath: "/"}, "/api/users", "/users"},
+		{"exact kept", models.Route{Path: "/health", MatchType: models.RouteMatchExact}, "/health", "/health"},
+		{"exact rewritten", models.Route{Path: "/health", MatchType: models.RouteMatchExact, RewritePath: "/status"}, "/health", "/status"},
+		{"regex kept", models.Route{Path: `^/u/(\d+)$`, MatchType: models.RouteMatchRegex}, "/u/42", "/u/42"},
+		{"regex rewritten with groups", models.Route{Path: `^/u/(\d+)/(\w+)$`, MatchType: models.RouteMatchRegex, RewritePath: "/users/$1?tab=$2"}, "/u/42/posts", "/users/42?tab=posts"},
+	}
+	for _, tt := range tests {
+		if got := mustCompileRoute(t, tt.route).rewrite(tt.path); got != tt.want {
+			t.Errorf("%s: rewrite(%q) = %q, want %q", tt.name, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRoutesAreMatchedByPriority(t *testing.T) {
+	useTestDatabase(t)
+
+	exec := func(query string, args ...interface{}) int {
+		t.Helper()
+		result, err := database.DB.Exec(query, args...)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		id, _ := result.LastInsertId()
+		return int(id)
+	}
+	ruleID := exec("INSERT INTO dns_rules (hostname) VALUES ('app.example.com')")
+	backendID := exec("INSERT INTO backends (url, weight, isActive) VALUES ('http://a.test', 1, 1)")
+	inactiveID := exec("INSERT INTO backends (url, weight, isActive) VALUES ('http://b.test', 1, 0)")
+	addRoute := func(path string, matchType models.RouteMatchType, priority, backendID int) {
+		t.Helper()
+		routeID := exec("INSERT INTO dns_routes (dns_rule_id, path, match_type, priority) VALUES (?, ?, ?, ?)", ruleID, path, string(matchType), priority)
+		exec("INSERT INTO dns_route_backend_map (route_id, backend_id) VALUES (?, ?)", routeID, backendID)
+	}
+
+	// Inserted in a different order than they are matched in
+	addRoute("/", models.RouteMatchPrefix, 0, backendID)
+	addRoute("/api", models.RouteMatchPrefix, 10, backendID)
+	addRoute("/api/admin", models.RouteMatchPrefix, 20, backendID)
+	addRoute("/api/legacy", models.RouteMatchPrefix, 10, backendID)
+	addRoute("/api/down", models.RouteMatchPrefix, 30, inactiveID)
+	addRoute("/api/(", models.RouteMatchRegex, 30, backendID)
+
+	routes := loadRoutes()
+	routeCacheLock.Lock()
+	routeCache = routes
+	routeCacheLock.Unlock()
+	t.Cleanup(func() {
+		routeCacheLock.Lock()
+		routeCache = make(map[int][]*compiledRoute)
+		routeCacheLock.Unlock()
+	})
+
+	// Routes without active backends and invalid routes are skipped
+	var order []string
+	for _, route := range routes[ruleID] {
+		order = append(order, route.Path)
+	}
+	if got, want := strings.Join(order, " "), "/api/admin /api /api/legacy /"; got != want {
+		t.Fatalf("routes loaded in order %s, want %s", got, want)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/admin/users", "/api/admin"},
+		{"/api/users", "/api"},
+		// Routes of the same priority are matched in the order they were created
+		{"/api/legacy/users", "/api"},
+		{"/api/down", "/api"},
+		{"/static/app.js", "/"},
+	}
+	for _, tt := range tests {
+		route := matchRoute(ruleID, httptest.NewRequest("GET", "http://app.example.com"+tt.path, nil))
+		if route == nil {
+			t.Errorf("%s matched no route, want %s", tt.path, tt.want)
+		} else if route.Path != tt.want {
+			t.Errorf("%s matched the route %s, want %s", tt.path, route.Path, tt.want)
+		}
+	}
+	if route := matchRoute(ruleID+1, httptest.NewRequest("GET", "http://other.example.com/api", nil)); route != nil {
+		t.Errorf("DNS rule without routes matched route %s", route.Path)
+	}
+}
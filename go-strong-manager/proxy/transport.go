@@ -0,0 +1,422 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+	"golang.org/x/net/http2"
+)
+
+// HTTP/2 modes for connections to backends
+const (
+	BackendHTTP2Auto = "auto" // HTTP/2 over TLS when the backend offers it via ALPN
+	BackendHTTP2Off  = "off"  // HTTP/1.1 only
+	BackendHTTP2H2C  = "h2c"  // HTTP/2 over TLS, and cleartext HTTP/2 for http:// backends
+)
+
+// transportConfig holds the connection settings of a backend transport
+type transportConfig struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	HTTP2                 string
+}
+
+// backendProxy is the reverse proxy of a backend, reused across requests so its
+// transport keeps connections to the backend alive
+type backendProxy struct {
+	proxy     *httputil.ReverseProxy
+	transport http.RoundTripper
+	config    transportConfig // Settings the transport was built with
+}
+
+// proxyRequest is the per-attempt state the shared reverse proxies need for logging and retries
+type proxyRequest struct {
+	clientIP    string
+	hostname    string
+	requestPath string
+	userAgent   string
+	backend     models.Backend
+	startTime   time.Time
+	attempt     int
+
+	rule      *models.DNSRule
+	retryable bool             // A failure is left to proxyHandler to retry instead of answered with 502
+	backends  []models.Backend // Backends available to the request, for retries
+	tried     map[int]bool     // Backends the request was already sent to
+	failure   error            // Set when a retryable attempt failed and nothing was written
+	status    int              // Status that answers the failure if it cannot be retried after all
+	timer     *time.Timer      // Per-try timeout, stopped once response headers arrive
+
+	probe         bool          // The attempt is a circuit breaker probe
+	result        circuitResult // Outcome reported to the circuit breaker
+	failureReason string
+
+	headers     *headerRules // Header rules of the DNS rule, nil when it has none
+	requestHost string
+	requestID   string
+}
+
+type proxyRequestKey struct{}
+
+var (
+	// Reverse proxies keyed by backend URL, rebuilt by refreshCache
+	backendProxies     = make(map[string]*backendProxy)
+	backendProxiesLock = sync.RWMutex{}
+
+	// Default connection settings for backend transports, overridden by each backend's own
+	transportSettings = transportConfig{
+		MaxIdleConns:        1000,
+		MaxIdleConnsPerHost: 100,
+		DialTimeout:         30 * time.Second,
+		KeepAlive:           30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		HTTP2:               BackendHTTP2Auto,
+	}
+
+	// Copy buffers shared by all reverse proxies
+	copyBuffers = &bufferPool{pool: sync.Pool{New: func() interface{} { return make([]byte, 32*1024) }}}
+)
+
+// configureTransport loads backend connection settings from the environment
+func configureTransport() {
+	transportSettings.MaxIdleConns = getEnvInt("PROXY_MAX_IDLE_CONNS", transportSettings.MaxIdleConns)
+	transportSettings.MaxIdleConnsPerHost = getEnvInt("PROXY_MAX_IDLE_CONNS_PER_HOST", transportSettings.MaxIdleConnsPerHost)
+	transportSettings.MaxConnsPerHost = getEnvInt("PROXY_MAX_CONNS_PER_HOST", transportSettings.MaxConnsPerHost)
+	transportSettings.DialTimeout = getEnvDuration("PROXY_DIAL_TIMEOUT", transportSettings.DialTimeout)
+	transportSettings.KeepAlive = getEnvDuration("PROXY_KEEP_ALIVE", transportSettings.KeepAlive)
+	transportSettings.TLSHandshakeTimeout = getEnvDuration("PROXY_TLS_HANDSHAKE_TIMEOUT", transportSettings.TLSHandshakeTimeout)
+	transportSettings.ResponseHeaderTimeout = getEnvDuration("PROXY_RESPONSE_HEADER_TIMEOUT", transportSettings.ResponseHeaderTimeout)
+	transportSettings.IdleConnTimeout = getEnvDuration("PROXY_IDLE_CONN_TIMEOUT", transportSettings.IdleConnTimeout)
+
+	switch mode := strings.ToLower(os.Getenv("PROXY_BACKEND_HTTP2")); mode {
+	case "":
+	case BackendHTTP2Auto, BackendHTTP2Off, BackendHTTP2H2C:
+		transportSettings.HTTP2 = mode
+	default:
+		fmt.Printf("Warning: Invalid value for PROXY_BACKEND_HTTP2: %s, using default %s\n", mode, transportSettings.HTTP2)
+	}
+}
+
+// ValidateBackendTransport checks the connection settings of a backend
+func ValidateBackendTransport(transport models.BackendTransport) error {
+	for _, setting := range []struct {
+		name  string
+		value *int
+	}{
+		{"max_idle_conns_per_host", transport.MaxIdleConnsPerHost},
+		{"dial_timeout_ms", transport.DialTimeoutMS},
+		{"tls_handshake_timeout_ms", transport.TLSHandshakeTimeoutMS},
+		{"response_header_timeout_ms", transport.ResponseHeaderTimeoutMS},
+		{"idle_conn_timeout_ms", transport.IdleConnTimeoutMS},
+	} {
+		if setting.value != nil && *setting.value < 0 {
+			return fmt.Errorf("%s must not be negative", setting.name)
+		}
+	}
+	if transport.HTTP2 != nil {
+		switch *transport.HTTP2 {
+		case BackendHTTP2Auto, BackendHTTP2Off, BackendHTTP2H2C:
+		default:
+			return fmt.Errorf("http2 must be 'auto', 'off' or 'h2c'")
+		}
+	}
+	return nil
+}
+
+// backendTransportConfig returns the connection settings of a backend: its own where
+// set, the defaults otherwise
+func backendTransportConfig(transport models.BackendTransport) transportConfig {
+	config := transportSettings
+	milliseconds := func(value *int, setting *time.Duration) {
+		if value != nil {
+			*setting = time.Duration(*value) * time.Millisecond
+		}
+	}
+	if transport.MaxIdleConnsPerHost != nil {
+		config.MaxIdleConnsPerHost = *transport.MaxIdleConnsPerHost
+	}
+	milliseconds(transport.DialTimeoutMS, &config.DialTimeout)
+	milliseconds(transport.TLSHandshakeTimeoutMS, &config.TLSHandshakeTimeout)
+	milliseconds(transport.ResponseHeaderTimeoutMS, &config.ResponseHeaderTimeout)
+	milliseconds(transport.IdleConnTimeoutMS, &config.IdleConnTimeout)
+	if transport.HTTP2 != nil {
+		config.HTTP2 = *transport.HTTP2
+	}
+	return config
+}
+
+// loadBackendTransports returns the connection settings of every backend, keyed by URL
+func loadBackendTransports() map[string]transportConfig {
+	configs := make(map[string]transportConfig)
+	rows, err := database.DB.Query(`
+		SELECT url, max_idle_conns_per_host, dial_timeout_ms, tls_handshake_timeout_ms,
+			response_header_timeout_ms, idle_conn_timeout_ms, http2
+		FROM backends
+	`)
+	if err != nil {
+		fmt.Printf("Error loading backend connection settings: %v\n", err)
+		return configs
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var backendURL string
+		var transport models.BackendTransport
+		if err := rows.Scan(&backendURL, &transport.MaxIdleConnsPerHost, &transport.DialTimeoutMS,
+			&transport.TLSHandshakeTimeoutMS, &transport.ResponseHeaderTimeoutMS,
+			&transport.IdleConnTimeoutMS, &transport.HTTP2); err != nil {
+			fmt.Printf("Error scanning backend connection settings: %v\n", err)
+			continue
+		}
+		if err := ValidateBackendTransport(transport); err != nil {
+			fmt.Printf("Ignoring connection settings of backend %s: %v\n", backendURL, err)
+			continue
+		}
+		configs[backendURL] = backendTransportConfig(transport)
+	}
+	return configs
+}
+
+// newTransport creates the transport for a backend from its connection settings
+func newTransport(target *url.URL, config transportConfig) http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: config.KeepAlive,
+	}
+
+	// Cleartext HTTP/2 needs its own transport, as net/http only speaks HTTP/2 over TLS
+	if config.HTTP2 == BackendHTTP2H2C && target.Scheme == "http" {
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			IdleConnTimeout: config.IdleConnTimeout,
+		}
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     config.HTTP2 != BackendHTTP2Off,
+	}
+	if config.HTTP2 == BackendHTTP2Off {
+		// A non-nil empty map disables HTTP/2 upgrades over TLS
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// newBackendProxy creates the reverse proxy of a backend
+func newBackendProxy(backendURL string, config transportConfig) (*backendProxy, error) {
+	target, err := url.Parse(backendURL)
+	if err != nil {
+		return nil, err
+	}
+
+	bp := &backendProxy{transport: newTransport(target, config), config: config}
+	bp.proxy = httputil.NewSingleHostReverseProxy(target)
+	bp.proxy.Transport = bp.transport
+	bp.proxy.BufferPool = copyBuffers
+
+	// Set the forwarding headers, then apply the DNS rule's request header rules
+	director := bp.proxy.Director
+	bp.proxy.Director = func(req *http.Request) {
+		director(req)
+		if pr, ok := req.Context().Value(proxyRequestKey{}).(*proxyRequest); ok {
+			setForwardedHeaders(req, pr)
+			applyRequestHeaders(req, pr)
+		}
+	}
+	bp.proxy.ModifyResponse = modifyResponse
+	bp.proxy.ErrorHandler = handleProxyError
+	return bp, nil
+}
+
+// closeIdleConnections closes the idle connections of a backend that is no longer used
+func (bp *backendProxy) closeIdleConnections() {
+	if closer, ok := bp.transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// rebuildBackendProxies creates reverse proxies for new backend URLs and drops the ones
+// no longer used. Existing proxies are kept so their connection pools survive a refresh,
+// unless the connection settings of their backend changed. Backends without settings
+// use the defaults.
+func rebuildBackendProxies(backendURLs map[string]bool, configs map[string]transportConfig) {
+	backendProxiesLock.RLock()
+	current := backendProxies
+	backendProxiesLock.RUnlock()
+
+	proxies := make(map[string]*backendProxy, len(backendURLs))
+	for backendURL := range backendURLs {
+		config, exists := configs[backendURL]
+		if !exists {
+			config = transportSettings
+		}
+		if bp, exists := current[backendURL]; exists && bp.config == config {
+			proxies[backendURL] = bp
+			continue
+		}
+		bp, err := newBackendProxy(backendURL, config)
+		if err != nil {
+			fmt.Printf("Error creating proxy for backend %s: %v\n", backendURL, err)
+			continue
+		}
+		proxies[backendURL] = bp
+	}
+
+	backendProxiesLock.Lock()
+	backendProxies = proxies
+	backendProxiesLock.Unlock()
+
+	for backendURL, bp := range current {
+		if proxies[backendURL] != bp {
+			bp.closeIdleConnections()
+		}
+	}
+}
+
+// getBackendProxy returns the reverse proxy of a backend, creating it with the default
+// connection settings if the cache has not seen the backend yet
+func getBackendProxy(backendURL string) (*backendProxy, error) {
+	backendProxiesLock.RLock()
+	bp, exists := backendProxies[backendURL]
+	backendProxiesLock.RUnlock()
+	if exists {
+		return bp, nil
+	}
+
+	backendProxiesLock.Lock()
+	defer backendProxiesLock.Unlock()
+	if bp, exists := backendProxies[backendURL]; exists {
+		return bp, nil
+	}
+	bp, err := newBackendProxy(backendURL, transportSettings)
+	if err != nil {
+		return nil, err
+	}
+	backendProxies[backendURL] = bp
+	return bp, nil
+}
+
+// modifyResponse is called on every response from a backend
+func modifyResponse(resp *http.Response) error {
+	pr, ok := resp.Request.Context().Value(proxyRequestKey{}).(*proxyRequest)
+	if !ok {
+		return nil
+	}
+
+	// The backend answered in time
+	if pr.timer != nil {
+		pr.timer.Stop()
+	}
+
+	// Calculate latency
+	latency := time.Since(pr.startTime)
+	latencyMS := latency.Milliseconds()
+
+	// Responses with a retried status are discarded so proxyHandler can try another backend
+	retry := retriesOnStatus(pr.rule, resp.StatusCode) && pr.canRetry()
+	go logRequest(pr.clientIP, pr.hostname, pr.requestPath, pr.backend.ID, int(latencyMS), resp.StatusCode, !retry, pr.userAgent, 0, pr.attempt)
+
+	// Feed the latency EWMA of the least latency balancer
+	loads.get(pr.backend.URL).observe(latency)
+
+	// Track server errors for passive health checking and the circuit breaker
+	if resp.StatusCode >= http.StatusInternalServerError {
+		pr.result = circuitFailure
+		pr.failureReason = fmt.Sprintf("status %d", resp.StatusCode)
+		outliers.RecordFailure(pr.backend.URL, pr.failureReason)
+	} else {
+		pr.result = circuitSuccess
+		outliers.RecordSuccess(pr.backend.URL)
+	}
+
+	if retry {
+		pr.status = resp.StatusCode
+		return errRetryableStatus
+	}
+
+	applyResponseHeaders(resp, pr)
+	return nil
+}
+
+// handleProxyError is called when a backend cannot be reached, or when modifyResponse
+// discarded a response to retry it
+func handleProxyError(rw http.ResponseWriter, req *http.Request, err error) {
+	pr, ok := req.Context().Value(proxyRequestKey{}).(*proxyRequest)
+
+	// Attempts cut short by their per-try timeout are answered with 504, other failures with 502
+	status := http.StatusBadGateway
+	if errors.Is(context.Cause(req.Context()), errPerTryTimeout) {
+		status = http.StatusGatewayTimeout
+	}
+
+	// Leave retryable failures to proxyHandler without writing a response
+	if ok && (errors.Is(err, errRetryableStatus) || isRetryableError(req, err) && pr.canRetry()) {
+		pr.failure = err
+		if pr.status == 0 {
+			pr.status = status
+		}
+	} else {
+		rw.WriteHeader(status)
+		rw.Write([]byte(http.StatusText(status)))
+	}
+
+	// Discarded responses were already logged and tracked by modifyResponse
+	if !ok || errors.Is(err, errRetryableStatus) {
+		return
+	}
+
+	// Calculate latency
+	latencyMS := time.Since(pr.startTime).Milliseconds()
+	go logRequest(pr.clientIP, pr.hostname, pr.requestPath, pr.backend.ID, int(latencyMS), status, false, pr.userAgent, 0, pr.attempt)
+
+	// Track connection errors for passive health checking, ignoring clients that went away
+	if !errors.Is(err, context.Canceled) || errors.Is(context.Cause(req.Context()), errPerTryTimeout) {
+		pr.result = circuitFailure
+		pr.failureReason = err.Error()
+		outliers.RecordFailure(pr.backend.URL, err.Error())
+	}
+}
+
+// bufferPool shares copy buffers between reverse proxies to reduce allocations
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func (p *bufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	p.pool.Put(b)
+}
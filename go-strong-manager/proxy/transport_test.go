@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+func intSetting(value int) *int {
+	return &value
+}
+
+func stringSetting(value string) *string {
+	return &value
+}
+
+func TestBackendTransportConfigOverridesDefaults(t *testing.T) {
+	config := backendTransportConfig(models.BackendTransport{
+		MaxIdleConnsPerHost:     intSetting(10),
+		DialTimeoutMS:           intSetting(500),
+		ResponseHeaderTimeoutMS: intSetting(2000),
+		HTTP2:                   stringSetting(BackendHTTP2Off),
+	})
+
+	want := transportSettings
+	want.MaxIdleConnsPerHost = 10
+	want.DialTimeout = 500 * time.Millisecond
+	want.ResponseHeaderTimeout = 2 * time.Second
+	want.HTTP2 = BackendHTTP2Off
+	if config != want {
+		t.Fatalf("config = %+v, want %+v", config, want)
+	}
+
+	if config := backendTransportConfig(models.BackendTransport{}); config != transportSettings {
+		t.Fatalf("config without settings = %+v, want the defaults %+v", config, transportSettings)
+	}
+}
+
+func TestNewTransportAppliesSettings(t *testing.T) {
+	config := backendTransportConfig(models.BackendTransport{
+		MaxIdleConnsPerHost:     intSetting(7),
+		TLSHandshakeTimeoutMS:   intSetting(3000),
+		ResponseHeaderTimeoutMS: intSetting(1500),
+		IdleConnTimeoutMS:       intSetting(60000),
+		HTTP2:                   stringSetting(BackendHTTP2Off),
+	})
+	target, _ := url.Parse("https://backend.test")
+
+	transport, ok := newTransport(target, config).(*http.Transport)
+	if !ok {
+		t.Fatal("transport is not an *http.Transport")
+	}
+	if transport.MaxIdleConnsPerHost != 7 || transport.TLSHandshakeTimeout != 3*time.Second ||
+		transport.ResponseHeaderTimeout != 1500*time.Millisecond || transport.IdleConnTimeout != time.Minute {
+		t.Fatalf("transport does not use the backend's settings: %+v", transport)
+	}
+	if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil {
+		t.Fatal("HTTP/2 is not disabled")
+	}
+}
+
+func TestValidateBackendTransport(t *testing.T) {
+	valid := models.BackendTransport{DialTimeoutMS: intSetting(0), HTTP2: stringSetting(BackendHTTP2H2C)}
+	if err := ValidateBackendTransport(valid); err != nil {
+		t.Fatalf("valid settings rejected: %v", err)
+	}
+	if err := ValidateBackendTransport(models.BackendTransport{IdleConnTimeoutMS: intSetting(-1)}); err == nil {
+		t.Fatal("negative timeout accepted")
+	}
+	if err := ValidateBackendTransport(models.BackendTransport{HTTP2: stringSetting("always")}); err == nil {
+		t.Fatal("unknown HTTP/2 mode accepted")
+	}
+}
+
+func TestRebuildBackendProxiesKeepsUnchangedProxies(t *testing.T) {
+	t.Cleanup(func() { rebuildBackendProxies(nil, nil) })
+
+	urls := map[string]bool{"http://a.test": true, "http://b.test": true}
+	rebuildBackendProxies(urls, nil)
+	first := make(map[string]*backendProxy)
+	for backendURL := range urls {
+		first[backendURL], _ = getBackendProxy(backendURL)
+	}
+
+	// Only the backend whose settings changed gets a new proxy
+	changed := backendTransportConfig(models.BackendTransport{DialTimeoutMS: intSetting(100)})
+	rebuildBackendProxies(urls, map[string]transportConfig{"http://b.test": changed})
+	if bp, _ := getBackendProxy("http://a.test"); bp != first["http://a.test"] {
+		t.Error("proxy of an unchanged backend was rebuilt")
+	}
+	bp, _ := getBackendProxy("http://b.test")
+	if bp == first["http://b.test"] || bp.config != changed {
+		t.Error("proxy of a backend with new settings was not rebuilt with them")
+	}
+
+	// Backends no longer used are dropped
+	rebuildBackendProxies(map[string]bool{"http://a.test": true}, nil)
+	backendProxiesLock.RLock()
+	_, exists := backendProxies["http://b.test"]
+	backendProxiesLock.RUnlock()
+	if exists {
+		t.Error("proxy of a removed backend was kept")
+	}
+}
+
+// BenchmarkProxyHandler compares building a reverse proxy for every request, as the proxy
+// used to, with reusing the backend's own reverse proxy and its pooled connections
+func BenchmarkProxyHandler(b *testing.B) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Repeat("x", 1024)))
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+
+	// proxyFor returns the reverse proxy of a request, and a function called once it is served
+	serve := func(b *testing.B, proxyFor func() (*httputil.ReverseProxy, func())) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				w := httptest.NewRecorder()
+				proxy, done := proxyFor()
+				proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://app.test/", nil))
+				done()
+				if w.Code != http.StatusOK {
+					b.Errorf("status = %d", w.Code)
+				}
+			}
+		})
+	}
+
+	b.Run("PerRequestProxy", func(b *testing.B) {
+		// A new proxy with its own transport, so no connection is reused between requests
+		serve(b, func() (*httputil.ReverseProxy, func()) {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			proxy.Transport = transport
+			return proxy, transport.CloseIdleConnections
+		})
+	})
+
+	b.Run("ReusedProxy", func(b *testing.B) {
+		bp, err := newBackendProxy(backend.URL, transportSettings)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer bp.closeIdleConnections()
+		serve(b, func() (*httputil.ReverseProxy, func()) { return bp.proxy, func() {} })
+	})
+}
@@ -0,0 +1,222 @@
+package tokens
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Supported signing algorithms
+const (
+	AlgorithmHS256 = "HS256" // Shared secret
+	AlgorithmRS256 = "RS256" // RSA key pair
+	AlgorithmEdDSA = "EdDSA" // Ed25519 key pair
+)
+
+// key is a JWT key identified by its kid. Keys without a signing key only verify
+// tokens, which lets tokens signed by a retired key stay valid until they expire.
+type key struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// keySet holds every accepted key and the one new tokens are signed with
+type keySet struct {
+	keys    map[string]*key
+	signing *key
+}
+
+// keyFile is the format of JWT_KEYS_FILE
+type keyFile struct {
+	SigningKey string         `json:"signing_key"`
+	Keys       []keyFileEntry `json:"keys"`
+}
+
+// keyFileEntry describes one key of JWT_KEYS_FILE. Paths are relative to the file.
+type keyFileEntry struct {
+	ID             string `json:"kid"`
+	Algorithm      string `json:"alg"`
+	Secret         string `json:"secret"`
+	SecretFile     string `json:"secret_file"`
+	PrivateKeyFile string `json:"private_key_file"`
+	PublicKeyFile  string `json:"public_key_file"`
+}
+
+// loadKeys loads the JWT keys from JWT_KEYS_FILE, or a single HS256 key from JWT_SECRET
+// or JWT_SECRET_FILE. Without any of them a random secret is used, so tokens do not
+// survive a restart.
+func loadKeys() (*keySet, error) {
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		return loadKeyFile(path)
+	}
+
+	secret := []byte(os.Getenv("JWT_SECRET"))
+	if path := os.Getenv("JWT_SECRET_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWT_SECRET_FILE: %w", err)
+		}
+		secret = []byte(strings.TrimSpace(string(data)))
+	}
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("failed to generate JWT secret: %w", err)
+		}
+		log.Println("Warning: JWT_SECRET not set, admin sessions will not survive a restart")
+	}
+
+	// Derive the kid from the secret, so a new secret never matches tokens of the old one
+	id := os.Getenv("JWT_KEY_ID")
+	if id == "" {
+		sum := sha256.Sum256(secret)
+		id = hex.EncodeToString(sum[:4])
+	}
+	k := &key{id: id, method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+	return &keySet{keys: map[string]*key{id: k}, signing: k}, nil
+}
+
+// loadKeyFile loads the keys listed in a JWT keys file
+func loadKeyFile(path string) (*keySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT keys file: %w", err)
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid JWT keys file: %w", err)
+	}
+
+	set := &keySet{keys: make(map[string]*key)}
+	dir := filepath.Dir(path)
+	for _, entry := range file.Keys {
+		k, err := loadKey(entry, dir)
+		if err != nil {
+			return nil, fmt.Errorf("JWT key %q: %w", entry.ID, err)
+		}
+		if _, exists := set.keys[k.id]; exists {
+			return nil, fmt.Errorf("duplicate JWT key %q", k.id)
+		}
+		set.keys[k.id] = k
+
+		// Sign with the designated key, or else the first key able to sign
+		if k.signKey != nil && (k.id == file.SigningKey || (file.SigningKey == "" && set.signing == nil)) {
+			set.signing = k
+		}
+	}
+	if set.signing == nil {
+		return nil, fmt.Errorf("JWT keys file has no signing key %q with a private key or secret", file.SigningKey)
+	}
+	return set, nil
+}
+
+// loadKey loads the secret or key pair of a keys file entry
+func loadKey(entry keyFileEntry, dir string) (*key, error) {
+	if entry.ID == "" {
+		return nil, fmt.Errorf("kid is required")
+	}
+	readFile := func(name string) ([]byte, error) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		return os.ReadFile(name)
+	}
+
+	k := &key{id: entry.ID}
+	switch entry.Algorithm {
+	case AlgorithmHS256:
+		k.method = jwt.SigningMethodHS256
+		secret := []byte(entry.Secret)
+		if entry.SecretFile != "" {
+			data, err := readFile(entry.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+			secret = []byte(strings.TrimSpace(string(data)))
+		}
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("secret or secret_file is required for HS256")
+		}
+		k.signKey, k.verifyKey = secret, secret
+
+	case AlgorithmRS256, AlgorithmEdDSA:
+		if entry.PrivateKeyFile != "" {
+			data, err := readFile(entry.PrivateKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			if entry.Algorithm == AlgorithmRS256 {
+				privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+				if err != nil {
+					return nil, err
+				}
+				k.signKey, k.verifyKey = privateKey, &privateKey.PublicKey
+			} else {
+				privateKey, err := jwt.ParseEdPrivateKeyFromPEM(data)
+				if err != nil {
+					return nil, err
+				}
+				signer, ok := privateKey.(crypto.Signer)
+				if !ok {
+					return nil, fmt.Errorf("unsupported EdDSA private key")
+				}
+				k.signKey, k.verifyKey = privateKey, signer.Public()
+			}
+		} else if entry.PublicKeyFile != "" {
+			data, err := readFile(entry.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			var publicKey interface{}
+			if entry.Algorithm == AlgorithmRS256 {
+				publicKey, err = jwt.ParseRSAPublicKeyFromPEM(data)
+			} else {
+				publicKey, err = jwt.ParseEdPublicKeyFromPEM(data)
+			}
+			if err != nil {
+				return nil, err
+			}
+			k.verifyKey = publicKey
+		} else {
+			return nil, fmt.Errorf("private_key_file or public_key_file is required for %s", entry.Algorithm)
+		}
+		k.method = jwt.GetSigningMethod(entry.Algorithm)
+
+	default:
+		return nil, fmt.Errorf("alg must be '%s', '%s' or '%s'", AlgorithmHS256, AlgorithmRS256, AlgorithmEdDSA)
+	}
+	return k, nil
+}
+
+// keyFunc returns the verification key of a token, chosen by its kid. Tokens without a
+// kid are checked against the signing key.
+func (s *keySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	k := s.signing
+	if id, ok := token.Header["kid"].(string); ok {
+		if k, ok = s.keys[id]; !ok {
+			return nil, fmt.Errorf("unknown key %q", id)
+		}
+	}
+	if token.Method.Alg() != k.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	return k.verifyKey, nil
+}
+
+// sign signs claims with the signing key, recording its kid in the header
+func (s *keySet) sign(claims jwt.MapClaims) (string, error) {
+	token := jwt.NewWithClaims(s.signing.method, claims)
+	token.Header["kid"] = s.signing.id
+	return token.SignedString(s.signing.signKey)
+}
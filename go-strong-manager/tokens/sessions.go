@@ -0,0 +1,108 @@
+package tokens
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+// How often the last use of a session is recorded, to avoid a write per request
+const lastSeenInterval = time.Minute
+
+// checkSession returns ErrTokenRevoked unless the session is active, and records its use
+func checkSession(sessionID string) error {
+	var active bool
+	err := database.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM sessions WHERE id = ? AND revoked_at IS NULL AND expires_at >= ?)",
+		sessionID, now(),
+	).Scan(&active)
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrTokenRevoked
+	}
+
+	_, err = database.DB.Exec(
+		"UPDATE sessions SET last_seen_at = ? WHERE id = ? AND last_seen_at < ?",
+		now(), sessionID, time.Now().Add(-lastSeenInterval).UTC().Format(timestampFormat),
+	)
+	return err
+}
+
+// Sessions returns the active sessions of a user, most recently used first
+func Sessions(userID int) ([]models.Session, error) {
+	rows, err := database.DB.Query(`
+		SELECT id, user_id, client_ip, user_agent, created_at, last_seen_at, expires_at
+		FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at >= ?
+		ORDER BY last_seen_at DESC
+	`, userID, now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var session models.Session
+		if err := rows.Scan(
+			&session.ID, &session.UserID, &session.ClientIP, &session.UserAgent,
+			&session.CreatedAt, &session.LastSeenAt, &session.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends a session of a user, invalidating its access and refresh tokens at
+// once. It reports whether the session was active.
+func RevokeSession(userID int, sessionID string) (bool, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE sessions SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		now(), sessionID, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return false, nil
+	}
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE session_id = ? AND revoked_at IS NULL", now(), sessionID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// RevokeUser ends every session of a user, invalidating their tokens at once
+func RevokeUser(userID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeUser(tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// revokeUser ends every session of a user within a transaction
+func revokeUser(tx *sql.Tx, userID int) error {
+	if _, err := tx.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now(), userID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL", now(), userID)
+	return err
+}
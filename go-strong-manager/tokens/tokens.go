@@ -0,0 +1,281 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Token types, stored in the "type" claim so one kind cannot be used as the other
+const (
+	TypeAccess  = "access"
+	TypeRefresh = "refresh"
+)
+
+// Format of the timestamps stored in refresh_tokens and sessions, matching CURRENT_TIMESTAMP
+const timestampFormat = "2006-01-02 15:04:05"
+
+var (
+	// ErrInvalidToken is returned for tokens that are malformed, expired, of the wrong
+	// type, signed by an unknown key, or unknown to the database
+	ErrInvalidToken = errors.New("invalid or expired token")
+	// ErrTokenRevoked is returned for tokens of a revoked session, and when a refresh
+	// token that was already exchanged is presented again
+	ErrTokenRevoked = errors.New("token has been revoked")
+
+	keys *keySet
+
+	// Lifetime of access tokens and refresh tokens
+	accessTTL  = 24 * time.Hour
+	refreshTTL = 7 * 24 * time.Hour
+)
+
+// Initialize loads the signing keys and token lifetimes. It exits when the configured
+// keys cannot be loaded, as nobody could log in.
+func Initialize() {
+	set, err := loadKeys()
+	if err != nil {
+		log.Fatalf("Error loading JWT keys: %v", err)
+	}
+	keys = set
+
+	accessTTL = getEnvDuration("JWT_ACCESS_TTL", accessTTL)
+	refreshTTL = getEnvDuration("JWT_REFRESH_TTL", refreshTTL)
+
+	log.Printf("JWT keys loaded: %d accepted, signing with %s (%s)", len(keys.keys), keys.signing.id, keys.signing.method.Alg())
+}
+
+// Issue starts a session for a user and returns its access token and refresh token
+func Issue(user models.User, clientIP, userAgent string) (accessToken, refreshToken string, err error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	// Forget sessions and refresh tokens that can no longer be used
+	if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE expires_at < ?", now()); err != nil {
+		return "", "", err
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE expires_at < ?", now()); err != nil {
+		return "", "", err
+	}
+
+	sessionID, err := newTokenID()
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO sessions (id, user_id, client_ip, user_agent, expires_at) VALUES (?, ?, ?, ?, ?)",
+		sessionID, user.ID, clientIP, userAgent, time.Now().Add(refreshTTL).UTC().Format(timestampFormat),
+	); err != nil {
+		return "", "", err
+	}
+
+	accessToken, refreshToken, _, err = issue(tx, user, sessionID)
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, refreshToken, tx.Commit()
+}
+
+// issue signs a token pair of a session and stores the refresh token within a
+// transaction. It returns the ID of the refresh token.
+func issue(tx *sql.Tx, user models.User, sessionID string) (string, string, string, error) {
+	issuedAt := time.Now()
+
+	accessToken, err := keys.sign(jwt.MapClaims{
+		"id":    user.ID,
+		"email": user.Email,
+		"role":  user.Role,
+		"sid":   sessionID,
+		"type":  TypeAccess,
+		"iat":   issuedAt.Unix(),
+		"exp":   issuedAt.Add(accessTTL).Unix(),
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", "", "", err
+	}
+	expiresAt := issuedAt.Add(refreshTTL)
+	refreshToken, err := keys.sign(jwt.MapClaims{
+		"id":   user.ID,
+		"jti":  tokenID,
+		"sid":  sessionID,
+		"type": TypeRefresh,
+		"iat":  issuedAt.Unix(),
+		"exp":  expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", "", "", err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO refresh_tokens (id, session_id, user_id, expires_at) VALUES (?, ?, ?, ?)",
+		tokenID, sessionID, user.ID, expiresAt.UTC().Format(timestampFormat),
+	); err != nil {
+		return "", "", "", err
+	}
+	return accessToken, refreshToken, tokenID, nil
+}
+
+// parse verifies a token's signature, expiry, type and session claim, and returns its claims
+func parse(tokenString, tokenType string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, keys.keyFunc, jwt.WithExpirationRequired())
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["type"] != tokenType {
+		return nil, ErrInvalidToken
+	}
+	if _, ok := claims["id"].(float64); !ok {
+		return nil, ErrInvalidToken
+	}
+	if sessionID, _ := claims["sid"].(string); sessionID == "" {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// ParseAccessToken verifies an access token and that its session is still active, and
+// returns its claims
+func ParseAccessToken(tokenString string) (jwt.MapClaims, error) {
+	claims, err := parse(tokenString, TypeAccess)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSession(claims["sid"].(string)); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Refresh exchanges a refresh token for a new token pair of the same session, carrying
+// the user's current email and role. The refresh token is rotated: it is revoked and can
+// only be used once. Presenting a revoked token revokes every session of the user, as it
+// means the token was stolen by someone, or from someone, who already exchanged it.
+func Refresh(refreshToken string) (user models.User, accessToken, newRefreshToken string, err error) {
+	claims, err := parse(refreshToken, TypeRefresh)
+	if err != nil {
+		return user, "", "", err
+	}
+	tokenID, _ := claims["jti"].(string)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return user, "", "", err
+	}
+	defer tx.Rollback()
+
+	var sessionID string
+	var tokenRevokedAt, sessionRevokedAt sql.NullString
+	err = tx.QueryRow(`
+		SELECT t.user_id, t.session_id, t.revoked_at, s.revoked_at
+		FROM refresh_tokens t JOIN sessions s ON s.id = t.session_id
+		WHERE t.id = ? AND t.expires_at >= ?
+	`, tokenID, now()).Scan(&user.ID, &sessionID, &tokenRevokedAt, &sessionRevokedAt)
+	if err == sql.ErrNoRows {
+		return user, "", "", ErrInvalidToken
+	}
+	if err != nil {
+		return user, "", "", err
+	}
+	if sessionRevokedAt.Valid {
+		return user, "", "", ErrTokenRevoked
+	}
+	if tokenRevokedAt.Valid {
+		if err := revokeUser(tx, user.ID); err != nil {
+			return user, "", "", err
+		}
+		if err := tx.Commit(); err != nil {
+			return user, "", "", err
+		}
+		return user, "", "", ErrTokenRevoked
+	}
+
+	// Users that were deleted since cannot refresh
+	err = tx.QueryRow("SELECT email, role FROM users WHERE id = ?", user.ID).Scan(&user.Email, &user.Role)
+	if err == sql.ErrNoRows {
+		return user, "", "", ErrInvalidToken
+	}
+	if err != nil {
+		return user, "", "", err
+	}
+
+	accessToken, newRefreshToken, newTokenID, err := issue(tx, user, sessionID)
+	if err != nil {
+		return user, "", "", err
+	}
+
+	// Only one concurrent exchange of the same token may succeed
+	result, err := tx.Exec(
+		"UPDATE refresh_tokens SET revoked_at = ?, replaced_by = ? WHERE id = ? AND revoked_at IS NULL",
+		now(), newTokenID, tokenID,
+	)
+	if err != nil {
+		return user, "", "", err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return user, "", "", ErrTokenRevoked
+	}
+
+	// The session lasts as long as its newest refresh token
+	if _, err := tx.Exec(
+		"UPDATE sessions SET last_seen_at = ?, expires_at = ? WHERE id = ?",
+		now(), time.Now().Add(refreshTTL).UTC().Format(timestampFormat), sessionID,
+	); err != nil {
+		return user, "", "", err
+	}
+	return user, accessToken, newRefreshToken, tx.Commit()
+}
+
+// Revoke ends the session a refresh token belongs to, invalidating its access tokens
+func Revoke(refreshToken string) error {
+	claims, err := parse(refreshToken, TypeRefresh)
+	if err != nil {
+		return err
+	}
+	_, err = RevokeSession(int(claims["id"].(float64)), claims["sid"].(string))
+	return err
+}
+
+// newTokenID returns a random token or session ID
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// now returns the current time in the format stored in the database
+func now() string {
+	return time.Now().UTC().Format(timestampFormat)
+}
+
+// getEnvDuration gets an environment variable as a duration or returns a default value
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Warning: Invalid duration for %s: %s, using default %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return duration
+}
@@ -0,0 +1,310 @@
+package tokens
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useTestDatabase initializes the database in a temporary directory
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	database.Initialize()
+	t.Cleanup(func() {
+		database.Close()
+		os.Chdir(wd)
+	})
+}
+
+// useKeys signs and verifies tokens with the given keys for the duration of a test
+func useKeys(t *testing.T, set *keySet) {
+	previous := keys
+	keys = set
+	t.Cleanup(func() { keys = previous })
+}
+
+// useSecret signs tokens with a single HS256 key
+func useSecret(t *testing.T) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test-secret")
+	set, err := loadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	useKeys(t, set)
+}
+
+// createUser adds a user to the test database
+func createUser(t *testing.T, email string) models.User {
+	t.Helper()
+	result, err := database.DB.Exec("INSERT INTO users (email, password_hash, role) VALUES (?, '', ?)", email, models.RoleAdmin)
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	return models.User{ID: int(id), Email: email, Role: models.RoleAdmin}
+}
+
+// writeKeyFile writes a JWT keys file, and the PEM files of the given Ed25519 keys, to a
+// temporary directory and returns its path
+func writeKeyFile(t *testing.T, file keyFile, privateKeys map[string]ed25519.PrivateKey, publicKeys map[string]ed25519.PublicKey) string {
+	t.Helper()
+	dir := t.TempDir()
+	writePEM := func(name, blockType string, der []byte) {
+		data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, privateKey := range privateKeys {
+		der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(name, "PRIVATE KEY", der)
+	}
+	for name, publicKey := range publicKeys {
+		der, err := x509.MarshalPKIXPublicKey(publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(name, "PUBLIC KEY", der)
+	}
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "keys.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// loadTestKeys loads a keys file written by writeKeyFile
+func loadTestKeys(t *testing.T, path string) *keySet {
+	t.Helper()
+	set, err := loadKeyFile(path)
+	if err != nil {
+		t.Fatalf("load keys file: %v", err)
+	}
+	return set
+}
+
+func TestRefreshRotatesRefreshToken(t *testing.T) {
+	useTestDatabase(t)
+	useSecret(t)
+	user := createUser(t, "admin@example.com")
+
+	_, refreshToken, err := Issue(user, "203.0.113.7", "test")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	refreshed, accessToken, newRefreshToken, err := Refresh(refreshToken)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if refreshed.ID != user.ID || refreshed.Email != user.Email || refreshed.Role != user.Role {
+		t.Errorf("refreshed user = %+v, want %+v", refreshed, user)
+	}
+	if newRefreshToken == refreshToken {
+		t.Fatal("the refresh token was not rotated")
+	}
+	claims, err := ParseAccessToken(accessToken)
+	if err != nil {
+		t.Fatalf("new access token rejected: %v", err)
+	}
+	original, _ := parse(refreshToken, TypeRefresh)
+	if claims["sid"] != original["sid"] {
+		t.Error("the new tokens belong to another session")
+	}
+
+	// The new refresh token can be exchanged in turn
+	if _, _, _, err := Refresh(newRefreshToken); err != nil {
+		t.Fatalf("Refresh with the rotated token: %v", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesEverySession(t *testing.T) {
+	useTestDatabase(t)
+	useSecret(t)
+	user := createUser(t, "admin@example.com")
+	other := createUser(t, "other@example.com")
+
+	_, stolen, err := Issue(user, "203.0.113.7", "test")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	laptopAccess, _, err := Issue(user, "203.0.113.8", "laptop")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	otherAccess, _, err := Issue(other, "203.0.113.9", "test")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	_, rotatedAccess, rotated, err := Refresh(stolen)
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	// Exchanging the same token again means it was stolen
+	if _, _, _, err := Refresh(stolen); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("reused refresh token: err = %v, want ErrTokenRevoked", err)
+	}
+
+	for name, accessToken := range map[string]string{"rotated session": rotatedAccess, "other session": laptopAccess} {
+		if _, err := ParseAccessToken(accessToken); !errors.Is(err, ErrTokenRevoked) {
+			t.Errorf("access token of the %s: err = %v, want ErrTokenRevoked", name, err)
+		}
+	}
+	if _, _, _, err := Refresh(rotated); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("rotated refresh token: err = %v, want ErrTokenRevoked", err)
+	}
+	if sessions, err := Sessions(user.ID); err != nil || len(sessions) != 0 {
+		t.Errorf("sessions = %v, %v, want none", sessions, err)
+	}
+
+	// Other users are not affected
+	if _, err := ParseAccessToken(otherAccess); err != nil {
+		t.Errorf("access token of another user rejected: %v", err)
+	}
+}
+
+func TestRetiredKeysOnlyVerifyTokens(t *testing.T) {
+	useTestDatabase(t)
+	user := createUser(t, "admin@example.com")
+
+	oldPublic, oldPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	_, newPrivate, _ := ed25519.GenerateKey(rand.Reader)
+
+	// Tokens signed by the old key...
+	useKeys(t, loadTestKeys(t, writeKeyFile(t, keyFile{
+		Keys: []keyFileEntry{{ID: "old", Algorithm: AlgorithmEdDSA, PrivateKeyFile: "old.pem"}},
+	}, map[string]ed25519.PrivateKey{"old.pem": oldPrivate}, nil)))
+	oldAccess, _, err := Issue(user, "203.0.113.7", "test")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	// ...are still accepted once it is retired to a verify-only key
+	rotated := loadTestKeys(t, writeKeyFile(t, keyFile{
+		SigningKey: "new",
+		Keys: []keyFileEntry{
+			{ID: "old", Algorithm: AlgorithmEdDSA, PublicKeyFile: "old.pub"},
+			{ID: "new", Algorithm: AlgorithmEdDSA, PrivateKeyFile: "new.pem"},
+		},
+	}, map[string]ed25519.PrivateKey{"new.pem": newPrivate}, map[string]ed25519.PublicKey{"old.pub": oldPublic}))
+	useKeys(t, rotated)
+	if rotated.signing.id != "new" {
+		t.Fatalf("signing with %q, want the new key", rotated.signing.id)
+	}
+	if _, err := ParseAccessToken(oldAccess); err != nil {
+		t.Fatalf("token of the retired key rejected: %v", err)
+	}
+
+	newAccess, _, err := Issue(user, "203.0.113.7", "test")
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(newAccess, jwt.MapClaims{})
+	if err != nil {
+		t.Fatalf("parse new token: %v", err)
+	}
+	if token.Header["kid"] != "new" {
+		t.Fatalf("new token header = %v, want kid new", token.Header)
+	}
+	if _, err := ParseAccessToken(newAccess); err != nil {
+		t.Fatalf("token of the new key rejected: %v", err)
+	}
+
+	// Once the old key is dropped its tokens are unknown
+	useKeys(t, &keySet{keys: map[string]*key{"new": rotated.keys["new"]}, signing: rotated.keys["new"]})
+	if _, err := ParseAccessToken(oldAccess); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("token of a dropped key: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestKeyFileRequiresSigningKey(t *testing.T) {
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	path := writeKeyFile(t, keyFile{
+		Keys: []keyFileEntry{{ID: "old", Algorithm: AlgorithmEdDSA, PublicKeyFile: "old.pub"}},
+	}, nil, map[string]ed25519.PublicKey{"old.pub": publicKey})
+
+	if _, err := loadKeyFile(path); err == nil {
+		t.Fatal("a keys file with only verify-only keys was accepted")
+	}
+}
+
+func TestParseRejectsForeignTokens(t *testing.T) {
+	useTestDatabase(t)
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	useKeys(t, loadTestKeys(t, writeKeyFile(t, keyFile{
+		Keys: []keyFileEntry{
+			{ID: "ed", Algorithm: AlgorithmEdDSA, PrivateKeyFile: "ed.pem"},
+			{ID: "hs", Algorithm: AlgorithmHS256, Secret: "shared-secret"},
+		},
+	}, map[string]ed25519.PrivateKey{"ed.pem": privateKey}, nil)))
+	user := createUser(t, "admin@example.com")
+	if _, _, err := Issue(user, "203.0.113.7", "test"); err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+
+	claims := jwt.MapClaims{"id": user.ID, "sid": "session", "type": TypeAccess, "exp": 4102444800}
+	signed := func(method jwt.SigningMethod, kid string, signKey interface{}) string {
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		tokenString, err := token.SignedString(signKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tokenString
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		// The public key of an asymmetric key used as an HMAC secret
+		{"HS256 with the kid of an EdDSA key", signed(jwt.SigningMethodHS256, "ed", []byte(publicKey))},
+		{"EdDSA with the kid of an HS256 key", signed(jwt.SigningMethodEdDSA, "hs", privateKey)},
+		{"HS256 without kid while signing with EdDSA", signed(jwt.SigningMethodHS256, "", []byte("shared-secret"))},
+		{"alg none", signed(jwt.SigningMethodNone, "ed", jwt.UnsafeAllowNoneSignatureType)},
+		{"unknown kid", signed(jwt.SigningMethodHS256, "retired", []byte("shared-secret"))},
+		{"right kid, wrong secret", signed(jwt.SigningMethodHS256, "hs", []byte("guessed-secret"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parse(tt.token, TypeAccess); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("err = %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+
+	// The same claims signed by a configured key are valid
+	if _, err := parse(signed(jwt.SigningMethodHS256, "hs", []byte("shared-secret")), TypeAccess); err != nil {
+		t.Fatalf("token of a configured key rejected: %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+package twofactor
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+	"github.com/arifur/strong-reverse-proxy/models"
+)
+
+const (
+	// Recovery codes issued at enrolment, each usable once instead of a TOTP code
+	recoveryCodeCount = 10
+	// Characters of a recovery code, excluding the separator
+	recoveryCodeLength = 10
+
+	// Invalid codes allowed before verification is locked for a while
+	maxFailures = 5
+	lockout     = 5 * time.Minute
+
+	// Key of the enforcement policy in the settings table
+	settingRequireTwoFactor = "require_two_factor"
+)
+
+var (
+	// ErrInvalidCode is returned when a TOTP or recovery code does not match, or a TOTP
+	// code was already used
+	ErrInvalidCode = errors.New("invalid two-factor code")
+	// ErrTooManyAttempts is returned while verification is locked after invalid codes
+	ErrTooManyAttempts = errors.New("too many invalid two-factor codes")
+	// ErrAlreadyEnabled is returned when setting up a user who is already enrolled
+	ErrAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrNotSetUp is returned when enabling a user who has no pending secret
+	ErrNotSetUp = errors.New("two-factor authentication has not been set up")
+
+	// Whether every user must use two-factor authentication
+	required atomic.Bool
+
+	// Invalid code counts by user ID, to slow down guessing
+	failuresMu sync.Mutex
+	failures   = make(map[int]*failureCount)
+)
+
+// failureCount tracks the invalid codes of a user
+type failureCount struct {
+	count       int
+	lockedUntil time.Time
+}
+
+// Initialize loads the enforcement policy
+func Initialize() {
+	var value string
+	err := database.DB.QueryRow("SELECT value FROM settings WHERE key = ?", settingRequireTwoFactor).Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading two-factor policy: %v", err)
+		return
+	}
+	enabled, _ := strconv.ParseBool(value)
+	required.Store(enabled)
+	if required.Load() {
+		log.Println("Two-factor authentication is required for all users")
+	}
+}
+
+// Required reports whether every user must use two-factor authentication
+func Required() bool {
+	return required.Load()
+}
+
+// SetRequired changes the enforcement policy
+func SetRequired(value bool) error {
+	_, err := database.DB.Exec(
+		"INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value",
+		settingRequireTwoFactor, strconv.FormatBool(value),
+	)
+	if err != nil {
+		return err
+	}
+	required.Store(value)
+	return nil
+}
+
+// Enabled reports whether a user is enrolled
+func Enabled(userID int) (bool, error) {
+	var enabled bool
+	err := database.DB.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", userID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// Status returns the enrolment of a user
+func Status(userID int) (models.TwoFactorStatus, error) {
+	status := models.TwoFactorStatus{Required: Required()}
+	err := database.DB.QueryRow(`
+		SELECT
+			u.totp_enabled,
+			(SELECT COUNT(*) FROM user_recovery_codes r WHERE r.user_id = u.id AND r.used_at IS NULL)
+		FROM users u
+		WHERE u.id = ?
+	`, userID).Scan(&status.Enabled, &status.RecoveryCodesRemaining)
+	return status, err
+}
+
+// Setup generates a new secret for a user, replacing any pending one. The user is only
+// enrolled once Enable confirms a code of the secret.
+func Setup(userID int, email string) (models.TwoFactorSetup, error) {
+	enabled, err := Enabled(userID)
+	if err != nil {
+		return models.TwoFactorSetup{}, err
+	}
+	if enabled {
+		return models.TwoFactorSetup{}, ErrAlreadyEnabled
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return models.TwoFactorSetup{}, err
+	}
+	if _, err := database.DB.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?", secret, userID); err != nil {
+		return models.TwoFactorSetup{}, err
+	}
+	return models.TwoFactorSetup{Secret: secret, OtpauthURI: otpauthURI(secret, email)}, nil
+}
+
+// Enable enrolls a user after checking a code of their pending secret, and returns their
+// recovery codes
+func Enable(userID int, code string) ([]string, error) {
+	var secret string
+	var enabled bool
+	err := database.DB.QueryRow("SELECT totp_secret, totp_enabled FROM users WHERE id = ?", userID).Scan(&secret, &enabled)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrAlreadyEnabled
+	}
+	if secret == "" {
+		return nil, ErrNotSetUp
+	}
+
+	if locked(userID) {
+		return nil, ErrTooManyAttempts
+	}
+	step := matchTOTP(secret, code, time.Now())
+	if step == 0 {
+		recordFailure(userID)
+		return nil, ErrInvalidCode
+	}
+	clearFailures(userID)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, userID); err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// Disable removes the enrolment of a user, with their secret and recovery codes
+func Disable(userID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0 WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of an enrolled user
+func RegenerateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// Verify checks the second factor of an enrolled user: a TOTP code, which cannot be used
+// twice, or else a recovery code, which is used up
+func Verify(userID int, code, recoveryCode string) error {
+	if locked(userID) {
+		return ErrTooManyAttempts
+	}
+
+	var err error
+	if code != "" {
+		err = verifyTOTP(userID, code)
+	} else {
+		err = useRecoveryCode(userID, recoveryCode)
+	}
+	if err == ErrInvalidCode {
+		recordFailure(userID)
+	} else if err == nil {
+		clearFailures(userID)
+	}
+	return err
+}
+
+// verifyTOTP checks a TOTP code and records its time step, so it cannot be replayed
+func verifyTOTP(userID int, code string) error {
+	var secret string
+	var lastStep int64
+	err := database.DB.QueryRow(
+		"SELECT totp_secret, totp_last_step FROM users WHERE id = ? AND totp_enabled = 1", userID,
+	).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return ErrInvalidCode
+	}
+	if err != nil {
+		return err
+	}
+
+	step := matchTOTP(secret, code, time.Now())
+	if step == 0 || step <= lastStep {
+		return ErrInvalidCode
+	}
+
+	// Only one concurrent use of the same code may succeed
+	result, err := database.DB.Exec(
+		"UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?",
+		step, userID, step,
+	)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// useRecoveryCode marks an unused recovery code of a user as used
+func useRecoveryCode(userID int, recoveryCode string) error {
+	result, err := database.DB.Exec(
+		"UPDATE user_recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now().UTC().Format("2006-01-02 15:04:05"), userID, hashRecoveryCode(recoveryCode),
+	)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// replaceRecoveryCodes generates new recovery codes for a user, storing only their hashes
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(
+			"INSERT INTO user_recovery_codes (user_id, code_hash) VALUES (?, ?)",
+			userID, hashRecoveryCode(code),
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// newRecoveryCode returns a random recovery code such as "K7QXM-2RTWB"
+func newRecoveryCode() (string, error) {
+	random := make([]byte, recoveryCodeLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	code := secretEncoding.EncodeToString(random)[:recoveryCodeLength]
+	return code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:], nil
+}
+
+// hashRecoveryCode hashes a recovery code, ignoring case and separators. Codes carry 50
+// random bits, so a fast hash is enough to keep them unusable if the database leaks.
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// locked reports whether verification is locked for a user after invalid codes
+func locked(userID int) bool {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+	failure, ok := failures[userID]
+	return ok && time.Now().Before(failure.lockedUntil)
+}
+
+// recordFailure counts an invalid code, locking verification after too many
+func recordFailure(userID int) {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+	failure, ok := failures[userID]
+	if !ok {
+		failure = &failureCount{}
+		failures[userID] = failure
+	}
+	failure.count++
+	if failure.count >= maxFailures {
+		failure.count = 0
+		failure.lockedUntil = time.Now().Add(lockout)
+		log.Printf("Two-factor verification locked for user %d after %d invalid codes", userID, maxFailures)
+	}
+}
+
+// clearFailures forgets the invalid codes of a user after a valid one
+func clearFailures(userID int) {
+	failuresMu.Lock()
+	defer failuresMu.Unlock()
+	delete(failures, userID)
+}
@@ -0,0 +1,199 @@
+package twofactor
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arifur/strong-reverse-proxy/database"
+)
+
+// useTestDatabase initializes the database in a temporary directory
+func useTestDatabase(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	database.Initialize()
+	t.Cleanup(func() {
+		database.Close()
+		os.Chdir(wd)
+	})
+}
+
+// enrolledUser creates a user and enrolls them, returning their ID, secret and recovery codes
+func enrolledUser(t *testing.T) (int, string, []string) {
+	t.Helper()
+	result, err := database.DB.Exec("INSERT INTO users (email, password_hash, role) VALUES ('admin@example.com', '', 'admin')")
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	userID := int(id)
+	t.Cleanup(func() { clearFailures(userID) })
+
+	setup, err := Setup(userID, "admin@example.com")
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	codes, err := Enable(userID, currentCode(t, setup.Secret, 0))
+	if err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+	return userID, setup.Secret, codes
+}
+
+// currentCode returns the code of a secret for the time step at the given offset from now
+func currentCode(t *testing.T, secret string, offset int64) string {
+	t.Helper()
+	code, err := totpCode(secret, totpStep(time.Now())+offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	// The SHA-1 test vectors of RFC 6238 appendix B, whose 8 digit codes end in our 6 digits
+	secret := secretEncoding.EncodeToString([]byte("12345678901234567890"))
+	for _, tt := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		step := totpStep(time.Unix(tt.unix, 0))
+		got, err := totpCode(secret, step)
+		if err != nil {
+			t.Fatalf("totpCode: %v", err)
+		}
+		if got != tt.want[2:] {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want[2:])
+		}
+
+		// Codes are accepted with spaces, and in the adjacent periods only
+		at := time.Unix(tt.unix, 0)
+		if matchTOTP(strings.ToLower(secret), got[:3]+" "+got[3:], at) != step {
+			t.Errorf("code at %d not matched", tt.unix)
+		}
+		if matchTOTP(secret, got, at.Add(totpPeriod*time.Second)) != step {
+			t.Errorf("code at %d not matched in the next period", tt.unix)
+		}
+		if matchTOTP(secret, got, at.Add(2*totpPeriod*time.Second)) != 0 {
+			t.Errorf("code at %d matched two periods later", tt.unix)
+		}
+	}
+}
+
+func TestTOTPCodeCannotBeReused(t *testing.T) {
+	useTestDatabase(t)
+	userID, secret, _ := enrolledUser(t)
+
+	var enabledStep int64
+	if err := database.DB.QueryRow("SELECT totp_last_step FROM users WHERE id = ?", userID).Scan(&enabledStep); err != nil {
+		t.Fatalf("load last step: %v", err)
+	}
+	codeAt := func(step int64) string {
+		code, err := totpCode(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	// Enabling used up its code
+	if err := Verify(userID, codeAt(enabledStep), ""); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("code used to enable: err = %v, want ErrInvalidCode", err)
+	}
+
+	next := codeAt(enabledStep + 1)
+	if err := Verify(userID, next, ""); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := Verify(userID, next, ""); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("replayed code: err = %v, want ErrInvalidCode", err)
+	}
+
+	// Neither are codes of earlier periods that were never used
+	if err := Verify(userID, codeAt(enabledStep-1), ""); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("code older than the last used one: err = %v, want ErrInvalidCode", err)
+	}
+}
+
+func TestRecoveryCodeIsUsedUp(t *testing.T) {
+	useTestDatabase(t)
+	userID, _, codes := enrolledUser(t)
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	// Case and separators do not matter
+	if err := Verify(userID, "", strings.ToLower(strings.ReplaceAll(codes[0], "-", ""))); err != nil {
+		t.Fatalf("Verify with a recovery code: %v", err)
+	}
+	if err := Verify(userID, "", codes[0]); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("used recovery code: err = %v, want ErrInvalidCode", err)
+	}
+	if err := Verify(userID, "", codes[1]); err != nil {
+		t.Fatalf("Verify with another recovery code: %v", err)
+	}
+
+	status, err := Status(userID)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if status.RecoveryCodesRemaining != recoveryCodeCount-2 {
+		t.Errorf("%d recovery codes remaining, want %d", status.RecoveryCodesRemaining, recoveryCodeCount-2)
+	}
+}
+
+func TestVerifyLocksAfterInvalidCodes(t *testing.T) {
+	useTestDatabase(t)
+	userID, secret, codes := enrolledUser(t)
+
+	// A valid code resets the count
+	for i := 0; i < maxFailures-1; i++ {
+		if err := Verify(userID, "not-a-code", ""); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("invalid code %d: err = %v, want ErrInvalidCode", i+1, err)
+		}
+	}
+	if err := Verify(userID, "", codes[0]); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	for i := 0; i < maxFailures; i++ {
+		if err := Verify(userID, "", "WRONG-CODES"); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("invalid code %d: err = %v, want ErrInvalidCode", i+1, err)
+		}
+	}
+
+	// Locked, even for valid codes, which are not used up
+	if err := Verify(userID, currentCode(t, secret, 1), ""); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("valid code while locked: err = %v, want ErrTooManyAttempts", err)
+	}
+	if err := Verify(userID, "", codes[1]); !errors.Is(err, ErrTooManyAttempts) {
+		t.Fatalf("recovery code while locked: err = %v, want ErrTooManyAttempts", err)
+	}
+
+	// Until the lockout is over
+	failuresMu.Lock()
+	failures[userID].lockedUntil = time.Now().Add(-time.Second)
+	failuresMu.Unlock()
+	if err := Verify(userID, currentCode(t, secret, 1), ""); err != nil {
+		t.Fatalf("valid code after the lockout: %v", err)
+	}
+	if err := Verify(userID, "", codes[1]); err != nil {
+		t.Fatalf("recovery code after the lockout: %v", err)
+	}
+}
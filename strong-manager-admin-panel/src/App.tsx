@@ -10,6 +10,7 @@ import Stats from './pages/Stats';
 import Users from './pages/Users';
 import Database from './pages/Database';
 import RequestRules from './pages/RequestRules';
+import Account from './pages/Account';
 import NotFound from './pages/NotFound';
 
 // Layout
@@ -48,6 +49,7 @@ function App() {
             <Route path="request-rules" element={<RequestRules />} />
             <Route path="users" element={<Users />} />
             <Route path="database" element={<Database />} />
+            <Route path="account" element={<Account />} />
             <Route path="*" element={<NotFound />} />
           </Route>
           
@@ -3,6 +3,7 @@ import { Link, Outlet, useLocation, useNavigate } from 'react-router-dom';
 import { RiServerLine, RiSettings3Line, RiDashboardLine, RiLineChartLine, RiNotification3Line, RiDatabase2Line, RiShieldLine } from 'react-icons/ri';
 import { BsGear, BsChevronDown, BsChevronUp } from 'react-icons/bs';
 import { FiUsers } from 'react-icons/fi';
+import { authAPI } from '../services/api';
 
 interface LayoutProps {
   children?: React.ReactNode;
@@ -64,7 +65,13 @@ const Layout: React.FC<LayoutProps> = ({ children }) => {
   };
 
   const handleLogout = () => {
+    // Revoke the session on the server; the local tokens are dropped either way
+    const refreshToken = localStorage.getItem('refreshToken');
+    if (refreshToken) {
+      authAPI.logout(refreshToken).catch(() => {});
+    }
     localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
     navigate('/login');
   };
 
@@ -173,9 +180,9 @@ const Layout: React.FC<LayoutProps> = ({ children }) => {
         <header className="h-16 bg-white border-b border-gray-200 flex items-center justify-between px-6">
           <div className="text-lg font-medium">Strong Reverse Proxy Admin</div>
           <div className="flex items-center space-x-4">
-            <button className="p-2 rounded hover:bg-gray-100">
+            <Link to="/account" className="p-2 rounded hover:bg-gray-100" title="Account security">
               <BsGear size={18} />
-            </button>
+            </Link>
           </div>
         </header>
 
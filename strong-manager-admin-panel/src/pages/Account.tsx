@@ -0,0 +1,261 @@
+import React, { useState } from 'react';
+import { useMutation, useQuery, useQueryClient } from '@tanstack/react-query';
+import { accountAPI, securityAPI } from '../services/api';
+import { RiShieldKeyholeLine, RiAlertLine } from 'react-icons/ri';
+
+interface TwoFactorStatus {
+  enabled: boolean;
+  required: boolean;
+  recovery_codes_remaining: number;
+}
+
+interface TwoFactorSetup {
+  secret: string;
+  otpauth_uri: string;
+}
+
+// Six digits are a TOTP code, anything longer a recovery code
+const secondFactor = (value: string) => {
+  const trimmed = value.replace(/\s/g, '');
+  return /^\d{6}$/.test(trimmed) ? { code: trimmed } : { recovery_code: trimmed };
+};
+
+const errorMessage = (error: any) =>
+  error?.response?.data?.error || 'An error occurred. Please try again.';
+
+const Account: React.FC = () => {
+  const [setup, setSetup] = useState<TwoFactorSetup | null>(null);
+  const [code, setCode] = useState('');
+  const [recoveryCodes, setRecoveryCodes] = useState<string[] | null>(null);
+  const [error, setError] = useState('');
+  const queryClient = useQueryClient();
+
+  const { data: status, isLoading } = useQuery<TwoFactorStatus>({
+    queryKey: ['two-factor'],
+    queryFn: async () => {
+      const res = await accountAPI.getTwoFactor();
+      return res.data;
+    },
+  });
+
+  // Only admins may read and change the security policies
+  const { data: security } = useQuery({
+    queryKey: ['security'],
+    queryFn: async () => {
+      const res = await securityAPI.get();
+      return res.data as { require_two_factor: boolean };
+    },
+    retry: false,
+  });
+
+  const onSuccess = () => {
+    setCode('');
+    setError('');
+    queryClient.invalidateQueries({ queryKey: ['two-factor'] });
+  };
+  const onError = (err: any) => setError(errorMessage(err));
+
+  const setupMutation = useMutation({
+    mutationFn: accountAPI.setupTwoFactor,
+    onSuccess: (res) => {
+      setSetup(res.data);
+      setRecoveryCodes(null);
+      onSuccess();
+    },
+    onError,
+  });
+
+  const enableMutation = useMutation({
+    mutationFn: (value: string) => accountAPI.enableTwoFactor(value.replace(/\s/g, '')),
+    onSuccess: (res) => {
+      setSetup(null);
+      setRecoveryCodes(res.data.recovery_codes);
+      onSuccess();
+    },
+    onError,
+  });
+
+  const regenerateMutation = useMutation({
+    mutationFn: (value: string) => accountAPI.regenerateRecoveryCodes(secondFactor(value)),
+    onSuccess: (res) => {
+      setRecoveryCodes(res.data.recovery_codes);
+      onSuccess();
+    },
+    onError,
+  });
+
+  const disableMutation = useMutation({
+    mutationFn: (value: string) => accountAPI.disableTwoFactor(secondFactor(value)),
+    onSuccess: () => {
+      setRecoveryCodes(null);
+      onSuccess();
+    },
+    onError,
+  });
+
+  const securityMutation = useMutation({
+    mutationFn: securityAPI.update,
+    onSuccess: () => {
+      setError('');
+      queryClient.invalidateQueries({ queryKey: ['security'] });
+      queryClient.invalidateQueries({ queryKey: ['two-factor'] });
+    },
+    onError,
+  });
+
+  const codeInput = (placeholder: string) => (
+    <input
+      type="text"
+      autoComplete="one-time-code"
+      className="px-3 py-2 border border-gray-300 rounded-md text-sm focus:outline-none focus:ring-blue-500 focus:border-blue-500"
+      placeholder={placeholder}
+      value={code}
+      onChange={(e) => setCode(e.target.value)}
+    />
+  );
+
+  return (
+    <div className="space-y-6">
+      <div className="flex justify-between items-center">
+        <h1 className="text-2xl font-bold text-gray-900">Account Security</h1>
+      </div>
+
+      {status?.required && !status.enabled && (
+        <div className="flex items-center p-4 rounded-md bg-yellow-50 text-yellow-800 text-sm">
+          <RiAlertLine className="mr-2" size={18} />
+          Two-factor authentication is required. Set it up to continue using the admin panel.
+        </div>
+      )}
+
+      {error && (
+        <div className="p-4 rounded-md bg-red-50 text-red-700 text-sm">{error}</div>
+      )}
+
+      <div className="bg-white rounded-lg shadow-sm border border-gray-200">
+        <div className="px-5 py-4 border-b border-gray-200 flex items-center">
+          <RiShieldKeyholeLine className="mr-2 text-gray-500" size={20} />
+          <h2 className="text-lg font-medium text-gray-700">Two-Factor Authentication</h2>
+        </div>
+
+        {isLoading ? (
+          <div className="p-8 flex justify-center">
+            <div className="animate-spin rounded-full h-8 w-8 border-t-2 border-b-2 border-blue-500"></div>
+          </div>
+        ) : (
+          <div className="p-5 space-y-4 text-sm text-gray-700">
+            <p>
+              Status:{' '}
+              <span className={status?.enabled ? 'text-green-600 font-medium' : 'text-gray-500 font-medium'}>
+                {status?.enabled ? 'Enabled' : 'Disabled'}
+              </span>
+              {status?.enabled && ` (${status.recovery_codes_remaining} recovery codes left)`}
+            </p>
+
+            {recoveryCodes && (
+              <div className="p-4 rounded-md bg-gray-50 border border-gray-200">
+                <p className="mb-2 font-medium">
+                  Store these recovery codes somewhere safe. Each can be used once instead of a code, and they will not be shown again.
+                </p>
+                <div className="grid grid-cols-2 gap-1 font-mono">
+                  {recoveryCodes.map((recoveryCode) => (
+                    <span key={recoveryCode}>{recoveryCode}</span>
+                  ))}
+                </div>
+              </div>
+            )}
+
+            {!status?.enabled && !setup && (
+              <button
+                onClick={() => setupMutation.mutate()}
+                disabled={setupMutation.isPending}
+                className="px-4 py-2 text-sm text-white bg-blue-600 rounded-md hover:bg-blue-700"
+              >
+                Set Up Two-Factor Authentication
+              </button>
+            )}
+
+            {!status?.enabled && setup && (
+              <form
+                className="space-y-3"
+                onSubmit={(e) => {
+                  e.preventDefault();
+                  enableMutation.mutate(code);
+                }}
+              >
+                <p>
+                  Add this account to your authenticator app with the{' '}
+                  <a href={setup.otpauth_uri} className="text-blue-600 hover:underline">setup link</a>{' '}
+                  or by entering the key manually:
+                </p>
+                <p className="font-mono break-all p-2 bg-gray-50 rounded">{setup.secret}</p>
+                <p>Then enter the code it shows to finish:</p>
+                <div className="flex space-x-2">
+                  {codeInput('123456')}
+                  <button
+                    type="submit"
+                    disabled={enableMutation.isPending}
+                    className="px-4 py-2 text-sm text-white bg-blue-600 rounded-md hover:bg-blue-700"
+                  >
+                    Enable
+                  </button>
+                </div>
+              </form>
+            )}
+
+            {status?.enabled && (
+              <div className="space-y-2">
+                <p>Enter a code from your authenticator app, or a recovery code, to manage two-factor authentication:</p>
+                <div className="flex space-x-2">
+                  {codeInput('123456')}
+                  <button
+                    onClick={() => regenerateMutation.mutate(code)}
+                    disabled={!code || regenerateMutation.isPending}
+                    className="px-4 py-2 text-sm text-gray-700 bg-gray-100 rounded-md hover:bg-gray-200"
+                  >
+                    New Recovery Codes
+                  </button>
+                  <button
+                    onClick={() => {
+                      if (window.confirm('Disable two-factor authentication for your account?')) {
+                        disableMutation.mutate(code);
+                      }
+                    }}
+                    disabled={!code || status.required || disableMutation.isPending}
+                    title={status.required ? 'Two-factor authentication is required for all users' : undefined}
+                    className="px-4 py-2 text-sm text-white bg-red-500 rounded-md hover:bg-red-600 disabled:opacity-50"
+                  >
+                    Disable
+                  </button>
+                </div>
+              </div>
+            )}
+          </div>
+        )}
+      </div>
+
+      {security && (
+        <div className="bg-white rounded-lg shadow-sm border border-gray-200">
+          <div className="px-5 py-4 border-b border-gray-200">
+            <h2 className="text-lg font-medium text-gray-700">Security Policies</h2>
+          </div>
+          <div className="p-5 text-sm text-gray-700">
+            <label className="flex items-center space-x-2">
+              <input
+                type="checkbox"
+                checked={security.require_two_factor}
+                disabled={securityMutation.isPending}
+                onChange={(e) => securityMutation.mutate({ require_two_factor: e.target.checked })}
+              />
+              <span>Require two-factor authentication for all users</span>
+            </label>
+            <p className="mt-2 text-gray-500">
+              Users who have not set it up can only do so until they have. Lost authenticators can be reset from the Users page.
+            </p>
+          </div>
+        </div>
+      )}
+    </div>
+  );
+};
+
+export default Account;
@@ -104,10 +104,19 @@ const Database: React.FC = () => {
   };
 
   // Handle download
-  const handleDownload = (filename: string) => {
-    // Create a link to download the file
-    const downloadUrl = databaseAPI.getDownloadUrl(filename);
-    window.open(downloadUrl, '_blank');
+  const handleDownload = async (filename: string) => {
+    // Fetch the backup with the auth token, then save it through a temporary link
+    try {
+      const response = await databaseAPI.downloadBackup(filename);
+      const downloadUrl = URL.createObjectURL(response.data);
+      const link = document.createElement('a');
+      link.href = downloadUrl;
+      link.download = filename;
+      link.click();
+      URL.revokeObjectURL(downloadUrl);
+    } catch {
+      alert('Failed to download backup');
+    }
   };
 
   // Format file size
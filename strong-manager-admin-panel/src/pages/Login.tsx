@@ -11,6 +11,8 @@ const Login = ({ onLogin }: LoginProps) => {
   const [error, setError] = useState('');
   const [isLoading, setIsLoading] = useState(false);
   const [isFirstUser, setIsFirstUser] = useState(false);
+  const [twoFactorRequired, setTwoFactorRequired] = useState(false);
+  const [code, setCode] = useState('');
 
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault();
@@ -25,6 +27,14 @@ const Login = ({ onLogin }: LoginProps) => {
         if (response.status === 201) {
           response = await authAPI.login(email, password);
         }
+      } else if (twoFactorRequired) {
+        // Six digits are a TOTP code, anything longer a recovery code
+        const trimmed = code.replace(/\s/g, '');
+        response = await authAPI.login(
+          email,
+          password,
+          /^\d{6}$/.test(trimmed) ? { code: trimmed } : { recovery_code: trimmed }
+        );
       } else {
         response = await authAPI.login(email, password);
       }
@@ -32,6 +42,7 @@ const Login = ({ onLogin }: LoginProps) => {
       if (response.data && response.data.token) {
         // Save token to localStorage
         localStorage.setItem('token', response.data.token);
+        localStorage.setItem('refreshToken', response.data.refreshToken);
         onLogin();
       }
     } catch (err: any) {
@@ -39,6 +50,13 @@ const Login = ({ onLogin }: LoginProps) => {
         // If we get a 403 during signup, it means users already exist
         setError('User already exists. Please login instead.');
         setIsFirstUser(false);
+      } else if (err.response && err.response.data?.two_factor_required) {
+        // Ask for the second factor, then report invalid codes
+        if (twoFactorRequired) {
+          setError(err.response.data.error);
+        }
+        setTwoFactorRequired(true);
+        setCode('');
       } else if (err.response && err.response.status === 401) {
         setError('Invalid email or password');
       } else {
@@ -52,6 +70,7 @@ const Login = ({ onLogin }: LoginProps) => {
 
   const toggleMode = () => {
     setIsFirstUser(!isFirstUser);
+    setTwoFactorRequired(false);
     setError('');
   };
 
@@ -106,6 +125,27 @@ const Login = ({ onLogin }: LoginProps) => {
             </div>
           </div>
 
+          {twoFactorRequired && (
+            <div>
+              <label htmlFor="code" className="block text-sm text-gray-600 mb-1">
+                Enter the code from your authenticator app, or a recovery code
+              </label>
+              <input
+                id="code"
+                name="code"
+                type="text"
+                inputMode="numeric"
+                autoComplete="one-time-code"
+                autoFocus
+                required
+                className="appearance-none rounded-md relative block w-full px-3 py-2 border border-gray-300 placeholder-gray-500 text-gray-900 focus:outline-none focus:ring-indigo-500 focus:border-indigo-500 sm:text-sm"
+                placeholder="123456"
+                value={code}
+                onChange={(e) => setCode(e.target.value)}
+              />
+            </div>
+          )}
+
           {error && (
             <div className="text-red-500 text-sm mt-2">{error}</div>
           )}
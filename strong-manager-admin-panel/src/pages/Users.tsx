@@ -5,6 +5,8 @@ import {
   RiAddLine, 
   RiEditLine, 
   RiDeleteBinLine, 
+  RiLogoutBoxRLine,
+  RiShieldKeyholeLine,
   RiSearchLine,
   RiUserLine,
   RiShieldUserLine 
@@ -14,6 +16,7 @@ interface User {
   id: number;
   email: string;
   role: string;
+  two_factor_enabled?: boolean;
 }
 
 const Users: React.FC = () => {
@@ -27,7 +30,7 @@ const Users: React.FC = () => {
   }>({
     email: '',
     password: '',
-    role: 'user',
+    role: 'viewer',
   });
 
   const [editingUser, setEditingUser] = useState<User | null>(null);
@@ -76,6 +79,17 @@ const Users: React.FC = () => {
     },
   });
 
+  const revokeSessions = useMutation({
+    mutationFn: (id: number) => usersAPI.revokeSessions(id),
+  });
+
+  const resetTwoFactor = useMutation({
+    mutationFn: (id: number) => usersAPI.resetTwoFactor(id),
+    onSuccess: () => {
+      queryClient.invalidateQueries({ queryKey: ['users'] });
+    },
+  });
+
   // Form handlers
   const handleUserSubmit = (e: React.FormEvent) => {
     e.preventDefault();
@@ -103,7 +117,7 @@ const Users: React.FC = () => {
     setNewUser({
       email: '',
       password: '',
-      role: 'user',
+      role: 'viewer',
     });
     setEditingUser(null);
   };
@@ -207,7 +221,8 @@ const Users: React.FC = () => {
                   value={newUser.role}
                   onChange={(e) => setNewUser({ ...newUser, role: e.target.value })}
                 >
-                  <option value="user">User</option>
+                  <option value="viewer">Viewer</option>
+                  <option value="operator">Operator</option>
                   <option value="admin">Admin</option>
                 </select>
               </div>
@@ -336,9 +351,14 @@ const Users: React.FC = () => {
                         {user.role === 'admin' ? (
                           <><RiShieldUserLine className="mr-1" size={14} /> Admin</>
                         ) : (
-                          <><RiUserLine className="mr-1" size={14} /> User</>
+                          <><RiUserLine className="mr-1" size={14} /> {user.role === 'operator' ? 'Operator' : 'Viewer'}</>
                         )}
                       </span>
+                      {user.two_factor_enabled && (
+                        <span className="ml-2 px-2 py-1 inline-flex items-center text-xs leading-5 font-semibold rounded-full bg-green-100 text-green-800">
+                          2FA
+                        </span>
+                      )}
                     </td>
                     <td className="px-6 py-4 whitespace-nowrap text-right text-sm font-medium">
                       <button
@@ -347,6 +367,30 @@ const Users: React.FC = () => {
                       >
                         <RiEditLine size={18} />
                       </button>
+                      <button
+                        onClick={() => {
+                          if (window.confirm('Sign this user out of every session?')) {
+                            revokeSessions.mutate(user.id);
+                          }
+                        }}
+                        className="text-gray-600 hover:text-gray-900 mr-4"
+                        title="Sign out all sessions"
+                      >
+                        <RiLogoutBoxRLine size={18} />
+                      </button>
+                      {user.two_factor_enabled && (
+                        <button
+                          onClick={() => {
+                            if (window.confirm('Reset two-factor authentication for this user? They will be signed out and must set it up again.')) {
+                              resetTwoFactor.mutate(user.id);
+                            }
+                          }}
+                          className="text-gray-600 hover:text-gray-900 mr-4"
+                          title="Reset two-factor authentication"
+                        >
+                          <RiShieldKeyholeLine size={18} />
+                        </button>
+                      )}
                       <button
                         onClick={() => {
                           if (window.confirm('Are you sure you want to delete this user?')) {
@@ -25,26 +25,74 @@ api.interceptors.request.use(
   }
 );
 
+// Refresh in progress, shared by requests failing at the same time since a refresh
+// token can only be used once
+let refreshing: Promise<string> | null = null;
+
+const refreshAccessToken = () => {
+  if (!refreshing) {
+    const refreshToken = localStorage.getItem('refreshToken');
+    refreshing = axios
+      .post(`${API_URL}/admin/api/refresh`, { refreshToken })
+      .then((response) => {
+        localStorage.setItem('token', response.data.token);
+        localStorage.setItem('refreshToken', response.data.refreshToken);
+        return response.data.token as string;
+      })
+      .finally(() => {
+        refreshing = null;
+      });
+  }
+  return refreshing;
+};
+
 // Add response interceptor to handle errors
 api.interceptors.response.use(
   (response) => response,
-  (error) => {
-    if (error.response && error.response.status === 401) {
-      // Unauthorized, clear token and redirect to login
+  async (error) => {
+    const request = error.config;
+    const isAuthRequest = request && /\/admin\/api\/(login|signup|refresh|logout)$/.test(request.url || '');
+    if (error.response && error.response.status === 401 && !isAuthRequest) {
+      // Expired access token, retry once with a refreshed one
+      if (!request._retried && localStorage.getItem('refreshToken')) {
+        request._retried = true;
+        try {
+          const token = await refreshAccessToken();
+          request.headers.Authorization = `Bearer ${token}`;
+          return api(request);
+        } catch {
+          // Fall through to the login page
+        }
+      }
+
+      // Unauthorized, clear tokens and redirect to login
       localStorage.removeItem('token');
+      localStorage.removeItem('refreshToken');
       window.location.href = '/login';
     }
+    if (
+      error.response &&
+      error.response.status === 403 &&
+      error.response.data?.two_factor_setup_required &&
+      window.location.pathname !== '/account'
+    ) {
+      // Two-factor authentication is required, send the user to set it up
+      window.location.href = '/account';
+    }
     return Promise.reject(error);
   }
 );
 
 // Authentication API
 export const authAPI = {
-  login: (email: string, password: string) => 
-    api.post('/admin/api/login', { email, password }),
+  login: (email: string, password: string, secondFactor?: { code?: string, recovery_code?: string }) => 
+    api.post('/admin/api/login', { email, password, ...secondFactor }),
   
   signup: (email: string, password: string) => 
     api.post('/admin/api/signup', { email, password }),
+
+  logout: (refreshToken: string) =>
+    api.post('/admin/api/logout', { refreshToken }),
 };
 
 // Users API
@@ -55,6 +103,30 @@ export const usersAPI = {
   update: (id: number, user: { email?: string, password?: string, role?: string }) => 
     api.patch(`/admin/api/users/${id}`, user),
   delete: (id: number) => api.delete(`/admin/api/users/${id}`),
+  getSessions: (id: number) => api.get(`/admin/api/users/${id}/sessions`),
+  revokeSession: (id: number, sessionId: string) =>
+    api.delete(`/admin/api/users/${id}/sessions/${sessionId}`),
+  revokeSessions: (id: number) => api.delete(`/admin/api/users/${id}/sessions`),
+  resetTwoFactor: (id: number) => api.delete(`/admin/api/users/${id}/two-factor`),
+};
+
+// Security policies API
+export const securityAPI = {
+  get: () => api.get('/admin/api/security'),
+  update: (settings: { require_two_factor: boolean }) =>
+    api.patch('/admin/api/security', settings),
+};
+
+// Two-factor enrolment of the signed in user
+export const accountAPI = {
+  getTwoFactor: () => api.get('/admin/api/account/two-factor'),
+  setupTwoFactor: () => api.post('/admin/api/account/two-factor/setup'),
+  enableTwoFactor: (code: string) =>
+    api.post('/admin/api/account/two-factor/enable', { code }),
+  disableTwoFactor: (secondFactor: { code?: string, recovery_code?: string }) =>
+    api.post('/admin/api/account/two-factor/disable', secondFactor),
+  regenerateRecoveryCodes: (secondFactor: { code?: string, recovery_code?: string }) =>
+    api.post('/admin/api/account/two-factor/recovery-codes', secondFactor),
 };
 
 // DNS Rules API
@@ -94,7 +166,7 @@ export const alertsAPI = {
 
 // Health & Metrics API - These routes must include the /admin prefix
 export const healthAPI = {
-  getHealth: () => api.get('/admin/health'),
+  getHealth: () => api.get('/admin/api/health'),
   getMetrics: () => api.get('/admin/metrics'),
   getMetricsForDNS: (hostname: string) => api.get(`/admin/metrics?hostname=${hostname}`),
   getRecentLogs: (limit = 10, hostname?: string, page = 1, filters?: Record<string, string>) => {
@@ -134,7 +206,10 @@ export const databaseAPI = {
   restoreBackup: (filename: string) => api.post('/admin/database/restore', { filename }),
   deleteBackup: (filename: string) => api.delete('/admin/database/backups', { data: { filename } }),
   resetDatabase: () => api.post('/admin/database/reset'),
-  getDownloadUrl: (filename: string) => `${API_URL}/admin/database/download?filename=${encodeURIComponent(filename)}`,
+  downloadBackup: (filename: string) => api.get('/admin/database/download', {
+    params: { filename },
+    responseType: 'blob'
+  }),
   uploadBackup: (formData: FormData) => api.post('/admin/database/upload', formData, {
     headers: {
       'Content-Type': 'multipart/form-data'